@@ -3,6 +3,9 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
@@ -14,6 +17,7 @@ import (
 	"sda-pipeline/internal/config"
 	"sda-pipeline/internal/database"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 
 	log "github.com/sirupsen/logrus"
@@ -22,11 +26,24 @@ import (
 var Conf *config.Config
 var err error
 
+// messageTypes are the messages that can be posted to the api, they are
+// validated and sent with their routes in broker.Routes
+var messageTypes = []string{"ingest", "accession", "mapping", "release", "deprecate"}
+
+// sendMessage is an internal variable to ease testing
+var sendMessage = func(corrID, exchange, routingKey string, reliable bool, body []byte) error {
+	return Conf.API.MQ.SendMessage(corrID, exchange, routingKey, reliable, body)
+}
+
 func main() {
 	Conf, err = config.NewConfig("api")
 	if err != nil {
 		log.Fatal(err)
 	}
+	jwtKeys, err = loadJWTKeys(Conf.API.JWT)
+	if err != nil {
+		log.Fatal(err)
+	}
 	Conf.API.MQ, err = broker.NewMQ(Conf.Broker)
 	if err != nil {
 		log.Fatal(err)
@@ -35,36 +52,55 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	go config.WatchSecrets(Conf, func(c *config.Config) {
+		Conf.API.MQ.UpdatePassword(c.Broker.Password)
+		if err := Conf.API.DB.UpdateConf(c.Database); err != nil {
+			log.Errorf("Failed to reconnect to database with refreshed secrets, reason: %v", err)
+		}
+	})
+
+	srv := setup(Conf)
 
 	sigc := make(chan os.Signal, 5)
 	signal.Notify(sigc, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	stopped := make(chan struct{})
 	go func() {
 		<-sigc
+		// Let the requests being handled finish before closing the connections they use
+		ctx, cancel := context.WithTimeout(context.Background(), Conf.Broker.ShutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Warnf("Requests were still being handled at shutdown, reason: %v", err)
+		}
 		shutdown()
-		os.Exit(0)
+		close(stopped)
 	}()
 
-	srv := setup(Conf)
-
 	if Conf.API.ServerCert != "" && Conf.API.ServerKey != "" {
 		log.Infof("Web server is ready to receive connections at https://%s:%d", Conf.API.Host, Conf.API.Port)
-		if err := srv.ListenAndServeTLS(Conf.API.ServerCert, Conf.API.ServerKey); err != nil {
-			shutdown()
-			log.Fatalln(err)
-		}
+		err = srv.ListenAndServeTLS(Conf.API.ServerCert, Conf.API.ServerKey)
 	} else {
 		log.Infof("Web server is ready to receive connections at http://%s:%d", Conf.API.Host, Conf.API.Port)
-		if err := srv.ListenAndServe(); err != nil {
-			shutdown()
-			log.Fatalln(err)
-		}
+		err = srv.ListenAndServe()
+	}
+	if !errors.Is(err, http.ErrServerClosed) {
+		shutdown()
+		log.Fatalln(err)
 	}
+
+	<-stopped
 }
 
 func setup(config *config.Config) *http.Server {
 	r := mux.NewRouter().SkipClean(true)
 
 	r.HandleFunc("/ready", readinessResponse).Methods("GET")
+	r.HandleFunc("/files", authenticate(false, fileDetails)).Methods("GET")
+	r.HandleFunc("/datasets/{dataset:.+}", authenticate(true, datasetFiles)).Methods("GET")
+	for _, msgType := range messageTypes {
+		// Submitters can start ingestion of their own files, everything else is for admins
+		r.HandleFunc("/"+msgType, authenticate(msgType != "ingest", postMessage(msgType))).Methods("POST")
+	}
 
 	cfg := &tls.Config{
 		MinVersion:               tls.VersionTLS12,
@@ -89,33 +125,17 @@ func setup(config *config.Config) *http.Server {
 }
 
 func shutdown() {
-	defer Conf.API.MQ.Channel.Close()
-	defer Conf.API.MQ.Connection.Close()
+	defer Conf.API.MQ.Close()
 	defer Conf.API.DB.Close()
 }
 
 func readinessResponse(w http.ResponseWriter, r *http.Request) {
 	statusCocde := http.StatusOK
 
-	if Conf.API.MQ.Connection.IsClosed() {
+	// the broker reconnects by itself, so only report it as unavailable
+	if !Conf.API.MQ.IsConnected() {
+		log.Debug("MQ connection is down")
 		statusCocde = http.StatusServiceUnavailable
-		newConn, err := broker.NewMQ(Conf.Broker)
-		if err != nil {
-			log.Errorf("failed to reconnect to MQ, reason: %v", err)
-		} else {
-			Conf.API.MQ = newConn
-		}
-	}
-
-	if Conf.API.MQ.Channel.IsClosed() {
-		statusCocde = http.StatusServiceUnavailable
-		Conf.API.MQ.Connection.Close()
-		newConn, err := broker.NewMQ(Conf.Broker)
-		if err != nil {
-			log.Errorf("failed to reconnect to MQ, reason: %v", err)
-		} else {
-			Conf.API.MQ = newConn
-		}
 	}
 
 	if DBRes := checkDB(Conf.API.DB, 5*time.Millisecond); DBRes != nil {
@@ -127,12 +147,183 @@ func readinessResponse(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(statusCocde)
 }
 
+// fileDetails looks up a file by correlation id, accession id or inbox user
+// and path, and responds with what is known about it. Submitters can only
+// look up their own files.
+func fileDetails(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	var (
+		fileID string
+		err    error
+	)
+	switch {
+	case query.Has("correlationId") && len(query) == 1:
+		if _, err := uuid.Parse(query.Get("correlationId")); err != nil {
+			respondError(w, http.StatusBadRequest, "correlationId is not a valid uuid")
+
+			return
+		}
+		fileID, err = Conf.API.DB.GetFileID(query.Get("correlationId"))
+	case query.Has("accessionId") && len(query) == 1:
+		fileID, err = Conf.API.DB.GetFileIDByAccession(query.Get("accessionId"))
+	case query.Has("user") && query.Has("path") && len(query) == 2:
+		fileID, err = Conf.API.DB.GetFileIDByUserPath(query.Get("user"), query.Get("path"))
+	default:
+		respondError(w, http.StatusBadRequest, "look up files by one of correlationId, accessionId or user and path")
+
+		return
+	}
+	if err != nil {
+		respondDBError(w, err, "file not found")
+
+		return
+	}
+
+	details, err := Conf.API.DB.GetFileDetails(fileID)
+	if err != nil {
+		respondDBError(w, err, "file not found")
+
+		return
+	}
+	if c := requestClaims(r); !c.Admin && c.User != details.User {
+		respondError(w, http.StatusNotFound, "file not found")
+
+		return
+	}
+
+	respondJSON(w, http.StatusOK, details)
+}
+
+// datasetFiles responds with the files in a dataset and their status
+func datasetFiles(w http.ResponseWriter, r *http.Request) {
+	dataset := mux.Vars(r)["dataset"]
+
+	files, err := Conf.API.DB.GetDatasetFiles(dataset)
+	if err != nil {
+		respondDBError(w, err, "dataset not found")
+
+		return
+	}
+	if len(files) == 0 {
+		respondError(w, http.StatusNotFound, "dataset not found")
+
+		return
+	}
+
+	respondJSON(w, http.StatusOK, struct {
+		Dataset string                 `json:"dataset"`
+		Files   []database.DatasetFile `json:"files"`
+	}{dataset, files})
+}
+
+// postMessage returns a handler that validates the posted message against
+// the schema of the message type and sends it to the broker. The type of
+// the message can be left out of the body. The correlation id the message
+// is sent with is returned to the caller.
+func postMessage(msgType string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var message map[string]interface{}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&message); err != nil {
+			respondError(w, http.StatusBadRequest, fmt.Sprintf("failed to decode message, reason: %v", err))
+
+			return
+		}
+		if _, ok := message["type"]; !ok {
+			message["type"] = msgType
+		}
+
+		body, _ := json.Marshal(message)
+		if err := broker.ValidateJSONBody(Conf.Broker.SchemasPath, broker.Routes[msgType].Schema, body); err != nil {
+			respondError(w, http.StatusBadRequest, err.Error())
+
+			return
+		}
+
+		if c := requestClaims(r); !c.Admin && message["user"] != c.User {
+			respondError(w, http.StatusForbidden, "files can only be ingested by the user that uploaded them")
+
+			return
+		}
+
+		corrID, err := correlationID(msgType, message)
+		if err != nil {
+			respondDBError(w, err, "file not found")
+
+			return
+		}
+
+		if err := sendMessage(corrID, Conf.Broker.Exchange, broker.Routes[msgType].RoutingKey, Conf.Broker.Durable, body); err != nil {
+			log.Errorf("Failed to send %s message (corr-id: %s, reason: %v)", msgType, corrID, err)
+			respondError(w, http.StatusInternalServerError, "failed to send message")
+
+			return
+		}
+
+		log.Infof("Sent %s message (corr-id: %s)", msgType, corrID)
+		respondJSON(w, http.StatusOK, struct {
+			CorrelationID string `json:"correlationId"`
+		}{corrID})
+	}
+}
+
+// correlationID returns the correlation id to send a validated message with.
+// Messages about a file use the latest correlation id in the event log of
+// the file, so that they can be followed together with the upload of the
+// file. Files that have not been ingested yet, and datasets, get a new
+// correlation id. Accessions and mappings fail with sql.ErrNoRows for files
+// that are not known.
+func correlationID(msgType string, message map[string]interface{}) (string, error) {
+	switch msgType {
+	case "ingest", "accession":
+		corrID, err := Conf.API.DB.GetCorrID(message["user"].(string), message["filepath"].(string))
+		if errors.Is(err, sql.ErrNoRows) && msgType == "ingest" {
+			return uuid.New().String(), nil
+		}
+
+		return corrID, err
+	case "mapping":
+		for _, accessionID := range message["accession_ids"].([]interface{}) {
+			if _, err := Conf.API.DB.GetFileIDByAccession(accessionID.(string)); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	return uuid.New().String(), nil
+}
+
+// respondDBError responds with not found if the database had no rows for
+// the query, and with an internal server error otherwise
+func respondDBError(w http.ResponseWriter, err error, notFound string) {
+	if errors.Is(err, sql.ErrNoRows) {
+		respondError(w, http.StatusNotFound, notFound)
+
+		return
+	}
+
+	log.Errorf("Database query failed, reason: %v", err)
+	respondError(w, http.StatusInternalServerError, "database query failed")
+}
+
+// respondError responds with the error message as json
+func respondError(w http.ResponseWriter, statusCode int, message string) {
+	respondJSON(w, statusCode, struct {
+		Error string `json:"error"`
+	}{message})
+}
+
+// respondJSON responds with the body encoded as json
+func respondJSON(w http.ResponseWriter, statusCode int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Errorf("Failed to write response, reason: %v", err)
+	}
+}
+
 func checkDB(database *database.SQLdb, timeout time.Duration) error {
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
-	if database.DB == nil {
-		return fmt.Errorf("database is nil")
-	}
-
-	return database.DB.PingContext(ctx)
+	return database.Ping(ctx)
 }
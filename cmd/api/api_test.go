@@ -1,6 +1,11 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
@@ -8,6 +13,7 @@ import (
 	"sda-pipeline/internal/database"
 
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/uuid"
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
@@ -54,3 +60,198 @@ func TestDatabasePingCheck(t *testing.T) {
 	assert.NoError(t, err)
 	assert.NoError(t, checkDB(&database, 1*time.Second), "ping should succeed")
 }
+
+func TestFileDetails(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	Conf = &config.Config{}
+	Conf.API.DB = &database.SQLdb{DB: db}
+	useTestKey(t)
+	server := setup(Conf)
+
+	fileID := "f83976fc-7e59-4a12-ad17-0154a36e36fc"
+	mock.ExpectQuery("SELECT id from sda.files WHERE stable_id = \\$1;").
+		WithArgs("EGAF00000000001").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(fileID))
+	mock.ExpectQuery("SELECT id, COALESCE\\(stable_id, ''\\)").
+		WithArgs(fileID).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "stable_id", "submission_user", "submission_file_path", "archive_file_path", "archive_file_size", "decrypted_file_size", "created_at"}).
+			AddRow(fileID, "EGAF00000000001", "dummy", "/inbox/file.c4gh", "", 0, 0, time.Date(2023, 10, 2, 12, 0, 0, 0, time.UTC)))
+	mock.ExpectQuery("SELECT checksum, type, source from sda.checksums").
+		WillReturnRows(sqlmock.NewRows([]string{"checksum", "type", "source"}))
+	mock.ExpectQuery("SELECT d.stable_id from sda.file_dataset").
+		WillReturnRows(sqlmock.NewRows([]string{"stable_id"}).AddRow("EGAD00000000001"))
+	mock.ExpectQuery("SELECT event, .* from sda.file_event_log").
+		WillReturnRows(sqlmock.NewRows([]string{"event", "correlation_id", "user_id", "message", "started_at"}).
+			AddRow("registered", "", "dummy", nil, time.Date(2023, 10, 2, 12, 0, 0, 0, time.UTC)))
+
+	w := httptest.NewRecorder()
+	server.Handler.ServeHTTP(w, adminRequest(http.MethodGet, "/files?accessionId=EGAF00000000001", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{
+		"fileId": "f83976fc-7e59-4a12-ad17-0154a36e36fc",
+		"accessionId": "EGAF00000000001",
+		"user": "dummy",
+		"inboxPath": "/inbox/file.c4gh",
+		"createdAt": "2023-10-02T12:00:00Z",
+		"checksums": [],
+		"datasets": ["EGAD00000000001"],
+		"events": [{"event": "registered", "user": "dummy", "time": "2023-10-02T12:00:00Z"}]
+	}`, w.Body.String())
+
+	mock.ExpectQuery("SELECT id from sda.files WHERE submission_user = \\$1 AND submission_file_path = \\$2").
+		WithArgs("dummy", "/inbox/missing.c4gh").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	w = httptest.NewRecorder()
+	server.Handler.ServeHTTP(w, adminRequest(http.MethodGet, "/files?user=dummy&path=/inbox/missing.c4gh", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	mock.ExpectQuery("SELECT DISTINCT file_id FROM sda.file_event_log where correlation_id = \\$1;").
+		WithArgs("7559caae-a17c-40ae-bdb9-3a7d33408c49").
+		WillReturnRows(sqlmock.NewRows([]string{"file_id"}).AddRow(fileID))
+	mock.ExpectQuery("SELECT id, COALESCE\\(stable_id, ''\\)").
+		WithArgs(fileID).
+		WillReturnError(fmt.Errorf("error for testing"))
+	w = httptest.NewRecorder()
+	server.Handler.ServeHTTP(w, adminRequest(http.MethodGet, "/files?correlationId=7559caae-a17c-40ae-bdb9-3a7d33408c49", nil))
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+
+	for _, query := range []string{"", "?correlationId=bad-uuid", "?user=dummy", "?accessionId=EGAF00000000001&user=dummy"} {
+		w = httptest.NewRecorder()
+		server.Handler.ServeHTTP(w, adminRequest(http.MethodGet, "/files"+query, nil))
+		assert.Equal(t, http.StatusBadRequest, w.Code, query)
+	}
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestDatasetFiles(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	Conf = &config.Config{}
+	Conf.API.DB = &database.SQLdb{DB: db}
+	useTestKey(t)
+	server := setup(Conf)
+
+	mock.ExpectQuery("SELECT f.id, .* WHERE d.stable_id = \\$1").
+		WithArgs("https://doi.org/10.1234/dataset").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "stable_id", "submission_file_path", "event"}).
+			AddRow("f83976fc-7e59-4a12-ad17-0154a36e36fc", "EGAF00000000001", "/inbox/file.c4gh", "ready"))
+
+	w := httptest.NewRecorder()
+	server.Handler.ServeHTTP(w, adminRequest(http.MethodGet, "/datasets/https://doi.org/10.1234/dataset", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{
+		"dataset": "https://doi.org/10.1234/dataset",
+		"files": [{"fileId": "f83976fc-7e59-4a12-ad17-0154a36e36fc", "accessionId": "EGAF00000000001", "inboxPath": "/inbox/file.c4gh", "status": "ready"}]
+	}`, w.Body.String())
+
+	mock.ExpectQuery("SELECT f.id, .* WHERE d.stable_id = \\$1").
+		WithArgs("EGAD00000000002").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "stable_id", "submission_file_path", "event"}))
+	w = httptest.NewRecorder()
+	server.Handler.ServeHTTP(w, adminRequest(http.MethodGet, "/datasets/EGAD00000000002", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPostMessage(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	Conf = &config.Config{}
+	Conf.API.DB = &database.SQLdb{DB: db}
+	useTestKey(t)
+	Conf.Broker.SchemasPath = "file://../../schemas/federated/"
+	Conf.Broker.Exchange = "sda"
+	server := setup(Conf)
+
+	type sent struct {
+		corrID, routingKey string
+		body               map[string]interface{}
+	}
+	var messages []sent
+	sendMessage = func(corrID, exchange, routingKey string, reliable bool, body []byte) error {
+		assert.Equal(t, "sda", exchange)
+		m := sent{corrID: corrID, routingKey: routingKey}
+		assert.NoError(t, json.Unmarshal(body, &m.body))
+		messages = append(messages, m)
+
+		return nil
+	}
+
+	corrIDQuery := "SELECT correlation_id from sda.file_event_log"
+	post := func(path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		server.Handler.ServeHTTP(w, adminRequest(http.MethodPost, path, strings.NewReader(body)))
+
+		return w
+	}
+
+	// Files that have been uploaded before keep their correlation id
+	mock.ExpectQuery(corrIDQuery).
+		WithArgs("dummy", "/inbox/file.c4gh").
+		WillReturnRows(sqlmock.NewRows([]string{"correlation_id"}).AddRow("7559caae-a17c-40ae-bdb9-3a7d33408c49"))
+	w := post("/ingest", `{"user": "dummy", "filepath": "/inbox/file.c4gh"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"correlationId": "7559caae-a17c-40ae-bdb9-3a7d33408c49"}`, w.Body.String())
+	assert.Equal(t, sent{"7559caae-a17c-40ae-bdb9-3a7d33408c49", "ingest", map[string]interface{}{"type": "ingest", "user": "dummy", "filepath": "/inbox/file.c4gh"}}, messages[0])
+
+	// New files get a new correlation id
+	mock.ExpectQuery(corrIDQuery).
+		WithArgs("dummy", "/inbox/new.c4gh").
+		WillReturnRows(sqlmock.NewRows([]string{"correlation_id"}))
+	w = post("/ingest", `{"type": "cancel", "user": "dummy", "filepath": "/inbox/new.c4gh"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	_, err = uuid.Parse(messages[1].corrID)
+	assert.NoError(t, err)
+	assert.Equal(t, "cancel", messages[1].body["type"])
+	assert.Contains(t, w.Body.String(), messages[1].corrID)
+
+	// Accessions must be for known files
+	accession := `{"user": "dummy", "filepath": "/inbox/new.c4gh", "accession_id": "EGAF00000000001", "decrypted_checksums": [{"type": "sha256", "value": "82e4e60e7beb3db2e06a00a079788f7d71f75b61a4b75f28c4c942703dabb6d6"}]}`
+	mock.ExpectQuery(corrIDQuery).
+		WithArgs("dummy", "/inbox/new.c4gh").
+		WillReturnRows(sqlmock.NewRows([]string{"correlation_id"}))
+	w = post("/accession", accession)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	mock.ExpectQuery(corrIDQuery).
+		WithArgs("dummy", "/inbox/new.c4gh").
+		WillReturnRows(sqlmock.NewRows([]string{"correlation_id"}).AddRow("1ffb9d3e-7a0f-4a55-8b7e-e3ba0b7c1b8d"))
+	w = post("/accession", accession)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "accessionIDs", messages[2].routingKey)
+	assert.Equal(t, "1ffb9d3e-7a0f-4a55-8b7e-e3ba0b7c1b8d", messages[2].corrID)
+
+	mock.ExpectQuery("SELECT id from sda.files WHERE stable_id = \\$1;").
+		WithArgs("EGAF00000000001").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("f83976fc-7e59-4a12-ad17-0154a36e36fc"))
+	w = post("/mapping", `{"dataset_id": "EGAD00000000001", "accession_ids": ["EGAF00000000001"]}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "mappings", messages[3].routingKey)
+
+	w = post("/release", `{"dataset_id": "EGAD00000000001"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, sent{messages[4].corrID, "mappings", map[string]interface{}{"type": "release", "dataset_id": "EGAD00000000001"}}, messages[4])
+
+	// Messages that don't match the schema are not sent
+	for path, body := range map[string]string{
+		"/deprecate": `{"dataset_id": "dataset"}`,
+		"/release":   `{"type": "deprecate", "dataset_id": "EGAD00000000001"}`,
+		"/mapping":   `{"dataset_id": "EGAD00000000001"}`,
+		"/ingest":    `not json`,
+	} {
+		w = post(path, body)
+		assert.Equal(t, http.StatusBadRequest, w.Code, path)
+	}
+	assert.Len(t, messages, 5)
+
+	sendMessage = func(_, _, _ string, _ bool, _ []byte) error {
+		return fmt.Errorf("broker unreachable")
+	}
+	w = post("/deprecate", `{"dataset_id": "EGAD00000000001"}`)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"sda-pipeline/internal/config"
+
+	"github.com/golang-jwt/jwt/v5"
+	log "github.com/sirupsen/logrus"
+)
+
+// jwtKey is a public key that tokens can be signed with. The id is the key
+// id from the key set, or the file name for PEM encoded keys.
+type jwtKey struct {
+	id  string
+	key crypto.PublicKey
+}
+
+// jwtKeys are the keys tokens are validated with
+var jwtKeys []jwtKey
+
+// validMethods are the signing methods accepted for tokens
+var validMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}
+
+// claims are what the api uses from a validated token
+type claims struct {
+	User    string
+	Admin   bool
+	Expires time.Time
+}
+
+type claimsKey struct{}
+
+// session is a browser session started by a request with a valid token
+type session struct {
+	claims  claims
+	expires time.Time
+}
+
+// sessions holds the browser sessions by session id
+var sessions = struct {
+	sync.Mutex
+	byID map[string]session
+}{byID: map[string]session{}}
+
+// loadJWTKeys reads the keys tokens are validated with from the PEM
+// encoded public keys and the key set in the configuration
+func loadJWTKeys(conf config.JWTConf) ([]jwtKey, error) {
+	var keys []jwtKey
+
+	if conf.PubKeyPath != "" {
+		files := []string{conf.PubKeyPath}
+		info, err := os.Stat(conf.PubKeyPath)
+		if err != nil {
+			return nil, err
+		}
+		if info.IsDir() {
+			entries, err := os.ReadDir(conf.PubKeyPath)
+			if err != nil {
+				return nil, err
+			}
+			files = files[:0]
+			for _, entry := range entries {
+				if !entry.IsDir() {
+					files = append(files, filepath.Join(conf.PubKeyPath, entry.Name()))
+				}
+			}
+		}
+
+		for _, file := range files {
+			key, err := readPEMPublicKey(file)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read jwt public key %s, reason: %v", file, err)
+			}
+			keys = append(keys, jwtKey{id: filepath.Base(file), key: key})
+		}
+	}
+
+	if conf.JwksPath != "" {
+		data, err := os.ReadFile(conf.JwksPath)
+		if err != nil {
+			return nil, err
+		}
+		jwks, err := parseJWKS(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read jwks %s, reason: %v", conf.JwksPath, err)
+		}
+		keys = append(keys, jwks...)
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("no keys to validate tokens with")
+	}
+
+	return keys, nil
+}
+
+// readPEMPublicKey reads a PEM encoded public key
+func readPEMPublicKey(file string) (crypto.PublicKey, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+
+	switch block.Type {
+	case "PUBLIC KEY":
+		return x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("PEM type %s is not a public key", block.Type)
+	}
+}
+
+// parseJWKS reads the signing keys of a JSON Web Key Set. Keys of types
+// that are not supported are skipped.
+func parseJWKS(data []byte) ([]jwtKey, error) {
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			Crv string `json:"crv"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &jwks); err != nil {
+		return nil, err
+	}
+
+	var keys []jwtKey
+	for _, k := range jwks.Keys {
+		if k.Use == "enc" {
+			continue
+		}
+
+		var key crypto.PublicKey
+		var err error
+		switch k.Kty {
+		case "RSA":
+			var n, e *big.Int
+			if n, err = decodeBigInt(k.N); err != nil {
+				return nil, fmt.Errorf("key %s has a bad modulus, reason: %v", k.Kid, err)
+			}
+			if e, err = decodeBigInt(k.E); err != nil {
+				return nil, fmt.Errorf("key %s has a bad exponent, reason: %v", k.Kid, err)
+			}
+			key = &rsa.PublicKey{N: n, E: int(e.Int64())}
+		case "EC":
+			curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+			curve, ok := curves[k.Crv]
+			if !ok {
+				return nil, fmt.Errorf("key %s has an unsupported curve %s", k.Kid, k.Crv)
+			}
+			var x, y *big.Int
+			if x, err = decodeBigInt(k.X); err != nil {
+				return nil, fmt.Errorf("key %s has a bad x coordinate, reason: %v", k.Kid, err)
+			}
+			if y, err = decodeBigInt(k.Y); err != nil {
+				return nil, fmt.Errorf("key %s has a bad y coordinate, reason: %v", k.Kid, err)
+			}
+			key = &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+		case "OKP":
+			x, err := base64.RawURLEncoding.DecodeString(k.X)
+			if err != nil || k.Crv != "Ed25519" || len(x) != ed25519.PublicKeySize {
+				return nil, fmt.Errorf("key %s is not an Ed25519 key", k.Kid)
+			}
+			key = ed25519.PublicKey(x)
+		default:
+			log.Warnf("Skipping key %s of unsupported type %s in jwks", k.Kid, k.Kty)
+
+			continue
+		}
+
+		keys = append(keys, jwtKey{id: k.Kid, key: key})
+	}
+
+	return keys, nil
+}
+
+// decodeBigInt decodes a base64url encoded big-endian integer
+func decodeBigInt(value string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, errors.New("value is empty")
+	}
+
+	return new(big.Int).SetBytes(b), nil
+}
+
+// validateToken validates the token with the key it names, or with each of
+// the keys if it doesn't name a known key, and returns its claims
+func validateToken(tokenString string, conf config.JWTConf) (*claims, error) {
+	options := []jwt.ParserOption{jwt.WithValidMethods(validMethods)}
+	if conf.Issuer != "" {
+		options = append(options, jwt.WithIssuer(conf.Issuer))
+	}
+	if conf.Audience != "" {
+		options = append(options, jwt.WithAudience(conf.Audience))
+	}
+	parser := jwt.NewParser(options...)
+
+	candidates := jwtKeys
+	if unverified, _, err := parser.ParseUnverified(tokenString, jwt.MapClaims{}); err == nil {
+		if kid, ok := unverified.Header["kid"].(string); ok {
+			for _, k := range jwtKeys {
+				if k.id == kid {
+					candidates = []jwtKey{k}
+
+					break
+				}
+			}
+		}
+	}
+
+	var (
+		token *jwt.Token
+		err   = errors.New("no keys to validate tokens with")
+	)
+	for _, k := range candidates {
+		token, err = parser.Parse(tokenString, func(*jwt.Token) (interface{}, error) { return k.key, nil })
+		if !errors.Is(err, jwt.ErrTokenSignatureInvalid) {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	mapClaims := token.Claims.(jwt.MapClaims)
+	expires, err := mapClaims.GetExpirationTime()
+	if err != nil || expires == nil {
+		return nil, errors.New("token has no expiration time")
+	}
+
+	user, _ := mapClaims[conf.UserClaim].(string)
+	if user == "" {
+		return nil, fmt.Errorf("token has no %s claim", conf.UserClaim)
+	}
+
+	c := claims{User: user, Expires: expires.Time}
+	switch roles := mapClaims[conf.RoleClaim].(type) {
+	case string:
+		c.Admin = roles == conf.AdminRole
+	case []interface{}:
+		for _, role := range roles {
+			if role == conf.AdminRole {
+				c.Admin = true
+			}
+		}
+	}
+
+	return &c, nil
+}
+
+// authenticate is a middleware that lets requests through to next if they
+// carry a valid bearer token, or a cookie for a session started with one.
+// Requests with a token start a browser session if they don't have one.
+// With admin set only users with the admin role are let through.
+func authenticate(admin bool, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var c *claims
+		if tokenString, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			var err error
+			c, err = validateToken(tokenString, Conf.API.JWT)
+			if err != nil {
+				log.Infof("Request with invalid token rejected, reason: %v", err)
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				respondError(w, http.StatusUnauthorized, "invalid token")
+
+				return
+			}
+			if _, err := sessionClaims(r); err != nil && Conf.API.Session.Name != "" {
+				startSession(w, tokenString, c)
+			}
+		} else {
+			var err error
+			c, err = sessionClaims(r)
+			if err != nil {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				respondError(w, http.StatusUnauthorized, "authentication required")
+
+				return
+			}
+		}
+
+		if admin && !c.Admin {
+			respondError(w, http.StatusForbidden, "admin role required")
+
+			return
+		}
+
+		next(w, r.WithContext(context.WithValue(r.Context(), claimsKey{}, c)))
+	}
+}
+
+// requestClaims returns the claims of the token the request was
+// authenticated with
+func requestClaims(r *http.Request) *claims {
+	c, _ := r.Context().Value(claimsKey{}).(*claims)
+
+	return c
+}
+
+// sessionClaims returns the claims of the session in the session cookie
+func sessionClaims(r *http.Request) (*claims, error) {
+	cookie, err := r.Cookie(Conf.API.Session.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	sessions.Lock()
+	defer sessions.Unlock()
+	s, ok := sessions.byID[cookie.Value]
+	if !ok || time.Now().After(s.expires) {
+		delete(sessions.byID, cookie.Value)
+
+		return nil, errors.New("session not found")
+	}
+
+	return &s.claims, nil
+}
+
+// startSession starts a browser session for the claims of the token and
+// sets the session cookie. The session id is the hash of the token, so
+// clients that send the same token without keeping cookies share a session.
+// Sessions end when the token expires, or after the configured session
+// expiration if that is sooner.
+func startSession(w http.ResponseWriter, tokenString string, c *claims) {
+	hash := sha256.Sum256([]byte(tokenString))
+	id := hex.EncodeToString(hash[:])
+
+	sessions.Lock()
+	s, ok := sessions.byID[id]
+	if !ok {
+		for sessionID, s := range sessions.byID {
+			if time.Now().After(s.expires) {
+				delete(sessions.byID, sessionID)
+			}
+		}
+
+		s = session{claims: *c, expires: c.Expires}
+		if Conf.API.Session.Expiration > 0 && time.Now().Add(Conf.API.Session.Expiration).Before(s.expires) {
+			s.expires = time.Now().Add(Conf.API.Session.Expiration)
+		}
+		sessions.byID[id] = s
+	}
+	sessions.Unlock()
+
+	cookie := &http.Cookie{
+		Name:     Conf.API.Session.Name,
+		Value:    id,
+		Path:     "/",
+		Domain:   Conf.API.Session.Domain,
+		Secure:   Conf.API.Session.Secure,
+		HttpOnly: Conf.API.Session.HTTPOnly,
+		SameSite: http.SameSiteStrictMode,
+	}
+	if Conf.API.Session.Expiration > 0 {
+		cookie.Expires = s.expires
+	}
+	http.SetCookie(w, cookie)
+}
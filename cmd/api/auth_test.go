@@ -0,0 +1,321 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"sda-pipeline/internal/config"
+	"sda-pipeline/internal/database"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+// testKey is the key test tokens are signed with
+var testKey ed25519.PrivateKey
+
+// useTestKey makes the api validate tokens with a new test key
+func useTestKey(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	testKey = private
+	jwtKeys = []jwtKey{{id: "test", key: public}}
+	Conf.API.JWT = config.JWTConf{UserClaim: "sub", RoleClaim: "role", AdminRole: "admin"}
+}
+
+// testToken returns a token for the user signed with the test key
+func testToken(t *testing.T, user string, role interface{}) string {
+	token, err := jwt.NewWithClaims(jwt.SigningMethodEdDSA, jwt.MapClaims{
+		"sub":  user,
+		"role": role,
+		"exp":  time.Now().Add(time.Hour).Unix(),
+	}).SignedString(testKey)
+	assert.NoError(t, err)
+
+	return token
+}
+
+// adminRequest returns a request with a token for an admin
+func adminRequest(method, target string, body io.Reader) *http.Request {
+	token, _ := jwt.NewWithClaims(jwt.SigningMethodEdDSA, jwt.MapClaims{
+		"sub":  "admin",
+		"role": "admin",
+		"exp":  time.Now().Add(time.Hour).Unix(),
+	}).SignedString(testKey)
+
+	r := httptest.NewRequest(method, target, body)
+	r.Header.Set("Authorization", "Bearer "+token)
+
+	return r
+}
+
+func writePEM(t *testing.T, path, pemType string, der []byte) {
+	assert.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: pemType, Bytes: der}), 0600))
+}
+
+func TestLoadJWTKeys(t *testing.T) {
+	dir := t.TempDir()
+	keyDir := filepath.Join(dir, "keys")
+	assert.NoError(t, os.Mkdir(keyDir, 0700))
+	assert.NoError(t, os.Mkdir(filepath.Join(keyDir, "subdir"), 0700))
+
+	edPublic, _, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(edPublic)
+	assert.NoError(t, err)
+	writePEM(t, filepath.Join(keyDir, "ed25519.pem"), "PUBLIC KEY", der)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	writePEM(t, filepath.Join(keyDir, "rsa.pem"), "RSA PUBLIC KEY", x509.MarshalPKCS1PublicKey(&rsaKey.PublicKey))
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	jwks := fmt.Sprintf(`{"keys": [
+		{"kty": "RSA", "kid": "rsa", "use": "sig", "n": "%s", "e": "AQAB"},
+		{"kty": "EC", "kid": "ec", "crv": "P-256", "x": "%s", "y": "%s"},
+		{"kty": "OKP", "kid": "okp", "crv": "Ed25519", "x": "%s"},
+		{"kty": "RSA", "kid": "encryption", "use": "enc", "n": "%s", "e": "AQAB"},
+		{"kty": "oct", "kid": "symmetric", "k": "c2VjcmV0"}
+	]}`,
+		base64.RawURLEncoding.EncodeToString(rsaKey.N.Bytes()),
+		base64.RawURLEncoding.EncodeToString(ecKey.X.FillBytes(make([]byte, 32))),
+		base64.RawURLEncoding.EncodeToString(ecKey.Y.FillBytes(make([]byte, 32))),
+		base64.RawURLEncoding.EncodeToString(edPublic),
+		base64.RawURLEncoding.EncodeToString(rsaKey.N.Bytes()))
+	jwksPath := filepath.Join(dir, "jwks.json")
+	assert.NoError(t, os.WriteFile(jwksPath, []byte(jwks), 0600))
+
+	keys, err := loadJWTKeys(config.JWTConf{PubKeyPath: keyDir, JwksPath: jwksPath})
+	assert.NoError(t, err)
+	assert.Equal(t, []jwtKey{
+		{id: "ed25519.pem", key: edPublic},
+		{id: "rsa.pem", key: &rsaKey.PublicKey},
+		{id: "rsa", key: &rsa.PublicKey{N: rsaKey.N, E: 65537}},
+		{id: "ec", key: &ecKey.PublicKey},
+		{id: "okp", key: edPublic},
+	}, keys)
+
+	keys, err = loadJWTKeys(config.JWTConf{PubKeyPath: filepath.Join(keyDir, "rsa.pem")})
+	assert.NoError(t, err)
+	assert.Len(t, keys, 1)
+
+	writePEM(t, filepath.Join(keyDir, "private.pem"), "PRIVATE KEY", []byte("private"))
+	_, err = loadJWTKeys(config.JWTConf{PubKeyPath: keyDir})
+	assert.EqualError(t, err, fmt.Sprintf("failed to read jwt public key %s, reason: PEM type PRIVATE KEY is not a public key", filepath.Join(keyDir, "private.pem")))
+
+	assert.NoError(t, os.WriteFile(jwksPath, []byte(`{"keys": [{"kty": "EC", "kid": "ec", "crv": "P-192"}]}`), 0600))
+	_, err = loadJWTKeys(config.JWTConf{JwksPath: jwksPath})
+	assert.EqualError(t, err, fmt.Sprintf("failed to read jwks %s, reason: key ec has an unsupported curve P-192", jwksPath))
+
+	assert.NoError(t, os.WriteFile(jwksPath, []byte(`{"keys": []}`), 0600))
+	_, err = loadJWTKeys(config.JWTConf{JwksPath: jwksPath})
+	assert.EqualError(t, err, "no keys to validate tokens with")
+}
+
+func TestValidateToken(t *testing.T) {
+	Conf = &config.Config{}
+	useTestKey(t)
+	conf := Conf.API.JWT
+
+	c, err := validateToken(testToken(t, "dummy", nil), conf)
+	assert.NoError(t, err)
+	assert.Equal(t, "dummy", c.User)
+	assert.False(t, c.Admin)
+
+	c, err = validateToken(testToken(t, "dummy", "admin"), conf)
+	assert.NoError(t, err)
+	assert.True(t, c.Admin)
+
+	c, err = validateToken(testToken(t, "dummy", []string{"submitter", "admin"}), conf)
+	assert.NoError(t, err)
+	assert.True(t, c.Admin)
+
+	_, err = validateToken(testToken(t, "", nil), conf)
+	assert.EqualError(t, err, "token has no sub claim")
+
+	sign := func(claims jwt.MapClaims) string {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims).SignedString(testKey)
+		assert.NoError(t, err)
+
+		return token
+	}
+
+	_, err = validateToken(sign(jwt.MapClaims{"sub": "dummy"}), conf)
+	assert.EqualError(t, err, "token has no expiration time")
+
+	_, err = validateToken(sign(jwt.MapClaims{"sub": "dummy", "exp": time.Now().Add(-time.Minute).Unix()}), conf)
+	assert.ErrorIs(t, err, jwt.ErrTokenExpired)
+
+	conf.Issuer = "https://login.example.org"
+	conf.Audience = "sda"
+	_, err = validateToken(sign(jwt.MapClaims{"sub": "dummy", "exp": time.Now().Add(time.Minute).Unix(), "iss": "https://other.example.org", "aud": "sda"}), conf)
+	assert.ErrorIs(t, err, jwt.ErrTokenInvalidIssuer)
+	_, err = validateToken(sign(jwt.MapClaims{"sub": "dummy", "exp": time.Now().Add(time.Minute).Unix(), "iss": "https://login.example.org", "aud": "other"}), conf)
+	assert.ErrorIs(t, err, jwt.ErrTokenInvalidAudience)
+	_, err = validateToken(sign(jwt.MapClaims{"sub": "dummy", "exp": time.Now().Add(time.Minute).Unix(), "iss": "https://login.example.org", "aud": "sda"}), conf)
+	assert.NoError(t, err)
+
+	// Symmetric and unsigned tokens are not accepted
+	hmac, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "dummy", "exp": time.Now().Add(time.Minute).Unix()}).SignedString([]byte("secret"))
+	assert.NoError(t, err)
+	_, err = validateToken(hmac, Conf.API.JWT)
+	assert.ErrorIs(t, err, jwt.ErrTokenSignatureInvalid)
+	none, err := jwt.NewWithClaims(jwt.SigningMethodNone, jwt.MapClaims{"sub": "dummy", "exp": time.Now().Add(time.Minute).Unix()}).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	assert.NoError(t, err)
+	_, err = validateToken(none, Conf.API.JWT)
+	assert.ErrorIs(t, err, jwt.ErrTokenSignatureInvalid)
+
+	// Tokens are validated with the key they name, or with all keys
+	otherPublic, otherPrivate, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	jwtKeys = append([]jwtKey{{id: "other", key: otherPublic}}, jwtKeys...)
+	_, err = validateToken(testToken(t, "dummy", nil), Conf.API.JWT)
+	assert.NoError(t, err)
+
+	token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, jwt.MapClaims{"sub": "dummy", "exp": time.Now().Add(time.Minute).Unix()})
+	token.Header["kid"] = "test"
+	signed, err := token.SignedString(otherPrivate)
+	assert.NoError(t, err)
+	_, err = validateToken(signed, Conf.API.JWT)
+	assert.ErrorIs(t, err, jwt.ErrTokenSignatureInvalid)
+}
+
+func TestAuthenticate(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	Conf = &config.Config{}
+	Conf.API.DB = &database.SQLdb{DB: db}
+	Conf.API.Session = config.SessionConfig{Name: "api_session_key", Secure: true, HTTPOnly: true, Expiration: time.Minute}
+	Conf.Broker.SchemasPath = "file://../../schemas/federated/"
+	useTestKey(t)
+	server := setup(Conf)
+	sendMessage = func(_, _, _ string, _ bool, _ []byte) error {
+		return nil
+	}
+
+	request := func(method, target, token, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		server.Handler.ServeHTTP(w, r)
+
+		return w
+	}
+	submitter := testToken(t, "dummy", "submitter")
+
+	w := request(http.MethodGet, "/datasets/EGAD00000000001", "", "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, "Bearer", w.Header().Get("WWW-Authenticate"))
+
+	w = request(http.MethodGet, "/datasets/EGAD00000000001", "not-a-token", "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = request(http.MethodGet, "/datasets/EGAD00000000001", submitter, "")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = request(http.MethodPost, "/release", submitter, `{"dataset_id": "EGAD00000000001"}`)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// Submitters can only ingest and look up their own files
+	w = request(http.MethodPost, "/ingest", submitter, `{"user": "other", "filepath": "/inbox/file.c4gh"}`)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	mock.ExpectQuery("SELECT correlation_id from sda.file_event_log").
+		WithArgs("dummy", "/inbox/file.c4gh").
+		WillReturnRows(sqlmock.NewRows([]string{"correlation_id"}).AddRow("7559caae-a17c-40ae-bdb9-3a7d33408c49"))
+	w = request(http.MethodPost, "/ingest", submitter, `{"user": "dummy", "filepath": "/inbox/file.c4gh"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	for user, code := range map[string]int{"dummy": http.StatusOK, "other": http.StatusNotFound} {
+		mock.ExpectQuery("SELECT id from sda.files WHERE stable_id = \\$1;").
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("f83976fc-7e59-4a12-ad17-0154a36e36fc"))
+		mock.ExpectQuery("SELECT id, COALESCE\\(stable_id, ''\\)").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "stable_id", "submission_user", "submission_file_path", "archive_file_path", "archive_file_size", "decrypted_file_size", "created_at"}).
+				AddRow("f83976fc-7e59-4a12-ad17-0154a36e36fc", "EGAF00000000001", user, "/inbox/file.c4gh", "", 0, 0, time.Now()))
+		mock.ExpectQuery("SELECT checksum, type, source from sda.checksums").
+			WillReturnRows(sqlmock.NewRows([]string{"checksum", "type", "source"}))
+		mock.ExpectQuery("SELECT d.stable_id from sda.file_dataset").
+			WillReturnRows(sqlmock.NewRows([]string{"stable_id"}))
+		mock.ExpectQuery("SELECT event, .* from sda.file_event_log").
+			WillReturnRows(sqlmock.NewRows([]string{"event", "correlation_id", "user_id", "message", "started_at"}))
+
+		w = request(http.MethodGet, "/files?accessionId=EGAF00000000001", submitter, "")
+		assert.Equal(t, code, w.Code, user)
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	// Requests with a token start a browser session
+	w = request(http.MethodGet, "/datasets/EGAD00000000001", submitter, "")
+	cookies := w.Result().Cookies()
+	if assert.Len(t, cookies, 1) {
+		assert.Equal(t, "api_session_key", cookies[0].Name)
+		assert.True(t, cookies[0].Secure)
+		assert.True(t, cookies[0].HttpOnly)
+		assert.WithinDuration(t, time.Now().Add(time.Minute), cookies[0].Expires, 5*time.Second)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/release", strings.NewReader(`{"dataset_id": "EGAD00000000001"}`))
+	r.AddCookie(cookies[0])
+	w = httptest.NewRecorder()
+	server.Handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	r = httptest.NewRequest(http.MethodPost, "/ingest", strings.NewReader(`{"user": "other", "filepath": "/inbox/file.c4gh"}`))
+	r.AddCookie(cookies[0])
+	w = httptest.NewRecorder()
+	server.Handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusForbidden, w.Code, "session should keep the user of the token")
+
+	// Clients that don't keep cookies share the session of the token
+	w = request(http.MethodGet, "/datasets/EGAD00000000001", submitter, "")
+	if assert.Len(t, w.Result().Cookies(), 1) {
+		assert.Equal(t, cookies[0].Value, w.Result().Cookies()[0].Value)
+	}
+
+	// Expired sessions are not accepted
+	sessions.Lock()
+	s := sessions.byID[cookies[0].Value]
+	s.expires = time.Now().Add(-time.Second)
+	sessions.byID[cookies[0].Value] = s
+	sessions.Unlock()
+	r = httptest.NewRequest(http.MethodPost, "/release", strings.NewReader(`{"dataset_id": "EGAD00000000001"}`))
+	r.AddCookie(cookies[0])
+	w = httptest.NewRecorder()
+	server.Handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	r = httptest.NewRequest(http.MethodPost, "/release", strings.NewReader(`{"dataset_id": "EGAD00000000001"}`))
+	r.AddCookie(&http.Cookie{Name: "api_session_key", Value: "made-up"})
+	w = httptest.NewRecorder()
+	server.Handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestDecodeBigInt(t *testing.T) {
+	n, err := decodeBigInt("AQAB")
+	assert.NoError(t, err)
+	assert.Equal(t, big.NewInt(65537), n)
+
+	_, err = decodeBigInt("")
+	assert.Error(t, err)
+}
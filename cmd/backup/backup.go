@@ -3,17 +3,25 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"hash"
 	"io"
 	"strings"
+	"sync"
 
 	"sda-pipeline/internal/broker"
 	"sda-pipeline/internal/config"
 	"sda-pipeline/internal/database"
+	"sda-pipeline/internal/health"
+	"sda-pipeline/internal/metrics"
 	"sda-pipeline/internal/storage"
 
 	"github.com/neicnordic/crypt4gh/model/headers"
+	amqp "github.com/rabbitmq/amqp091-go"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/crypto/chacha20poly1305"
 )
@@ -39,6 +47,7 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	metrics.Start("backup", conf.Metrics)
 	mq, err := broker.NewMQ(conf.Broker)
 	if err != nil {
 		log.Fatal(err)
@@ -47,32 +56,62 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	backupStorage, err := storage.NewBackend(conf.Backup)
+	recorded, err := db.TableExists("backups")
 	if err != nil {
-		log.Fatal(err)
+		log.Fatalf("failed to inspect database schema: %v", err)
+	}
+	if !recorded {
+		log.Fatal("sda.backups does not exist, apply the migration migrations/03_backups.sql before starting backup")
 	}
 	archive, err := storage.NewBackend(conf.Archive)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	// we don't need crypt4gh keys if copyheader disabled
-	var key *[32]byte
-	var publicKey *[32]byte
-	if config.CopyHeader() {
-		key, err = config.GetC4GHKey()
+	// we don't need crypt4gh keys if no destination copies the header
+	var keyring []config.C4GHKey
+	destinations := make([]destination, 0, len(conf.Backups))
+	for _, backupConf := range conf.Backups {
+		backupStorage, err := storage.NewBackend(backupConf.Storage)
 		if err != nil {
 			log.Fatal(err)
 		}
+		destinations = append(destinations, destination{
+			name:       backupConf.Name,
+			storage:    backupStorage,
+			copyHeader: backupConf.CopyHeader,
+			publicKeys: backupConf.PublicKeys,
+		})
+
+		if backupConf.CopyHeader && keyring == nil {
+			keyring, err = config.GetC4GHKeyring()
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
 
-		publicKey, err = config.GetC4GHPublicKey()
-		if err != nil {
-			log.Fatal(err)
+	go config.WatchSecrets(conf, func(c *config.Config) {
+		mq.UpdatePassword(c.Broker.Password)
+		if err := db.UpdateConf(c.Database); err != nil {
+			log.Errorf("Failed to reconnect to database with refreshed secrets, reason: %v", err)
+		}
+		storage.UpdateCredentials(archive, c.Archive)
+		for i, d := range destinations {
+			storage.UpdateCredentials(d.storage, c.Backups[i].Storage)
 		}
+	})
+
+	healthServer := health.NewServer(conf.Health)
+	healthServer.AddReadinessCheck("broker", health.BrokerCheck(mq))
+	healthServer.AddReadinessCheck("database", health.DatabaseCheck(db))
+	healthServer.AddReadinessCheck("archive", health.StorageCheck(archive))
+	for _, d := range destinations {
+		healthServer.AddReadinessCheck("backup/"+d.name, health.StorageCheck(d.storage))
 	}
+	healthServer.Start()
 
-	defer mq.Channel.Close()
-	defer mq.Connection.Close()
+	defer mq.Close()
 	defer db.Close()
 
 	go func() {
@@ -121,17 +160,9 @@ func main() {
 
 			// we unmarshal the message in the validation step so this is safe to do
 			_ = json.Unmarshal(delivered.Body, &message)
+			fields := messageFields(delivered.CorrelationId, message)
 
-			log.Infof("Received work (corr-id: %s, "+
-				"filepath: %s, "+
-				"user: %s, "+
-				"accessionid: %s, "+
-				"decryptedChecksums: %v)",
-				delivered.CorrelationId,
-				message.Filepath,
-				message.User,
-				message.AccessionID,
-				message.DecryptedChecksums)
+			log.Infof("Received work (%s)", fields)
 
 			// Extract the sha256 from the message and use it for the database
 			var checksumSha256 string
@@ -144,33 +175,10 @@ func main() {
 			var filePath string
 			var fileSize int
 			if filePath, fileSize, err = db.GetArchived(message.User, message.Filepath, checksumSha256); err != nil {
-				log.Errorf("GetArchived failed "+
-					"(corr-id: %s, "+
-					"filepath: %s, "+
-					"user: %s, "+
-					"accessionid: %s, "+
-					"decryptedChecksums: %v, error: %v)",
-					delivered.CorrelationId,
-					message.Filepath,
-					message.User,
-					message.AccessionID,
-					message.DecryptedChecksums,
-					err)
+				log.Errorf("GetArchived failed (%s, error: %v)", fields, err)
 
-				// nack the message but requeue until we fixed the SQL retry.
-				if e := delivered.Nack(false, true); e != nil {
-					log.Errorf("Failed to NAck because of GetArchived failed "+
-						"(corr-id: %s, "+
-						"filepath: %s, "+
-						"user: %s, "+
-						"accessionid: %s, "+
-						"decryptedChecksums: %v, error: %v)",
-						delivered.CorrelationId,
-						message.Filepath,
-						message.User,
-						message.AccessionID,
-						message.DecryptedChecksums,
-						e)
+				if e := mq.Retry(&delivered, "GetArchived failed", err.Error()); e != nil {
+					log.Errorf("Failed to retry message because of GetArchived failed (%s, error: %v)", fields, e)
 				}
 
 				continue
@@ -184,33 +192,10 @@ func main() {
 			diskFileSize, err := archive.GetFileSize(filePath)
 
 			if err != nil {
-				log.Errorf("Failed to get size info for archived file %s "+
-					"(corr-id: %s, "+
-					"filepath: %s, "+
-					"user: %s, "+
-					"accessionid: %s, "+
-					"decryptedChecksums: %v, error: %v)",
-					filePath,
-					delivered.CorrelationId,
-					message.Filepath,
-					message.User,
-					message.AccessionID,
-					message.DecryptedChecksums,
-					err)
+				log.Errorf("Failed to get size info for archived file %s (%s, error: %v)", filePath, fields, err)
 
-				if e := delivered.Nack(false, true); e != nil {
-					log.Errorf("Failed to NAck because of GetFileSize failed "+
-						"(corr-id: %s, "+
-						"filepath: %s, "+
-						"user: %s, "+
-						"accessionid: %s, "+
-						"decryptedChecksums: %v, error: %v)",
-						delivered.CorrelationId,
-						message.Filepath,
-						message.User,
-						message.AccessionID,
-						message.DecryptedChecksums,
-						e)
+				if e := mq.Retry(&delivered, "Failed to get size info for archived file", err.Error()); e != nil {
+					log.Errorf("Failed to retry message because of GetFileSize failed (%s, error: %v)", fields, e)
 				}
 
 				continue
@@ -218,316 +203,510 @@ func main() {
 
 			if diskFileSize != int64(fileSize) {
 				log.Errorf("File size in archive does not match database for archive file %s "+
-					"- archive size is %d, database has %d "+
-					"(corr-id: %s, "+
-					"filepath: %s, "+
-					"user: %s, "+
-					"accessionid: %s, "+
-					"decryptedChecksums: %v, error: %v)",
+					"- archive size is %d, database has %d (%s)",
 					filePath,
 					diskFileSize,
 					fileSize,
-					delivered.CorrelationId,
-					message.Filepath,
-					message.User,
-					message.AccessionID,
-					message.DecryptedChecksums,
-					err)
+					fields)
 
-				if e := delivered.Nack(false, true); e != nil {
-					log.Errorf("Failed to NAck because of file size differences failed "+
-						"(corr-id: %s, "+
-						"filepath: %s, "+
-						"user: %s, "+
-						"accessionid: %s, "+
-						"decryptedChecksums: %v, error: %v)",
-						delivered.CorrelationId,
-						message.Filepath,
-						message.User,
-						message.AccessionID,
-						message.DecryptedChecksums,
-						e)
+				if e := mq.Retry(&delivered, "File size in archive does not match database", fmt.Sprintf("archive size is %d, database has %d", diskFileSize, fileSize)); e != nil {
+					log.Errorf("Failed to retry message because of file size differences failed (%s, error: %v)", fields, e)
 				}
 
 				continue
 			}
 
-			file, err := archive.NewFileReader(filePath)
+			// Decrypt the header once if any destination needs a copy of it
+			var decHeader []byte
+			var key *[32]byte
+			//nolint:nestif
+			if copyHeader(destinations) {
+				// Get the header from db
+				header, err := db.GetHeaderForStableID(message.AccessionID)
+				if err != nil {
+					log.Errorf("GetHeaderForStableID failed (%s, error: %v)", fields, err)
+
+					if e := mq.Retry(&delivered, "GetHeaderForStableID failed", err.Error()); e != nil {
+						log.Errorf("Failed to retry message because of GetHeaderForStableID failed (%s, error: %v)", fields, e)
+					}
+
+					continue
+				}
+
+				// Decrypt header
+				log.Debug("Decrypt header")
+				decHeader, err = FormatHexHeader(header)
+				if err != nil {
+					log.Errorf("Failed to decode the header (%s, error: %v)", fields, err)
+
+					if e := mq.Retry(&delivered, "Failed to decode the header", err.Error()); e != nil {
+						log.Errorf("Failed to retry message because of decode header failed (%s, error: %v)", fields, e)
+					}
+
+					continue
+				}
+
+				archiveKey, err := config.FindC4GHKey(keyring, decHeader)
+				if err != nil {
+					log.Errorf("Failed to decrypt header with any key in the keyring (%s, error: %v)", fields, err)
+
+					if e := delivered.Nack(false, false); e != nil {
+						log.Errorf("Failed to NAck because of decrypt header failed (%s, error: %v)", fields, e)
+					}
+
+					// Send the message to an error queue so it can be analyzed.
+					infoErrorMessage := broker.InfoError{
+						Error:           "Failed to decrypt header with any key in the keyring",
+						Reason:          err.Error(),
+						OriginalMessage: message,
+					}
+					body, _ := json.Marshal(infoErrorMessage)
+					if e := mq.SendMessage(delivered.CorrelationId, conf.Broker.Exchange, conf.Broker.RoutingError, conf.Broker.Durable, body); e != nil {
+						log.Errorf("Failed to publish message (decrypt header error), to error queue (%s, error: %v)", fields, e)
+					}
+
+					continue
+				}
+				key = &archiveKey.PrivateKey
+			}
+
+			archivedChecksum, err := db.GetArchivedChecksum(message.AccessionID)
 			if err != nil {
-				log.Errorf("Failed to open archived file %s "+
-					"(corr-id: %s, "+
-					"filepath: %s, "+
-					"user: %s, "+
-					"accessionid: %s, "+
-					"decryptedChecksums: %v, error: %v)",
-					filePath,
-					delivered.CorrelationId,
-					message.Filepath,
-					message.User,
-					message.AccessionID,
-					message.DecryptedChecksums,
-					err)
+				log.Errorf("GetArchivedChecksum failed (%s, error: %v)", fields, err)
 
-				//FIXME: should it retry?
-				if e := delivered.Nack(false, true); e != nil {
-					log.Errorf("Failed to NAck because of NewFileReader failed "+
-						"(corr-id: %s, "+
-						"filepath: %s, "+
-						"user: %s, "+
-						"accessionid: %s, "+
-						"decryptedChecksums: %v, error: %v)",
-						delivered.CorrelationId,
-						message.Filepath,
-						message.User,
-						message.AccessionID,
-						message.DecryptedChecksums,
-						e)
+				if e := mq.Retry(&delivered, "GetArchivedChecksum failed", err.Error()); e != nil {
+					log.Errorf("Failed to retry message because of GetArchivedChecksum failed (%s, error: %v)", fields, e)
 				}
 
 				continue
 			}
 
-			// If the copy header is enabled, use the actual filepath to make backup
-			// This will be used in the BigPicture backup, enabling for ingestion of the file
-			if config.CopyHeader() {
-				filePath = message.Filepath
+			// Destinations that the file was backed up to by an earlier
+			// attempt of the message are not copied to again
+			backedUp, pending := pendingDestinations(destinations, delivered.Headers)
+			if len(backedUp) > 0 {
+				log.Infof("File is already backed up to %s (%s)", strings.Join(backedUp, ", "), fields)
 			}
 
-			dest, err := backupStorage.NewFileWriter(filePath)
-			if err != nil {
-				log.Errorf("Failed to open backup file %s for writing "+
-					"(corr-id: %s, "+
-					"filepath: %s, "+
-					"user: %s, "+
-					"accessionid: %s, "+
-					"decryptedChecksums: %v, error: %v)",
-					filePath,
-					delivered.CorrelationId,
-					message.Filepath,
-					message.User,
-					message.AccessionID,
-					message.DecryptedChecksums,
-					err)
+			// Copy the file to the destinations, resuming earlier interrupted copies if the backup storage supports it
+			results := backupToDestinations(archive, pending, key, decHeader, filePath, message.Filepath, diskFileSize, archivedChecksum)
+
+			var verificationErrors []string
+			for _, result := range results {
+				status, reason := "backed up", ""
+				if result.err != nil {
+					status, reason = "error", result.err.Error()
+					if result.verifyFailed {
+						verificationErrors = append(verificationErrors, fmt.Sprintf("%s: %s", result.destination, reason))
+					}
 
-				//FIXME: should it retry?
-				if e := delivered.Nack(false, true); e != nil {
-					log.Errorf("Failed to NAck because of NewFileWriter failed "+
-						"(corr-id: %s, "+
-						"filepath: %s, "+
-						"user: %s, "+
-						"accessionid: %s, "+
-						"decryptedChecksums: %v, error: %v)",
-						delivered.CorrelationId,
-						message.Filepath,
-						message.User,
-						message.AccessionID,
-						message.DecryptedChecksums,
-						e)
+					log.Errorf("Failed to backup file to %s (%s, error: %v)", result.destination, fields, result.err)
+				} else {
+					backedUp = append(backedUp, result.destination)
+					metrics.FileProcessed(diskFileSize)
+
+					log.Infof("Backuped file %s (%d bytes, sha256: %s) from archive to %s (%s)",
+						result.path,
+						fileSize,
+						result.checksum,
+						result.destination,
+						fields)
 				}
 
-				continue
+				if err := db.SetBackupStatus(message.AccessionID, result.destination, status, delivered.CorrelationId, message.User, reason); err != nil {
+					log.Errorf("SetBackupStatus failed for %s (%s, error: %v)", result.destination, fields, err)
+				}
 			}
 
-			// Check if the header is needed
-			//nolint:nestif
-			if config.CopyHeader() {
-				// Get the header from db
-				header, err := db.GetHeaderForStableID(message.AccessionID)
-				if err != nil {
-					log.Errorf("GetHeaderForStableID failed "+
-						"(corr-id: %s, "+
-						"filepath: %s, "+
-						"user: %s, "+
-						"accessionid: %s, "+
-						"decryptedChecksums: %v, error: %v)",
-						delivered.CorrelationId,
-						message.Filepath,
-						message.User,
-						message.AccessionID,
-						message.DecryptedChecksums,
-						err)
+			if len(backedUp) < conf.BackupQuorum {
+				log.Errorf("Backup quorum not reached, %d of %d destinations succeeded and %d are required (%s)",
+					len(backedUp),
+					len(destinations),
+					conf.BackupQuorum,
+					fields)
+
+				reason := fmt.Sprintf("%d of %d destinations succeeded and %d are required", len(backedUp), len(destinations), conf.BackupQuorum)
+				if len(verificationErrors) > 0 {
+					reason = strings.Join(verificationErrors, "; ")
+				}
+				if err := db.SetBackupError(message.AccessionID, delivered.CorrelationId, message.User, reason); err != nil {
+					log.Errorf("SetBackupError failed (%s, error: %v)", fields, err)
 				}
 
-				// Decrypt header
-				log.Debug("Decrypt header")
-				DecHeader, err := FormatHexHeader(header)
-				if err != nil {
-					log.Errorf("Failed to decode the header %s "+
-						"(corr-id: %s, "+
-						"filepath: %s, "+
-						"user: %s, "+
-						"accessionid: %s, "+
-						"decryptedChecksums: %v, error: %v)",
-						filePath,
-						delivered.CorrelationId,
-						message.Filepath,
-						message.User,
-						message.AccessionID,
-						message.DecryptedChecksums,
-						err)
-
-					if e := delivered.Nack(false, true); e != nil {
-						log.Errorf("Failed to NAck because of decode header failed "+
-							"(corr-id: %s, "+
-							"filepath: %s, "+
-							"user: %s, "+
-							"accessionid: %s, "+
-							"decryptedChecksums: %v, error: %v)",
-							delivered.CorrelationId,
-							message.Filepath,
-							message.User,
-							message.AccessionID,
-							message.DecryptedChecksums,
-							e)
+				// Failed copies are retried, but a copy that does not match the archive needs to be looked into
+				if len(verificationErrors) == 0 {
+					setBackedUp(&delivered, backedUp)
+					if e := mq.Retry(&delivered, "Backup quorum not reached", reason); e != nil {
+						log.Errorf("Failed to retry message because of backup quorum not reached (%s, error: %v)", fields, e)
 					}
+
+					continue
 				}
 
-				// Reencrypt header
-				log.Debug("Reencrypt header")
-				pubkeyList := [][chacha20poly1305.KeySize]byte{}
-				pubkeyList = append(pubkeyList, *publicKey)
-				newHeader, err := headers.ReEncryptHeader(DecHeader, *key, pubkeyList)
-				if err != nil {
-					log.Errorf("Failed to reencrypt the header %s "+
-						"(corr-id: %s, "+
-						"filepath: %s, "+
-						"user: %s, "+
-						"accessionid: %s, "+
-						"decryptedChecksums: %v, error: %v)",
-						filePath,
-						delivered.CorrelationId,
-						message.Filepath,
-						message.User,
-						message.AccessionID,
-						message.DecryptedChecksums,
-						err)
-
-					if e := delivered.Nack(false, true); e != nil {
-						log.Errorf("Failed to NAck because of reencrypt header failed "+
-							"(corr-id: %s, "+
-							"filepath: %s, "+
-							"user: %s, "+
-							"accessionid: %s, "+
-							"decryptedChecksums: %v, error: %v)",
-							delivered.CorrelationId,
-							message.Filepath,
-							message.User,
-							message.AccessionID,
-							message.DecryptedChecksums,
-							e)
-					}
+				if e := delivered.Nack(false, false); e != nil {
+					log.Errorf("Failed to NAck because of backup quorum not reached (%s, error: %v)", fields, e)
 				}
 
-				// write header to destination file
-				_, err = dest.Write(newHeader)
-				if err != nil {
-					log.Errorf("Failed to write the header to destination %s "+
-						"(corr-id: %s, "+
-						"filepath: %s, "+
-						"user: %s, "+
-						"accessionid: %s, "+
-						"decryptedChecksums: %v, error: %v)",
-						filePath,
-						delivered.CorrelationId,
-						message.Filepath,
-						message.User,
-						message.AccessionID,
-						message.DecryptedChecksums,
-						err)
+				// Send the message to an error queue so it can be analyzed.
+				infoErrorMessage := broker.InfoError{
+					Error:           "Verification of backup failed",
+					Reason:          reason,
+					OriginalMessage: message,
+				}
+				body, _ := json.Marshal(infoErrorMessage)
+				if e := mq.SendMessage(delivered.CorrelationId, conf.Broker.Exchange, conf.Broker.RoutingError, conf.Broker.Durable, body); e != nil {
+					log.Errorf("Failed to publish message (backup verification error), to error queue (%s, error: %v)", fields, e)
 				}
+
+				continue
 			}
 
-			// Copy the file and check is sizes match
-			copiedSize, err := io.Copy(dest, file)
-			if err != nil || copiedSize != int64(fileSize) {
-				log.Errorf("Failed to copy file "+
-					"(corr-id: %s, "+
-					"filepath: %s, "+
-					"user: %s, "+
-					"accessionid: %s, "+
-					"decryptedChecksums: %v, error: %v)",
-					delivered.CorrelationId,
-					message.Filepath,
-					message.User,
-					message.AccessionID,
-					message.DecryptedChecksums,
-					err)
+			if err := mq.SendMessage(delivered.CorrelationId, conf.Broker.Exchange, conf.Broker.RoutingKey, conf.Broker.Durable, delivered.Body); err != nil {
+				log.Errorf("Failed to send message for completed (%s, error: %v)", fields, err)
 
-				//FIXME: should it retry?
-				if e := delivered.Nack(false, true); e != nil {
-					log.Errorf("Failed to NAck because of Copy failed "+
-						"(corr-id: %s, "+
-						"filepath: %s, "+
-						"user: %s, "+
-						"accessionid: %s, "+
-						"decryptedChecksums: %v, error: %v)",
-						delivered.CorrelationId,
-						message.Filepath,
-						message.User,
-						message.AccessionID,
-						message.DecryptedChecksums,
-						e)
+				if e := mq.Retry(&delivered, "Failed to send message for completed", err.Error()); e != nil {
+					log.Errorf("Failed to retry message (%s, error: %v)", fields, e)
 				}
 
 				continue
 			}
 
-			file.Close()
-			dest.Close()
-
-			log.Infof("Backuped file %s (%d bytes) from archive to backup "+
-				"(corr-id: %s, "+
-				"filepath: %s, "+
-				"user: %s, "+
-				"accessionid: %s, "+
-				"decryptedChecksums: %v)",
-				filePath,
-				fileSize,
-				delivered.CorrelationId,
-				message.Filepath,
-				message.User,
-				message.AccessionID,
-				message.DecryptedChecksums)
+			if err := delivered.Ack(false); err != nil {
+				log.Errorf("Failed to ack message after work completed (%s, error: %v)", fields, err)
+			}
+		}
+	}()
 
-			if err := mq.SendMessage(delivered.CorrelationId, conf.Broker.Exchange, conf.Broker.RoutingKey, conf.Broker.Durable, delivered.Body); err != nil {
-				// TODO fix resend mechanism
-				log.Errorf("Failed to send message for completed "+
-					"(corr-id: %s, "+
-					"filepath: %s, "+
-					"user: %s, "+
-					"accessionid: %s, "+
-					"decryptedChecksums: %v, error: %v)",
-					delivered.CorrelationId,
-					message.Filepath,
-					message.User,
-					message.AccessionID,
-					message.DecryptedChecksums,
-					err)
+	mq.WaitForShutdown(forever, nil)
+}
 
-				// Restart loop, do not ack
-				continue
+// messageFields formats the fields that identify a message in the logs
+func messageFields(corrID string, message backup) string {
+	return fmt.Sprintf("corr-id: %s, filepath: %s, user: %s, accessionid: %s, decryptedChecksums: %v",
+		corrID,
+		message.Filepath,
+		message.User,
+		message.AccessionID,
+		message.DecryptedChecksums)
+}
+
+// backedUpHeader is the header of a retried message that holds the names
+// of the destinations the file was backed up to by earlier attempts
+const backedUpHeader = "x-backed-up"
+
+// pendingDestinations splits the destinations into the names of those the
+// file has already been backed up to, according to the headers of the
+// message, and those it still needs to be backed up to
+func pendingDestinations(destinations []destination, headers amqp.Table) ([]string, []destination) {
+	done := map[string]bool{}
+	names, _ := headers[backedUpHeader].([]interface{})
+	for _, name := range names {
+		if name, ok := name.(string); ok {
+			done[name] = true
+		}
+	}
+
+	backedUp := []string{}
+	pending := []destination{}
+	for _, d := range destinations {
+		if done[d.name] {
+			backedUp = append(backedUp, d.name)
+		} else {
+			pending = append(pending, d)
+		}
+	}
+
+	return backedUp, pending
+}
+
+// setBackedUp records the names of the destinations the file has been
+// backed up to in the headers of the message, so that a retry of it only
+// backs up to the rest
+func setBackedUp(delivered *amqp.Delivery, backedUp []string) {
+	names := make([]interface{}, 0, len(backedUp))
+	for _, name := range backedUp {
+		names = append(names, name)
+	}
+
+	headers := amqp.Table{}
+	for k, v := range delivered.Headers {
+		headers[k] = v
+	}
+	headers[backedUpHeader] = names
+	delivered.Headers = headers
+}
+
+// destination is a backup storage and how files are written to it
+type destination struct {
+	name       string
+	storage    storage.Backend
+	copyHeader bool
+	publicKeys [][chacha20poly1305.KeySize]byte
+}
+
+// backupResult is the outcome of backing up a file to one destination
+type backupResult struct {
+	destination  string
+	path         string
+	checksum     string
+	err          error
+	verifyFailed bool
+}
+
+// copyHeader returns true if any of the destinations gets the header
+func copyHeader(destinations []destination) bool {
+	for _, d := range destinations {
+		if d.copyHeader {
+			return true
+		}
+	}
+
+	return false
+}
+
+// backupToDestinations backs up the archived file to all destinations
+// concurrently and returns the results in the order of the destinations
+func backupToDestinations(archive storage.Backend, destinations []destination, key *[32]byte, decHeader []byte, archivePath, inboxPath string, size int64, archivedChecksum string) []backupResult {
+	results := make([]backupResult, len(destinations))
+
+	var wg sync.WaitGroup
+	for i := range destinations {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = backupTo(archive, destinations[i], key, decHeader, archivePath, inboxPath, size, archivedChecksum)
+		}(i)
+	}
+	wg.Wait()
+
+	return results
+}
+
+// backupTo copies the archived file to one destination and verifies the
+// copy. Destinations that copy the header get the header reencrypted for
+// their public keys, and the file is stored at the inbox path.
+func backupTo(archive storage.Backend, d destination, key *[32]byte, decHeader []byte, archivePath, inboxPath string, size int64, archivedChecksum string) backupResult {
+	result := backupResult{destination: d.name, path: archivePath}
+
+	var header []byte
+	if d.copyHeader {
+		// This will be used in the BigPicture backup, enabling for ingestion of the file
+		result.path = inboxPath
+
+		var err error
+		header, err = headers.ReEncryptHeader(decHeader, *key, d.publicKeys)
+		if err != nil {
+			result.err = fmt.Errorf("failed to reencrypt the header, %v", err)
+
+			return result
+		}
+	}
+
+	written, err := backupFile(archive, d.storage, archivePath, result.path, header, size)
+	if err != nil {
+		result.err = fmt.Errorf("failed to copy file, %v", err)
+
+		return result
+	}
+
+	// Read the backup back to make sure it holds what was archived and written
+	checksum, err := verifyBackup(d.storage, result.path, header, size, archivedChecksum, written)
+	if err != nil {
+		result.err = err
+		result.verifyFailed = true
+
+		return result
+	}
+	result.checksum = checksum
+
+	return result
+}
+
+// readCloser combines a reader with the closer of the underlying file
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// writtenRange is a range of a backup file that was written by backupFile,
+// with the hash of the bytes that were written to it
+type writtenRange struct {
+	offset int64
+	length int64
+	hash   hash.Hash
+}
+
+// backupFile copies the archived file to the backup storage, prefixed by
+// header if it is set. Backup storages that support it resume an earlier
+// interrupted copy of the file, others always get a full copy. The ranges
+// of the file that were written are returned with the hashes of what was
+// written to them, which covers the whole file unless the copy was resumed.
+func backupFile(archive, backupStorage storage.Backend, archivePath, backupPath string, header []byte, size int64) ([]writtenRange, error) {
+	headerSize := int64(len(header))
+
+	if resumable, ok := backupStorage.(storage.ResumableBackend); ok {
+		var written []writtenRange
+		source := func(offset, length int64) (io.ReadCloser, error) {
+			if offset >= headerSize {
+				return archive.NewFileReaderAt(archivePath, offset-headerSize, length)
 			}
 
-			if err := delivered.Ack(false); err != nil {
+			// The range starts in the header
+			end := offset + length
+			if end > headerSize {
+				end = headerSize
+			}
+			headerPart := header[offset:end]
+			remaining := length - int64(len(headerPart))
+			if remaining == 0 {
+				return io.NopCloser(bytes.NewReader(headerPart)), nil
+			}
+			file, err := archive.NewFileReaderAt(archivePath, 0, remaining)
+			if err != nil {
+				return nil, err
+			}
 
-				log.Errorf("Failed to ack message after work completed "+
-					"(corr-id: %s, "+
-					"filepath: %s, "+
-					"user: %s, "+
-					"accessionid: %s, "+
-					"decryptedChecksums: %v, error: %v)",
-					delivered.CorrelationId,
-					message.Filepath,
-					message.User,
-					message.AccessionID,
-					message.DecryptedChecksums,
-					err)
+			return readCloser{io.MultiReader(bytes.NewReader(headerPart), file), file}, nil
+		}
 
+		err := resumable.ResumableWrite(backupPath, headerSize+size, func(offset, length int64) (io.ReadCloser, error) {
+			r, err := source(offset, length)
+			if err != nil {
+				return nil, err
 			}
+			written = append(written, writtenRange{offset: offset, length: length, hash: sha256.New()})
+
+			return readCloser{io.TeeReader(r, written[len(written)-1].hash), r}, nil
+		})
+
+		return written, err
+	}
+
+	file, err := archive.NewFileReader(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	dest, err := backupStorage.NewFileWriter(backupPath)
+	if err != nil {
+		return nil, err
+	}
+
+	writtenHash := sha256.New()
+	stream := io.MultiWriter(dest, writtenHash)
+	if _, err := stream.Write(header); err != nil {
+		dest.Close()
+
+		return nil, err
+	}
+
+	copiedSize, err := io.Copy(stream, file)
+	if err != nil {
+		dest.Close()
+
+		return nil, err
+	}
+	if copiedSize != size {
+		dest.Close()
+
+		return nil, fmt.Errorf("copied %d bytes but the archived file is %d bytes", copiedSize, size)
+	}
+
+	return []writtenRange{{offset: 0, length: headerSize + size, hash: writtenHash}}, dest.Close()
+}
+
+// rangeHasher hashes the bytes written to it that fall in the written
+// ranges, as they are read back from the backup file
+type rangeHasher struct {
+	written []writtenRange
+	hashes  []hash.Hash
+	pos     int64
+}
+
+func newRangeHasher(written []writtenRange) *rangeHasher {
+	h := &rangeHasher{written: written, hashes: make([]hash.Hash, len(written))}
+	for i := range h.hashes {
+		h.hashes[i] = sha256.New()
+	}
+
+	return h
+}
+
+func (h *rangeHasher) Write(p []byte) (int, error) {
+	end := h.pos + int64(len(p))
+	for i, r := range h.written {
+		from, to := r.offset, r.offset+r.length
+		if from < h.pos {
+			from = h.pos
 		}
-	}()
+		if to > end {
+			to = end
+		}
+		if from < to {
+			h.hashes[i].Write(p[from-h.pos : to-h.pos])
+		}
+	}
+	h.pos = end
+
+	return len(p), nil
+}
+
+// check returns an error for the first range whose read back bytes differ
+// from what was written
+func (h *rangeHasher) check() error {
+	for i, r := range h.written {
+		if !bytes.Equal(h.hashes[i].Sum(nil), r.hash.Sum(nil)) {
+			return fmt.Errorf("backup bytes %d to %d do not match what was written", r.offset, r.offset+r.length)
+		}
+	}
+
+	return nil
+}
+
+// verifyBackup reads back the backup file and checks that it consists of
+// a crypt4gh header of the same size as header followed by size bytes of
+// data with the archived sha256 checksum, and that the written ranges hold
+// what was written to them. The header is not compared with header as
+// such, since a resumed copy can hold the header from an earlier attempt.
+// The sha256 checksum of the whole backup file is returned.
+func verifyBackup(backupStorage storage.Backend, backupPath string, header []byte, size int64, archivedChecksum string, written []writtenRange) (string, error) {
+	file, err := backupStorage.NewFileReader(backupPath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	backupHash := sha256.New()
+	writtenHashes := newRangeHasher(written)
+	stream := io.TeeReader(file, io.MultiWriter(backupHash, writtenHashes))
+
+	if len(header) > 0 {
+		backupHeader := make([]byte, len(header))
+		if _, err := io.ReadFull(stream, backupHeader); err != nil {
+			return "", fmt.Errorf("failed to read back header, %v", err)
+		}
+		if _, err := headers.ReadHeader(bytes.NewReader(backupHeader)); err != nil {
+			return "", fmt.Errorf("backup header is broken, %v", err)
+		}
+	}
+
+	dataHash := sha256.New()
+	dataSize, err := io.Copy(dataHash, stream)
+	if err != nil {
+		return "", err
+	}
+	if dataSize != size {
+		return "", fmt.Errorf("backup holds %d bytes of data but the archived file is %d bytes", dataSize, size)
+	}
+	if checksum := hex.EncodeToString(dataHash.Sum(nil)); checksum != archivedChecksum {
+		return "", fmt.Errorf("checksum %s of backup does not match archived checksum %s", checksum, archivedChecksum)
+	}
+	if err := writtenHashes.check(); err != nil {
+		return "", err
+	}
 
-	<-forever
+	return hex.EncodeToString(backupHash.Sum(nil)), nil
 }
 
 // FormatHexHeader decodes a hex formatted file header, and returns the data as a binary
@@ -1,9 +1,25 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
 	"testing"
 
+	"sda-pipeline/internal/config"
+	"sda-pipeline/internal/storage"
+
+	"github.com/neicnordic/crypt4gh/keys"
+	"github.com/neicnordic/crypt4gh/model/headers"
+	"github.com/neicnordic/crypt4gh/streaming"
+	amqp "github.com/rabbitmq/amqp091-go"
 	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
 )
 
@@ -32,3 +48,277 @@ func (suite *TestSuite) SetupTest() {
 	viper.Set("db.password", "test")
 	viper.Set("db.database", "test")
 }
+
+// resumableBackend records what a resumable write reads from the source
+type resumableBackend struct {
+	storage.Backend
+	partSize int64
+	written  []byte
+}
+
+func (r *resumableBackend) ResumableWrite(_ string, size int64, source storage.RangeSource) error {
+	for offset := int64(0); offset < size; offset += r.partSize {
+		length := r.partSize
+		if offset+length > size {
+			length = size - offset
+		}
+		reader, err := source(offset, length)
+		if err != nil {
+			return err
+		}
+		data, err := io.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			return err
+		}
+		r.written = append(r.written, data...)
+	}
+
+	return nil
+}
+
+// backends returns posix archive and backup backends in temporary directories
+func (suite *TestSuite) backends() (storage.Backend, storage.Backend, string) {
+	archiveDir := suite.T().TempDir()
+	backupDir := suite.T().TempDir()
+	viper.Set("archive.location", archiveDir)
+	viper.Set("backup.location", backupDir)
+
+	conf, err := config.NewConfig("backup")
+	assert.NoError(suite.T(), err)
+	archive, err := storage.NewBackend(conf.Archive)
+	assert.NoError(suite.T(), err)
+	backupStorage, err := storage.NewBackend(conf.Backup)
+	assert.NoError(suite.T(), err)
+
+	assert.NoError(suite.T(), os.WriteFile(filepath.Join(archiveDir, "archived"), []byte("archived file data"), 0600))
+
+	return archive, backupStorage, backupDir
+}
+
+func (suite *TestSuite) TestBackupFile() {
+	archive, backupStorage, backupDir := suite.backends()
+
+	written, err := backupFile(archive, backupStorage, "archived", "backup", nil, 18)
+	assert.NoError(suite.T(), err)
+	data, err := os.ReadFile(filepath.Join(backupDir, "backup"))
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), []byte("archived file data"), data)
+	assert.Len(suite.T(), written, 1)
+	sum := sha256.Sum256(data)
+	assert.Equal(suite.T(), sum[:], written[0].hash.Sum(nil))
+
+	written, err = backupFile(archive, backupStorage, "archived", "withheader", []byte("header:"), 18)
+	assert.NoError(suite.T(), err)
+	data, err = os.ReadFile(filepath.Join(backupDir, "withheader"))
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), []byte("header:archived file data"), data)
+	assert.Equal(suite.T(), int64(25), written[0].length)
+	sum = sha256.Sum256(data)
+	assert.Equal(suite.T(), sum[:], written[0].hash.Sum(nil))
+
+	_, err = backupFile(archive, backupStorage, "archived", "backup", nil, 20)
+	assert.EqualError(suite.T(), err, "copied 18 bytes but the archived file is 20 bytes")
+	_, err = backupFile(archive, backupStorage, "missing", "backup", nil, 18)
+	assert.Error(suite.T(), err)
+}
+
+func (suite *TestSuite) TestBackupFile_resumable() {
+	archive, _, _ := suite.backends()
+
+	// Parts that start in the header, span the header and the file, and start in the file
+	for _, partSize := range []int64{3, 5, 7, 100} {
+		resumable := &resumableBackend{partSize: partSize}
+		written, err := backupFile(archive, resumable, "archived", "backup", []byte("header:"), 18)
+		assert.NoError(suite.T(), err)
+		assert.True(suite.T(), bytes.Equal([]byte("header:archived file data"), resumable.written), "part size %d gave %q", partSize, resumable.written)
+
+		// Each part is hashed as it is written
+		for _, r := range written {
+			sum := sha256.Sum256(resumable.written[r.offset : r.offset+r.length])
+			assert.Equal(suite.T(), sum[:], r.hash.Sum(nil), "part size %d", partSize)
+		}
+	}
+
+	resumable := &resumableBackend{partSize: 5}
+	written, err := backupFile(archive, resumable, "archived", "backup", nil, 18)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), []byte("archived file data"), resumable.written)
+	assert.Len(suite.T(), written, 4)
+}
+
+func (suite *TestSuite) TestVerifyBackup() {
+	archive, backupStorage, _ := suite.backends()
+	written, err := backupFile(archive, backupStorage, "archived", "backup", nil, 18)
+	assert.NoError(suite.T(), err)
+
+	sum := sha256.Sum256([]byte("archived file data"))
+	archivedChecksum := hex.EncodeToString(sum[:])
+
+	checksum, err := verifyBackup(backupStorage, "backup", nil, 18, archivedChecksum, written)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), archivedChecksum, checksum)
+
+	_, err = verifyBackup(backupStorage, "backup", nil, 20, archivedChecksum, written)
+	assert.EqualError(suite.T(), err, "backup holds 18 bytes of data but the archived file is 20 bytes")
+
+	_, err = verifyBackup(backupStorage, "backup", nil, 18, "deadbeef", written)
+	assert.EqualError(suite.T(), err, "checksum "+archivedChecksum+" of backup does not match archived checksum deadbeef")
+
+	_, err = verifyBackup(backupStorage, "missing", nil, 18, archivedChecksum, written)
+	assert.Error(suite.T(), err)
+}
+
+func (suite *TestSuite) TestVerifyBackup_header() {
+	archive, backupStorage, _ := suite.backends()
+
+	file, err := os.Open("../../dev_utils/dummy_data.c4gh")
+	assert.NoError(suite.T(), err)
+	defer file.Close()
+	header, err := headers.ReadHeader(file)
+	assert.NoError(suite.T(), err)
+
+	sum := sha256.Sum256([]byte("archived file data"))
+	archivedChecksum := hex.EncodeToString(sum[:])
+
+	written, err := backupFile(archive, backupStorage, "archived", "backup", header, 18)
+	assert.NoError(suite.T(), err)
+	checksum, err := verifyBackup(backupStorage, "backup", header, 18, archivedChecksum, written)
+	assert.NoError(suite.T(), err)
+	sum = sha256.Sum256(append(append([]byte{}, header...), []byte("archived file data")...))
+	assert.Equal(suite.T(), hex.EncodeToString(sum[:]), checksum)
+
+	// A header that is still crypt4gh but not what was written is refused
+	changed := append([]byte{}, header...)
+	changed[len(changed)-1] ^= 0xff
+	_, err = backupFile(archive, backupStorage, "archived", "changed", changed, 18)
+	assert.NoError(suite.T(), err)
+	_, err = verifyBackup(backupStorage, "changed", header, 18, archivedChecksum, written)
+	assert.EqualError(suite.T(), err, fmt.Sprintf("backup bytes 0 to %d do not match what was written", len(header)+18))
+
+	// A header that is not crypt4gh is refused
+	broken := bytes.Repeat([]byte("x"), len(header))
+	written, err = backupFile(archive, backupStorage, "archived", "broken", broken, 18)
+	assert.NoError(suite.T(), err)
+	_, err = verifyBackup(backupStorage, "broken", header, 18, archivedChecksum, written)
+	assert.ErrorContains(suite.T(), err, "backup header is broken")
+}
+
+func (suite *TestSuite) TestRangeHasher() {
+	data := []byte("header:archived file data")
+	var written []writtenRange
+	for _, r := range [][2]int64{{0, 5}, {5, 10}, {20, 5}} {
+		h := sha256.New()
+		h.Write(data[r[0] : r[0]+r[1]])
+		written = append(written, writtenRange{offset: r[0], length: r[1], hash: h})
+	}
+
+	// The ranges are hashed however the data is split up when it is read
+	for _, chunk := range []int{1, 3, 7, 100} {
+		hasher := newRangeHasher(written)
+		for i := 0; i < len(data); i += chunk {
+			end := i + chunk
+			if end > len(data) {
+				end = len(data)
+			}
+			_, _ = hasher.Write(data[i:end])
+		}
+		assert.NoError(suite.T(), hasher.check(), "chunk size %d", chunk)
+	}
+
+	hasher := newRangeHasher(written)
+	_, _ = hasher.Write([]byte("header:archived file DATA"))
+	assert.EqualError(suite.T(), hasher.check(), "backup bytes 20 to 25 do not match what was written")
+}
+
+// failingBackend fails all writes
+type failingBackend struct {
+	storage.Backend
+}
+
+func (f failingBackend) NewFileWriter(string) (io.WriteCloser, error) {
+	return nil, errors.New("storage unavailable")
+}
+
+func (suite *TestSuite) TestBackupToDestinations() {
+	archive, north, northDir := suite.backends()
+	_, south, southDir := suite.backends()
+
+	// Encrypt a file for the archive key to get a header to reencrypt
+	publicKey, key, err := keys.GenerateKeyPair()
+	assert.NoError(suite.T(), err)
+	_, writerKey, err := keys.GenerateKeyPair()
+	assert.NoError(suite.T(), err)
+	var encrypted bytes.Buffer
+	c4ghw, err := streaming.NewCrypt4GHWriter(&encrypted, writerKey, [][32]byte{publicKey}, nil)
+	assert.NoError(suite.T(), err)
+	assert.NoError(suite.T(), c4ghw.Close())
+	header, err := headers.ReadHeader(&encrypted)
+	assert.NoError(suite.T(), err)
+
+	// The backup header is reencrypted for two recipients
+	escrowPublicKey, escrowKey, err := keys.GenerateKeyPair()
+	assert.NoError(suite.T(), err)
+	partnerPublicKey, partnerKey, err := keys.GenerateKeyPair()
+	assert.NoError(suite.T(), err)
+
+	sum := sha256.Sum256([]byte("archived file data"))
+	archivedChecksum := hex.EncodeToString(sum[:])
+
+	destinations := []destination{
+		{name: "north", storage: north},
+		{name: "south", storage: south, copyHeader: true, publicKeys: [][32]byte{escrowPublicKey, partnerPublicKey}},
+		{name: "west", storage: failingBackend{}},
+	}
+	assert.True(suite.T(), copyHeader(destinations))
+	assert.False(suite.T(), copyHeader(destinations[:1]))
+
+	results := backupToDestinations(archive, destinations, &key, header, "archived", "file.c4gh", 18, archivedChecksum)
+	assert.Len(suite.T(), results, 3)
+
+	assert.Equal(suite.T(), "north", results[0].destination)
+	assert.NoError(suite.T(), results[0].err)
+	assert.Equal(suite.T(), "archived", results[0].path)
+	assert.Equal(suite.T(), archivedChecksum, results[0].checksum)
+	assert.FileExists(suite.T(), filepath.Join(northDir, "archived"))
+
+	assert.Equal(suite.T(), "south", results[1].destination)
+	assert.NoError(suite.T(), results[1].err)
+	assert.Equal(suite.T(), "file.c4gh", results[1].path)
+	data, err := os.ReadFile(filepath.Join(southDir, "file.c4gh"))
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), []byte("archived file data"), data[len(data)-18:])
+	for _, recipientKey := range [][32]byte{escrowKey, partnerKey} {
+		_, err = headers.NewHeader(bytes.NewReader(data), recipientKey)
+		assert.NoError(suite.T(), err)
+	}
+	_, err = headers.NewHeader(bytes.NewReader(data), key)
+	assert.Error(suite.T(), err)
+
+	assert.Equal(suite.T(), "west", results[2].destination)
+	assert.EqualError(suite.T(), results[2].err, "failed to copy file, storage unavailable")
+	assert.False(suite.T(), results[2].verifyFailed)
+
+	// A copy that does not match the archived checksum fails verification
+	results = backupToDestinations(archive, destinations[:1], nil, nil, "archived", "", 18, "deadbeef")
+	assert.Error(suite.T(), results[0].err)
+	assert.True(suite.T(), results[0].verifyFailed)
+}
+
+func (suite *TestSuite) TestPendingDestinations() {
+	destinations := []destination{{name: "north"}, {name: "south"}, {name: "west"}}
+
+	backedUp, pending := pendingDestinations(destinations, nil)
+	assert.Empty(suite.T(), backedUp)
+	assert.Equal(suite.T(), destinations, pending)
+
+	// A retry only backs up to the destinations that failed, destinations
+	// that are no longer configured are left out
+	delivered := amqp.Delivery{Headers: amqp.Table{"x-retry-count": int32(1)}}
+	setBackedUp(&delivered, []string{"south", "east"})
+	assert.Equal(suite.T(), int32(1), delivered.Headers["x-retry-count"])
+
+	backedUp, pending = pendingDestinations(destinations, delivered.Headers)
+	assert.Equal(suite.T(), []string{"south"}, backedUp)
+	assert.Equal(suite.T(), []destination{{name: "north"}, {name: "west"}}, pending)
+}
@@ -4,10 +4,14 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 
 	"sda-pipeline/internal/broker"
 	"sda-pipeline/internal/config"
 	"sda-pipeline/internal/database"
+	"sda-pipeline/internal/health"
+	"sda-pipeline/internal/metrics"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -41,6 +45,7 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	metrics.Start("finalize", conf.Metrics)
 	mq, err := broker.NewMQ(conf.Broker)
 	if err != nil {
 		log.Fatal(err)
@@ -49,9 +54,19 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	go config.WatchSecrets(conf, func(c *config.Config) {
+		mq.UpdatePassword(c.Broker.Password)
+		if err := db.UpdateConf(c.Database); err != nil {
+			log.Errorf("Failed to reconnect to database with refreshed secrets, reason: %v", err)
+		}
+	})
+
+	healthServer := health.NewServer(conf.Health)
+	healthServer.AddReadinessCheck("broker", health.BrokerCheck(mq))
+	healthServer.AddReadinessCheck("database", health.DatabaseCheck(db))
+	healthServer.Start()
 
-	defer mq.Channel.Close()
-	defer mq.Connection.Close()
+	defer mq.Close()
 	defer db.Close()
 
 	go func() {
@@ -67,7 +82,6 @@ func main() {
 	}()
 
 	log.Info("Starting finalize service")
-	var message finalize
 
 	go func() {
 		messages, err := mq.GetMessages(conf.Broker.Queue)
@@ -75,6 +89,7 @@ func main() {
 			log.Fatal(err)
 		}
 		for delivered := range messages {
+			var message finalize
 			log.Debugf("Received a message (corr-id: %s, message: %s)",
 				delivered.CorrelationId,
 				delivered.Body)
@@ -175,8 +190,8 @@ func main() {
 					message.DecryptedChecksums,
 					err)
 
-				if e := delivered.Nack(false, true); e != nil {
-					log.Errorf("Failed to NAck because of checking accession id exists failed "+
+				if e := mq.Retry(&delivered, "CheckAccessionIdExists failed", err.Error()); e != nil {
+					log.Errorf("Failed to retry message after checking accession id exists failed "+
 						"(corr-id: %s, "+
 						"filepath: %s, "+
 						"user: %s, "+
@@ -227,6 +242,21 @@ func main() {
 						e)
 				}
 
+				userError := &broker.UserError{
+					Code:   broker.UserErrorDuplicateAccession,
+					Reason: fmt.Sprintf("The accession ID %s is already given to another file", message.AccessionID),
+					Err:    errors.New("accession ID already exists"),
+				}
+				if e := mq.SendUserError(&delivered, message.User, message.Filepath, userError); e != nil {
+					log.Errorf("Failed to publish conflict in accessionID user error message "+
+						"(corr-id: %s, user: %s, filepath: %s, accessionID: %s, reason: %v)",
+						delivered.CorrelationId,
+						message.User,
+						message.Filepath,
+						message.AccessionID,
+						e)
+				}
+
 				// Nack message so the server gets notified that something is wrong and don't requeue the message
 				if e := delivered.Nack(false, false); e != nil {
 					log.Errorf("Failed to NAck because of sending error failed "+
@@ -262,8 +292,8 @@ func main() {
 					message.DecryptedChecksums,
 					err)
 
-				if e := delivered.Nack(false, true); e != nil {
-					log.Errorf("Failed to NAck because of SetAccessionID failed "+
+				if e := mq.Retry(&delivered, "SetAccessionID failed", err.Error()); e != nil {
+					log.Errorf("Failed to retry message after SetAccessionID failed "+
 						"(corr-id: %s, "+
 						"filepath: %s, "+
 						"user: %s, "+
@@ -294,7 +324,6 @@ func main() {
 				message.DecryptedChecksums)
 
 			if err := mq.SendMessage(delivered.CorrelationId, conf.Broker.Exchange, conf.Broker.RoutingKey, conf.Broker.Durable, completeMsg); err != nil {
-				// TODO fix resend mechanism
 				log.Errorf("Failed to send message for completed "+
 					"(corr-id: %s, "+
 					"filepath: %s, "+
@@ -308,7 +337,21 @@ func main() {
 					message.DecryptedChecksums,
 					err)
 
-				// Restart loop, do not ack
+				if e := mq.Retry(&delivered, "Failed to send message for completed", err.Error()); e != nil {
+					log.Errorf("Failed to retry message "+
+						"(corr-id: %s, "+
+						"filepath: %s, "+
+						"user: %s, "+
+						"accessionid: %s, "+
+						"decryptedChecksums: %v, error: %v)",
+						delivered.CorrelationId,
+						message.Filepath,
+						message.User,
+						message.AccessionID,
+						message.DecryptedChecksums,
+						e)
+				}
+
 				continue
 			}
 
@@ -332,5 +375,5 @@ func main() {
 		}
 	}()
 
-	<-forever
+	mq.WaitForShutdown(forever, nil)
 }
@@ -4,24 +4,36 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/md5" // #nosec
 	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"strings"
 
 	"sda-pipeline/internal/broker"
 	"sda-pipeline/internal/config"
 	"sda-pipeline/internal/database"
+	"sda-pipeline/internal/health"
+	"sda-pipeline/internal/metrics"
 	"sda-pipeline/internal/storage"
 
 	"github.com/google/uuid"
 	"github.com/neicnordic/crypt4gh/model/headers"
 	"github.com/neicnordic/crypt4gh/streaming"
+	amqp "github.com/rabbitmq/amqp091-go"
 
 	log "github.com/sirupsen/logrus"
 )
 
+// cipherSegmentSize is the size of one encrypted crypt4gh data segment,
+// 64KiB of data plus the 12 byte nonce and the 16 byte MAC.
+const cipherSegmentSize = 65536 + 12 + 16
+
 type trigger struct {
 	Type               string      `json:"type"`
 	User               string      `json:"user"`
@@ -51,6 +63,7 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	metrics.Start("ingest", conf.Metrics)
 	mq, err := broker.NewMQ(conf.Broker)
 	if err != nil {
 		log.Fatal(err)
@@ -66,7 +79,19 @@ func main() {
 	if version < 8 {
 		log.Fatalf("database schema v8 is required")
 	}
-	key, err := config.GetC4GHKey()
+	// The key that decrypted each file is only recorded if the schema has
+	// the column for it, which is not part of v8
+	recordKeyHash, err := db.ColumnExists("files", "key_hash")
+	if err != nil {
+		log.Fatalf("failed to inspect database schema: %v", err)
+	}
+	if !recordKeyHash {
+		log.Warn("sda.files has no key_hash column, the keys that files are encrypted with are not recorded")
+	}
+	if err := db.CheckChecksumAlgorithms(conf.ChecksumAlgorithms...); err != nil {
+		log.Fatalf("checksums.algorithms can not be stored in the database: %v", err)
+	}
+	keyring, err := config.GetC4GHKeyring()
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -79,8 +104,14 @@ func main() {
 		log.Fatal(err)
 	}
 
-	defer mq.Channel.Close()
-	defer mq.Connection.Close()
+	healthServer := health.NewServer(conf.Health)
+	healthServer.AddReadinessCheck("broker", health.BrokerCheck(mq))
+	healthServer.AddReadinessCheck("database", health.DatabaseCheck(db))
+	healthServer.AddReadinessCheck("inbox", health.StorageCheck(inbox))
+	healthServer.AddReadinessCheck("archive", health.StorageCheck(archive))
+	healthServer.Start()
+
+	defer mq.Close()
 	defer db.Close()
 
 	go func() {
@@ -96,346 +127,592 @@ func main() {
 	}()
 
 	log.Info("starting ingest service")
-	var message trigger
+
+	// Reading files from the inbox stops when ingestion is aborted on
+	// shutdown, which rolls back the files being ingested
+	ctx, abort := context.WithCancel(context.Background())
+
+	// Every worker has database and storage handles of its own, the first
+	// one uses the ones created above
+	workers := make([]broker.Handler, conf.Broker.Workers)
+	handlers := make([]*worker, 0, len(workers))
+	for i := range workers {
+		w := &worker{conf: conf, mq: mq, db: db, inbox: inbox, archive: archive, keyring: keyring, recordKeyHash: recordKeyHash, ctx: ctx}
+		if i > 0 {
+			if w.db, err = database.NewDB(conf.Database); err != nil {
+				log.Fatal(err)
+			}
+			defer w.db.Close()
+			if w.archive, err = storage.NewBackend(conf.Archive); err != nil {
+				log.Fatal(err)
+			}
+			if w.inbox, err = storage.NewBackend(conf.Inbox); err != nil {
+				log.Fatal(err)
+			}
+		}
+		workers[i] = w.handle
+		handlers = append(handlers, w)
+	}
+
+	go config.WatchSecrets(conf, func(c *config.Config) {
+		mq.UpdatePassword(c.Broker.Password)
+		for _, w := range handlers {
+			if err := w.db.UpdateConf(c.Database); err != nil {
+				log.Errorf("Failed to reconnect to database with refreshed secrets, reason: %v", err)
+			}
+			storage.UpdateCredentials(w.inbox, c.Inbox)
+			storage.UpdateCredentials(w.archive, c.Archive)
+		}
+	})
 
 	go func() {
-		messages, err := mq.GetMessages(conf.Broker.Queue)
-		if err != nil {
+		if err := mq.Work(conf.Broker.Queue, workers...); err != nil {
 			log.Fatal(err)
 		}
-	mainWorkLoop:
-		for delivered := range messages {
-			log.Debugf("Received a message: %s", delivered.Body)
+	}()
+
+	mq.WaitForShutdown(forever, abort)
+}
+
+// worker ingests one file at a time, with database and storage handles
+// that are not shared with the other workers
+type worker struct {
+	conf          *config.Config
+	mq            *broker.AMQPBroker
+	db            *database.SQLdb
+	inbox         storage.Backend
+	archive       storage.Backend
+	keyring       []config.C4GHKey
+	recordKeyHash bool
+	ctx           context.Context
+}
+
+// handle processes a message to ingest or cancel a file
+func (w *worker) handle(delivered amqp.Delivery) {
+	var message trigger
 
-			err := mq.ValidateJSON(&delivered, "ingestion-trigger", delivered.Body, &message)
-			if err != nil {
-				log.Errorf("Validation of incoming message failed (corr-id: %s, error: %v)", delivered.CorrelationId, err)
+	log.Debugf("Received a message: %s", delivered.Body)
 
-				continue
+	err := w.mq.ValidateJSON(&delivered, "ingestion-trigger", delivered.Body, &message)
+	if err != nil {
+		log.Errorf("Validation of incoming message failed (corr-id: %s, error: %v)", delivered.CorrelationId, err)
+
+		return
+	}
+
+	// we unmarshal the message in the validation step so this is safe to do
+	_ = json.Unmarshal(delivered.Body, &message)
+
+	log.Infof(
+		"Received work (corr-id: %s, filepath: %s, user: %s)",
+		delivered.CorrelationId, message.Filepath, message.User,
+	)
+
+	switch message.Type {
+	case "cancel":
+		fileUUID, err := w.db.GetFileID(delivered.CorrelationId)
+		if err != nil || fileUUID == "" {
+			log.Errorf("failed to get ID for file from message: %v", delivered.CorrelationId)
+
+			if e := delivered.Nack(false, false); e != nil {
+				log.Errorf("Failed to Nack message, reason: %v)", e)
 			}
 
-			// we unmarshal the message in the validation step so this is safe to do
-			_ = json.Unmarshal(delivered.Body, &message)
-
-			log.Infof(
-				"Received work (corr-id: %s, filepath: %s, user: %s)",
-				delivered.CorrelationId, message.Filepath, message.User,
-			)
-
-			switch message.Type {
-			case "cancel":
-				fileUUID, err := db.GetFileID(delivered.CorrelationId)
-				if err != nil || fileUUID == "" {
-					log.Errorf("failed to get ID for file from message: %v", delivered.CorrelationId)
-
-					if e := delivered.Nack(false, false); e != nil {
-						log.Errorf("Failed to Nack message, reason: %v)", e)
-					}
-
-					continue
-				}
-
-				if err := db.UpdateFileStatus(fileUUID, "disabled", delivered.CorrelationId, message.User, string(delivered.Body)); err != nil {
-					log.Errorf("failed to set ingestion status for file from message: %v", delivered.CorrelationId)
-
-					if e := delivered.Nack(false, false); e != nil {
-						log.Errorf("Failed to Nack message, reason: %v)", e)
-					}
-
-					continue
-				}
-
-				if err := delivered.Ack(false); err != nil {
-					log.Errorf("failed to ack message for reason: %v", err)
-				}
-
-				continue
-			case "ingest":
-				file, err := inbox.NewFileReader(message.Filepath)
-				if err != nil {
-					log.Errorf("Failed to open file to ingest (corr-id: %s, user: %s, filepath: %s, reason: %v)",
-						delivered.CorrelationId, message.User, message.Filepath, err)
-					// Nack message so the server gets notified that something is wrong. Do not requeue the message.
-					if e := delivered.Nack(false, false); e != nil {
-						log.Errorf("Failed to Nack message (failed to open file to ingest) (corr-id: %s, user: %s, filepath: %s, reason: %v)",
-							delivered.CorrelationId, message.User, message.Filepath, e)
-					}
-					// Send the message to an error queue so it can be analyzed.
-					fileError := broker.InfoError{
-						Error:           "Failed to open file to ingest",
-						Reason:          err.Error(),
-						OriginalMessage: message,
-					}
-					body, _ := json.Marshal(fileError)
-					if e := mq.SendMessage(delivered.CorrelationId, conf.Broker.Exchange, conf.Broker.RoutingError, conf.Broker.Durable, body); e != nil {
-						log.Errorf("Failed to publish message (open file to ingest error), to error queue (corr-id: %s, user: %s, filepath: %s, reason: %v)",
-							delivered.CorrelationId, message.User, message.Filepath, e)
-					}
-
-					// Restart on new message
-					continue
-				}
-
-				fileSize, err := inbox.GetFileSize(message.Filepath)
-				if err != nil {
-					log.Errorf("Failed to get file size of file to inges (corr-id: %s, user: %s, filepath: %s, reason: %v)",
-						delivered.CorrelationId, message.User, message.Filepath, err)
-					// Nack message so the server gets notified that something is wrong and requeue the message.
-					// Since reading the file worked, this should eventually succeed so it is ok to requeue.
-					if e := delivered.Nack(false, true); e != nil {
-						log.Errorf("Failed to Nack message (failed get file size) (corr-id: %s, user: %s, filepath: %s, reason: %v)",
-							delivered.CorrelationId, message.User, message.Filepath, e)
-					}
-					// Send the message to an error queue so it can be analyzed.
-					fileError := broker.InfoError{
-						Error:           "Failed to get file size of file to ingest",
-						Reason:          err.Error(),
-						OriginalMessage: message,
-					}
-					body, _ := json.Marshal(fileError)
-					if e := mq.SendMessage(delivered.CorrelationId, conf.Broker.Exchange, conf.Broker.RoutingError, conf.Broker.Durable, body); e != nil {
-						log.Errorf("Failed to publish message (get file size error), to error queue (corr-id: %s, user: %s, filepath: %s, reason: %v)",
-							delivered.CorrelationId, message.User, message.Filepath, e)
-					}
-
-					// Restart on new message
-					continue
-				}
-
-				log.Infof("Got file size (corr-id: %s, user: %s, filepath: %s, filesize: %d)",
-					delivered.CorrelationId, message.User, message.Filepath, fileSize)
-
-				// Create a random uuid as file name
-				archivedFile := uuid.New().String()
-				dest, err := archive.NewFileWriter(archivedFile)
-				if err != nil {
-					log.Errorf("Failed to create archive file (corr-id: %s, user: %s, filepath: %s, archivepath: %s, reason: %v)",
-						delivered.CorrelationId, message.User, message.Filepath, archivedFile, err)
-					// Nack message so the server gets notified that something is wrong and requeue the message.
-					// NewFileWriter returns an error when the backend itself fails so this is reasonable to requeue.
-					if e := delivered.Nack(false, true); e != nil {
-						log.Errorf("Failed to Nack message (archive file create error) (corr-id: %s, user: %s, filepath: %s, archivepath: %s, reason: %v)",
-							delivered.CorrelationId, message.User, message.Filepath, archivedFile, e)
-					}
-
-					continue
-				}
-
-				fileID, err := db.RegisterFile(message.Filepath, message.User)
-				if err != nil {
-					log.Errorf("InsertFile failed (corr-id: %s, user: %s, filepath: %s, archivepath: %s, reason: %v)",
-						delivered.CorrelationId, message.User, message.Filepath, archivedFile, err)
-				}
-				err = db.UpdateFileStatus(fileID, "submitted", delivered.CorrelationId, message.User, string(delivered.Body))
-				if err != nil {
-					log.Errorf("failed to set ingestion status for file from message: %v", delivered.CorrelationId)
-				}
-
-				// 4MiB readbuffer, this must be large enough that we get the entire header and the first 64KiB datablock
-				var bufSize int
-				if bufSize = 4 * 1024 * 1024; conf.Inbox.S3.Chunksize > 4*1024*1024 {
-					bufSize = conf.Inbox.S3.Chunksize
-				}
-				readBuffer := make([]byte, bufSize)
-				hash := sha256.New()
-				var bytesRead int64
-				var byteBuf bytes.Buffer
-
-				for bytesRead < fileSize {
-					i, _ := io.ReadFull(file, readBuffer)
-					if i == 0 {
-						return
-					}
-					// truncate the readbuffer if the file is smaller than the buffer size
-					if i < len(readBuffer) {
-						readBuffer = readBuffer[:i]
-					}
-
-					bytesRead += int64(i)
-
-					h := bytes.NewReader(readBuffer)
-					if _, err = io.Copy(hash, h); err != nil {
-						log.Errorf("Copy to hash failed while reading file (corr-id: %s, user: %s, filepath: %s, archivepath: %s, reason: %v)",
-							delivered.CorrelationId, message.User, message.Filepath, archivedFile, err)
-
-						continue mainWorkLoop
-					}
-
-					//nolint:nestif
-					if bytesRead <= int64(len(readBuffer)) {
-						header, err := tryDecrypt(key, readBuffer)
-						if err != nil {
-							log.Errorf("Trying to decrypt start of file failed (corr-id: %s, user: %s, filepath: %s, archivepath: %s, reason: %v)",
-								delivered.CorrelationId, message.User, message.Filepath, archivedFile, err)
-
-							// Nack message so the server gets notified that something is wrong. Do not requeue the message.
-							if e := delivered.Nack(false, false); e != nil {
-								log.Errorf("Failed to Nack message (failed decrypt file) (corr-id: %s, user: %s, filepath: %s, archivepath: %s, reason: %v)",
-									delivered.CorrelationId, message.User, message.Filepath, archivedFile, e)
-							}
-
-							// Send the message to an error queue so it can be analyzed.
-							fileError := broker.InfoError{
-								Error:           "Trying to decrypt start of file failed",
-								Reason:          err.Error(),
-								OriginalMessage: message,
-							}
-							body, _ := json.Marshal(fileError)
-							if e := mq.SendMessage(delivered.CorrelationId, conf.Broker.Exchange, conf.Broker.RoutingError, conf.Broker.Durable, body); e != nil {
-								log.Errorf("Failed to publish message (decrypt file error), to error queue (corr-id: %s, user: %s, filepath: %s, reason: %v)",
-									delivered.CorrelationId, message.User, message.Filepath, e)
-							}
-
-							continue mainWorkLoop
-						}
-						log.Debugln("store header")
-						if err := db.StoreHeader(header, fileID); err != nil {
-							log.Errorf("StoreHeader failed (corr-id: %s, user: %s, filepath: %s, archivepath: %s, reason: %v)",
-								delivered.CorrelationId, message.User, message.Filepath, archivedFile, err)
-
-							continue mainWorkLoop
-						}
-
-						if _, err = byteBuf.Write(readBuffer); err != nil {
-							log.Errorf("Failed to write to read buffer for header read (corr-id: %s, user: %s, filepath: %s, archivepath: %s, reason: %v)",
-								delivered.CorrelationId, message.User, message.Filepath, archivedFile, err)
-
-							continue mainWorkLoop
-						}
-
-						// Strip header from buffer
-						h := make([]byte, len(header))
-						if _, err = byteBuf.Read(h); err != nil {
-							log.Errorf("Failed to read buffer for header skip (corr-id: %s, user: %s, filepath: %s, archivepath: %s, reason: %v)",
-								delivered.CorrelationId, message.User, message.Filepath, archivedFile, err)
-
-							continue mainWorkLoop
-						}
-
-					} else {
-						if i < len(readBuffer) {
-							readBuffer = readBuffer[:i]
-						}
-						if _, err = byteBuf.Write(readBuffer); err != nil {
-							log.Errorf("Failed to write to read buffer for full read (corr-id: %s, user: %s, filepath: %s, archivepath: %s, reason: %v)",
-								delivered.CorrelationId, message.User, message.Filepath, archivedFile, err)
-
-							continue mainWorkLoop
-						}
-					}
-
-					// Write data to file
-					if _, err = byteBuf.WriteTo(dest); err != nil {
-						log.Errorf("Failed to write to archive file (corr-id: %s, user: %s, filepath: %s, archivepath: %s, reason: %v)",
-							delivered.CorrelationId, message.User, message.Filepath, archivedFile, err)
-
-						continue mainWorkLoop
-					}
-				}
-
-				file.Close()
-				dest.Close()
-
-				fileInfo := database.FileInfo{}
-				fileInfo.Path = archivedFile
-				fileInfo.Checksum = hash
-				fileInfo.Size, err = archive.GetFileSize(archivedFile)
-				if err != nil {
-					log.Errorf("Couldn't get file size from archive for verification (corr-id: %s, user: %s, filepath: %s, archivepath: %s, reason: %v)",
-						delivered.CorrelationId, message.User, message.Filepath, archivedFile, err)
-
-					continue
-				}
-
-				log.Infof("Wrote archived file (corr-id: %s, user: %s, filepath: %s, archivepath: %s, archivedsize: %d)",
-					delivered.CorrelationId, message.User, message.Filepath, archivedFile, fileInfo.Size)
-
-				status, err := db.GetFileStatus(delivered.CorrelationId)
-				if err != nil {
-					log.Errorf("failed to get file status, reason: %v", err.Error())
-				}
-				if status == "disabled" {
-					log.Infof("file with correlation ID: %s is disabled, stopping ingestion", delivered.CorrelationId)
-					if err := delivered.Ack(false); err != nil {
-						log.Errorf("Failed acking canceled work, reason: %v", err)
-					}
-
-					continue
-				}
-
-				if err := db.SetArchived(fileInfo, fileID, delivered.CorrelationId); err != nil {
-					log.Errorf("SetArchived failed (corr-id: %s, user: %s, filepath: %s, archivepath: %s, reason: %v)",
-						delivered.CorrelationId, message.User, message.Filepath, archivedFile, err)
-				}
-
-				log.Infof("File marked as archived (corr-id: %s, user: %s, filepath: %s, archivepath: %s)",
-					delivered.CorrelationId, message.User, message.Filepath, archivedFile)
-
-				// Send message to archived
-				msg := archived{
-					User:        message.User,
-					FilePath:    message.Filepath,
-					FileID:      fileID,
-					ArchivePath: archivedFile,
-					EncryptedChecksums: []checksums{
-						{"sha256", fmt.Sprintf("%x", hash.Sum(nil))},
-					},
-				}
-				archivedMsg, _ := json.Marshal(&msg)
-
-				err = mq.ValidateJSON(&delivered, "ingestion-verification", archivedMsg, new(archived))
-				if err != nil {
-					log.Errorf("Validation of outgoing (archived) message failed (corr-id: %s, user: %s, filepath: %s, archivepath: %s, reason: %v)",
-						delivered.CorrelationId, message.User, message.Filepath, archivedFile, err)
-
-					continue
-				}
-
-				if err := mq.SendMessage(delivered.CorrelationId, conf.Broker.Exchange, conf.Broker.RoutingKey, conf.Broker.Durable, archivedMsg); err != nil {
-					// TODO fix resend mechanism
-					log.Errorf("Sending outgoing (archived) message failed (corr-id: %s, user: %s, filepath: %s, archivepath: %s, reason: %v)",
-						delivered.CorrelationId, message.User, message.Filepath, archivedFile, err)
-
-					// Do not try to ACK message to make sure we have another go
-					continue
-				}
-				if err := delivered.Ack(false); err != nil {
-					log.Errorf("Failed to ack message for performed work (corr-id: %s, user: %s, filepath: %s, archivepath: %s, reason: %v)",
-						delivered.CorrelationId, message.User, message.Filepath, archivedFile, err)
-				}
+			return
+		}
+
+		if err := w.db.UpdateFileStatus(fileUUID, "disabled", delivered.CorrelationId, message.User, string(delivered.Body)); err != nil {
+			log.Errorf("failed to set ingestion status for file from message: %v", delivered.CorrelationId)
+
+			if e := delivered.Nack(false, false); e != nil {
+				log.Errorf("Failed to Nack message, reason: %v)", e)
 			}
+
+			return
 		}
-	}()
 
-	<-forever
+		if err := delivered.Ack(false); err != nil {
+			log.Errorf("failed to ack message for reason: %v", err)
+		}
+
+		return
+	case "ingest":
+		file, err := w.inbox.NewFileReader(message.Filepath)
+		if err != nil {
+			log.Errorf("Failed to open file to ingest (corr-id: %s, user: %s, filepath: %s, reason: %v)",
+				delivered.CorrelationId, message.User, message.Filepath, err)
+			// Nack message so the server gets notified that something is wrong. Do not requeue the message.
+			if e := delivered.Nack(false, false); e != nil {
+				log.Errorf("Failed to Nack message (failed to open file to ingest) (corr-id: %s, user: %s, filepath: %s, reason: %v)",
+					delivered.CorrelationId, message.User, message.Filepath, e)
+			}
+			// Send the message to an error queue so it can be analyzed.
+			fileError := broker.InfoError{
+				Error:           "Failed to open file to ingest",
+				Reason:          err.Error(),
+				OriginalMessage: message,
+			}
+			body, _ := json.Marshal(fileError)
+			if e := w.mq.SendMessage(delivered.CorrelationId, w.conf.Broker.Exchange, w.conf.Broker.RoutingError, w.conf.Broker.Durable, body); e != nil {
+				log.Errorf("Failed to publish message (open file to ingest error), to error queue (corr-id: %s, user: %s, filepath: %s, reason: %v)",
+					delivered.CorrelationId, message.User, message.Filepath, e)
+			}
+			userError := &broker.UserError{Code: broker.UserErrorFileNotFound, Reason: "The file was not found in the inbox", Err: err}
+			if e := w.mq.SendUserError(&delivered, message.User, message.Filepath, userError); e != nil {
+				log.Errorf("Failed to publish user error message (open file to ingest error) (corr-id: %s, user: %s, filepath: %s, reason: %v)",
+					delivered.CorrelationId, message.User, message.Filepath, e)
+			}
+
+			// Restart on new message
+			return
+		}
+
+		fileSize, err := w.inbox.GetFileSize(message.Filepath)
+		if err != nil {
+			log.Errorf("Failed to get file size of file to inges (corr-id: %s, user: %s, filepath: %s, reason: %v)",
+				delivered.CorrelationId, message.User, message.Filepath, err)
+			// Since reading the file worked, this should eventually succeed so it is retried.
+			// The message is sent to the error queue if it keeps failing.
+			if e := w.mq.Retry(&delivered, "Failed to get file size of file to ingest", err.Error()); e != nil {
+				log.Errorf("Failed to retry message (failed get file size) (corr-id: %s, user: %s, filepath: %s, reason: %v)",
+					delivered.CorrelationId, message.User, message.Filepath, e)
+			}
+
+			// Restart on new message
+			return
+		}
+
+		log.Infof("Got file size (corr-id: %s, user: %s, filepath: %s, filesize: %d)",
+			delivered.CorrelationId, message.User, message.Filepath, fileSize)
+
+		// Create a random uuid as file name
+		archivedFile := uuid.New().String()
+		dest, err := w.archive.NewFileWriter(archivedFile)
+		if err != nil {
+			log.Errorf("Failed to create archive file (corr-id: %s, user: %s, filepath: %s, archivepath: %s, reason: %v)",
+				delivered.CorrelationId, message.User, message.Filepath, archivedFile, err)
+			// NewFileWriter returns an error when the backend itself fails so this is reasonable to retry.
+			if e := w.mq.Retry(&delivered, "Failed to create archive file", err.Error()); e != nil {
+				log.Errorf("Failed to retry message (archive file create error) (corr-id: %s, user: %s, filepath: %s, archivepath: %s, reason: %v)",
+					delivered.CorrelationId, message.User, message.Filepath, archivedFile, e)
+			}
+
+			return
+		}
+
+		// Everything written to the archive from here on is removed
+		// again if the ingestion fails.
+		current := &inFlight{archive: w.archive, dest: dest, path: archivedFile}
+
+		fileID, err := w.db.RegisterFile(message.Filepath, message.User)
+		if err != nil {
+			log.Errorf("InsertFile failed (corr-id: %s, user: %s, filepath: %s, archivepath: %s, reason: %v)",
+				delivered.CorrelationId, message.User, message.Filepath, archivedFile, err)
+			file.Close()
+			failIngestion(w.mq, w.db, &delivered, message, current, "Failed to register file", err)
+
+			return
+		}
+		current.fileID = fileID
+
+		err = w.db.UpdateFileStatus(fileID, "submitted", delivered.CorrelationId, message.User, string(delivered.Body))
+		if err != nil {
+			log.Errorf("failed to set ingestion status for file from message: %v", delivered.CorrelationId)
+		}
+
+		// Everything read from the inbox passes through the hashes so that
+		// the checksums cover the complete encrypted file, header included.
+		hash := sha256.New()
+		md5hash := md5.New() // #nosec
+		// The algorithms are checked when the configuration is read
+		digests, _ := database.NewDigests(w.conf.ChecksumAlgorithms...)
+		header, keyHash, stream, err := tryDecrypt(w.keyring, io.TeeReader(abortableReader{ctx: w.ctx, r: file}, io.MultiWriter(hash, md5hash, digests.Writer())))
+		if err != nil {
+			log.Errorf("Trying to decrypt start of file failed (corr-id: %s, user: %s, filepath: %s, archivepath: %s, reason: %v)",
+				delivered.CorrelationId, message.User, message.Filepath, archivedFile, err)
+			file.Close()
+			failIngestion(w.mq, w.db, &delivered, message, current, "Trying to decrypt start of file failed", err)
+
+			return
+		}
+
+		log.Debugln("store header")
+		if err := w.db.StoreHeader(header, fileID); err != nil {
+			log.Errorf("StoreHeader failed (corr-id: %s, user: %s, filepath: %s, archivepath: %s, reason: %v)",
+				delivered.CorrelationId, message.User, message.Filepath, archivedFile, err)
+			file.Close()
+			failIngestion(w.mq, w.db, &delivered, message, current, "Failed to store header", err)
+
+			return
+		}
+
+		// The key hash is only needed to track key rotation, so the file
+		// is ingested even if it can't be recorded
+		if w.recordKeyHash {
+			if err := w.db.SetKeyHash(keyHash, fileID); err != nil {
+				log.Errorf("SetKeyHash failed (corr-id: %s, user: %s, filepath: %s, archivepath: %s, reason: %v)",
+					delivered.CorrelationId, message.User, message.Filepath, archivedFile, err)
+			}
+		}
+
+		// The header has been consumed from the stream, the rest is
+		// the encrypted payload that goes to the archive as is.
+		if _, err = io.Copy(dest, stream); err != nil {
+			log.Errorf("Failed to write to archive file (corr-id: %s, user: %s, filepath: %s, archivepath: %s, reason: %v)",
+				delivered.CorrelationId, message.User, message.Filepath, archivedFile, err)
+			file.Close()
+			failIngestion(w.mq, w.db, &delivered, message, current, "Failed to write to archive file", err)
+
+			return
+		}
+
+		file.Close()
+
+		// For s3 the upload is only done once the writer is closed
+		if err := dest.Close(); err != nil {
+			log.Errorf("Failed to close archive file (corr-id: %s, user: %s, filepath: %s, archivepath: %s, reason: %v)",
+				delivered.CorrelationId, message.User, message.Filepath, archivedFile, err)
+			failIngestion(w.mq, w.db, &delivered, message, current, "Failed to write to archive file", err)
+
+			return
+		}
+
+		// The file is only archived if it is what the submitter uploaded
+		computed := map[string]string{
+			"sha256": fmt.Sprintf("%x", hash.Sum(nil)),
+			"md5":    fmt.Sprintf("%x", md5hash.Sum(nil)),
+		}
+		for _, name := range digests.Names() {
+			computed[name] = digests.Hex(name)
+		}
+		if err := checkChecksums(message.EncryptedChecksums, computed); err != nil {
+			log.Errorf("Checksum of file does not match the submitted checksum (corr-id: %s, user: %s, filepath: %s, archivepath: %s, reason: %v)",
+				delivered.CorrelationId, message.User, message.Filepath, archivedFile, err)
+			failIngestion(w.mq, w.db, &delivered, message, current, "Checksum of file does not match the submitted checksum", err)
+
+			return
+		}
+
+		fileInfo := database.FileInfo{}
+		fileInfo.Path = archivedFile
+		fileInfo.Checksum = hash
+		fileInfo.UploadedDigests = digests
+		fileInfo.Size, err = w.archive.GetFileSize(archivedFile)
+		if err != nil {
+			log.Errorf("Couldn't get file size from archive for verification (corr-id: %s, user: %s, filepath: %s, archivepath: %s, reason: %v)",
+				delivered.CorrelationId, message.User, message.Filepath, archivedFile, err)
+			failIngestion(w.mq, w.db, &delivered, message, current, "Failed to get size of archived file", err)
+
+			return
+		}
+
+		log.Infof("Wrote archived file (corr-id: %s, user: %s, filepath: %s, archivepath: %s, archivedsize: %d)",
+			delivered.CorrelationId, message.User, message.Filepath, archivedFile, fileInfo.Size)
+		metrics.FileProcessed(fileInfo.Size)
+
+		status, err := w.db.GetFileStatus(delivered.CorrelationId)
+		if err != nil {
+			log.Errorf("failed to get file status, reason: %v", err.Error())
+		}
+		if status == "disabled" {
+			log.Infof("file with correlation ID: %s is disabled, stopping ingestion", delivered.CorrelationId)
+			// The file will never be marked as archived, so it is removed from the archive.
+			if err := current.remove(nil); err != nil {
+				log.Errorf("Failed to remove archive file of canceled work (corr-id: %s, archivepath: %s, reason: %v)",
+					delivered.CorrelationId, archivedFile, err)
+			}
+			if err := delivered.Ack(false); err != nil {
+				log.Errorf("Failed acking canceled work, reason: %v", err)
+			}
+
+			return
+		}
+
+		if err := w.db.SetArchived(fileInfo, fileID, delivered.CorrelationId); err != nil {
+			log.Errorf("SetArchived failed (corr-id: %s, user: %s, filepath: %s, archivepath: %s, reason: %v)",
+				delivered.CorrelationId, message.User, message.Filepath, archivedFile, err)
+			failIngestion(w.mq, w.db, &delivered, message, current, "Failed to mark file as archived", err)
+
+			return
+		}
+
+		log.Infof("File marked as archived (corr-id: %s, user: %s, filepath: %s, archivepath: %s)",
+			delivered.CorrelationId, message.User, message.Filepath, archivedFile)
+
+		// Send message to archived
+		msg := archived{
+			User:        message.User,
+			FilePath:    message.Filepath,
+			FileID:      fileID,
+			ArchivePath: archivedFile,
+			EncryptedChecksums: []checksums{
+				{"sha256", fmt.Sprintf("%x", hash.Sum(nil))},
+			},
+		}
+		archivedMsg, _ := json.Marshal(&msg)
+
+		err = w.mq.ValidateJSON(&delivered, "ingestion-verification", archivedMsg, new(archived))
+		if err != nil {
+			log.Errorf("Validation of outgoing (archived) message failed (corr-id: %s, user: %s, filepath: %s, archivepath: %s, reason: %v)",
+				delivered.CorrelationId, message.User, message.Filepath, archivedFile, err)
+			// ValidateJSON has already nacked the message and sent it to the error queue.
+			current.rollback(w.db, delivered.CorrelationId, message.User, err, archivedMsg)
+
+			return
+		}
+
+		if err := w.mq.SendMessage(delivered.CorrelationId, w.conf.Broker.Exchange, w.conf.Broker.RoutingKey, w.conf.Broker.Durable, archivedMsg); err != nil {
+			log.Errorf("Sending outgoing (archived) message failed (corr-id: %s, user: %s, filepath: %s, archivepath: %s, reason: %v)",
+				delivered.CorrelationId, message.User, message.Filepath, archivedFile, err)
+			// A new archive file is written when the message is
+			// processed again, so this one is removed.
+			current.rollback(w.db, delivered.CorrelationId, message.User, err, delivered.Body)
+
+			// Retry the message to make sure we have another go
+			if e := w.mq.Retry(&delivered, "Sending outgoing (archived) message failed", err.Error()); e != nil {
+				log.Errorf("Failed to retry message (send archived message error) (corr-id: %s, user: %s, filepath: %s, archivepath: %s, reason: %v)",
+					delivered.CorrelationId, message.User, message.Filepath, archivedFile, e)
+			}
+
+			return
+		}
+		if err := delivered.Ack(false); err != nil {
+			log.Errorf("Failed to ack message for performed work (corr-id: %s, user: %s, filepath: %s, archivepath: %s, reason: %v)",
+				delivered.CorrelationId, message.User, message.Filepath, archivedFile, err)
+		}
+	}
 }
 
-// tryDecrypt tries to decrypt the start of buf.
-func tryDecrypt(key *[32]byte, buf []byte) ([]byte, error) {
+// checkChecksums compares the checksums computed for the encrypted file
+// with the checksums it was submitted with, if any. A mismatch is returned
+// as a *broker.UserError. Submitted checksums of types that are not
+// computed are not compared.
+func checkChecksums(submitted []checksums, computed map[string]string) error {
+	for _, c := range submitted {
+		value, ok := computed[c.Type]
+		if !ok {
+			continue
+		}
 
-	log.Debugln("Try decrypting the first data block")
-	a := bytes.NewReader(buf)
-	b, err := streaming.NewCrypt4GHReader(a, *key, nil)
+		if !strings.EqualFold(c.Value, value) {
+			return &broker.UserError{
+				Code:   broker.UserErrorChecksumMismatch,
+				Reason: fmt.Sprintf("The %s checksum of the file does not match the submitted checksum, the file may have been corrupted during upload", c.Type),
+				Err:    fmt.Errorf("%s checksum %s does not match the submitted checksum %s", c.Type, value, c.Value),
+			}
+		}
+	}
+
+	return nil
+}
+
+// tryDecrypt reads the crypt4gh header from the start of r and checks that
+// the header and the first data segment can be decrypted with one of the
+// keys in the keyring, tried in order. The hash of the key that decrypted
+// the file is returned along with the header.
+// Errors caused by the file itself are returned as a *broker.UserError, so
+// that they can be reported to the submitter.
+// Only the header is consumed, the returned reader continues from the start
+// of the encrypted payload.
+func tryDecrypt(keyring []config.C4GHKey, r io.Reader) ([]byte, string, io.Reader, error) {
+	source := &errReader{r: r}
+	stream := bufio.NewReaderSize(source, cipherSegmentSize)
+
+	// headers.ReadHeader reads the magic number with a single Read call,
+	// make sure it is buffered so that a short read can't break the parsing.
+	if _, err := stream.Peek(len(headers.MagicNumber)); err != nil {
+		log.Error(err)
+
+		return nil, "", nil, corruptFile(source, err)
+	}
+
+	header, err := headers.ReadHeader(stream)
 	if err != nil {
 		log.Error(err)
 
-		return nil, err
+		return nil, "", nil, corruptFile(source, err)
+	}
 
+	log.Debugln("Try decrypting the first data block")
+	segment, err := stream.Peek(cipherSegmentSize)
+	if err != nil && err != io.EOF {
+		log.Error(err)
+
+		return nil, "", nil, corruptFile(source, err)
 	}
-	_, err = b.ReadByte()
-	if err != nil {
+
+	for _, key := range keyring {
+		if err = decryptSegment(key.PrivateKey, header, segment); err == nil {
+			return header, key.KeyHash, stream, nil
+		}
+
+		log.Debugf("Failed to decrypt with key %s, reason: %v", key.KeyHash, err)
+	}
+	if err == nil {
+		err = errors.New("no keys to decrypt with")
+
 		log.Error(err)
 
-		return nil, err
+		return nil, "", nil, err
+	}
+	log.Error(err)
+
+	return nil, "", nil, &broker.UserError{
+		Code:   broker.UserErrorWrongKey,
+		Reason: "The file is not encrypted with the public key of the archive",
+		Err:    err,
+	}
+}
+
+// corruptFile returns err as the user error of a file that could not be
+// read as a crypt4gh file, unless reading the file itself failed.
+func corruptFile(source *errReader, err error) error {
+	if source.err != nil {
+		return source.err
+	}
+
+	return &broker.UserError{
+		Code:   broker.UserErrorCorruptFile,
+		Reason: "The file is not a valid crypt4gh file",
+		Err:    err,
+	}
+}
+
+// errReader keeps the first error other than io.EOF that reading from r
+// failed with, so that errors reading a file can be told apart from errors
+// in what was read
+type errReader struct {
+	r   io.Reader
+	err error
+}
+
+func (e *errReader) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if err != nil && err != io.EOF && e.err == nil {
+		e.err = err
 	}
 
-	f := bytes.NewReader(buf)
-	header, err := headers.ReadHeader(f)
+	return n, err
+}
+
+// decryptSegment decrypts the start of the data segment with key
+func decryptSegment(key [32]byte, header, segment []byte) error {
+	c4ghr, err := streaming.NewCrypt4GHReader(io.MultiReader(bytes.NewReader(header), bytes.NewReader(segment)), key, nil)
 	if err != nil {
-		log.Error(err)
+		return err
+	}
+	defer c4ghr.Close()
+
+	_, err = c4ghr.ReadByte()
+
+	return err
+}
+
+// inFlight is an archive file that is being written during ingestion.
+// It is kept track of so that the file can be removed from the archive
+// if the ingestion fails.
+type inFlight struct {
+	archive storage.Backend
+	dest    io.WriteCloser
+	path    string
+	fileID  string
+}
+
+// remove stops any ongoing write and removes the file from the archive.
+func (f *inFlight) remove(cause error) error {
+	// Closing the s3 writer with an error makes the uploader abort the
+	// upload instead of completing it with what has been written so far,
+	// and returns once the uploader has stopped writing to the file.
+	if aw, ok := f.dest.(interface{ CloseWithError(error) error }); ok {
+		_ = aw.CloseWithError(cause)
+	} else {
+		_ = f.dest.Close()
+	}
+
+	return f.archive.RemoveFile(f.path)
+}
+
+// rollback removes the file from the archive and marks the file with an
+// error event, errorMsg is stored as the message of the event.
+func (f *inFlight) rollback(db *database.SQLdb, corrID, user string, cause error, errorMsg []byte) {
+	if err := f.remove(cause); err != nil {
+		log.Errorf("Failed to remove archive file (corr-id: %s, user: %s, archivepath: %s, reason: %v)",
+			corrID, user, f.path, err)
+	}
 
-		return nil, err
+	// Without a file id there is nothing registered to mark
+	if f.fileID == "" {
+		return
 	}
 
-	return header, nil
+	if err := db.UpdateFileStatus(f.fileID, "error", corrID, user, string(errorMsg)); err != nil {
+		log.Errorf("Failed to set error status for file (corr-id: %s, user: %s, fileid: %s, reason: %v)",
+			corrID, user, f.fileID, err)
+	}
+}
+
+// abortableReader reads from r until ctx is done, and then fails with the
+// error of ctx
+type abortableReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (a abortableReader) Read(p []byte) (int, error) {
+	if err := a.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	return a.r.Read(p)
+}
+
+// failIngestion rolls back an ingestion that failed after the archive file
+// was created. The message is nacked without requeue and sent to the error
+// queue so it can be analyzed, unless the ingestion was aborted on shutdown.
+// Then the message is requeued to be ingested again.
+func failIngestion(mq *broker.AMQPBroker, db *database.SQLdb, delivered *amqp.Delivery, message trigger, f *inFlight, errorString string, cause error) {
+	if errors.Is(cause, context.Canceled) {
+		log.Infof("Ingestion aborted on shutdown (corr-id: %s, user: %s, filepath: %s, archivepath: %s)",
+			delivered.CorrelationId, message.User, message.Filepath, f.path)
+		if err := f.remove(cause); err != nil {
+			log.Errorf("Failed to remove archive file (corr-id: %s, user: %s, archivepath: %s, reason: %v)",
+				delivered.CorrelationId, message.User, f.path, err)
+		}
+		if e := delivered.Nack(false, true); e != nil {
+			log.Errorf("Failed to Nack message (corr-id: %s, user: %s, filepath: %s, reason: %v)",
+				delivered.CorrelationId, message.User, message.Filepath, e)
+		}
+
+		return
+	}
+
+	fileError := broker.InfoError{
+		Error:           errorString,
+		Reason:          cause.Error(),
+		OriginalMessage: message,
+	}
+	body, _ := json.Marshal(fileError)
+
+	f.rollback(db, delivered.CorrelationId, message.User, cause, body)
+
+	// Nack message so the server gets notified that something is wrong. Do not requeue the message.
+	if e := delivered.Nack(false, false); e != nil {
+		log.Errorf("Failed to Nack message (%s) (corr-id: %s, user: %s, filepath: %s, archivepath: %s, reason: %v)",
+			errorString, delivered.CorrelationId, message.User, message.Filepath, f.path, e)
+	}
+
+	// Send the message to an error queue so it can be analyzed.
+	if e := mq.SendMessage(delivered.CorrelationId, mq.Conf.Exchange, mq.Conf.RoutingError, mq.Conf.Durable, body); e != nil {
+		log.Errorf("Failed to publish message (%s), to error queue (corr-id: %s, user: %s, filepath: %s, reason: %v)",
+			errorString, delivered.CorrelationId, message.User, message.Filepath, e)
+	}
+
+	// Let the submitter know if the file was at fault
+	var userError *broker.UserError
+	if errors.As(cause, &userError) {
+		if e := mq.SendUserError(delivered, message.User, message.Filepath, userError); e != nil {
+			log.Errorf("Failed to publish user error message (%s) (corr-id: %s, user: %s, filepath: %s, reason: %v)",
+				userError.Code, delivered.CorrelationId, message.User, message.Filepath, e)
+		}
+	}
 }
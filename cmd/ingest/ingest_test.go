@@ -1,12 +1,23 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"io"
 	"os"
 	"testing"
 
+	"sda-pipeline/internal/broker"
 	"sda-pipeline/internal/config"
+	"sda-pipeline/internal/database"
+	"sda-pipeline/internal/storage"
 
+	"github.com/DATA-DOG/go-sqlmock"
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"github.com/neicnordic/crypt4gh/keys"
+	"github.com/neicnordic/crypt4gh/streaming"
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
@@ -41,37 +52,300 @@ func (suite *TestSuite) SetupTest() {
 
 func (suite *TestSuite) TestTryDecrypt_wrongFile() {
 
-	buf := make([]byte, 1024)
 	file, err := os.Open("../../dev_utils/README.md")
 	assert.NoError(suite.T(), err)
+	defer file.Close()
 
-	_, err = io.ReadFull(file, buf)
-	assert.NoError(suite.T(), err)
-
-	key, err := config.GetC4GHKey()
+	keyring, err := config.GetC4GHKeyring()
 	assert.Nil(suite.T(), err)
 
-	b, err := tryDecrypt(key, buf)
+	b, _, _, err := tryDecrypt(keyring, file)
 	assert.Nil(suite.T(), b)
 	assert.EqualError(suite.T(), err, "not a Crypt4GH file")
+
+	var userError *broker.UserError
+	assert.True(suite.T(), errors.As(err, &userError))
+	assert.Equal(suite.T(), broker.UserErrorCorruptFile, userError.Code)
 }
 
-func (suite *TestSuite) TestTryDecrypt() {
+func (suite *TestSuite) TestTryDecrypt_readError() {
+	keyring, err := config.GetC4GHKeyring()
+	assert.Nil(suite.T(), err)
+
+	// Errors reading the inbox are not the fault of the file
+	_, _, _, err = tryDecrypt(keyring, io.MultiReader(bytes.NewReader([]byte("crypt")), failingReader{}))
+	assert.EqualError(suite.T(), err, "connection reset")
 
-	buf := make([]byte, 65*1024)
+	var userError *broker.UserError
+	assert.False(suite.T(), errors.As(err, &userError))
+}
+
+func (suite *TestSuite) TestTryDecrypt() {
 
 	file, err := os.Open("../../dev_utils/dummy_data.c4gh")
 	assert.NoError(suite.T(), err)
+	defer file.Close()
 
-	_, err = io.ReadFull(file, buf)
+	stat, err := file.Stat()
 	assert.NoError(suite.T(), err)
 
-	key, err := config.GetC4GHKey()
+	keyring, err := config.GetC4GHKeyring()
 	assert.Nil(suite.T(), err)
 
 	data := []byte{99, 114, 121, 112, 116, 52, 103, 104, 1, 0, 0, 0, 1, 0, 0, 0, 108, 0, 0, 0, 0, 0, 0, 0, 106, 241, 64, 122, 188, 116, 101, 107, 137, 19, 167, 211, 35, 196, 191, 211, 11, 247, 200, 202, 53, 159, 116, 174, 53, 53, 122, 206, 242, 157, 197, 7, 55, 153, 226, 7, 236, 93, 2, 43, 38, 1, 52, 5, 133, 255, 8, 37, 101, 229, 95, 191, 245, 182, 205, 187, 190, 107, 18, 160, 208, 161, 158, 243, 37, 162, 25, 248, 182, 35, 68, 50, 94, 34, 200, 210, 106, 142, 130, 228, 95, 5, 63, 77, 206, 225, 12, 14, 196, 187, 158, 70, 109, 82, 83, 241, 57, 220, 212, 190}
 
-	b, err := tryDecrypt(key, buf)
+	b, keyHash, stream, err := tryDecrypt(keyring, file)
 	assert.Equal(suite.T(), b, data)
+	assert.Equal(suite.T(), keyring[0].KeyHash, keyHash)
+	assert.NoError(suite.T(), err)
+
+	// the stream should be left at the start of the encrypted payload
+	rest, err := io.Copy(io.Discard, stream)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), stat.Size()-int64(len(data)), rest)
+}
+
+func (suite *TestSuite) TestTryDecrypt_wrongKey() {
+
+	file, err := os.Open("../../dev_utils/dummy_data.c4gh")
+	assert.NoError(suite.T(), err)
+	defer file.Close()
+
+	_, key, err := keys.GenerateKeyPair()
+	assert.NoError(suite.T(), err)
+
+	b, _, _, err := tryDecrypt([]config.C4GHKey{{PrivateKey: key}}, file)
+	assert.Nil(suite.T(), b)
+	assert.Error(suite.T(), err)
+
+	var userError *broker.UserError
+	assert.True(suite.T(), errors.As(err, &userError))
+	assert.Equal(suite.T(), broker.UserErrorWrongKey, userError.Code)
+}
+
+func (suite *TestSuite) TestTryDecrypt_keyring() {
+
+	file, err := os.Open("../../dev_utils/dummy_data.c4gh")
+	assert.NoError(suite.T(), err)
+	defer file.Close()
+
+	archiveKeyring, err := config.GetC4GHKeyring()
+	assert.NoError(suite.T(), err)
+
+	// The file is encrypted for the second key in the keyring
+	_, newKey, err := keys.GenerateKeyPair()
+	assert.NoError(suite.T(), err)
+	keyring := []config.C4GHKey{{PrivateKey: newKey, KeyHash: "new"}, archiveKeyring[0]}
+
+	b, keyHash, _, err := tryDecrypt(keyring, file)
+	assert.NoError(suite.T(), err)
+	assert.NotNil(suite.T(), b)
+	assert.Equal(suite.T(), archiveKeyring[0].KeyHash, keyHash)
+}
+
+func (suite *TestSuite) TestTryDecrypt_largeHeader() {
+
+	keyring, err := config.GetC4GHKeyring()
+	assert.Nil(suite.T(), err)
+
+	// Encrypt for enough recipients that the header is larger than a data segment
+	recipients := [][32]byte{keys.DerivePublicKey(keyring[0].PrivateKey)}
+	for i := 0; i < 1000; i++ {
+		pub, _, err := keys.GenerateKeyPair()
+		assert.NoError(suite.T(), err)
+		recipients = append(recipients, pub)
+	}
+
+	_, writerKey, err := keys.GenerateKeyPair()
+	assert.NoError(suite.T(), err)
+
+	var encrypted bytes.Buffer
+	c4ghw, err := streaming.NewCrypt4GHWriter(&encrypted, writerKey, recipients, nil)
+	assert.NoError(suite.T(), err)
+	_, err = c4ghw.Write(bytes.Repeat([]byte("data"), 50000))
+	assert.NoError(suite.T(), err)
+	assert.NoError(suite.T(), c4ghw.Close())
+
+	total := int64(encrypted.Len())
+
+	b, _, stream, err := tryDecrypt(keyring, &encrypted)
+	assert.NoError(suite.T(), err)
+	assert.Greater(suite.T(), len(b), cipherSegmentSize)
+
+	rest, err := io.Copy(io.Discard, stream)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), total-int64(len(b)), rest)
+}
+
+// failingReader fails every read like a lost connection
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+// mockBackend is a storage backend that only keeps track of removed files
+type mockBackend struct {
+	removed []string
+}
+
+func (m *mockBackend) GetFileSize(string) (int64, error)           { return 0, nil }
+func (m *mockBackend) NewFileReader(string) (io.ReadCloser, error) { return nil, nil }
+func (m *mockBackend) NewFileReaderAt(string, int64, int64) (io.ReadCloser, error) {
+	return nil, nil
+}
+func (m *mockBackend) NewFileWriter(string) (io.WriteCloser, error) { return nil, nil }
+func (m *mockBackend) List(string) ([]storage.FileInfo, error)      { return nil, nil }
+func (m *mockBackend) Walk(string, storage.WalkFunc) error          { return nil }
+func (m *mockBackend) Ping() error                                  { return nil }
+func (m *mockBackend) RemoveFile(filePath string) error {
+	m.removed = append(m.removed, filePath)
+
+	return nil
+}
+
+func (suite *TestSuite) TestInFlightRemove_abortsPipe() {
+	archive := &mockBackend{}
+	r, w := io.Pipe()
+	current := &inFlight{archive: archive, dest: w, path: "archived-file"}
+
+	cause := errors.New("write failed")
+	assert.NoError(suite.T(), current.remove(cause))
+	assert.Equal(suite.T(), []string{"archived-file"}, archive.removed)
+
+	// the reading side of the pipe must see the error, not a clean EOF
+	_, err := io.ReadAll(r)
+	assert.Equal(suite.T(), cause, err)
+}
+
+// abortableWriter is a writer like the s3 writer, that records when it
+// is aborted in the same list as the removed files
+type abortableWriter struct {
+	io.Writer
+	archive *mockBackend
+}
+
+func (w abortableWriter) Close() error { return nil }
+func (w abortableWriter) CloseWithError(error) error {
+	w.archive.removed = append(w.archive.removed, "aborted")
+
+	return nil
+}
+
+func (suite *TestSuite) TestInFlightRemove_abortsWriter() {
+	archive := &mockBackend{}
+	current := &inFlight{archive: archive, dest: abortableWriter{Writer: io.Discard, archive: archive}, path: "archived-file"}
+
+	// the write is aborted before the file is removed
+	assert.NoError(suite.T(), current.remove(errors.New("write failed")))
+	assert.Equal(suite.T(), []string{"aborted", "archived-file"}, archive.removed)
+}
+
+func (suite *TestSuite) TestInFlightRollback() {
+	db, mock, err := sqlmock.New()
 	assert.NoError(suite.T(), err)
+	defer db.Close()
+
+	mock.ExpectExec("INSERT INTO sda.file_event_log").
+		WithArgs("file-id", "error", "corr-id", "user", "reason").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	archive := &mockBackend{}
+	_, w := io.Pipe()
+	current := &inFlight{archive: archive, dest: w, path: "archived-file", fileID: "file-id"}
+	current.rollback(&database.SQLdb{DB: db}, "corr-id", "user", errors.New("failed"), []byte("reason"))
+
+	assert.Equal(suite.T(), []string{"archived-file"}, archive.removed)
+	assert.NoError(suite.T(), mock.ExpectationsWereMet())
+}
+
+func (suite *TestSuite) TestInFlightRollback_noFileID() {
+	db, mock, err := sqlmock.New()
+	assert.NoError(suite.T(), err)
+	defer db.Close()
+
+	archive := &mockBackend{}
+	_, w := io.Pipe()
+	current := &inFlight{archive: archive, dest: w, path: "archived-file"}
+	current.rollback(&database.SQLdb{DB: db}, "corr-id", "user", errors.New("failed"), []byte("reason"))
+
+	assert.Equal(suite.T(), []string{"archived-file"}, archive.removed)
+	assert.NoError(suite.T(), mock.ExpectationsWereMet())
+}
+
+// mockAcknowledger records how a message was acked or nacked
+type mockAcknowledger struct {
+	acked, nacked, requeued bool
+}
+
+func (m *mockAcknowledger) Ack(uint64, bool) error {
+	m.acked = true
+
+	return nil
+}
+
+func (m *mockAcknowledger) Nack(_ uint64, _, requeue bool) error {
+	m.nacked, m.requeued = true, requeue
+
+	return nil
+}
+
+func (m *mockAcknowledger) Reject(uint64, bool) error { return nil }
+
+func (suite *TestSuite) TestFailIngestion_aborted() {
+	db, mock, err := sqlmock.New()
+	assert.NoError(suite.T(), err)
+	defer db.Close()
+
+	archive := &mockBackend{}
+	_, w := io.Pipe()
+	current := &inFlight{archive: archive, dest: w, path: "archived-file", fileID: "file-id"}
+
+	ack := &mockAcknowledger{}
+	delivered := amqp.Delivery{Acknowledger: ack, CorrelationId: "corr-id"}
+
+	// An aborted ingestion is requeued without sending errors or marking the file
+	failIngestion(nil, &database.SQLdb{DB: db}, &delivered, trigger{User: "user"}, current, "Failed to write to archive file", context.Canceled)
+
+	assert.Equal(suite.T(), []string{"archived-file"}, archive.removed)
+	assert.Equal(suite.T(), &mockAcknowledger{nacked: true, requeued: true}, ack)
+	assert.NoError(suite.T(), mock.ExpectationsWereMet())
+}
+
+func (suite *TestSuite) TestAbortableReader() {
+	ctx, abort := context.WithCancel(context.Background())
+	r := abortableReader{ctx: ctx, r: bytes.NewReader([]byte("data"))}
+
+	b := make([]byte, 2)
+	n, err := r.Read(b)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 2, n)
+
+	abort()
+	_, err = io.ReadAll(r)
+	assert.ErrorIs(suite.T(), err, context.Canceled)
+}
+
+func (suite *TestSuite) TestCheckChecksums() {
+	computed := map[string]string{
+		"sha256": "82e4e60e7beb3db2e06a00a079788f7d71f75b61a4b75f28c4c942703dabb6d6",
+		"md5":    "7ac236b1a8dce2dac89e7cf45d2b48bd",
+	}
+
+	assert.NoError(suite.T(), checkChecksums(nil, computed))
+	assert.NoError(suite.T(), checkChecksums([]checksums{
+		{"sha256", "82E4e60e7beb3db2e06A00a079788F7d71f75b61a4b75f28c4c942703dabb6d6"},
+		{"md5", "7Ac236b1a8dce2dac89e7cf45d2b48BD"},
+	}, computed), "checksums should be compared case-insensitively")
+	assert.NoError(suite.T(), checkChecksums([]checksums{{"sha512", "abc"}}, computed), "unknown checksum types should be skipped")
+
+	err := checkChecksums([]checksums{
+		{"sha256", "82e4e60e7beb3db2e06a00a079788f7d71f75b61a4b75f28c4c942703dabb6d6"},
+		{"md5", "00000000000000000000000000000000"},
+	}, computed)
+	assert.EqualError(suite.T(), err, "md5 checksum 7ac236b1a8dce2dac89e7cf45d2b48bd does not match the submitted checksum 00000000000000000000000000000000")
+
+	var userError *broker.UserError
+	assert.True(suite.T(), errors.As(err, &userError))
+	assert.Equal(suite.T(), broker.UserErrorChecksumMismatch, userError.Code)
 }
@@ -9,6 +9,8 @@ import (
 
 	"sda-pipeline/internal/broker"
 	"sda-pipeline/internal/config"
+	"sda-pipeline/internal/health"
+	"sda-pipeline/internal/metrics"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -18,8 +20,6 @@ const (
 	msgCancel    string = "cancel"
 	msgIngest    string = "ingest"
 	msgMapping   string = "mapping"
-	msgRelease   string = "release"
-	msgDeprecate string = "deprecate"
 )
 
 func main() {
@@ -28,13 +28,20 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	metrics.Start("intercept", conf.Metrics)
 	mq, err := broker.NewMQ(conf.Broker)
 	if err != nil {
 		log.Fatal(err)
 	}
+	go config.WatchSecrets(conf, func(c *config.Config) {
+		mq.UpdatePassword(c.Broker.Password)
+	})
 
-	defer mq.Channel.Close()
-	defer mq.Connection.Close()
+	healthServer := health.NewServer(conf.Health)
+	healthServer.AddReadinessCheck("broker", health.BrokerCheck(mq))
+	healthServer.Start()
+
+	defer mq.Close()
 
 	go func() {
 		connError := mq.ConnectionWatcher()
@@ -123,16 +130,7 @@ func main() {
 				continue
 			}
 
-			routing := map[string]string{
-				msgAccession: "accessionIDs",
-				msgCancel:    "ingest",
-				msgIngest:    "ingest",
-				msgMapping:   "mappings",
-				msgRelease:   "mappings",
-				msgDeprecate: "mappings",
-			}
-
-			routingKey := routing[msgType]
+			routingKey := broker.Routes[msgType].RoutingKey
 
 			if routingKey == "" {
 				continue
@@ -144,8 +142,20 @@ func main() {
 				routingKey)
 
 			if err := mq.SendMessage(delivered.CorrelationId, conf.Broker.Exchange, routingKey, conf.Broker.Durable, delivered.Body); err != nil {
-				// TODO fix resend mechanism
-				log.Errorln("We need to fix this resend stuff ...")
+				log.Errorf("Failed to route message "+
+					"(corr-id: %s, routingkey: %s, reason: %v)",
+					delivered.CorrelationId,
+					routingKey,
+					err)
+
+				if e := mq.Retry(&delivered, "Failed to route message", err.Error()); e != nil {
+					log.Errorf("Failed to retry message "+
+						"(corr-id: %s, reason: %v)",
+						delivered.CorrelationId,
+						e)
+				}
+
+				continue
 			}
 			if err := delivered.Ack(false); err != nil {
 				log.Errorf("failed to ack message for reason: %v", err)
@@ -153,23 +163,14 @@ func main() {
 		}
 	}()
 
-	<-forever
+	mq.WaitForShutdown(forever, nil)
 }
 
 // schemaNameFromType returns the schema to use for messages of
 // type msgType
 func schemaNameFromType(msgType string) (string, error) {
-	m := map[string]string{
-		msgAccession: "ingestion-accession",
-		msgCancel:    "ingestion-trigger",
-		msgIngest:    "ingestion-trigger",
-		msgMapping:   "dataset-mapping",
-		msgRelease:   "dataset-release",
-		msgDeprecate: "dataset-deprecate",
-	}
-
-	if m[msgType] != "" {
-		return m[msgType], nil
+	if route, ok := broker.Routes[msgType]; ok {
+		return route.Schema, nil
 	}
 
 	return "", fmt.Errorf("Don't know what schema to use for %s", msgType)
@@ -9,6 +9,8 @@ import (
 	"sda-pipeline/internal/broker"
 	"sda-pipeline/internal/config"
 	"sda-pipeline/internal/database"
+	"sda-pipeline/internal/health"
+	"sda-pipeline/internal/metrics"
 	"sda-pipeline/internal/storage"
 
 	log "github.com/sirupsen/logrus"
@@ -26,6 +28,7 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	metrics.Start("mapper", conf.Metrics)
 	mq, err := broker.NewMQ(conf.Broker)
 	if err != nil {
 		log.Fatal(err)
@@ -38,9 +41,21 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	go config.WatchSecrets(conf, func(c *config.Config) {
+		mq.UpdatePassword(c.Broker.Password)
+		if err := db.UpdateConf(c.Database); err != nil {
+			log.Errorf("Failed to reconnect to database with refreshed secrets, reason: %v", err)
+		}
+		storage.UpdateCredentials(inbox, c.Inbox)
+	})
+
+	healthServer := health.NewServer(conf.Health)
+	healthServer.AddReadinessCheck("broker", health.BrokerCheck(mq))
+	healthServer.AddReadinessCheck("database", health.DatabaseCheck(db))
+	healthServer.AddReadinessCheck("inbox", health.StorageCheck(inbox))
+	healthServer.Start()
 
-	defer mq.Channel.Close()
-	defer mq.Connection.Close()
+	defer mq.Close()
 	defer db.Close()
 
 	go func() {
@@ -122,9 +137,9 @@ func main() {
 						mappings.AccessionIDs,
 						err)
 
-					// Nack message so the server gets notified that something is wrong and requeue the message
-					if e := delivered.Nack(false, true); e != nil {
-						log.Errorf("Failed to nack message on mapping files to dataset) "+
+					// Retry the message, it is sent to the error queue if it keeps failing
+					if e := mq.Retry(&delivered, "MapFilesToDataset failed", err.Error()); e != nil {
+						log.Errorf("Failed to retry message on mapping files to dataset) "+
 							"(corr-id: %s, "+
 							"datasetid: %s, "+
 							"accessionid: %s, "+
@@ -168,9 +183,9 @@ func main() {
 						mappings.AccessionIDs,
 						err)
 
-					// Nack message so the server gets notified that something is wrong and requeue the message
-					if e := delivered.Nack(false, true); e != nil {
-						log.Errorf("Failed to nack message on marking ready the files in the dataset) "+
+					// Retry the message, it is sent to the error queue if it keeps failing
+					if e := mq.Retry(&delivered, "MarkReady failed", err.Error()); e != nil {
+						log.Errorf("Failed to retry message on marking ready the files in the dataset) "+
 							"(corr-id: %s, "+
 							"datasetid: %s, "+
 							"accessionid: %s, "+
@@ -200,9 +215,9 @@ func main() {
 						mappings.AccessionIDs,
 						err)
 
-					// Nack message so the server gets notified that something is wrong and requeue the message
-					if e := delivered.Nack(false, true); e != nil {
-						log.Errorf("Failed to nack message on marking ready the files in the dataset) "+
+					// Retry the message, it is sent to the error queue if it keeps failing
+					if e := mq.Retry(&delivered, "MarkDisabled failed", err.Error()); e != nil {
+						log.Errorf("Failed to retry message on marking ready the files in the dataset) "+
 							"(corr-id: %s, "+
 							"datasetid: %s, "+
 							"accessionid: %s, "+
@@ -231,7 +246,7 @@ func main() {
 		}
 	}()
 
-	<-forever
+	mq.WaitForShutdown(forever, nil)
 }
 
 // schemaFromDatasetOperation returns the operation done with dataset
@@ -9,7 +9,10 @@ import (
 	"sda-pipeline/internal/broker"
 	"sda-pipeline/internal/common"
 	"sda-pipeline/internal/config"
+	"sda-pipeline/internal/health"
+	"sda-pipeline/internal/metrics"
 	"strconv"
+	"sync/atomic"
 
 	"github.com/rabbitmq/amqp091-go"
 	log "github.com/sirupsen/logrus"
@@ -24,13 +27,24 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	metrics.Start("notify", conf.Metrics)
 	mq, err := broker.NewMQ(conf.Broker)
 	if err != nil {
 		log.Fatal(err)
 	}
+	// the smtp settings are replaced when the secrets are refreshed
+	var smtpConf atomic.Pointer[config.SMTPConf]
+	smtpConf.Store(&conf.Notify)
+	go config.WatchSecrets(conf, func(c *config.Config) {
+		mq.UpdatePassword(c.Broker.Password)
+		smtpConf.Store(&c.Notify)
+	})
 
-	defer mq.Channel.Close()
-	defer mq.Connection.Close()
+	healthServer := health.NewServer(conf.Health)
+	healthServer.AddReadinessCheck("broker", health.BrokerCheck(mq))
+	healthServer.Start()
+
+	defer mq.Close()
 
 	go func() {
 		connError := mq.ConnectionWatcher()
@@ -67,7 +81,7 @@ func main() {
 				continue
 			}
 
-			if err := sendEmail(conf.Notify, "THIS SHOULD TAKE A TEMPLATE", user, setSubject(conf.Broker.Queue)); err != nil {
+			if err := sendEmail(*smtpConf.Load(), "THIS SHOULD TAKE A TEMPLATE", user, setSubject(conf.Broker.Queue)); err != nil {
 				log.Errorf("Failed to send email, error %v", err)
 
 				if e := d.Nack(false, false); e != nil {
@@ -83,7 +97,7 @@ func main() {
 		}
 	}()
 
-	<-forever
+	mq.WaitForShutdown(forever, nil)
 }
 
 func getUser(queue string, orgMsg []byte) string {
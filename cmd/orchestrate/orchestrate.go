@@ -11,6 +11,8 @@ import (
 
 	"sda-pipeline/internal/broker"
 	"sda-pipeline/internal/config"
+	"sda-pipeline/internal/health"
+	"sda-pipeline/internal/metrics"
 
 	uuid "github.com/google/uuid"
 	"github.com/rabbitmq/amqp091-go"
@@ -63,13 +65,20 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	metrics.Start("orchestrate", conf.Metrics)
 	mq, err := broker.NewMQ(conf.Broker)
 	if err != nil {
 		log.Fatal(err)
 	}
+	go config.WatchSecrets(conf, func(c *config.Config) {
+		mq.UpdatePassword(c.Broker.Password)
+	})
 
-	defer mq.Channel.Close()
-	defer mq.Connection.Close()
+	healthServer := health.NewServer(conf.Health)
+	healthServer.AddReadinessCheck("broker", health.BrokerCheck(mq))
+	healthServer.Start()
+
+	defer mq.Close()
 
 	queues := []string{conf.Orchestrator.QueueInbox, conf.Orchestrator.QueueVerify, conf.Orchestrator.QueueComplete}
 
@@ -93,7 +102,7 @@ func main() {
 		routingKey := routing[queue]
 		go processQueue(mq, queue, routingKey, conf)
 	}
-	<-forever
+	mq.WaitForShutdown(forever, nil)
 }
 
 func processQueue(mq *broker.AMQPBroker, queue string, routingKey string, conf *config.Config) {
@@ -156,54 +165,26 @@ func processQueue(mq *broker.AMQPBroker, queue string, routingKey string, conf *
 			continue
 		}
 
+		var outgoing []outgoingMessage
 		switch routingKey {
 		case conf.Orchestrator.QueueAccession:
 			publishMsg, publishType = finalizeMessage(delivered.Body, conf)
-			err = validateMsg(&delivered, mq, routingKey, durable, routingSchema, publishMsg, publishType)
-			if err != nil {
-				log.Errorf("Validation of outgoing message failed, error: %v", err)
-				if err := delivered.Nack(false, true); err != nil {
-					log.Errorf("failed to nack message for reason: %v", err)
-				}
-
-				continue
-			}
+			outgoing = append(outgoing, outgoingMessage{publishMsg, publishType})
 		case conf.Orchestrator.QueueIngest:
 			publishMsg, publishType = ingestMessage(delivered.Body)
-			err = validateMsg(&delivered, mq, routingKey, durable, routingSchema, publishMsg, publishType)
-			if err != nil {
-				log.Errorf("Validation of outgoing message failed, error: %v", err)
-				if err := delivered.Nack(false, true); err != nil {
-					log.Errorf("failed to nack message for reason: %v", err)
-				}
-
-				continue
-			}
+			outgoing = append(outgoing, outgoingMessage{publishMsg, publishType})
 		case conf.Orchestrator.QueueMapping:
 			publishMsg, publishType = mappingMessage(delivered.Body, conf)
-			err = validateMsg(&delivered, mq, routingKey, durable, routingSchema, publishMsg, publishType)
-			if err != nil {
-				log.Errorf("Validation of outgoing message failed, error: %v", err)
-				if err := delivered.Nack(false, true); err != nil {
-					log.Errorf("failed to nack message for reason: %v", err)
-				}
-
-				continue
-			}
-			// let us wait a minute before sending the release message
-			time.Sleep(conf.Orchestrator.ReleaseDelay * time.Minute)
+			outgoing = append(outgoing, outgoingMessage{publishMsg, publishType})
+			// the release message is sent a while after the mapping message
 			publishMsg, publishType = releaseMessage(delivered.Body, conf)
-			err = validateMsg(&delivered, mq, routingKey, durable, routingSchema, publishMsg, publishType)
-			if err != nil {
-				log.Errorf("Validation of outgoing message failed, error: %v", err)
-				if err := delivered.Nack(false, true); err != nil {
-					log.Errorf("failed to nack message for reason: %v", err)
-				}
-
-				continue
-			}
+			outgoing = append(outgoing, outgoingMessage{publishMsg, publishType})
 		}
 
+		err = routeMessages(&delivered, mq, routingKey, durable, routingSchema, conf.Orchestrator.ReleaseDelay*time.Minute, outgoing)
+		if err != nil {
+			log.Errorf("Validation of outgoing message failed, error: %v", err)
+		}
 	}
 }
 
@@ -376,18 +357,42 @@ func releaseMessage(body []byte, conf *config.Config) ([]byte, interface{}) {
 	return publish, new(mapping)
 }
 
-func validateMsg(delivered *amqp091.Delivery, mq *broker.AMQPBroker, routingKey string, durable bool, routingSchema string, publishMsg []byte, publishType interface{}) error {
-	err := mq.ValidateJSON(delivered, routingSchema, publishMsg, publishType)
-	if err != nil {
-		return err
+// outgoingMessage is a message to route, and the type it is validated
+// against
+type outgoingMessage struct {
+	body []byte
+	dest interface{}
+}
+
+// routeMessages validates the outgoing messages and sends them in order,
+// waiting delay between them. The delivered message is acked once all of
+// them are sent, and retried if sending fails. If any of them is invalid
+// none is sent, and ValidateJSON nacks the delivered message without
+// requeueing it and sends it to the error queue.
+func routeMessages(delivered *amqp091.Delivery, mq *broker.AMQPBroker, routingKey string, durable bool, routingSchema string, delay time.Duration, outgoing []outgoingMessage) error {
+	for _, m := range outgoing {
+		if err := mq.ValidateJSON(delivered, routingSchema, m.body, m.dest); err != nil {
+			return err
+		}
 	}
 
-	log.Debugf("Routing message (corr-id: %s, routingkey: %s, message: %s)",
-		delivered.CorrelationId, routingKey, publishMsg)
+	for i, m := range outgoing {
+		if i > 0 {
+			time.Sleep(delay)
+		}
+
+		log.Debugf("Routing message (corr-id: %s, routingkey: %s, message: %s)",
+			delivered.CorrelationId, routingKey, m.body)
+
+		if err := mq.SendMessage(delivered.CorrelationId, mq.Conf.Exchange, routingKey, durable, m.body); err != nil {
+			log.Errorf("Failed to route message (corr-id: %s, routingkey: %s, reason: %v)",
+				delivered.CorrelationId, routingKey, err)
+			if err := mq.Retry(delivered, "Failed to route message", err.Error()); err != nil {
+				log.Errorf("failed to retry message for reason: %v", err)
+			}
 
-	if err := mq.SendMessage(delivered.CorrelationId, mq.Conf.Exchange, routingKey, durable, publishMsg); err != nil {
-		// TODO fix resend mechanism
-		log.Errorln("We need to fix this resend stuff ...")
+			return nil
+		}
 	}
 	if err := delivered.Ack(false); err != nil {
 		log.Errorf("failed to ack message for reason: %v", err)
@@ -0,0 +1,220 @@
+// The reconcile command cross-checks the files in the archive storage against
+// the files registered in the database, and reports archive files that are
+// not known to the database as well as registered files that are missing from
+// the archive.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"sda-pipeline/internal/config"
+	"sda-pipeline/internal/database"
+	"sda-pipeline/internal/storage"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// report holds the outcome of a reconciliation run
+type report struct {
+	Started       time.Time     `json:"started"`
+	Action        string        `json:"action"`
+	ArchiveFiles  int           `json:"archive_files"`
+	DatabaseFiles int           `json:"database_files"`
+	Orphans       []orphan      `json:"orphans"`
+	Missing       []missingFile `json:"missing"`
+}
+
+// orphan is a file in the archive that has no matching file in the database
+type orphan struct {
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	Action   string    `json:"action,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// missingFile is a file in the database whose archive file can't be found
+type missingFile struct {
+	FileID      string `json:"file_id"`
+	ArchivePath string `json:"archive_path"`
+}
+
+func main() {
+	conf, err := config.NewConfig("reconcile")
+	if err != nil {
+		log.Fatal(err)
+	}
+	db, err := database.NewDB(conf.Database)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+	archive, err := storage.NewBackend(conf.Archive)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	started := time.Now()
+
+	// The database is read first, so that files archived while the archive
+	// is walked are known, and not taken for orphans
+	archivePaths, err := db.GetArchivePaths()
+	if err != nil {
+		log.Fatalf("Failed to get archive paths from database, reason: %v", err)
+	}
+
+	r, err := reconcile(archive, archivePaths, conf.Reconcile, started)
+	if err != nil {
+		log.Fatalf("Failed to list archive files, reason: %v", err)
+	}
+	log.Infof("Found %d orphaned archive files and %d files missing from the archive", len(r.Orphans), len(r.Missing))
+
+	for i := range r.Orphans {
+		handleOrphan(archive, &r.Orphans[i], conf.Reconcile)
+	}
+
+	if err := writeReport(r, conf.Reconcile.Report); err != nil {
+		log.Fatalf("Failed to write report, reason: %v", err)
+	}
+}
+
+// reconcile compares the files in the archive with the archive paths in the
+// database, walking the archive so that the files don't have to be held in
+// memory. Files modified after now minus the configured minimum age are
+// left out since they can belong to ongoing ingestions, and so are files
+// that have already been quarantined. The missing files are sorted by
+// archive path.
+func reconcile(archive storage.Backend, archivePaths map[string]string, conf config.ReconcileConf, now time.Time) (report, error) {
+	r := report{
+		Started:       now,
+		Action:        conf.Action,
+		DatabaseFiles: len(archivePaths),
+		Orphans:       []orphan{},
+		Missing:       []missingFile{},
+	}
+
+	found := make(map[string]bool, len(archivePaths))
+	err := archive.Walk("", func(file storage.FileInfo) error {
+		r.ArchiveFiles++
+
+		if _, ok := archivePaths[file.Path]; ok {
+			found[file.Path] = true
+
+			return nil
+		}
+		if conf.QuarantinePrefix != "" && strings.HasPrefix(file.Path, conf.QuarantinePrefix) {
+			return nil
+		}
+		if now.Sub(file.ModTime) < conf.MinAge {
+			log.Debugf("Skipping recently modified file %s", file.Path)
+
+			return nil
+		}
+
+		r.Orphans = append(r.Orphans, orphan{Path: file.Path, Size: file.Size, Modified: file.ModTime})
+
+		return nil
+	})
+	if err != nil {
+		return r, err
+	}
+
+	for archivePath, fileID := range archivePaths {
+		if !found[archivePath] {
+			r.Missing = append(r.Missing, missingFile{FileID: fileID, ArchivePath: archivePath})
+		}
+	}
+	sort.Slice(r.Missing, func(i, j int) bool { return r.Missing[i].ArchivePath < r.Missing[j].ArchivePath })
+
+	return r, nil
+}
+
+// handleOrphan quarantines or deletes an orphaned file depending on the
+// configured action, and records the outcome in the orphan
+func handleOrphan(archive storage.Backend, o *orphan, conf config.ReconcileConf) {
+	var err error
+	switch conf.Action {
+	case "quarantine":
+		err = quarantine(archive, o.Path, conf.QuarantinePrefix+o.Path)
+		o.Action = "quarantined"
+	case "delete":
+		err = archive.RemoveFile(o.Path)
+		o.Action = "deleted"
+	default:
+		return
+	}
+
+	if err != nil {
+		log.Errorf("Failed to handle orphaned archive file (archivepath: %s, action: %s, reason: %v)", o.Path, conf.Action, err)
+		o.Action = ""
+		o.Error = err.Error()
+
+		return
+	}
+
+	log.Infof("Orphaned archive file %s (archivepath: %s)", o.Action, o.Path)
+}
+
+// quarantine moves a file to the quarantine path in the same storage.
+// The original is only removed once the copy has the same size.
+func quarantine(archive storage.Backend, filePath, quarantinePath string) error {
+	size, err := archive.GetFileSize(filePath)
+	if err != nil {
+		return err
+	}
+
+	src, err := archive.NewFileReader(filePath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dest, err := archive.NewFileWriter(quarantinePath)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(dest, src); err != nil {
+		dest.Close()
+
+		return err
+	}
+	if err := dest.Close(); err != nil {
+		return err
+	}
+
+	copied, err := archive.GetFileSize(quarantinePath)
+	if err != nil {
+		return err
+	}
+	if copied != size {
+		return fmt.Errorf("size of quarantined file %d does not match original size %d", copied, size)
+	}
+
+	return archive.RemoveFile(filePath)
+}
+
+// writeReport writes the report as JSON to reportPath, or to stdout if no
+// path is given
+func writeReport(r report, reportPath string) error {
+	out := os.Stdout
+	if reportPath != "" {
+		f, err := os.Create(reportPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+
+	return encoder.Encode(r)
+}
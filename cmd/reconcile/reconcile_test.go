@@ -0,0 +1,133 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"sda-pipeline/internal/config"
+	"sda-pipeline/internal/storage"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type TestSuite struct {
+	suite.Suite
+	archiveDir string
+	archive    storage.Backend
+}
+
+func TestReconcileTestSuite(t *testing.T) {
+	suite.Run(t, new(TestSuite))
+}
+
+func (suite *TestSuite) SetupTest() {
+	suite.archiveDir = suite.T().TempDir()
+	assert.NoError(suite.T(), os.Mkdir(filepath.Join(suite.archiveDir, "quarantine"), 0750))
+
+	viper.Set("archive.type", "posix")
+	viper.Set("archive.location", suite.archiveDir)
+	viper.Set("db.host", "test")
+	viper.Set("db.port", 123)
+	viper.Set("db.user", "test")
+	viper.Set("db.password", "test")
+	viper.Set("db.database", "test")
+
+	conf, err := config.NewConfig("reconcile")
+	assert.NoError(suite.T(), err)
+
+	suite.archive, err = storage.NewBackend(conf.Archive)
+	assert.NoError(suite.T(), err)
+}
+
+func (suite *TestSuite) TearDownTest() {
+	viper.Reset()
+}
+
+func (suite *TestSuite) TestReconcile() {
+	now := time.Now()
+	old := now.Add(-48 * time.Hour)
+	for name, modified := range map[string]time.Time{
+		"known":             old,
+		"orphan":            old,
+		"recent":            now.Add(-time.Minute),
+		"quarantine/orphan": old,
+	} {
+		path := filepath.Join(suite.archiveDir, name)
+		assert.NoError(suite.T(), os.WriteFile(path, []byte("data"), 0600))
+		assert.NoError(suite.T(), os.Chtimes(path, modified, modified))
+	}
+	archivePaths := map[string]string{
+		"known":     "c9ce4ef2-4e2e-4a38-93e0-7e8f1b4a3f4b",
+		"missing-b": "54c0a5b9-3a0e-4d8e-9b1b-9e3e4a2b8c17",
+		"missing-a": "0d3a6c8e-1b2f-4e5a-8c7d-6f9e0a1b2c3d",
+	}
+	conf := config.ReconcileConf{Action: "report", QuarantinePrefix: "quarantine/", MinAge: 24 * time.Hour}
+
+	r, err := reconcile(suite.archive, archivePaths, conf, now)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 4, r.ArchiveFiles)
+	assert.Equal(suite.T(), 3, r.DatabaseFiles)
+	if assert.Len(suite.T(), r.Orphans, 1) {
+		assert.Equal(suite.T(), "orphan", r.Orphans[0].Path)
+		assert.Equal(suite.T(), int64(4), r.Orphans[0].Size)
+		assert.WithinDuration(suite.T(), old, r.Orphans[0].Modified, time.Second)
+	}
+	assert.Equal(suite.T(), []missingFile{
+		{FileID: "0d3a6c8e-1b2f-4e5a-8c7d-6f9e0a1b2c3d", ArchivePath: "missing-a"},
+		{FileID: "54c0a5b9-3a0e-4d8e-9b1b-9e3e4a2b8c17", ArchivePath: "missing-b"},
+	}, r.Missing)
+}
+
+func (suite *TestSuite) TestHandleOrphan_quarantine() {
+	assert.NoError(suite.T(), os.WriteFile(filepath.Join(suite.archiveDir, "orphan"), []byte("orphaned data"), 0600))
+
+	o := orphan{Path: "orphan"}
+	handleOrphan(suite.archive, &o, config.ReconcileConf{Action: "quarantine", QuarantinePrefix: "quarantine/"})
+	assert.Equal(suite.T(), "quarantined", o.Action)
+	assert.Empty(suite.T(), o.Error)
+
+	assert.NoFileExists(suite.T(), filepath.Join(suite.archiveDir, "orphan"))
+	data, err := os.ReadFile(filepath.Join(suite.archiveDir, "quarantine", "orphan"))
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), []byte("orphaned data"), data)
+}
+
+func (suite *TestSuite) TestHandleOrphan_delete() {
+	assert.NoError(suite.T(), os.WriteFile(filepath.Join(suite.archiveDir, "orphan"), []byte("orphaned data"), 0600))
+
+	o := orphan{Path: "orphan"}
+	handleOrphan(suite.archive, &o, config.ReconcileConf{Action: "delete"})
+	assert.Equal(suite.T(), "deleted", o.Action)
+	assert.NoFileExists(suite.T(), filepath.Join(suite.archiveDir, "orphan"))
+}
+
+func (suite *TestSuite) TestHandleOrphan_report() {
+	assert.NoError(suite.T(), os.WriteFile(filepath.Join(suite.archiveDir, "orphan"), []byte("orphaned data"), 0600))
+
+	o := orphan{Path: "orphan"}
+	handleOrphan(suite.archive, &o, config.ReconcileConf{Action: "report"})
+	assert.Empty(suite.T(), o.Action)
+	assert.FileExists(suite.T(), filepath.Join(suite.archiveDir, "orphan"))
+}
+
+func (suite *TestSuite) TestHandleOrphan_failure() {
+	o := orphan{Path: "does-not-exist"}
+	handleOrphan(suite.archive, &o, config.ReconcileConf{Action: "delete"})
+	assert.Empty(suite.T(), o.Action)
+	assert.NotEmpty(suite.T(), o.Error)
+}
+
+func (suite *TestSuite) TestWriteReport() {
+	reportPath := filepath.Join(suite.T().TempDir(), "report.json")
+	r := report{Action: "report", Orphans: []orphan{{Path: "orphan", Size: 20}}, Missing: []missingFile{}}
+
+	assert.NoError(suite.T(), writeReport(r, reportPath))
+	data, err := os.ReadFile(reportPath)
+	assert.NoError(suite.T(), err)
+	assert.Contains(suite.T(), string(data), `"path": "orphan"`)
+	assert.Contains(suite.T(), string(data), `"missing": []`)
+}
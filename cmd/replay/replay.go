@@ -0,0 +1,380 @@
+// The replay command reads the error messages that the services have sent
+// to the error queue, reports them grouped by error and reason, and sends
+// the original messages of the selected errors again to the queues they
+// were first sent to.
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"sda-pipeline/internal/broker"
+	"sda-pipeline/internal/config"
+	"sda-pipeline/internal/database"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	log "github.com/sirupsen/logrus"
+)
+
+// routes are the schemas that original messages are matched against, and
+// the routing keys they are replayed with, which are the same as intercept
+// uses. Messages with a type are tried first since they also match the
+// schemas of the messages without one.
+var routes = []broker.Route{
+	broker.Routes["ingest"],
+	broker.Routes["accession"],
+	broker.Routes["mapping"],
+	broker.Routes["release"],
+	broker.Routes["deprecate"],
+	{Schema: "ingestion-verification", RoutingKey: "archived"},
+	{Schema: "ingestion-completion", RoutingKey: "backup"},
+}
+
+// report holds the outcome of a replay run
+type report struct {
+	Started  time.Time `json:"started"`
+	Action   string    `json:"action"`
+	Messages int       `json:"messages"`
+	Selected int       `json:"selected"`
+	Replayed int       `json:"replayed"`
+	Groups   []group   `json:"groups"`
+}
+
+// group holds the selected errors with the same error and reason
+type group struct {
+	Error  string  `json:"error"`
+	Reason string  `json:"reason"`
+	Errors []entry `json:"errors"`
+}
+
+// entry is a selected error message and what was done with it
+type entry struct {
+	CorrelationID string     `json:"correlation_id"`
+	User          string     `json:"user,omitempty"`
+	Timestamp     *time.Time `json:"timestamp,omitempty"`
+	RoutingKey    string     `json:"routing_key,omitempty"`
+	Action        string     `json:"action,omitempty"`
+	Failure       string     `json:"failure,omitempty"`
+}
+
+// errorMessage is a message read from the error queue
+type errorMessage struct {
+	delivered  amqp.Delivery
+	err        string
+	reason     string
+	original   []byte
+	user       string
+	routingKey string
+}
+
+func main() {
+	conf, err := config.NewConfig("replay")
+	if err != nil {
+		log.Fatal(err)
+	}
+	mq, err := broker.NewMQ(conf.Broker)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer mq.Close()
+	db, err := database.NewDB(conf.Database)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+	if conf.Replay.Action == "replay" {
+		recorded, err := db.TableExists("replays")
+		if err != nil {
+			log.Fatalf("failed to inspect database schema: %v", err)
+		}
+		if !recorded {
+			log.Fatal("sda.replays does not exist, apply the migration migrations/02_replays.sql before replaying messages")
+		}
+	}
+
+	started := time.Now()
+
+	length, err := mq.QueueLength(conf.Broker.Queue)
+	if err != nil {
+		log.Fatalf("Failed to inspect queue %s, reason: %v", conf.Broker.Queue, err)
+	}
+	messages, err := mq.GetMessages(conf.Broker.Queue)
+	if err != nil {
+		log.Fatalf("Failed to get messages, reason: %v", err)
+	}
+	deliveries := read(messages, length, conf.Replay.Wait)
+	log.Infof("Read %d of %d messages from %s", len(deliveries), length, conf.Broker.Queue)
+
+	var errorMessages []*errorMessage
+	for _, delivered := range deliveries {
+		m, err := parse(delivered, conf.Broker.SchemasPath)
+		if err != nil {
+			log.Errorf("Failed to read error message, it is left in the queue (corr-id: %s, reason: %v)", delivered.CorrelationId, err)
+			// It is requeued together with the messages that are not replayed
+			m = &errorMessage{delivered: delivered}
+		}
+		errorMessages = append(errorMessages, m)
+	}
+
+	r := report{Started: started, Action: conf.Replay.Action, Messages: len(errorMessages), Groups: []group{}}
+	var entries = map[*errorMessage]*entry{}
+	for _, m := range errorMessages {
+		if m.original == nil || !selected(m, conf.Replay) {
+			continue
+		}
+		r.Selected++
+		entries[m] = newEntry(m)
+
+		if conf.Replay.Action != "replay" {
+			continue
+		}
+		if err := replay(m, conf, mq.SendMessage, db); err != nil {
+			log.Errorf("Failed to replay message (corr-id: %s, reason: %v)", m.delivered.CorrelationId, err)
+			entries[m].Failure = err.Error()
+
+			continue
+		}
+		entries[m].Action = "replayed"
+		r.Replayed++
+	}
+
+	// Everything that was not replayed goes back to the queue
+	for _, m := range errorMessages {
+		if e := entries[m]; e != nil && e.Action == "replayed" {
+			continue
+		}
+		if err := m.delivered.Nack(false, true); err != nil {
+			log.Errorf("Failed to requeue message (corr-id: %s, reason: %v)", m.delivered.CorrelationId, err)
+		}
+	}
+	if err := mq.StopConsuming(conf.Broker.ShutdownTimeout); err != nil {
+		log.Error(err)
+	}
+
+	r.Groups = groupEntries(errorMessages, entries)
+	log.Infof("Selected %d error messages and replayed %d", r.Selected, r.Replayed)
+	if err := writeReport(r, conf.Replay.Report); err != nil {
+		log.Fatalf("Failed to write report, reason: %v", err)
+	}
+}
+
+// read reads count messages, or until no message has come for wait
+func read(messages <-chan amqp.Delivery, count int, wait time.Duration) []amqp.Delivery {
+	deliveries := []amqp.Delivery{}
+	for len(deliveries) < count {
+		select {
+		case delivered, ok := <-messages:
+			if !ok {
+				return deliveries
+			}
+			deliveries = append(deliveries, delivered)
+		case <-time.After(wait):
+			log.Warnf("No message came for %v, the rest of the queue is left as is", wait)
+
+			return deliveries
+		}
+	}
+
+	return deliveries
+}
+
+// parse reads an error message and finds the routing key of its original
+// message. The routing key is empty if the original message does not
+// match any of the known schemas.
+func parse(delivered amqp.Delivery, schemasPath string) (*errorMessage, error) {
+	var infoError struct {
+		Error           string          `json:"error"`
+		Reason          string          `json:"reason"`
+		OriginalMessage json.RawMessage `json:"original-message"`
+	}
+	if err := json.Unmarshal(delivered.Body, &infoError); err != nil {
+		return nil, err
+	}
+
+	original, err := originalMessage(infoError.OriginalMessage)
+	if err != nil {
+		return nil, err
+	}
+	original, err = withoutNulls(original)
+	if err != nil {
+		return nil, err
+	}
+
+	var fields struct {
+		User string `json:"user"`
+	}
+	_ = json.Unmarshal(original, &fields)
+
+	m := &errorMessage{
+		delivered: delivered,
+		err:       infoError.Error,
+		reason:    infoError.Reason,
+		original:  original,
+		user:      fields.User,
+	}
+	for _, route := range routes {
+		if broker.ValidateJSONBody(schemasPath, route.Schema, original) == nil {
+			m.routingKey = route.RoutingKey
+
+			break
+		}
+	}
+
+	return m, nil
+}
+
+// originalMessage returns the original message of an error as JSON. The
+// services send it either as the message itself, as a string, or as the
+// base64 encoded message body.
+func originalMessage(raw json.RawMessage) ([]byte, error) {
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		if !json.Valid(raw) || len(raw) == 0 || raw[0] != '{' {
+			return nil, errors.New("original message is not a JSON object or string")
+		}
+
+		return raw, nil
+	}
+
+	if json.Valid([]byte(s)) {
+		return []byte(s), nil
+	}
+	if decoded, err := base64.StdEncoding.DecodeString(s); err == nil && json.Valid(decoded) {
+		return decoded, nil
+	}
+
+	return nil, errors.New("original message is not JSON")
+}
+
+// withoutNulls removes the fields that are null from a message. Original
+// messages that were sent as the message structs of the services have null
+// for the fields that were left out, which the schemas don't allow.
+func withoutNulls(message []byte) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(message, &fields); err != nil {
+		return nil, err
+	}
+
+	for name, value := range fields {
+		if string(value) == "null" {
+			delete(fields, name)
+		}
+	}
+
+	return json.Marshal(fields)
+}
+
+// selected reports whether the error message matches the filters of the
+// configuration. Messages without a timestamp never match a time filter.
+func selected(m *errorMessage, conf config.ReplayConf) bool {
+	if conf.CorrelationID != "" && m.delivered.CorrelationId != conf.CorrelationID {
+		return false
+	}
+	if conf.User != "" && m.user != conf.User {
+		return false
+	}
+	if !conf.Since.IsZero() && (m.delivered.Timestamp.IsZero() || m.delivered.Timestamp.Before(conf.Since)) {
+		return false
+	}
+	if !conf.Until.IsZero() && (m.delivered.Timestamp.IsZero() || m.delivered.Timestamp.After(conf.Until)) {
+		return false
+	}
+
+	return true
+}
+
+// replay sends the original message again with the correlation id of the
+// error, keeps a record of it in the database and acks the error message
+func replay(m *errorMessage, conf *config.Config, send func(corrID, exchange, routingKey string, reliable bool, body []byte) error, db *database.SQLdb) error {
+	if m.routingKey == "" {
+		return errors.New("original message does not match any known message type")
+	}
+
+	if err := send(m.delivered.CorrelationId, conf.Broker.Exchange, m.routingKey, conf.Broker.Durable, m.original); err != nil {
+		return fmt.Errorf("failed to send message, reason: %v", err)
+	}
+	log.Infof("Replayed message (corr-id: %s, user: %s, routingkey: %s)", m.delivered.CorrelationId, m.user, m.routingKey)
+
+	// The message has been sent, so the error is acked even if the replay
+	// can't be recorded, or it would be replayed twice
+	if err := m.delivered.Ack(false); err != nil {
+		log.Errorf("Failed to ack replayed message (corr-id: %s, reason: %v)", m.delivered.CorrelationId, err)
+	}
+
+	record := database.Replay{
+		CorrelationID: m.delivered.CorrelationId,
+		RoutingKey:    m.routingKey,
+		Error:         m.err,
+		Reason:        m.reason,
+		Message:       m.original,
+		Operator:      conf.Replay.Operator,
+	}
+	if err := db.RecordReplay(record); err != nil {
+		log.Errorf("Failed to record replay of message (corr-id: %s, reason: %v)", m.delivered.CorrelationId, err)
+	}
+
+	return nil
+}
+
+// newEntry returns the report entry of an error message
+func newEntry(m *errorMessage) *entry {
+	e := &entry{CorrelationID: m.delivered.CorrelationId, User: m.user, RoutingKey: m.routingKey}
+	if !m.delivered.Timestamp.IsZero() {
+		timestamp := m.delivered.Timestamp
+		e.Timestamp = &timestamp
+	}
+
+	return e
+}
+
+// groupEntries groups the entries of the selected messages by error and
+// reason, with the largest groups first
+func groupEntries(errorMessages []*errorMessage, entries map[*errorMessage]*entry) []group {
+	groups := []group{}
+	index := map[[2]string]int{}
+	for _, m := range errorMessages {
+		e := entries[m]
+		if e == nil {
+			continue
+		}
+
+		key := [2]string{m.err, m.reason}
+		i, ok := index[key]
+		if !ok {
+			i = len(groups)
+			index[key] = i
+			groups = append(groups, group{Error: m.err, Reason: m.reason})
+		}
+		groups[i].Errors = append(groups[i].Errors, *e)
+	}
+
+	sort.SliceStable(groups, func(i, j int) bool {
+		return len(groups[i].Errors) > len(groups[j].Errors)
+	})
+
+	return groups
+}
+
+// writeReport writes the report as JSON to reportPath, or to stdout if no
+// path is given
+func writeReport(r report, reportPath string) error {
+	out := os.Stdout
+	if reportPath != "" {
+		f, err := os.Create(reportPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+
+	return encoder.Encode(r)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"sda-pipeline/internal/config"
+	"sda-pipeline/internal/database"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+const schemasPath = "file://../../schemas/federated/"
+
+const trigger = `{"type":"ingest","user":"dummy","filepath":"dummy_data.c4gh"}`
+
+type TestSuite struct {
+	suite.Suite
+}
+
+func TestReplayTestSuite(t *testing.T) {
+	suite.Run(t, new(TestSuite))
+}
+
+// mockAcknowledger records how a message was acked or nacked
+type mockAcknowledger struct {
+	acked, nacked bool
+}
+
+func (m *mockAcknowledger) Ack(uint64, bool) error {
+	m.acked = true
+
+	return nil
+}
+
+func (m *mockAcknowledger) Nack(uint64, bool, bool) error {
+	m.nacked = true
+
+	return nil
+}
+
+func (m *mockAcknowledger) Reject(uint64, bool) error { return nil }
+
+func errorDelivery(t *testing.T, corrID string, original interface{}) amqp.Delivery {
+	body, err := json.Marshal(map[string]interface{}{
+		"error":            "Failed to open file to ingest",
+		"reason":           "file not found",
+		"original-message": original,
+	})
+	assert.NoError(t, err)
+
+	return amqp.Delivery{Acknowledger: &mockAcknowledger{}, CorrelationId: corrID, Body: body}
+}
+
+func (suite *TestSuite) TestParse() {
+	for name, original := range map[string]interface{}{
+		"object": json.RawMessage(`{"type":"ingest","user":"dummy","filepath":"dummy_data.c4gh","encrypted_checksums":null}`),
+		"string": trigger,
+		"base64": base64.StdEncoding.EncodeToString([]byte(trigger)),
+	} {
+		m, err := parse(errorDelivery(suite.T(), "corr-id", original), schemasPath)
+		assert.NoError(suite.T(), err, name)
+		assert.JSONEq(suite.T(), trigger, string(m.original), name)
+		assert.Equal(suite.T(), "Failed to open file to ingest", m.err, name)
+		assert.Equal(suite.T(), "file not found", m.reason, name)
+		assert.Equal(suite.T(), "dummy", m.user, name)
+		assert.Equal(suite.T(), "ingest", m.routingKey, name)
+	}
+
+	_, err := parse(errorDelivery(suite.T(), "corr-id", "not json"), schemasPath)
+	assert.EqualError(suite.T(), err, "original message is not JSON")
+}
+
+func (suite *TestSuite) TestParse_routingKeys() {
+	for routingKey, original := range map[string]string{
+		"accessionIDs": `{"type":"accession","user":"dummy","filepath":"dummy_data.c4gh","accession_id":"EGAF00000000001",` +
+			`"decrypted_checksums":[{"type":"sha256","value":"82e4e60e7beb3db2e06a00a079788f7d71f75b61a4b75f28c4c942703dabb6d6"}]}`,
+		"mappings": `{"type":"mapping","dataset_id":"EGAD00000000001","accession_ids":["EGAF00000000001"]}`,
+		"archived": `{"user":"dummy","filepath":"dummy_data.c4gh","file_id":"file-id","archive_path":"archive-path","re_verify":false,` +
+			`"encrypted_checksums":[{"type":"sha256","value":"82e4e60e7beb3db2e06a00a079788f7d71f75b61a4b75f28c4c942703dabb6d6"}]}`,
+		"": `{"user":"dummy"}`,
+	} {
+		m, err := parse(errorDelivery(suite.T(), "corr-id", json.RawMessage(original)), schemasPath)
+		assert.NoError(suite.T(), err)
+		assert.Equal(suite.T(), routingKey, m.routingKey, original)
+	}
+}
+
+func (suite *TestSuite) TestSelected() {
+	sent := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	m := &errorMessage{delivered: amqp.Delivery{CorrelationId: "corr-id", Timestamp: sent}, user: "dummy"}
+
+	assert.True(suite.T(), selected(m, config.ReplayConf{}))
+	assert.True(suite.T(), selected(m, config.ReplayConf{CorrelationID: "corr-id", User: "dummy"}))
+	assert.False(suite.T(), selected(m, config.ReplayConf{CorrelationID: "other"}))
+	assert.False(suite.T(), selected(m, config.ReplayConf{User: "other"}))
+	assert.True(suite.T(), selected(m, config.ReplayConf{Since: sent.Add(-time.Hour), Until: sent.Add(time.Hour)}))
+	assert.False(suite.T(), selected(m, config.ReplayConf{Since: sent.Add(time.Hour)}))
+	assert.False(suite.T(), selected(m, config.ReplayConf{Until: sent.Add(-time.Hour)}))
+
+	// The time of messages without a timestamp is not known
+	m.delivered.Timestamp = time.Time{}
+	assert.False(suite.T(), selected(m, config.ReplayConf{Since: sent}))
+}
+
+func (suite *TestSuite) TestReplay() {
+	db, mock, err := sqlmock.New()
+	assert.NoError(suite.T(), err)
+	defer db.Close()
+
+	conf := &config.Config{}
+	conf.Broker.Exchange = "sda"
+	conf.Replay.Operator = "admin"
+
+	delivered := errorDelivery(suite.T(), "corr-id", trigger)
+	m, err := parse(delivered, schemasPath)
+	assert.NoError(suite.T(), err)
+
+	mock.ExpectExec("INSERT INTO sda.replays").
+		WithArgs("corr-id", "ingest", "Failed to open file to ingest", "file not found", string(m.original), "admin").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	var sent []string
+	send := func(corrID, exchange, routingKey string, _ bool, body []byte) error {
+		sent = append(sent, corrID, exchange, routingKey, string(body))
+
+		return nil
+	}
+	assert.NoError(suite.T(), replay(m, conf, send, &database.SQLdb{DB: db}))
+	assert.Equal(suite.T(), []string{"corr-id", "sda", "ingest", string(m.original)}, sent)
+	assert.Equal(suite.T(), &mockAcknowledger{acked: true}, delivered.Acknowledger)
+	assert.NoError(suite.T(), mock.ExpectationsWereMet())
+}
+
+func (suite *TestSuite) TestReplay_failed() {
+	db, mock, err := sqlmock.New()
+	assert.NoError(suite.T(), err)
+	defer db.Close()
+
+	delivered := errorDelivery(suite.T(), "corr-id", trigger)
+	m, err := parse(delivered, schemasPath)
+	assert.NoError(suite.T(), err)
+
+	send := func(string, string, string, bool, []byte) error { return errors.New("channel closed") }
+	assert.EqualError(suite.T(), replay(m, &config.Config{}, send, &database.SQLdb{DB: db}), "failed to send message, reason: channel closed")
+	assert.Equal(suite.T(), &mockAcknowledger{}, delivered.Acknowledger, "the error message should be left for the caller to requeue")
+
+	m.routingKey = ""
+	assert.EqualError(suite.T(), replay(m, &config.Config{}, send, &database.SQLdb{DB: db}), "original message does not match any known message type")
+	assert.NoError(suite.T(), mock.ExpectationsWereMet())
+}
+
+func (suite *TestSuite) TestGroupEntries() {
+	messages := []*errorMessage{
+		{delivered: amqp.Delivery{CorrelationId: "1"}, err: "Failed to open file to ingest", reason: "file not found"},
+		{delivered: amqp.Delivery{CorrelationId: "2"}, err: "GetHeader failed", reason: "no rows"},
+		{delivered: amqp.Delivery{CorrelationId: "3"}, err: "Failed to open file to ingest", reason: "file not found"},
+		{delivered: amqp.Delivery{CorrelationId: "4"}, err: "Failed to open file to ingest", reason: "permission denied"},
+	}
+	entries := map[*errorMessage]*entry{}
+	for _, m := range messages[:3] {
+		entries[m] = newEntry(m)
+	}
+
+	groups := groupEntries(messages, entries)
+	assert.Equal(suite.T(), []group{
+		{Error: "Failed to open file to ingest", Reason: "file not found", Errors: []entry{{CorrelationID: "1"}, {CorrelationID: "3"}}},
+		{Error: "GetHeader failed", Reason: "no rows", Errors: []entry{{CorrelationID: "2"}}},
+	}, groups)
+}
+
+func (suite *TestSuite) TestRead() {
+	messages := make(chan amqp.Delivery, 2)
+	messages <- amqp.Delivery{CorrelationId: "1"}
+	messages <- amqp.Delivery{CorrelationId: "2"}
+
+	assert.Len(suite.T(), read(messages, 1, time.Second), 1)
+	assert.Len(suite.T(), read(messages, 2, 10*time.Millisecond), 1, "reading should stop when no message comes")
+}
@@ -0,0 +1,261 @@
+// The rotatekey command reencrypts the file headers stored in the database
+// for a new archive key, without touching the archived files.
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"sda-pipeline/internal/broker"
+	"sda-pipeline/internal/config"
+	"sda-pipeline/internal/database"
+
+	"github.com/neicnordic/crypt4gh/model/headers"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// rotation struct that holds the json message data
+type rotation struct {
+	Type   string `json:"type"`
+	FileID string `json:"file_id"`
+}
+
+// errCannotRotate is the error of headers that can't be rotated however
+// many times it is tried
+var errCannotRotate = errors.New("header can not be rotated")
+
+func main() {
+	conf, err := config.NewConfig("rotatekey")
+	if err != nil {
+		log.Fatal(err)
+	}
+	db, err := database.NewDB(conf.Database)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	hasKeyHash, err := db.ColumnExists("files", "key_hash")
+	if err != nil {
+		log.Fatalf("Failed to inspect database schema, reason: %v", err)
+	}
+	if !hasKeyHash {
+		log.Fatal("The database has no key_hash column in sda.files, which is needed to track the key of each header")
+	}
+
+	keyring, err := config.GetC4GHKeyring()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Infof("Rotating file headers to the key with hash %s", conf.RotateKey.KeyHash)
+
+	if conf.Broker.Queue == "" {
+		rotateAll(db, keyring, conf.RotateKey)
+
+		return
+	}
+
+	rotateFromQueue(conf, db, keyring)
+}
+
+// rotateAll rotates the headers of all files that are not encrypted with
+// the new key
+func rotateAll(db *database.SQLdb, keyring []config.C4GHKey, conf config.RotateKeyConf) {
+	fileIDs, err := db.GetFilesToRotate(conf.KeyHash)
+	if err != nil {
+		log.Fatalf("Failed to get files to rotate from database, reason: %v", err)
+	}
+
+	log.Infof("Found %d files to rotate", len(fileIDs))
+
+	// A file that fails is logged and left for a later run, the others
+	// are rotated all the same
+	failed, skipped := 0, 0
+	for _, fileID := range fileIDs {
+		rotated, err := rotateHeader(db, fileID, keyring, conf)
+		if err != nil {
+			log.Errorf("Failed to rotate header (fileid: %s, reason: %v)", fileID, err)
+			failed++
+
+			continue
+		}
+		if !rotated {
+			log.Debugf("Header is already encrypted with the new key (fileid: %s)", fileID)
+			skipped++
+
+			continue
+		}
+
+		log.Debugf("Rotated header (fileid: %s)", fileID)
+	}
+
+	log.Infof("Rotated %d of %d files, %d were already encrypted with the new key", len(fileIDs)-failed-skipped, len(fileIDs), skipped)
+	if failed > 0 {
+		log.Errorf("Failed to rotate %d files, they are rotated by the next run", failed)
+	}
+}
+
+// rotateFromQueue rotates the headers of the files in the messages read
+// from the configured queue
+func rotateFromQueue(conf *config.Config, db *database.SQLdb, keyring []config.C4GHKey) {
+	forever := make(chan bool)
+	mq, err := broker.NewMQ(conf.Broker)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	defer mq.Close()
+
+	go func() {
+		connError := mq.ConnectionWatcher()
+		log.Error(connError)
+		forever <- false
+	}()
+
+	go func() {
+		connError := mq.ChannelWatcher()
+		log.Error(connError)
+		forever <- false
+	}()
+
+	log.Info("Starting rotatekey service")
+	var message rotation
+
+	go func() {
+		messages, err := mq.GetMessages(conf.Broker.Queue)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for delivered := range messages {
+			log.Debugf("Received a message (corr-id: %s, message: %s)",
+				delivered.CorrelationId,
+				delivered.Body)
+
+			err := mq.ValidateJSON(&delivered,
+				"key-rotation",
+				delivered.Body,
+				&message)
+
+			if err != nil {
+				log.Errorf("Validation of incoming message failed "+
+					"(corr-id: %s, error: %v)",
+					delivered.CorrelationId,
+					err)
+
+				continue
+			}
+
+			// we unmarshal the message in the validation step so this is safe to do
+			_ = json.Unmarshal(delivered.Body, &message)
+
+			if _, err := rotateHeader(db, message.FileID, keyring, conf.RotateKey); err != nil {
+				log.Errorf("Failed to rotate header "+
+					"(corr-id: %s, "+
+					"fileid: %s, "+
+					"error: %v)",
+					delivered.CorrelationId,
+					message.FileID,
+					err)
+
+				// Database errors may go away by themselves
+				if !errors.Is(err, errCannotRotate) {
+					if e := mq.Retry(&delivered, "Failed to rotate header", err.Error()); e != nil {
+						log.Errorf("Failed to retry message because of rotation failed "+
+							"(corr-id: %s, "+
+							"fileid: %s, "+
+							"error: %v)",
+							delivered.CorrelationId,
+							message.FileID,
+							e)
+					}
+
+					continue
+				}
+
+				// Nack message so the server gets notified that something is wrong. Do not requeue the message.
+				if e := delivered.Nack(false, false); e != nil {
+					log.Errorf("Failed to NAck because of rotation failed "+
+						"(corr-id: %s, "+
+						"fileid: %s, "+
+						"error: %v)",
+						delivered.CorrelationId,
+						message.FileID,
+						e)
+				}
+
+				// Send the message to an error queue so it can be analyzed.
+				infoErrorMessage := broker.InfoError{
+					Error:           "Failed to rotate header",
+					Reason:          err.Error(),
+					OriginalMessage: message,
+				}
+				body, _ := json.Marshal(infoErrorMessage)
+				if e := mq.SendMessage(delivered.CorrelationId, conf.Broker.Exchange, conf.Broker.RoutingError, conf.Broker.Durable, body); e != nil {
+					log.Errorf("Failed to publish message (rotation error), to error queue "+
+						"(corr-id: %s, "+
+						"fileid: %s, "+
+						"error: %v)",
+						delivered.CorrelationId,
+						message.FileID,
+						e)
+				}
+
+				continue
+			}
+
+			log.Infof("Rotated header "+
+				"(corr-id: %s, "+
+				"fileid: %s)",
+				delivered.CorrelationId,
+				message.FileID)
+
+			if err := delivered.Ack(false); err != nil {
+				log.Errorf("Failed to ack message after work completed "+
+					"(corr-id: %s, "+
+					"fileid: %s, "+
+					"error: %v)",
+					delivered.CorrelationId,
+					message.FileID,
+					err)
+			}
+		}
+	}()
+
+	mq.WaitForShutdown(forever, nil)
+}
+
+// rotateHeader reencrypts the header of the file for the new key, with
+// the first key in the keyring that can decrypt it, and stores it together
+// with the hash of the new key. A header that is already encrypted with
+// the new key is left as it is and only its key hash is recorded, and
+// false is returned. Headers that can't be rotated, unlike those that
+// failed on database errors, fail with errCannotRotate.
+func rotateHeader(db *database.SQLdb, fileID string, keyring []config.C4GHKey, conf config.RotateKeyConf) (bool, error) {
+	header, err := db.GetHeader(fileID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, fmt.Errorf("%w, file not found", errCannotRotate)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	key, err := config.FindC4GHKey(keyring, header)
+	if err != nil {
+		return false, fmt.Errorf("%w, %v", errCannotRotate, err)
+	}
+
+	if key.KeyHash == conf.KeyHash {
+		return false, db.SetKeyHash(conf.KeyHash, fileID)
+	}
+
+	newHeader, err := headers.ReEncryptHeader(header, key.PrivateKey, [][chacha20poly1305.KeySize]byte{conf.PublicKey})
+	if err != nil {
+		return false, fmt.Errorf("%w, %v", errCannotRotate, err)
+	}
+
+	return true, db.RotateHeader(newHeader, conf.KeyHash, fileID)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	"sda-pipeline/internal/config"
+	"sda-pipeline/internal/database"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/neicnordic/crypt4gh/keys"
+	"github.com/neicnordic/crypt4gh/model/headers"
+	"github.com/neicnordic/crypt4gh/streaming"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type TestSuite struct {
+	suite.Suite
+	header  []byte
+	oldKey  [32]byte
+	newKey  [32]byte
+	rotConf config.RotateKeyConf
+}
+
+func TestRotateKeyTestSuite(t *testing.T) {
+	suite.Run(t, new(TestSuite))
+}
+
+func (suite *TestSuite) SetupTest() {
+	oldPublicKey, oldKey, err := keys.GenerateKeyPair()
+	assert.NoError(suite.T(), err)
+	newPublicKey, newKey, err := keys.GenerateKeyPair()
+	assert.NoError(suite.T(), err)
+	_, writerKey, err := keys.GenerateKeyPair()
+	assert.NoError(suite.T(), err)
+
+	var encrypted bytes.Buffer
+	c4ghw, err := streaming.NewCrypt4GHWriter(&encrypted, writerKey, [][32]byte{oldPublicKey}, nil)
+	assert.NoError(suite.T(), err)
+	assert.NoError(suite.T(), c4ghw.Close())
+	suite.header, err = headers.ReadHeader(&encrypted)
+	assert.NoError(suite.T(), err)
+
+	suite.oldKey = oldKey
+	suite.newKey = newKey
+	suite.rotConf = config.RotateKeyConf{PublicKey: newPublicKey, KeyHash: config.KeyHash(newPublicKey)}
+}
+
+func (suite *TestSuite) TestRotateHeader() {
+	db, mock, err := sqlmock.New()
+	assert.NoError(suite.T(), err)
+	defer db.Close()
+
+	var stored []byte
+	mock.ExpectQuery("SELECT header from sda.files").
+		WithArgs("file-id").
+		WillReturnRows(sqlmock.NewRows([]string{"header"}).AddRow(hex.EncodeToString(suite.header)))
+	mock.ExpectExec("UPDATE sda.files SET header = \\$1, key_hash = \\$2").
+		WithArgs(headerArg{&stored}, suite.rotConf.KeyHash, "file-id").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	// The header is decrypted with whichever key in the keyring can
+	_, otherKey, err := keys.GenerateKeyPair()
+	assert.NoError(suite.T(), err)
+	keyring := []config.C4GHKey{{PrivateKey: otherKey, KeyHash: "other"}, {PrivateKey: suite.oldKey, KeyHash: "old"}}
+	rotated, err := rotateHeader(&database.SQLdb{DB: db}, "file-id", keyring, suite.rotConf)
+	assert.NoError(suite.T(), err)
+	assert.True(suite.T(), rotated)
+	assert.NoError(suite.T(), mock.ExpectationsWereMet())
+
+	// The stored header decrypts with the new key but not with the old one
+	_, err = headers.NewHeader(bytes.NewReader(stored), suite.newKey)
+	assert.NoError(suite.T(), err)
+	_, err = headers.NewHeader(bytes.NewReader(stored), suite.oldKey)
+	assert.Error(suite.T(), err)
+}
+
+func (suite *TestSuite) TestRotateHeader_wrongKey() {
+	db, mock, err := sqlmock.New()
+	assert.NoError(suite.T(), err)
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT header from sda.files").
+		WithArgs("file-id").
+		WillReturnRows(sqlmock.NewRows([]string{"header"}).AddRow(hex.EncodeToString(suite.header)))
+
+	// Nothing is written when the header can't be decrypted
+	_, err = rotateHeader(&database.SQLdb{DB: db}, "file-id", []config.C4GHKey{{PrivateKey: suite.newKey, KeyHash: suite.rotConf.KeyHash}}, suite.rotConf)
+	assert.ErrorIs(suite.T(), err, errCannotRotate)
+	assert.NoError(suite.T(), mock.ExpectationsWereMet())
+}
+
+func (suite *TestSuite) TestRotateHeader_databaseError() {
+	db, mock, err := sqlmock.New()
+	assert.NoError(suite.T(), err)
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT header from sda.files").
+		WithArgs("file-id").
+		WillReturnError(errors.New("connection refused"))
+
+	// Database errors are retried, so they are not errCannotRotate
+	_, err = rotateHeader(&database.SQLdb{DB: db}, "file-id", []config.C4GHKey{{PrivateKey: suite.oldKey, KeyHash: "old"}}, suite.rotConf)
+	assert.Error(suite.T(), err)
+	assert.NotErrorIs(suite.T(), err, errCannotRotate)
+}
+
+func (suite *TestSuite) TestRotateHeader_alreadyRotated() {
+	db, mock, err := sqlmock.New()
+	assert.NoError(suite.T(), err)
+	defer db.Close()
+
+	header, err := headers.ReEncryptHeader(suite.header, suite.oldKey, [][32]byte{suite.rotConf.PublicKey})
+	assert.NoError(suite.T(), err)
+
+	// Only the key hash is recorded for a header that is already
+	// encrypted with the new key
+	mock.ExpectQuery("SELECT header from sda.files").
+		WithArgs("file-id").
+		WillReturnRows(sqlmock.NewRows([]string{"header"}).AddRow(hex.EncodeToString(header)))
+	mock.ExpectExec("UPDATE sda.files SET key_hash = \\$1").
+		WithArgs(suite.rotConf.KeyHash, "file-id").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	keyring := []config.C4GHKey{{PrivateKey: suite.newKey, KeyHash: suite.rotConf.KeyHash}, {PrivateKey: suite.oldKey, KeyHash: "old"}}
+	rotated, err := rotateHeader(&database.SQLdb{DB: db}, "file-id", keyring, suite.rotConf)
+	assert.NoError(suite.T(), err)
+	assert.False(suite.T(), rotated)
+	assert.NoError(suite.T(), mock.ExpectationsWereMet())
+}
+
+// headerArg captures the hex encoded header written to the database
+type headerArg struct {
+	header *[]byte
+}
+
+func (h headerArg) Match(v driver.Value) bool {
+	s, ok := v.(string)
+	if !ok {
+		return false
+	}
+	header, err := hex.DecodeString(s)
+	if err != nil {
+		return false
+	}
+	*h.header = header
+
+	return true
+}
@@ -13,9 +13,12 @@ import (
 	"sda-pipeline/internal/broker"
 	"sda-pipeline/internal/config"
 	"sda-pipeline/internal/database"
+	"sda-pipeline/internal/health"
+	"sda-pipeline/internal/metrics"
 	"sda-pipeline/internal/storage"
 
 	"github.com/neicnordic/crypt4gh/streaming"
+	amqp "github.com/rabbitmq/amqp091-go"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -49,6 +52,7 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	metrics.Start("verify", conf.Metrics)
 	mq, err := broker.NewMQ(conf.Broker)
 	if err != nil {
 		log.Fatal(err)
@@ -61,13 +65,30 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	key, err := config.GetC4GHKey()
+	keyring, err := config.GetC4GHKeyring()
 	if err != nil {
 		log.Fatal(err)
 	}
+	// The key that decrypted each file is only recorded if the schema has
+	// the column for it
+	recordKeyHash, err := db.ColumnExists("files", "key_hash")
+	if err != nil {
+		log.Fatalf("failed to inspect database schema: %v", err)
+	}
+	if !recordKeyHash {
+		log.Warn("sda.files has no key_hash column, the keys that files are encrypted with are not recorded")
+	}
+	if err := db.CheckChecksumAlgorithms(conf.ChecksumAlgorithms...); err != nil {
+		log.Fatalf("checksums.algorithms can not be stored in the database: %v", err)
+	}
+
+	healthServer := health.NewServer(conf.Health)
+	healthServer.AddReadinessCheck("broker", health.BrokerCheck(mq))
+	healthServer.AddReadinessCheck("database", health.DatabaseCheck(db))
+	healthServer.AddReadinessCheck("archive", health.StorageCheck(archive))
+	healthServer.Start()
 
-	defer mq.Channel.Close()
-	defer mq.Connection.Close()
+	defer mq.Close()
 	defer db.Close()
 
 	go func() {
@@ -84,388 +105,512 @@ func main() {
 
 	log.Info("starting verify service")
 
+	// Every worker has database and storage handles of its own, the first
+	// one uses the ones created above
+	workers := make([]broker.Handler, conf.Broker.Workers)
+	handlers := make([]*worker, 0, len(workers))
+	for i := range workers {
+		w := &worker{conf: conf, mq: mq, db: db, archive: archive, keyring: keyring, recordKeyHash: recordKeyHash}
+		if i > 0 {
+			if w.db, err = database.NewDB(conf.Database); err != nil {
+				log.Fatal(err)
+			}
+			defer w.db.Close()
+			if w.archive, err = storage.NewBackend(conf.Archive); err != nil {
+				log.Fatal(err)
+			}
+		}
+		workers[i] = w.handle
+		handlers = append(handlers, w)
+	}
+
+	go config.WatchSecrets(conf, func(c *config.Config) {
+		mq.UpdatePassword(c.Broker.Password)
+		for _, w := range handlers {
+			if err := w.db.UpdateConf(c.Database); err != nil {
+				log.Errorf("Failed to reconnect to database with refreshed secrets, reason: %v", err)
+			}
+			storage.UpdateCredentials(w.archive, c.Archive)
+		}
+	})
+
 	go func() {
-		messages, err := mq.GetMessages(conf.Broker.Queue)
-		if err != nil {
+		if err := mq.Work(conf.Broker.Queue, workers...); err != nil {
 			log.Fatalf("Failed to get messages (error: %v) ",
 				err)
 		}
-		for delivered := range messages {
-			var message message
-			log.Debugf("Received a message (corr-id: %s, message: %s)",
-				delivered.CorrelationId,
-				delivered.Body)
+	}()
 
-			err := mq.ValidateJSON(&delivered, "ingestion-verification", delivered.Body, &message)
+	mq.WaitForShutdown(forever, nil)
+}
 
-			if err != nil {
-				log.Errorf("Validation (ingestion-verifiation) of incoming message failed "+
-					"(corr-id: %s, error: %v, message: %s)",
-					delivered.CorrelationId,
-					err,
-					delivered.Body)
+// worker verifies one file at a time, with database and storage handles
+// that are not shared with the other workers
+type worker struct {
+	conf          *config.Config
+	mq            *broker.AMQPBroker
+	db            *database.SQLdb
+	archive       storage.Backend
+	keyring       []config.C4GHKey
+	recordKeyHash bool
+}
 
-				// Restart on new message
-				continue
-			}
+// handle verifies the archived file of a message
+func (w *worker) handle(delivered amqp.Delivery) {
+	var message message
+
+	log.Debugf("Received a message (corr-id: %s, message: %s)",
+		delivered.CorrelationId,
+		delivered.Body)
+
+	err := w.mq.ValidateJSON(&delivered, "ingestion-verification", delivered.Body, &message)
+
+	if err != nil {
+		log.Errorf("Validation (ingestion-verifiation) of incoming message failed "+
+			"(corr-id: %s, error: %v, message: %s)",
+			delivered.CorrelationId,
+			err,
+			delivered.Body)
+
+		// Restart on new message
+		return
+	}
 
-			// we unmarshal the message in the validation step so this is safe to do
-			_ = json.Unmarshal(delivered.Body, &message)
+	// we unmarshal the message in the validation step so this is safe to do
+	_ = json.Unmarshal(delivered.Body, &message)
+
+	log.Infof("Received work "+
+		"(corr-id: %s, user: %s, filepath: %s, fileid: %s, archivepath: %s, encryptedchecksums: %v, reverify: %t)",
+		delivered.CorrelationId,
+		message.User,
+		message.FilePath,
+		message.FileID,
+		message.ArchivePath,
+		message.EncryptedChecksums,
+		message.ReVerify)
+
+	// If the file has been canceled by the uploader, don't spend time working on it.
+	status, err := w.db.GetFileStatus(delivered.CorrelationId)
+	if err != nil {
+		log.Errorf("failed to get file status, reason: %v", err.Error())
+		// Send the message to an error queue so it can be analyzed.
+		infoErrorMessage := broker.InfoError{
+			Error:           "Getheader failed",
+			Reason:          err.Error(),
+			OriginalMessage: message,
+		}
+
+		body, _ := json.Marshal(infoErrorMessage)
+		if e := w.mq.SendMessage(delivered.CorrelationId, w.conf.Broker.Exchange, w.conf.Broker.RoutingError, w.conf.Broker.Durable, body); e != nil {
+			log.Errorf("failed so publish message, reason: %v", err)
+		}
 
-			log.Infof("Received work "+
-				"(corr-id: %s, user: %s, filepath: %s, fileid: %s, archivepath: %s, encryptedchecksums: %v, reverify: %t)",
+		if err := delivered.Ack(false); err != nil {
+			log.Errorf("Failed acking canceled work, reason: %v", err)
+		}
+
+		return
+	}
+	if status == "disabled" {
+		log.Infof("file with correlation ID: %s is disabled, stopping verification", delivered.CorrelationId)
+		if err := delivered.Ack(false); err != nil {
+			log.Errorf("Failed acking canceled work, reason: %v", err)
+		}
+
+		return
+	}
+
+	header, err := w.db.GetHeader(message.FileID)
+	if err != nil {
+		log.Errorf("GetHeader failed "+
+			"(corr-id: %s, user: %s, filepath: %s, fileid: %s, archivepath: %s, encryptedchecksums: %v, reverify: %t, reason: %v)",
+			delivered.CorrelationId,
+			message.User,
+			message.FilePath,
+			message.FileID,
+			message.ArchivePath,
+			message.EncryptedChecksums,
+			message.ReVerify,
+			err)
+
+		// Nack message so the server gets notified that something is wrong but don't requeue the message
+		if e := delivered.Nack(false, false); e != nil {
+			log.Errorf("Failed to nack following getheader error message "+
+				"(corr-id: %s, user: %s, filepath: %s, fileid: %s, archivepath: %s, encryptedchecksums: %v, reverify: %t, reason: %v)",
 				delivered.CorrelationId,
 				message.User,
 				message.FilePath,
 				message.FileID,
 				message.ArchivePath,
 				message.EncryptedChecksums,
-				message.ReVerify)
-
-			// If the file has been canceled by the uploader, don't spend time working on it.
-			status, err := db.GetFileStatus(delivered.CorrelationId)
-			if err != nil {
-				log.Errorf("failed to get file status, reason: %v", err.Error())
-				// Send the message to an error queue so it can be analyzed.
-				infoErrorMessage := broker.InfoError{
-					Error:           "Getheader failed",
-					Reason:          err.Error(),
-					OriginalMessage: message,
-				}
-
-				body, _ := json.Marshal(infoErrorMessage)
-				if e := mq.SendMessage(delivered.CorrelationId, conf.Broker.Exchange, conf.Broker.RoutingError, conf.Broker.Durable, body); e != nil {
-					log.Errorf("failed so publish message, reason: %v", err)
-				}
-
-				if err := delivered.Ack(false); err != nil {
-					log.Errorf("Failed acking canceled work, reason: %v", err)
-				}
-
-				continue
-			}
-			if status == "disabled" {
-				log.Infof("file with correlation ID: %s is disabled, stopping verification", delivered.CorrelationId)
-				if err := delivered.Ack(false); err != nil {
-					log.Errorf("Failed acking canceled work, reason: %v", err)
-				}
+				message.ReVerify,
+				e)
 
-				continue
-			}
+		}
+		// store full message info in case we want to fix the db entry and retry
+		infoErrorMessage := broker.InfoError{
+			Error:           "Getheader failed",
+			Reason:          err.Error(),
+			OriginalMessage: message,
+		}
 
-			header, err := db.GetHeader(message.FileID)
-			if err != nil {
-				log.Errorf("GetHeader failed "+
-					"(corr-id: %s, user: %s, filepath: %s, fileid: %s, archivepath: %s, encryptedchecksums: %v, reverify: %t, reason: %v)",
-					delivered.CorrelationId,
-					message.User,
-					message.FilePath,
-					message.FileID,
-					message.ArchivePath,
-					message.EncryptedChecksums,
-					message.ReVerify,
-					err)
-
-				// Nack message so the server gets notified that something is wrong but don't requeue the message
-				if e := delivered.Nack(false, false); e != nil {
-					log.Errorf("Failed to nack following getheader error message "+
-						"(corr-id: %s, user: %s, filepath: %s, fileid: %s, archivepath: %s, encryptedchecksums: %v, reverify: %t, reason: %v)",
-						delivered.CorrelationId,
-						message.User,
-						message.FilePath,
-						message.FileID,
-						message.ArchivePath,
-						message.EncryptedChecksums,
-						message.ReVerify,
-						e)
-
-				}
-				// store full message info in case we want to fix the db entry and retry
-				infoErrorMessage := broker.InfoError{
-					Error:           "Getheader failed",
-					Reason:          err.Error(),
-					OriginalMessage: message,
-				}
-
-				body, _ := json.Marshal(infoErrorMessage)
-
-				// Send the message to an error queue so it can be analyzed.
-				if e := mq.SendMessage(delivered.CorrelationId, conf.Broker.Exchange, conf.Broker.RoutingError, conf.Broker.Durable, body); e != nil {
-					log.Errorf("Failed to publish getheader error message "+
-						"(corr-id: %s, user: %s, filepath: %s, fileid: %s, archivepath: %s, encryptedchecksums: %v, reverify: %t, reason: %v)",
-						delivered.CorrelationId,
-						message.User,
-						message.FilePath,
-						message.FileID,
-						message.ArchivePath,
-						message.EncryptedChecksums,
-						message.ReVerify,
-						e)
-				}
-
-				continue
-			}
+		body, _ := json.Marshal(infoErrorMessage)
 
-			var file database.FileInfo
+		// Send the message to an error queue so it can be analyzed.
+		if e := w.mq.SendMessage(delivered.CorrelationId, w.conf.Broker.Exchange, w.conf.Broker.RoutingError, w.conf.Broker.Durable, body); e != nil {
+			log.Errorf("Failed to publish getheader error message "+
+				"(corr-id: %s, user: %s, filepath: %s, fileid: %s, archivepath: %s, encryptedchecksums: %v, reverify: %t, reason: %v)",
+				delivered.CorrelationId,
+				message.User,
+				message.FilePath,
+				message.FileID,
+				message.ArchivePath,
+				message.EncryptedChecksums,
+				message.ReVerify,
+				e)
+		}
 
-			file.Size, err = archive.GetFileSize(message.ArchivePath)
+		return
+	}
 
-			if err != nil {
-				log.Errorf("Failed to get archived file size "+
-					"(corr-id: %s, user: %s, filepath: %s, fileid: %s, archivepath: %s, encryptedchecksums: %v, reverify: %t, reason: %v)",
-					delivered.CorrelationId,
-					message.User,
-					message.FilePath,
-					message.FileID,
-					message.ArchivePath,
-					message.EncryptedChecksums,
-					message.ReVerify,
-					err)
+	var file database.FileInfo
 
-				continue
-			}
+	file.Size, err = w.archive.GetFileSize(message.ArchivePath)
+
+	if err != nil {
+		log.Errorf("Failed to get archived file size "+
+			"(corr-id: %s, user: %s, filepath: %s, fileid: %s, archivepath: %s, encryptedchecksums: %v, reverify: %t, reason: %v)",
+			delivered.CorrelationId,
+			message.User,
+			message.FilePath,
+			message.FileID,
+			message.ArchivePath,
+			message.EncryptedChecksums,
+			message.ReVerify,
+			err)
+
+		return
+	}
+
+	log.Infof("Got archived file size "+
+		"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, encryptedchecksums: %v, reverify: %t, archivedsize: %d)",
+		delivered.CorrelationId,
+		message.User,
+		message.FilePath,
+		message.ArchivePath,
+		message.EncryptedChecksums,
+		message.ReVerify,
+		file.Size)
+
+	archiveFileHash := sha256.New()
+
+	f, err := w.archive.NewFileReader(message.ArchivePath)
+	if err != nil {
+		log.Errorf("Failed to open archived file "+
+			"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, encryptedchecksums: %v, reverify: %t, reason: %v)",
+			delivered.CorrelationId,
+			message.User,
+			message.FilePath,
+			message.ArchivePath,
+			message.EncryptedChecksums,
+			message.ReVerify,
+			err)
+
+		// Send the message to an error queue so it can be analyzed.
+		infoErrorMessage := broker.InfoError{
+			Error:           "Failed to open archived file",
+			Reason:          err.Error(),
+			OriginalMessage: message,
+		}
 
-			log.Infof("Got archived file size "+
-				"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, encryptedchecksums: %v, reverify: %t, archivedsize: %d)",
+		body, _ := json.Marshal(infoErrorMessage)
+		if e := w.mq.SendMessage(delivered.CorrelationId, w.conf.Broker.Exchange, w.conf.Broker.RoutingError, w.conf.Broker.Durable, body); e != nil {
+
+			log.Errorf("Failed to publish file open error message "+
+				"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, encryptedchecksums: %v, reverify: %t, reason: %v)",
 				delivered.CorrelationId,
 				message.User,
 				message.FilePath,
 				message.ArchivePath,
 				message.EncryptedChecksums,
 				message.ReVerify,
-				file.Size)
+				e)
 
-			archiveFileHash := sha256.New()
+		}
 
-			f, err := archive.NewFileReader(message.ArchivePath)
-			if err != nil {
-				log.Errorf("Failed to open archived file "+
-					"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, encryptedchecksums: %v, reverify: %t, reason: %v)",
-					delivered.CorrelationId,
-					message.User,
-					message.FilePath,
-					message.ArchivePath,
-					message.EncryptedChecksums,
-					message.ReVerify,
-					err)
-
-				// Send the message to an error queue so it can be analyzed.
-				infoErrorMessage := broker.InfoError{
-					Error:           "Failed to open archived file",
-					Reason:          err.Error(),
-					OriginalMessage: message,
-				}
-
-				body, _ := json.Marshal(infoErrorMessage)
-				if e := mq.SendMessage(delivered.CorrelationId, conf.Broker.Exchange, conf.Broker.RoutingError, conf.Broker.Durable, body); e != nil {
-
-					log.Errorf("Failed to publish file open error message "+
-						"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, encryptedchecksums: %v, reverify: %t, reason: %v)",
-						delivered.CorrelationId,
-						message.User,
-						message.FilePath,
-						message.ArchivePath,
-						message.EncryptedChecksums,
-						message.ReVerify,
-						e)
-
-				}
-
-				// Restart on new message
-				continue
+		// Restart on new message
+		return
+	}
+
+	key, err := config.FindC4GHKey(w.keyring, header)
+	if err != nil {
+		log.Errorf("Failed to decrypt header with any key in the keyring "+
+			"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, encryptedchecksums: %v, reverify: %t, reason: %v)",
+			delivered.CorrelationId,
+			message.User,
+			message.FilePath,
+			message.ArchivePath,
+			message.EncryptedChecksums,
+			message.ReVerify,
+			err)
+
+		// Send the message to an error queue so it can be analyzed.
+		infoErrorMessage := broker.InfoError{
+			Error:           "Failed to decrypt header",
+			Reason:          err.Error(),
+			OriginalMessage: message,
+		}
+
+		body, _ := json.Marshal(infoErrorMessage)
+		if e := w.mq.SendMessage(delivered.CorrelationId, w.conf.Broker.Exchange, w.conf.Broker.RoutingError, w.conf.Broker.Durable, body); e != nil {
+			log.Errorf("Failed to publish error message: %v", e)
+		}
+
+		return
+	}
+
+	hr := bytes.NewReader(header)
+	// Feed everything read from the archive file to archiveFileHash
+	archived := &errReader{r: f}
+	mr := io.MultiReader(hr, io.TeeReader(archived, archiveFileHash))
+
+	c4ghr, err := streaming.NewCrypt4GHReader(mr, key.PrivateKey, nil)
+	if err != nil {
+		log.Errorf("Failed to open c4gh decryptor stream "+
+			"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, encryptedchecksums: %v, reverify: %t, reason: %v)",
+			delivered.CorrelationId,
+			message.User,
+			message.FilePath,
+			message.ArchivePath,
+			message.EncryptedChecksums,
+			message.ReVerify,
+			err)
+
+		return
+	}
+
+	md5hash := md5.New() // #nosec
+	sha256hash := sha256.New()
+	// The algorithms are checked when the configuration is read
+	digests, _ := database.NewDigests(w.conf.ChecksumAlgorithms...)
+
+	if file.DecryptedSize, err = io.Copy(io.MultiWriter(sha256hash, md5hash, digests.Writer()), c4ghr); err != nil {
+		log.Errorf("Failed to copy decrypted data to hash stream "+
+			"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, encryptedchecksums: %v, reverify: %t, reason: %v)",
+			delivered.CorrelationId,
+			message.User,
+			message.FilePath,
+			message.ArchivePath,
+			message.EncryptedChecksums,
+			message.ReVerify,
+			err)
+
+		// Send the message to an error queue so it can be analyzed.
+		infoErrorMessage := broker.InfoError{
+			Error:           "Failed to verify archived file",
+			Reason:          err.Error(),
+			OriginalMessage: message,
+		}
+
+		body, _ := json.Marshal(infoErrorMessage)
+		if e := w.mq.SendMessage(delivered.CorrelationId, w.conf.Broker.Exchange, w.conf.Broker.RoutingError, w.conf.Broker.Durable, body); e != nil {
+			log.Errorf("Failed to publish error message: %v", e)
+		}
+
+		// The submitter is told if the file could be read but not
+		// decrypted, unless it is an already ingested file that is
+		// verified again
+		if archived.err == nil && !message.ReVerify {
+			userError := &broker.UserError{Code: broker.UserErrorCorruptFile, Reason: "The file could not be decrypted, it is not a valid crypt4gh file", Err: err}
+			if e := w.mq.SendUserError(&delivered, message.User, message.FilePath, userError); e != nil {
+				log.Errorf("Failed to publish user error message: %v", e)
 			}
+		}
 
-			hr := bytes.NewReader(header)
-			// Feed everything read from the archive file to archiveFileHash
-			mr := io.MultiReader(hr, io.TeeReader(f, archiveFileHash))
+		if err := delivered.Ack(false); err != nil {
+			log.Errorf("Failed to ack message: %v", err)
+		}
 
-			c4ghr, err := streaming.NewCrypt4GHReader(mr, *key, nil)
-			if err != nil {
-				log.Errorf("Failed to open c4gh decryptor stream "+
-					"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, encryptedchecksums: %v, reverify: %t, reason: %v)",
-					delivered.CorrelationId,
-					message.User,
-					message.FilePath,
-					message.ArchivePath,
-					message.EncryptedChecksums,
-					message.ReVerify,
-					err)
+		return
+	}
+
+	file.Checksum = archiveFileHash
+	file.DecryptedChecksum = sha256hash
+	file.DecryptedDigests = digests
+
+	log.Infof("Calculated decrypted hash "+
+		"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, "+
+		"encryptedchecksums: %v, reverify: %t, decryptedsize: %d, "+
+		"decryptedchecksum: %x)",
+		delivered.CorrelationId,
+		message.User,
+		message.FilePath,
+		message.ArchivePath,
+		message.EncryptedChecksums,
+		message.ReVerify,
+		file.DecryptedSize,
+		file.DecryptedChecksum.Sum(nil))
+	metrics.FileProcessed(file.Size)
+
+	// Record which key decrypted the file, so key rotation can be tracked
+	if w.recordKeyHash {
+		if err := w.db.SetKeyHash(key.KeyHash, message.FileID); err != nil {
+			log.Errorf("SetKeyHash failed "+
+				"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, encryptedchecksums: %v, reverify: %t, reason: %v)",
+				delivered.CorrelationId,
+				message.User,
+				message.FilePath,
+				message.ArchivePath,
+				message.EncryptedChecksums,
+				message.ReVerify,
+				err)
+		}
+	}
+
+	//nolint:nestif
+	if !message.ReVerify {
+
+		c := verified{
+			User:     message.User,
+			FilePath: message.FilePath,
+			DecryptedChecksums: []checksums{
+				{"sha256", fmt.Sprintf("%x", sha256hash.Sum(nil))},
+				{"md5", fmt.Sprintf("%x", md5hash.Sum(nil))},
+			},
+		}
+		for _, name := range digests.Names() {
+			c.DecryptedChecksums = append(c.DecryptedChecksums, checksums{name, digests.Hex(name)})
+		}
+
+		verifiedMessage, _ := json.Marshal(&c)
+
+		err = w.mq.ValidateJSON(&delivered,
+			"ingestion-accession-request",
+			verifiedMessage,
+			new(verified))
+
+		if err != nil {
+			log.Errorf("Validation (ingestion-accession-request) of outgoing message failed "+
+				"(corr-id: %s, error: %v, message: %s)",
+				delivered.CorrelationId,
+				err,
+				verifiedMessage)
 
-				continue
+			// Logging is in ValidateJSON so just restart on new message
+			return
+		}
+		status, err := w.db.GetFileStatus(delivered.CorrelationId)
+		if err != nil {
+			log.Errorf("failed to get file status, reason: %v", err.Error())
+			// Send the message to an error queue so it can be analyzed.
+			infoErrorMessage := broker.InfoError{
+				Error:           "Getheader failed",
+				Reason:          err.Error(),
+				OriginalMessage: message,
 			}
 
-			md5hash := md5.New() // #nosec
-			sha256hash := sha256.New()
+			body, _ := json.Marshal(infoErrorMessage)
+			if e := w.mq.SendMessage(delivered.CorrelationId, w.conf.Broker.Exchange, w.conf.Broker.RoutingError, w.conf.Broker.Durable, body); e != nil {
+				log.Errorf("failed so publish message, reason: %v", err)
+			}
 
-			stream := io.TeeReader(c4ghr, md5hash)
+			if err := delivered.Ack(false); err != nil {
+				log.Errorf("Failed acking canceled work, reason: %v", err)
+			}
 
-			if file.DecryptedSize, err = io.Copy(sha256hash, stream); err != nil {
-				log.Errorf("Failed to copy decrypted data to hash stream "+
-					"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, encryptedchecksums: %v, reverify: %t, reason: %v)",
-					delivered.CorrelationId,
-					message.User,
-					message.FilePath,
-					message.ArchivePath,
-					message.EncryptedChecksums,
-					message.ReVerify,
-					err)
-
-				// Send the message to an error queue so it can be analyzed.
-				infoErrorMessage := broker.InfoError{
-					Error:           "Failed to verify archived file",
-					Reason:          err.Error(),
-					OriginalMessage: message,
-				}
-
-				body, _ := json.Marshal(infoErrorMessage)
-				if e := mq.SendMessage(delivered.CorrelationId, conf.Broker.Exchange, conf.Broker.RoutingError, conf.Broker.Durable, body); e != nil {
-					log.Errorf("Failed to publish error message: %v", e)
-				}
-
-				if err := delivered.Ack(false); err != nil {
-					log.Errorf("Failed to ack message: %v", err)
-				}
-
-				continue
+			return
+		}
+		if status == "disabled" {
+			log.Infof("file with correlation ID: %s is disabled, stopping verification", delivered.CorrelationId)
+			if err := delivered.Ack(false); err != nil {
+				log.Errorf("Failed acking canceled work, reason: %v", err)
 			}
 
-			file.Checksum = archiveFileHash
-			file.DecryptedChecksum = sha256hash
+			return
+		}
 
-			log.Infof("Calculated decrypted hash "+
-				"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, "+
-				"encryptedchecksums: %v, reverify: %t, decryptedsize: %d, "+
-				"decryptedchecksum: %x)",
+		// Mark file as "COMPLETED"
+		if e := w.db.MarkCompleted(file, message.FileID, delivered.CorrelationId); e != nil {
+			log.Errorf("MarkCompleted failed "+
+				"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, encryptedchecksums: %v, reverify: %t, reason: %v)",
 				delivered.CorrelationId,
 				message.User,
 				message.FilePath,
 				message.ArchivePath,
 				message.EncryptedChecksums,
 				message.ReVerify,
-				file.DecryptedSize,
-				file.DecryptedChecksum.Sum(nil))
-
-			//nolint:nestif
-			if !message.ReVerify {
-
-				c := verified{
-					User:     message.User,
-					FilePath: message.FilePath,
-					DecryptedChecksums: []checksums{
-						{"sha256", fmt.Sprintf("%x", sha256hash.Sum(nil))},
-						{"md5", fmt.Sprintf("%x", md5hash.Sum(nil))},
-					},
-				}
-
-				verifiedMessage, _ := json.Marshal(&c)
-
-				err = mq.ValidateJSON(&delivered,
-					"ingestion-accession-request",
-					verifiedMessage,
-					new(verified))
-
-				if err != nil {
-					log.Errorf("Validation (ingestion-accession-request) of outgoing message failed "+
-						"(corr-id: %s, error: %v, message: %s)",
-						delivered.CorrelationId,
-						err,
-						verifiedMessage)
-
-					// Logging is in ValidateJSON so just restart on new message
-					continue
-				}
-				status, err := db.GetFileStatus(delivered.CorrelationId)
-				if err != nil {
-					log.Errorf("failed to get file status, reason: %v", err.Error())
-					// Send the message to an error queue so it can be analyzed.
-					infoErrorMessage := broker.InfoError{
-						Error:           "Getheader failed",
-						Reason:          err.Error(),
-						OriginalMessage: message,
-					}
-
-					body, _ := json.Marshal(infoErrorMessage)
-					if e := mq.SendMessage(delivered.CorrelationId, conf.Broker.Exchange, conf.Broker.RoutingError, conf.Broker.Durable, body); e != nil {
-						log.Errorf("failed so publish message, reason: %v", err)
-					}
-
-					if err := delivered.Ack(false); err != nil {
-						log.Errorf("Failed acking canceled work, reason: %v", err)
-					}
-
-					continue
-				}
-				if status == "disabled" {
-					log.Infof("file with correlation ID: %s is disabled, stopping verification", delivered.CorrelationId)
-					if err := delivered.Ack(false); err != nil {
-						log.Errorf("Failed acking canceled work, reason: %v", err)
-					}
-
-					continue
-				}
-
-				// Mark file as "COMPLETED"
-				if e := db.MarkCompleted(file, message.FileID, delivered.CorrelationId); e != nil {
-					log.Errorf("MarkCompleted failed "+
-						"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, encryptedchecksums: %v, reverify: %t, reason: %v)",
-						delivered.CorrelationId,
-						message.User,
-						message.FilePath,
-						message.ArchivePath,
-						message.EncryptedChecksums,
-						message.ReVerify,
-						e)
-
-					continue
-					// this should really be hadled by the DB retry mechanism
-				}
-
-				log.Infof("File marked completed "+
-					"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, encryptedchecksums: %v, reverify: %t, decryptedchecksum: %x)",
+				e)
+
+			return
+			// this should really be hadled by the DB retry mechanism
+		}
+
+		log.Infof("File marked completed "+
+			"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, encryptedchecksums: %v, reverify: %t, decryptedchecksum: %x)",
+			delivered.CorrelationId,
+			message.User,
+			message.FilePath,
+			message.ArchivePath,
+			message.EncryptedChecksums,
+			message.ReVerify,
+			file.DecryptedChecksum.Sum(nil))
+
+		// Send message to verified queue
+
+		if err := w.mq.SendMessage(delivered.CorrelationId,
+			w.conf.Broker.Exchange,
+			w.conf.Broker.RoutingKey,
+			w.conf.Broker.Durable,
+			verifiedMessage); err != nil {
+			log.Errorf("Sending of message failed "+
+				"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, encryptedchecksums: %v, reverify: %t, reason: %v)",
+				delivered.CorrelationId,
+				message.User,
+				message.FilePath,
+				message.ArchivePath,
+				message.EncryptedChecksums,
+				message.ReVerify,
+				err)
+
+			if e := w.mq.Retry(&delivered, "Sending of message failed", err.Error()); e != nil {
+				log.Errorf("Failed to retry message "+
+					"(corr-id: %s, user: %s, filepath: %s, reason: %v)",
 					delivered.CorrelationId,
 					message.User,
 					message.FilePath,
-					message.ArchivePath,
-					message.EncryptedChecksums,
-					message.ReVerify,
-					file.DecryptedChecksum.Sum(nil))
-
-				// Send message to verified queue
-
-				if err := mq.SendMessage(delivered.CorrelationId,
-					conf.Broker.Exchange,
-					conf.Broker.RoutingKey,
-					conf.Broker.Durable,
-					verifiedMessage); err != nil {
-					// TODO fix resend mechanism
-
-					log.Errorf("Sending of message failed "+
-						"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, encryptedchecksums: %v, reverify: %t, reason: %v)",
-						delivered.CorrelationId,
-						message.User,
-						message.FilePath,
-						message.ArchivePath,
-						message.EncryptedChecksums,
-						message.ReVerify,
-						err)
-
-					continue
-				}
-
-				if err := delivered.Ack(false); err != nil {
-					log.Errorf("Failed acking completed work"+
-						"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, encryptedchecksums: %v, reverify: %t, reason: %v)",
-						delivered.CorrelationId,
-						message.User,
-						message.FilePath,
-						message.ArchivePath,
-						message.EncryptedChecksums,
-						message.ReVerify,
-						err)
-				}
+					e)
 			}
+
+			return
 		}
-	}()
 
-	<-forever
+		if err := delivered.Ack(false); err != nil {
+			log.Errorf("Failed acking completed work"+
+				"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, encryptedchecksums: %v, reverify: %t, reason: %v)",
+				delivered.CorrelationId,
+				message.User,
+				message.FilePath,
+				message.ArchivePath,
+				message.EncryptedChecksums,
+				message.ReVerify,
+				err)
+		}
+	}
+}
+
+// errReader keeps the first error other than io.EOF that reading from r
+// failed with, so that errors reading a file can be told apart from errors
+// in what was read
+type errReader struct {
+	r   io.Reader
+	err error
+}
+
+func (e *errReader) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if err != nil && err != io.EOF && e.err == nil {
+		e.err = err
+	}
+
+	return n, err
 }
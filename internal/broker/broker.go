@@ -6,8 +6,15 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"sda-pipeline/internal/metrics"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/xeipuuv/gojsonschema"
@@ -25,16 +32,54 @@ type AMQPChannel interface {
 	NotifyClose(c chan *amqp.Error) chan *amqp.Error
 	NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation
 	Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+	Cancel(consumer string, noWait bool) error
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	QueueDeclarePassive(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
 	Close() error
 	IsClosed() bool
 }
 
-// AMQPBroker is a Broker that reads messages from an AMQP broker
+// AMQPBroker is a Broker that reads messages from an AMQP broker. When the
+// connection or the channel is lost it reconnects, and consumers started
+// by GetMessages continue on the new channel.
 type AMQPBroker struct {
 	Connection   *amqp.Connection
 	Channel      AMQPChannel
 	Conf         MQConf
 	confirmsChan <-chan amqp.Confirmation
+	consumers    consumers
+
+	// publishing makes publishers wait for each other, so that each of
+	// them reads the confirmation of its own message
+	publishing sync.Mutex
+
+	// mu guards the connection, the channel and confirmsChan, which are
+	// replaced on reconnection, and password
+	mu sync.RWMutex
+	// password replaces Conf.Password when reconnecting, once it is set by
+	// UpdatePassword
+	password string
+	// connected is closed while the broker is connected, and replaced
+	// while reconnecting
+	connected chan struct{}
+	// closed is closed by Close, and failed when reconnecting is given up
+	// with the error the connection was lost with in failErr
+	closed    chan struct{}
+	closeOnce sync.Once
+	failed    chan struct{}
+	failErr   *amqp.Error
+}
+
+// consumers keeps track of the consumers started by GetMessages and the
+// messages they have delivered that are not yet acked or nacked, so that
+// consuming can be stopped gracefully
+type consumers struct {
+	sync.Mutex
+	tags     []string
+	queues   map[string]string // the queue consumed by each tag
+	stop     chan struct{}
+	stopped  bool
+	inFlight sync.WaitGroup
 }
 
 // MQConf stores information about the message broker
@@ -48,6 +93,7 @@ type MQConf struct {
 	Exchange           string
 	RoutingKey         string
 	RoutingError       string
+	RoutingUserError   string
 	Ssl                bool
 	InsecureSkipVerify bool
 	VerifyPeer         bool
@@ -58,6 +104,11 @@ type MQConf struct {
 	Durable            bool
 	SchemasPath        string
 	PrefetchCount      int
+	ShutdownTimeout    time.Duration
+	ReconnectTimeout   time.Duration
+	Workers            int
+	RetryMax           int
+	RetryDelays        []time.Duration
 }
 
 // InfoError struct for sending detailed error messages to analysis.
@@ -69,33 +120,63 @@ type InfoError struct {
 	OriginalMessage interface{} `json:"original-message"`
 }
 
+// maxReconnectDelay is the longest time between attempts to reconnect
+const maxReconnectDelay = time.Minute
+
 // NewMQ creates a new Broker that can communicate with a backend
 // amqp server.
 func NewMQ(config MQConf) (*AMQPBroker, error) {
-	brokerURI := buildMQURI(config.Host, config.User, config.Password, config.Vhost, config.Port, config.Ssl)
+	connection, err := dial(config)
+	if err != nil {
+		return nil, err
+	}
+
+	channel, confirms, err := openChannel(connection, config)
+	if err != nil {
+		connection.Close()
 
-	var Connection *amqp.Connection
-	var Channel *amqp.Channel
-	var err error
+		return nil, err
+	}
+
+	connected := make(chan struct{})
+	close(connected)
+	broker := &AMQPBroker{
+		Connection:   connection,
+		Channel:      channel,
+		Conf:         config,
+		confirmsChan: confirms,
+		connected:    connected,
+		closed:       make(chan struct{}),
+		failed:       make(chan struct{}),
+	}
+	go broker.watch()
+
+	return broker, nil
+}
+
+// dial connects to the broker
+func dial(config MQConf) (*amqp.Connection, error) {
+	brokerURI := buildMQURI(config.Host, config.User, config.Password, config.Vhost, config.Port, config.Ssl)
 
 	log.Debugf("Connecting to broker host: %s:%d vhost: %s with user: %s", config.Host, config.Port, config.Vhost, config.User)
 	if config.Ssl {
-		var tlsConfig *tls.Config
-		tlsConfig, err = TLSConfigBroker(config)
+		tlsConfig, err := TLSConfigBroker(config)
 		if err != nil {
 			return nil, err
 		}
-		Connection, err = amqp.DialTLS(brokerURI, tlsConfig)
-	} else {
-		Connection, err = amqp.Dial(brokerURI)
-	}
-	if err != nil {
-		return nil, err
+
+		return amqp.DialTLS(brokerURI, tlsConfig)
 	}
 
-	Channel, err = Connection.Channel()
+	return amqp.Dial(brokerURI)
+}
+
+// openChannel opens a channel on the connection in confirm mode, with the
+// configured prefetch count, and returns it with its publish confirmations
+func openChannel(connection *amqp.Connection, config MQConf) (*amqp.Channel, <-chan amqp.Confirmation, error) {
+	Channel, err := connection.Channel()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	if config.Queue != "" {
 		// The queues already exists so we can safely do a passive declaration
@@ -108,14 +189,12 @@ func NewMQ(config MQConf) (*AMQPBroker, error) {
 			nil,          // arguments
 		)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 	}
 
 	if e := Channel.Confirm(false); e != nil {
-		fmt.Printf("channel could not be put into confirm mode: %s", e)
-
-		return nil, fmt.Errorf("channel could not be put into confirm mode: %s", e)
+		return nil, nil, fmt.Errorf("channel could not be put into confirm mode: %s", e)
 	}
 
 	// limit the number of messages retrieved from the queue
@@ -123,18 +202,262 @@ func NewMQ(config MQConf) (*AMQPBroker, error) {
 		log.Errorf("failed to set Channel QoS to %d, reason: %v", config.PrefetchCount, err)
 	}
 
-	confirms := Channel.NotifyPublish(make(chan amqp.Confirmation, 1))
+	return Channel, Channel.NotifyPublish(make(chan amqp.Confirmation, 1)), nil
+}
+
+// watch reconnects to the broker when the connection or the channel is
+// lost, until the broker is closed or gives up reconnecting
+func (broker *AMQPBroker) watch() {
+	for {
+		broker.mu.RLock()
+		connectionClosed := broker.Connection.NotifyClose(make(chan *amqp.Error, 1))
+		channelClosed := broker.Channel.NotifyClose(make(chan *amqp.Error, 1))
+		broker.mu.RUnlock()
+
+		var reason *amqp.Error
+		select {
+		case reason = <-connectionClosed:
+		case reason = <-channelClosed:
+		case <-broker.closed:
+			return
+		}
+
+		select {
+		case <-broker.closed:
+			return
+		default:
+		}
+
+		if !broker.reconnect(reason) {
+			return
+		}
+	}
+}
+
+// reconnect reopens the channel, and the connection if it is lost too,
+// retrying with increasing delays. It returns false if the broker is
+// closed, or if it gives up after Conf.ReconnectTimeout.
+func (broker *AMQPBroker) reconnect(reason *amqp.Error) bool {
+	log.Errorf("Lost connection to broker, reconnecting, reason: %v", reason)
+
+	broker.mu.Lock()
+	broker.connected = make(chan struct{})
+	connection := broker.Connection
+	broker.mu.Unlock()
+
+	start := time.Now()
+	delay := time.Second
+	for {
+		var err error
+		config := broker.connectionConf()
+		if connection == nil || connection.IsClosed() {
+			connection, err = dial(config)
+		}
+
+		var channel *amqp.Channel
+		var confirms <-chan amqp.Confirmation
+		if err == nil {
+			channel, confirms, err = openChannel(connection, config)
+		}
+
+		if err == nil {
+			broker.mu.Lock()
+			defer broker.mu.Unlock()
+
+			select {
+			case <-broker.closed:
+				connection.Close()
+
+				return false
+			default:
+			}
+
+			broker.Connection, broker.Channel, broker.confirmsChan = connection, channel, confirms
+			close(broker.connected)
+			log.Info("Reconnected to broker")
+
+			return true
+		}
+
+		if broker.Conf.ReconnectTimeout > 0 && time.Since(start)+delay > broker.Conf.ReconnectTimeout {
+			log.Errorf("Giving up reconnecting to broker after %v, reason: %v", time.Since(start).Round(time.Second), err)
+			broker.failErr = reason
+			close(broker.failed)
+
+			return false
+		}
+
+		log.Errorf("Failed to reconnect to broker, retrying in %v, reason: %v", delay, err)
+		select {
+		case <-broker.closed:
+			return false
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+	}
+}
+
+// UpdatePassword sets the password used the next time the broker
+// reconnects, such as when the secret it is read from has changed. The
+// current connection is kept.
+func (broker *AMQPBroker) UpdatePassword(password string) {
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
 
-	return &AMQPBroker{Connection, Channel, config, confirms}, nil
+	broker.password = password
+}
+
+// connectionConf returns the configuration to reconnect with
+func (broker *AMQPBroker) connectionConf() MQConf {
+	broker.mu.RLock()
+	defer broker.mu.RUnlock()
+
+	config := broker.Conf
+	if broker.password != "" {
+		config.Password = broker.password
+	}
+
+	return config
+}
+
+// waitForConnection waits until the broker is connected. It returns false
+// if the broker is closed or gives up reconnecting first.
+func (broker *AMQPBroker) waitForConnection() bool {
+	broker.mu.RLock()
+	connected := broker.connected
+	broker.mu.RUnlock()
+
+	if connected == nil {
+		return false
+	}
+
+	select {
+	case <-connected:
+		return true
+	case <-broker.closed:
+		return false
+	case <-broker.failed:
+		return false
+	}
 }
 
-// GetMessages reads messages from the queue
+// current returns the channel to the broker and its publish confirmations
+func (broker *AMQPBroker) current() (AMQPChannel, <-chan amqp.Confirmation) {
+	broker.mu.RLock()
+	defer broker.mu.RUnlock()
+
+	return broker.Channel, broker.confirmsChan
+}
+
+// IsConnected reports whether the connection and the channel to the broker
+// are open
+func (broker *AMQPBroker) IsConnected() bool {
+	broker.mu.RLock()
+	defer broker.mu.RUnlock()
+
+	return broker.Connection != nil && !broker.Connection.IsClosed() &&
+		broker.Channel != nil && !broker.Channel.IsClosed()
+}
+
+// Close closes the channel and the connection to the broker, and stops
+// reconnecting
+func (broker *AMQPBroker) Close() {
+	broker.mu.Lock()
+	broker.closeOnce.Do(func() {
+		if broker.closed != nil {
+			close(broker.closed)
+		}
+	})
+	channel, connection := broker.Channel, broker.Connection
+	broker.mu.Unlock()
+
+	if channel != nil {
+		_ = channel.Close()
+	}
+	if connection != nil {
+		_ = connection.Close()
+	}
+}
+
+// GetMessages reads messages from the queue. Acks, nacks and rejects of
+// the messages are counted in the metrics. When the broker reconnects the
+// queue is consumed again on the new channel, and the messages keep coming
+// on the returned channel. It is closed when consuming is stopped by
+// StopConsuming, or when the broker is closed or gives up reconnecting.
 func (broker *AMQPBroker) GetMessages(queue string) (<-chan amqp.Delivery, error) {
-	ch := broker.Channel
+	broker.consumers.Lock()
+	defer broker.consumers.Unlock()
+	if broker.consumers.stopped {
+		return nil, errors.New("consuming has been stopped")
+	}
+	if broker.consumers.stop == nil {
+		broker.consumers.stop = make(chan struct{})
+	}
+	tag := fmt.Sprintf("%s-%d", queue, len(broker.consumers.tags))
+
+	deliveries, err := broker.consume(queue, tag)
+	if err != nil {
+		return nil, err
+	}
+	broker.consumers.tags = append(broker.consumers.tags, tag)
+	if broker.consumers.queues == nil {
+		broker.consumers.queues = map[string]string{}
+	}
+	broker.consumers.queues[tag] = queue
+
+	stop := broker.consumers.stop
+	messages := make(chan amqp.Delivery)
+	go func() {
+		defer close(messages)
+		for {
+			if !broker.forward(deliveries, messages, stop) {
+				return
+			}
+
+			// The deliveries end when the channel is lost, consume again
+			// once the broker has reconnected
+			for {
+				if !broker.waitForConnection() {
+					return
+				}
+
+				broker.consumers.Lock()
+				stopped := broker.consumers.stopped
+				if !stopped {
+					deliveries, err = broker.consume(queue, tag)
+				}
+				broker.consumers.Unlock()
+				if stopped {
+					return
+				}
+				if err == nil {
+					log.Infof("Consuming %s again after reconnecting", queue)
+
+					break
+				}
+
+				log.Errorf("Failed to consume %s after reconnecting, reason: %v", queue, err)
+				select {
+				case <-stop:
+					return
+				case <-time.After(time.Second):
+				}
+			}
+		}
+	}()
+
+	return messages, nil
+}
+
+// consume starts a consumer for the queue on the current channel
+func (broker *AMQPBroker) consume(queue, tag string) (<-chan amqp.Delivery, error) {
+	ch, _ := broker.current()
 
 	return ch.Consume(
 		queue, // queue
-		"",    // consumer
+		tag,   // consumer
 		false, // auto-ack
 		false, // exclusive
 		false, // no-local
@@ -143,29 +466,217 @@ func (broker *AMQPBroker) GetMessages(queue string) (<-chan amqp.Delivery, error
 	)
 }
 
-// SendMessage sends a message to RabbitMQ
+// forward hands the deliveries over to messages until they end. It returns
+// false if consuming was stopped.
+func (broker *AMQPBroker) forward(deliveries <-chan amqp.Delivery, messages chan<- amqp.Delivery, stop <-chan struct{}) bool {
+	for d := range deliveries {
+		// Messages that were not handed over before consuming was
+		// stopped are requeued by the server when the channel closes
+		select {
+		case <-stop:
+			return false
+		default:
+		}
+
+		broker.consumers.inFlight.Add(1)
+		d.Acknowledger = &meteredAcknowledger{Acknowledger: d.Acknowledger, delivered: time.Now(), done: broker.consumers.inFlight.Done}
+
+		select {
+		case messages <- d:
+		case <-stop:
+			broker.consumers.inFlight.Done()
+
+			return false
+		}
+	}
+
+	select {
+	case <-stop:
+		return false
+	default:
+		return true
+	}
+}
+
+// QueueLength returns the number of messages in the queue that are ready
+// to be delivered
+func (broker *AMQPBroker) QueueLength(queue string) (int, error) {
+	ch, _ := broker.current()
+	q, err := ch.QueueDeclarePassive(queue, true, false, false, false, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	return q.Messages, nil
+}
+
+// StopConsuming cancels the consumers started by GetMessages and waits up
+// to timeout for the messages they delivered to be acked or nacked.
+func (broker *AMQPBroker) StopConsuming(timeout time.Duration) error {
+	broker.consumers.Lock()
+	if !broker.consumers.stopped {
+		broker.consumers.stopped = true
+		if broker.consumers.stop != nil {
+			close(broker.consumers.stop)
+		}
+		ch, _ := broker.current()
+		for _, tag := range broker.consumers.tags {
+			if err := ch.Cancel(tag, false); err != nil {
+				log.Errorf("Failed to cancel consumer %s, reason: %v", tag, err)
+			}
+		}
+	}
+	broker.consumers.Unlock()
+
+	return broker.waitForMessages(timeout)
+}
+
+// waitForMessages waits up to timeout for the delivered messages to be
+// acked or nacked
+func (broker *AMQPBroker) waitForMessages(timeout time.Duration) error {
+	done := make(chan struct{})
+	go func() {
+		broker.consumers.inFlight.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("messages were still being processed after %v", timeout)
+	}
+}
+
+// WaitForShutdown blocks until a watcher reports on forever that the broker
+// gave up reconnecting, or until the process gets SIGINT or SIGTERM. On a
+// signal it stops consuming and waits for the messages being processed for
+// Conf.ShutdownTimeout. If they are still not done, abort is called, if
+// set, to roll back what is being processed, and it waits as long again.
+func (broker *AMQPBroker) WaitForShutdown(forever <-chan bool, abort func()) {
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigc)
+
+	select {
+	case <-forever:
+		return
+	case sig := <-sigc:
+		log.Infof("Received %v, stopping consumers", sig)
+	}
+
+	err := broker.StopConsuming(broker.Conf.ShutdownTimeout)
+	if err != nil && abort != nil {
+		log.Warnf("%v, aborting", err)
+		abort()
+		err = broker.waitForMessages(broker.Conf.ShutdownTimeout)
+	}
+	if err != nil {
+		log.Warnf("%v, shutting down anyway", err)
+
+		return
+	}
+
+	log.Info("All messages processed, shutting down")
+}
+
+// meteredAcknowledger records in the metrics how a delivered message was
+// handled, and how long it took, and marks it as no longer in flight
+type meteredAcknowledger struct {
+	amqp.Acknowledger
+	delivered time.Time
+	done      func()
+	once      sync.Once
+}
+
+func (a *meteredAcknowledger) Ack(tag uint64, multiple bool) error {
+	err := a.Acknowledger.Ack(tag, multiple)
+	if err == nil {
+		metrics.MessageHandled("acked", a.delivered)
+	}
+	a.once.Do(a.done)
+
+	return err
+}
+
+func (a *meteredAcknowledger) Nack(tag uint64, multiple, requeue bool) error {
+	err := a.Acknowledger.Nack(tag, multiple, requeue)
+	if err == nil {
+		metrics.MessageHandled("nacked", a.delivered)
+	}
+	a.once.Do(a.done)
+
+	return err
+}
+
+func (a *meteredAcknowledger) Reject(tag uint64, requeue bool) error {
+	err := a.Acknowledger.Reject(tag, requeue)
+	if err == nil {
+		metrics.MessageHandled("rejected", a.delivered)
+	}
+	a.once.Do(a.done)
+
+	return err
+}
+
+// SendMessage sends a message to RabbitMQ. If the channel is closed it
+// waits for the broker to reconnect and tries again.
 func (broker *AMQPBroker) SendMessage(corrID, exchange, routingKey string, reliable bool, body []byte) error {
-	err := broker.Channel.Publish(
+	err := broker.publish(exchange, routingKey, amqp.Publishing{
+		Headers:         amqp.Table{},
+		ContentEncoding: "UTF-8",
+		ContentType:     "application/json",
+		DeliveryMode:    amqp.Persistent, // 1=non-persistent, 2=persistent
+		CorrelationId:   corrID,
+		Timestamp:       time.Now(),
+		Priority:        0, // 0-9
+		Body:            body,
+		// a bunch of application/implementation-specific fields
+	})
+	if err != nil {
+		return err
+	}
+
+	if routingKey != "" && routingKey == broker.Conf.RoutingError {
+		metrics.MessageErrored()
+	}
+
+	return nil
+}
+
+// publish publishes a message, and if the channel is closed waits for the
+// broker to reconnect and tries again
+func (broker *AMQPBroker) publish(exchange, routingKey string, msg amqp.Publishing) error {
+	err := broker.sendMessage(exchange, routingKey, msg)
+	if errors.Is(err, amqp.ErrClosed) && broker.waitForConnection() {
+		err = broker.sendMessage(exchange, routingKey, msg)
+	}
+
+	return err
+}
+
+// sendMessage publishes a message on the current channel and waits for the
+// broker to confirm it
+func (broker *AMQPBroker) sendMessage(exchange, routingKey string, msg amqp.Publishing) error {
+	broker.publishing.Lock()
+	defer broker.publishing.Unlock()
+
+	ch, confirms := broker.current()
+	err := ch.Publish(
 		exchange,
 		routingKey,
 		false, // mandatory
 		false, // immediate
-		amqp.Publishing{
-			Headers:         amqp.Table{},
-			ContentEncoding: "UTF-8",
-			ContentType:     "application/json",
-			DeliveryMode:    amqp.Persistent, // 1=non-persistent, 2=persistent
-			CorrelationId:   corrID,
-			Priority:        0, // 0-9
-			Body:            body,
-			// a bunch of application/implementation-specific fields
-		},
+		msg,
 	)
 	if err != nil {
 		return err
 	}
 
-	confirmed := <-broker.confirmsChan
+	confirmed, ok := <-confirms
+	if !ok {
+		return errors.New("channel closed before delivery was confirmed")
+	}
 	if !confirmed.Ack {
 		return fmt.Errorf("failed delivery of delivery tag: %d", confirmed.DeliveryTag)
 	}
@@ -245,17 +756,18 @@ func TLSConfigBroker(config MQConf) (*tls.Config, error) {
 	return &tlsConfig, nil
 }
 
-// ConnectionWatcher listens to events from the server
+// ConnectionWatcher blocks until the broker gives up reconnecting after
+// the connection was lost, and returns the error it was lost with
 func (broker *AMQPBroker) ConnectionWatcher() *amqp.Error {
-	amqpError := <-broker.Connection.NotifyClose(make(chan *amqp.Error))
+	<-broker.failed
 
-	return amqpError
+	return broker.failErr
 }
 
+// ChannelWatcher is the same as ConnectionWatcher, as lost channels are
+// reopened when reconnecting too
 func (broker *AMQPBroker) ChannelWatcher() *amqp.Error {
-	amqpError := <-broker.Channel.NotifyClose(make(chan *amqp.Error))
-
-	return amqpError
+	return broker.ConnectionWatcher()
 }
 
 // SendJSONError sends message on JSON error
@@ -361,6 +873,27 @@ func (broker *AMQPBroker) ValidateJSON(delivered *amqp.Delivery,
 	return err
 }
 
+// ValidateJSONBody validates a message body against the schema of the
+// message type, for messages that are about to be sent rather than ones
+// that have been delivered
+func ValidateJSONBody(schemasPath, messageType string, body []byte) error {
+	res, err := validateJSON(messageType, schemasPath, body)
+	if err != nil {
+		return err
+	}
+
+	if !res.Valid() {
+		errorString := ""
+		for _, validErr := range res.Errors() {
+			errorString += validErr.String() + "\n\n"
+		}
+
+		return fmt.Errorf("Errors while validating JSON %s", errorString)
+	}
+
+	return nil
+}
+
 // validateJSON is a helper function for ValidateJson
 func validateJSON(messageType string, schemasPath string, body []byte) (*gojsonschema.Result, error) {
 
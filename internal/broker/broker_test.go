@@ -8,6 +8,7 @@ import (
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	amqp "github.com/rabbitmq/amqp091-go"
 	log "github.com/sirupsen/logrus"
@@ -33,12 +34,35 @@ type mockChannel struct {
 	failConfirm    bool
 	failPublish    bool
 	confirmChannel chan amqp.Confirmation
+	deliveries     chan amqp.Delivery
+	cancelled      []string
+	declared       map[string]amqp.Table
+	published      []published
+}
+
+// published is a message published on the mock channel
+type published struct {
+	exchange, routingKey string
+	msg                  amqp.Publishing
 }
 
 func (c *mockChannel) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	if c.deliveries != nil {
+		return c.deliveries, nil
+	}
+
 	return nil, fmt.Errorf("error")
 }
 
+func (c *mockChannel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	if c.declared == nil {
+		c.declared = map[string]amqp.Table{}
+	}
+	c.declared[name] = args
+
+	return amqp.Queue{Name: name}, nil
+}
+
 func (c *mockChannel) QueueDeclarePassive(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
 	return amqp.Queue{}, fmt.Errorf("error")
 }
@@ -69,6 +93,7 @@ func (c *mockChannel) Publish(exchange, key string, mandatory, immediate bool, m
 	if c.failPublish {
 		return fmt.Errorf("failPublish")
 	}
+	c.published = append(c.published, published{exchange, key, msg})
 
 	ack := amqp.Confirmation{}
 	ack.DeliveryTag = 1
@@ -78,6 +103,13 @@ func (c *mockChannel) Publish(exchange, key string, mandatory, immediate bool, m
 	return nil
 }
 
+func (c *mockChannel) Cancel(consumer string, noWait bool) error {
+	c.cancelled = append(c.cancelled, consumer)
+	close(c.deliveries)
+
+	return nil
+}
+
 func (*mockChannel) Close() error {
 	return nil
 }
@@ -98,6 +130,158 @@ func TestGetMessages_Error(t *testing.T) {
 	assert.Error(t, err, "Must be an error")
 }
 
+type mockAcknowledger struct {
+	acks, nacks, rejects int
+}
+
+func (a *mockAcknowledger) Ack(tag uint64, multiple bool) error {
+	a.acks++
+
+	return nil
+}
+
+func (a *mockAcknowledger) Nack(tag uint64, multiple, requeue bool) error {
+	a.nacks++
+
+	return nil
+}
+
+func (a *mockAcknowledger) Reject(tag uint64, requeue bool) error {
+	a.rejects++
+
+	return nil
+}
+
+func TestGetMessages(t *testing.T) {
+	b := AMQPBroker{}
+	c := mockChannel{deliveries: make(chan amqp.Delivery, 3)}
+	b.Channel = &c
+
+	ack := &mockAcknowledger{}
+	for i := 0; i < 3; i++ {
+		c.deliveries <- amqp.Delivery{Acknowledger: ack, DeliveryTag: uint64(i), CorrelationId: "corrID"}
+	}
+
+	messages, err := b.GetMessages("queue")
+	assert.NoError(t, err)
+
+	delivered := <-messages
+	assert.Equal(t, "corrID", delivered.CorrelationId)
+	assert.NoError(t, delivered.Ack(false))
+	delivered = <-messages
+	assert.NoError(t, delivered.Nack(false, true))
+	delivered = <-messages
+	assert.NoError(t, delivered.Reject(false))
+	assert.Equal(t, &mockAcknowledger{acks: 1, nacks: 1, rejects: 1}, ack)
+
+	assert.NoError(t, b.StopConsuming(time.Second))
+	_, open := <-messages
+	assert.False(t, open, "messages should be closed when consuming stops")
+}
+
+func TestStopConsuming(t *testing.T) {
+	b := AMQPBroker{}
+	c := mockChannel{deliveries: make(chan amqp.Delivery, 2)}
+	b.Channel = &c
+
+	ack := &mockAcknowledger{}
+	c.deliveries <- amqp.Delivery{Acknowledger: ack, DeliveryTag: 1}
+	c.deliveries <- amqp.Delivery{Acknowledger: ack, DeliveryTag: 2}
+
+	messages, err := b.GetMessages("queue")
+	assert.NoError(t, err)
+	delivered := <-messages
+
+	// The message being processed is not acked in time
+	assert.EqualError(t, b.StopConsuming(10*time.Millisecond), "messages were still being processed after 10ms")
+	assert.Equal(t, []string{"queue-0"}, c.cancelled)
+
+	// The next message is not handed over once consuming has stopped
+	for range messages {
+		t.Error("Got a message after consuming was stopped")
+	}
+
+	assert.NoError(t, delivered.Ack(false))
+	assert.NoError(t, b.StopConsuming(10*time.Millisecond))
+	assert.Equal(t, []string{"queue-0"}, c.cancelled, "consumers should only be cancelled once")
+
+	_, err = b.GetMessages("queue")
+	assert.EqualError(t, err, "consuming has been stopped")
+}
+
+func TestGetMessages_reconnect(t *testing.T) {
+	b := AMQPBroker{connected: make(chan struct{}), closed: make(chan struct{})}
+	c := mockChannel{deliveries: make(chan amqp.Delivery)}
+	b.Channel = &c
+
+	messages, err := b.GetMessages("queue")
+	assert.NoError(t, err)
+
+	// The deliveries end when the channel is lost, and the queue is
+	// consumed again on the new channel once reconnected
+	close(c.deliveries)
+	reopened := mockChannel{deliveries: make(chan amqp.Delivery, 1)}
+	reopened.deliveries <- amqp.Delivery{Acknowledger: &mockAcknowledger{}, CorrelationId: "corrID"}
+	b.mu.Lock()
+	b.Channel = &reopened
+	close(b.connected)
+	b.mu.Unlock()
+
+	delivered := <-messages
+	assert.Equal(t, "corrID", delivered.CorrelationId)
+	assert.NoError(t, delivered.Ack(false))
+
+	b.Close()
+	assert.NoError(t, b.StopConsuming(time.Second))
+	_, open := <-messages
+	assert.False(t, open, "messages should be closed when consuming stops")
+}
+
+func TestReconnect_giveUp(t *testing.T) {
+	conf := tMqconf
+	conf.Ssl = false
+	conf.Port = 42
+	conf.ReconnectTimeout = time.Millisecond
+	b := AMQPBroker{Conf: conf, closed: make(chan struct{}), failed: make(chan struct{})}
+
+	var str bytes.Buffer
+	log.SetOutput(&str)
+
+	reason := &amqp.Error{Code: amqp.ConnectionForced, Reason: "broker restarted"}
+	assert.False(t, b.reconnect(reason))
+	assert.Contains(t, str.String(), "Giving up reconnecting to broker")
+	assert.Equal(t, reason, b.ConnectionWatcher())
+	assert.False(t, b.waitForConnection())
+	assert.False(t, b.IsConnected())
+}
+
+func TestUpdatePassword(t *testing.T) {
+	b := AMQPBroker{Conf: tMqconf}
+	assert.Equal(t, tMqconf.Password, b.connectionConf().Password)
+
+	b.UpdatePassword("refreshed")
+	assert.Equal(t, "refreshed", b.connectionConf().Password)
+	assert.Equal(t, tMqconf.Password, b.Conf.Password)
+}
+
+func TestClose(t *testing.T) {
+	b := AMQPBroker{connected: make(chan struct{}), closed: make(chan struct{})}
+	b.Channel = &mockChannel{}
+
+	b.Close()
+	b.Close()
+	assert.False(t, b.waitForConnection(), "nothing should wait for a closed broker to connect")
+	assert.False(t, b.IsConnected())
+}
+
+func TestQueueLength(t *testing.T) {
+	b := AMQPBroker{}
+	b.Channel = &mockChannel{}
+
+	_, err := b.QueueLength("queue")
+	assert.EqualError(t, err, "error")
+}
+
 func TestSendMessage(t *testing.T) {
 	b := AMQPBroker{}
 	c := mockChannel{}
@@ -127,6 +311,7 @@ var tMqconf = MQConf{
 	"exchange",
 	"routingkey",
 	"routingError",
+	"routingUserError",
 	true,
 	false,
 	true,
@@ -137,6 +322,11 @@ var tMqconf = MQConf{
 	true,
 	"file://../../schemas/federated/",
 	2,
+	30 * time.Second,
+	time.Minute,
+	1,
+	5,
+	[]time.Duration{10 * time.Second, time.Minute, 10 * time.Minute},
 }
 
 func TestBuildMqURI(t *testing.T) {
@@ -159,6 +349,7 @@ func TestNewMQ(t *testing.T) {
 	b, e := NewMQ(noSslConf)
 	assert.Nil(t, e, "Unwanted Error")
 	assert.NotNil(t, b, "NewMQ without ssl did not return a broker")
+	b.Close()
 	// Fail the queuedeclarepassive
 	go handleOneConnection(s.Sessions, false, true)
 	errret := CatchNewMQPanic(t, noSslConf)
@@ -187,6 +378,7 @@ func CatchNewMQPanic(t *testing.T, conf MQConf) (err error) {
 	if b == nil {
 		return fmt.Errorf("NewMQ did not return a broker")
 	}
+	b.Close()
 
 	return nil
 }
@@ -235,6 +427,7 @@ func TestNewMQTLS(t *testing.T) {
 	b, e := NewMQ(sslConf)
 	assert.Nil(t, e, "Unwanted Error")
 	assert.NotNil(t, b, "NewMQ with ssl did not return a broker")
+	b.Close()
 
 	ss.Close()
 }
@@ -381,6 +574,18 @@ func TestValidateJSON(t *testing.T) {
 	assert.NotZero(t, buf.Len(), "Did not get expected logs from failed ValidateJSON")
 }
 
+func TestValidateJSONBody(t *testing.T) {
+	message := []byte(`{"type": "mapping", "dataset_id": "EGAD12345678901", "accession_ids": ["EGAF12345678901"]}`)
+	assert.NoError(t, ValidateJSONBody(tMqconf.SchemasPath, "dataset-mapping", message))
+
+	err := ValidateJSONBody(tMqconf.SchemasPath, "dataset-mapping", []byte(`{"type": "mapping", "dataset_id": "dataset"}`))
+	assert.ErrorContains(t, err, "accession_ids is required")
+	assert.ErrorContains(t, err, "dataset_id: Does not match pattern")
+
+	assert.Error(t, ValidateJSONBody(tMqconf.SchemasPath, "dataset-mapping", message[:20]))
+	assert.Error(t, ValidateJSONBody(tMqconf.SchemasPath, "notfound", message))
+}
+
 func TestSendJSONError(t *testing.T) {
 	b := AMQPBroker{}
 	c := mockChannel{}
@@ -0,0 +1,146 @@
+package broker
+
+import (
+	"fmt"
+	"time"
+
+	"sda-pipeline/internal/metrics"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	log "github.com/sirupsen/logrus"
+)
+
+// retryCountHeader is the header of a retried message that holds how many
+// times it has been retried
+const retryCountHeader = "x-retry-count"
+
+// Retry has the delivered message processed again after a delay, for errors
+// that may go away by themselves, like a database or a storage that is
+// down. The message is republished, with the number of times it has been
+// retried in the x-retry-count header, to a retry queue that holds it for
+// the delay and then sends it back to the queue it was consumed from. The
+// delay of each retry is taken in turn from Conf.RetryDelays, the last one
+// is used for all retries after that.
+// Once the message has been retried Conf.RetryMax times it is given up on,
+// it is nacked and sent to the error queue with errorMsg and reason. If the
+// message can't be republished it is requeued right away instead, and the
+// error is returned.
+func (broker *AMQPBroker) Retry(delivered *amqp.Delivery, errorMsg, reason string) error {
+	retries := retryCount(delivered.Headers)
+	if retries >= broker.Conf.RetryMax {
+		log.Errorf("Giving up on message after %d retries "+
+			"(corr-id: %s, error: %s, reason: %s)",
+			retries,
+			delivered.CorrelationId,
+			errorMsg,
+			reason)
+
+		if err := delivered.Nack(false, false); err != nil {
+			log.Errorf("Failed to nack message "+
+				"(corr-id: %s, reason: %v)",
+				delivered.CorrelationId,
+				err)
+		}
+
+		return broker.SendJSONError(delivered, delivered.Body, broker.Conf, reason, errorMsg)
+	}
+
+	delay, err := broker.retry(delivered, retries+1)
+	if err != nil {
+		if e := delivered.Nack(false, true); e != nil {
+			log.Errorf("Failed to requeue message "+
+				"(corr-id: %s, reason: %v)",
+				delivered.CorrelationId,
+				e)
+		}
+
+		return fmt.Errorf("failed to schedule retry, reason: %v", err)
+	}
+	metrics.MessageRetried()
+
+	log.Infof("Retrying message in %v, retry %d of %d "+
+		"(corr-id: %s, error: %s, reason: %s)",
+		delay,
+		retries+1,
+		broker.Conf.RetryMax,
+		delivered.CorrelationId,
+		errorMsg,
+		reason)
+
+	return delivered.Ack(false)
+}
+
+// retry publishes the delivered message to the retry queue of its delay
+// and returns the delay
+func (broker *AMQPBroker) retry(delivered *amqp.Delivery, retries int) (time.Duration, error) {
+	broker.consumers.Lock()
+	queue, ok := broker.consumers.queues[delivered.ConsumerTag]
+	broker.consumers.Unlock()
+	if !ok {
+		return 0, fmt.Errorf("message was not consumed by %s", delivered.ConsumerTag)
+	}
+
+	delay := retryDelay(broker.Conf.RetryDelays, retries)
+	retryQueue := fmt.Sprintf("%s.retry.%v", queue, delay)
+
+	// Messages expire from the retry queue after the delay, and are then
+	// dead lettered back to the queue through the default exchange
+	ch, _ := broker.current()
+	_, err := ch.QueueDeclare(
+		retryQueue,
+		true,  // durable
+		false, // auto-delete
+		false, // exclusive
+		false, // no-wait
+		amqp.Table{
+			"x-message-ttl":             delay.Milliseconds(),
+			"x-dead-letter-exchange":    "",
+			"x-dead-letter-routing-key": queue,
+		},
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	headers := amqp.Table{}
+	for k, v := range delivered.Headers {
+		headers[k] = v
+	}
+	headers[retryCountHeader] = int32(retries)
+
+	return delay, broker.publish("", retryQueue, amqp.Publishing{
+		Headers:         headers,
+		ContentEncoding: delivered.ContentEncoding,
+		ContentType:     delivered.ContentType,
+		DeliveryMode:    amqp.Persistent,
+		CorrelationId:   delivered.CorrelationId,
+		Timestamp:       delivered.Timestamp,
+		Body:            delivered.Body,
+	})
+}
+
+// retryCount returns how many times a message has been retried
+func retryCount(headers amqp.Table) int {
+	switch count := headers[retryCountHeader].(type) {
+	case int:
+		return count
+	case int32:
+		return int(count)
+	case int64:
+		return int(count)
+	default:
+		return 0
+	}
+}
+
+// retryDelay returns the delay of a retry, where the first retry is 1
+func retryDelay(delays []time.Duration, retry int) time.Duration {
+	if len(delays) == 0 {
+		return 0
+	}
+	if retry > len(delays) {
+		return delays[len(delays)-1]
+	}
+
+	return delays[retry-1]
+}
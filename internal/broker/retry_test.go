@@ -0,0 +1,92 @@
+package broker
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func retryBroker() (*AMQPBroker, *mockChannel) {
+	b := &AMQPBroker{Conf: tMqconf}
+	c := &mockChannel{}
+	b.Channel = c
+	b.confirmsChan = c.NotifyPublish(make(chan amqp.Confirmation, 1))
+	b.consumers.queues = map[string]string{"ingest-0": "ingest"}
+
+	return b, c
+}
+
+func TestRetry(t *testing.T) {
+	b, c := retryBroker()
+
+	ack := &mockAcknowledger{}
+	delivered := amqp.Delivery{
+		Acknowledger:  ack,
+		ConsumerTag:   "ingest-0",
+		CorrelationId: "corrID",
+		ContentType:   "application/json",
+		Headers:       amqp.Table{"x-retry-count": int32(1)},
+		Body:          []byte(`{"user":"dummy"}`),
+	}
+	assert.NoError(t, b.Retry(&delivered, "Failed to get file size", "storage is down"))
+	assert.Equal(t, &mockAcknowledger{acks: 1}, ack)
+
+	// The second retry waits for the second delay
+	assert.Equal(t, amqp.Table{
+		"x-message-ttl":             time.Minute.Milliseconds(),
+		"x-dead-letter-exchange":    "",
+		"x-dead-letter-routing-key": "ingest",
+	}, c.declared["ingest.retry.1m0s"])
+	assert.Len(t, c.published, 1)
+	assert.Equal(t, "", c.published[0].exchange)
+	assert.Equal(t, "ingest.retry.1m0s", c.published[0].routingKey)
+	assert.Equal(t, int32(2), c.published[0].msg.Headers["x-retry-count"])
+	assert.Equal(t, "corrID", c.published[0].msg.CorrelationId)
+	assert.Equal(t, delivered.Body, c.published[0].msg.Body)
+}
+
+func TestRetry_giveUp(t *testing.T) {
+	b, c := retryBroker()
+
+	ack := &mockAcknowledger{}
+	delivered := amqp.Delivery{
+		Acknowledger:  ack,
+		ConsumerTag:   "ingest-0",
+		CorrelationId: "corrID",
+		Headers:       amqp.Table{"x-retry-count": int64(5)},
+		Body:          []byte(`{"user":"dummy"}`),
+	}
+	assert.NoError(t, b.Retry(&delivered, "Failed to get file size", "storage is down"))
+	assert.Equal(t, &mockAcknowledger{nacks: 1}, ack)
+
+	assert.Empty(t, c.declared)
+	assert.Len(t, c.published, 1)
+	assert.Equal(t, tMqconf.RoutingError, c.published[0].routingKey)
+	var infoError InfoError
+	assert.NoError(t, json.Unmarshal(c.published[0].msg.Body, &infoError))
+	assert.Equal(t, InfoError{Error: "Failed to get file size", Reason: "storage is down", OriginalMessage: `{"user":"dummy"}`}, infoError)
+}
+
+func TestRetry_failed(t *testing.T) {
+	b, c := retryBroker()
+	c.failPublish = true
+
+	ack := &mockAcknowledger{}
+	delivered := amqp.Delivery{Acknowledger: ack, ConsumerTag: "ingest-0"}
+	assert.EqualError(t, b.Retry(&delivered, "Failed to get file size", "storage is down"), "failed to schedule retry, reason: failPublish")
+	assert.Equal(t, &mockAcknowledger{nacks: 1}, ack, "the message should be requeued")
+
+	delivered = amqp.Delivery{Acknowledger: ack, ConsumerTag: "unknown"}
+	assert.EqualError(t, b.Retry(&delivered, "Failed to get file size", "storage is down"), "failed to schedule retry, reason: message was not consumed by unknown")
+}
+
+func TestRetryDelay(t *testing.T) {
+	delays := []time.Duration{time.Second, time.Minute}
+	assert.Equal(t, time.Second, retryDelay(delays, 1))
+	assert.Equal(t, time.Minute, retryDelay(delays, 2))
+	assert.Equal(t, time.Minute, retryDelay(delays, 5))
+	assert.Equal(t, time.Duration(0), retryDelay(nil, 1))
+}
@@ -0,0 +1,20 @@
+package broker
+
+// Route is the schema that a message of a type is validated against, and
+// the routing key it is sent into the pipeline with
+type Route struct {
+	Schema     string
+	RoutingKey string
+}
+
+// Routes are the routes of the message types that start work in the
+// pipeline. Intercept routes them when they come from Central EGA, and
+// the api and replay send them the same way.
+var Routes = map[string]Route{
+	"accession": {Schema: "ingestion-accession", RoutingKey: "accessionIDs"},
+	"cancel":    {Schema: "ingestion-trigger", RoutingKey: "ingest"},
+	"ingest":    {Schema: "ingestion-trigger", RoutingKey: "ingest"},
+	"mapping":   {Schema: "dataset-mapping", RoutingKey: "mappings"},
+	"release":   {Schema: "dataset-release", RoutingKey: "mappings"},
+	"deprecate": {Schema: "dataset-deprecate", RoutingKey: "mappings"},
+}
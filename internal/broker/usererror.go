@@ -0,0 +1,80 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	log "github.com/sirupsen/logrus"
+)
+
+// The codes of the errors that are reported to the submitter. They are
+// part of the ingestion-user-error messages and must not change, since
+// they are what the receivers of the messages go by.
+const (
+	// UserErrorFileNotFound is for a file that is not in the inbox
+	UserErrorFileNotFound = "FILE_NOT_FOUND"
+	// UserErrorWrongKey is for a file that is not encrypted with any of
+	// the keys of the archive
+	UserErrorWrongKey = "WRONG_KEY"
+	// UserErrorCorruptFile is for a file that is not a valid crypt4gh file
+	UserErrorCorruptFile = "CORRUPT_FILE"
+	// UserErrorChecksumMismatch is for a file that does not match the
+	// checksums it was submitted with
+	UserErrorChecksumMismatch = "CHECKSUM_MISMATCH"
+	// UserErrorDuplicateAccession is for an accession ID that is already
+	// given to another file
+	UserErrorDuplicateAccession = "DUPLICATE_ACCESSION"
+)
+
+// UserError is an error that is caused by what the submitter sent, and
+// that is reported back to them. Reason is written for the submitter,
+// while Err holds the error for the logs and the operators.
+type UserError struct {
+	Code   string
+	Reason string
+	Err    error
+}
+
+func (e *UserError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *UserError) Unwrap() error {
+	return e.Err
+}
+
+// userErrorMessage is an ingestion-user-error message
+type userErrorMessage struct {
+	User     string `json:"user"`
+	Filepath string `json:"filepath"`
+	Code     string `json:"code"`
+	Reason   string `json:"reason"`
+}
+
+// SendUserError sends an ingestion-user-error message about the file to
+// Conf.RoutingUserError. It is sent in addition to the error message for
+// the operators, and nothing is sent if no routing key is configured.
+func (broker *AMQPBroker) SendUserError(delivered *amqp.Delivery, user, filepath string, userError *UserError) error {
+	if broker.Conf.RoutingUserError == "" {
+		log.Debugf("No routing key for user errors, not sending %s (corr-id: %s)", userError.Code, delivered.CorrelationId)
+
+		return nil
+	}
+
+	body, err := json.Marshal(userErrorMessage{
+		User:     user,
+		Filepath: filepath,
+		Code:     userError.Code,
+		Reason:   userError.Reason,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := ValidateJSONBody(broker.Conf.SchemasPath, "ingestion-user-error", body); err != nil {
+		return fmt.Errorf("user error message is not valid, reason: %v", err)
+	}
+
+	return broker.SendMessage(delivered.CorrelationId, broker.Conf.Exchange, broker.Conf.RoutingUserError, broker.Conf.Durable, body)
+}
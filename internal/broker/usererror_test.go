@@ -0,0 +1,45 @@
+package broker
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSendUserError(t *testing.T) {
+	b := AMQPBroker{Conf: tMqconf}
+	c := mockChannel{}
+	b.Channel = &c
+	b.confirmsChan = c.NotifyPublish(make(chan amqp.Confirmation, 1))
+
+	userError := &UserError{Code: UserErrorWrongKey, Reason: "The file is not encrypted with the public key of the archive", Err: errors.New("could not decrypt")}
+	assert.EqualError(t, userError, "could not decrypt")
+
+	delivered := amqp.Delivery{CorrelationId: "corrID"}
+	assert.NoError(t, b.SendUserError(&delivered, "dummy", "dummy_data.c4gh", userError))
+	assert.Len(t, c.published, 1)
+	assert.Equal(t, "routingUserError", c.published[0].routingKey)
+	assert.Equal(t, "corrID", c.published[0].msg.CorrelationId)
+
+	var message map[string]string
+	assert.NoError(t, json.Unmarshal(c.published[0].msg.Body, &message))
+	assert.Equal(t, map[string]string{
+		"user":     "dummy",
+		"filepath": "dummy_data.c4gh",
+		"code":     "WRONG_KEY",
+		"reason":   "The file is not encrypted with the public key of the archive",
+	}, message)
+
+	// Only the codes in the schema can be sent
+	unknown := &UserError{Code: "SOMETHING_ELSE", Reason: "Something else went wrong", Err: errors.New("unknown")}
+	assert.ErrorContains(t, b.SendUserError(&delivered, "dummy", "dummy_data.c4gh", unknown), "user error message is not valid")
+	assert.Len(t, c.published, 1)
+
+	// Nothing is sent without a routing key for user errors
+	b.Conf.RoutingUserError = ""
+	assert.NoError(t, b.SendUserError(&delivered, "dummy", "dummy_data.c4gh", userError))
+	assert.Len(t, c.published, 1)
+}
@@ -0,0 +1,50 @@
+package broker
+
+import (
+	"errors"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	log "github.com/sirupsen/logrus"
+)
+
+// Handler processes a message read from a queue. It is responsible for
+// acking or nacking the message.
+type Handler func(delivered amqp.Delivery)
+
+// Work reads messages from the queue and processes them with the handlers,
+// each running in a goroutine of its own, so that as many messages are
+// processed at the same time as there are handlers. A handler only ever
+// processes one message at a time, so anything it doesn't share with the
+// other handlers, like its own database and storage handles, doesn't have
+// to be safe for concurrent use.
+// Work returns when consuming is stopped and all handlers are done.
+func (broker *AMQPBroker) Work(queue string, handlers ...Handler) error {
+	if len(handlers) == 0 {
+		return errors.New("no workers to process messages with")
+	}
+
+	messages, err := broker.GetMessages(queue)
+	if err != nil {
+		return err
+	}
+
+	if broker.Conf.PrefetchCount > 0 && broker.Conf.PrefetchCount < len(handlers) {
+		log.Warnf("Prefetch count %d is lower than the number of workers %d, some workers will be idle",
+			broker.Conf.PrefetchCount, len(handlers))
+	}
+
+	var wg sync.WaitGroup
+	for _, handle := range handlers {
+		wg.Add(1)
+		go func(handle Handler) {
+			defer wg.Done()
+			for delivered := range messages {
+				handle(delivered)
+			}
+		}(handle)
+	}
+	wg.Wait()
+
+	return nil
+}
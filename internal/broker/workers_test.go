@@ -0,0 +1,56 @@
+package broker
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWork(t *testing.T) {
+	b := AMQPBroker{}
+	c := mockChannel{deliveries: make(chan amqp.Delivery, 2)}
+	b.Channel = &c
+
+	ack := &mockAcknowledger{}
+	c.deliveries <- amqp.Delivery{Acknowledger: ack, DeliveryTag: 1}
+	c.deliveries <- amqp.Delivery{Acknowledger: ack, DeliveryTag: 2}
+
+	// Both workers wait until the other one has a message too, which only
+	// happens if the messages are processed at the same time
+	var started sync.WaitGroup
+	started.Add(2)
+	var mu sync.Mutex
+	handled := map[int][]uint64{}
+	worker := func(id int) Handler {
+		return func(delivered amqp.Delivery) {
+			started.Done()
+			started.Wait()
+
+			mu.Lock()
+			defer mu.Unlock()
+			handled[id] = append(handled[id], delivered.DeliveryTag)
+			assert.NoError(t, delivered.Ack(false))
+		}
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- b.Work("queue", worker(0), worker(1))
+	}()
+
+	started.Wait()
+	assert.NoError(t, b.StopConsuming(time.Second))
+	assert.NoError(t, <-done)
+
+	assert.Len(t, handled[0], 1)
+	assert.Len(t, handled[1], 1)
+	assert.Equal(t, 2, ack.acks)
+}
+
+func TestWork_noWorkers(t *testing.T) {
+	b := AMQPBroker{}
+	assert.EqualError(t, b.Work("queue"), "no workers to process messages with")
+}
@@ -2,17 +2,24 @@
 package config
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"os"
 	"path"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/neicnordic/crypt4gh/keys"
+	"github.com/neicnordic/crypt4gh/model/headers"
 	log "github.com/sirupsen/logrus"
 
 	"sda-pipeline/internal/broker"
 	"sda-pipeline/internal/database"
+	"sda-pipeline/internal/health"
+	"sda-pipeline/internal/metrics"
 	"sda-pipeline/internal/storage"
 
 	"github.com/pkg/errors"
@@ -31,10 +38,21 @@ type Config struct {
 	Broker       broker.MQConf
 	Inbox        storage.Conf
 	Backup       storage.Conf
+	Backups      []BackupConf
+	BackupQuorum int
 	Database     database.DBConf
 	API          APIConf
+	Metrics      metrics.Conf
+	Health       health.Conf
 	Notify       SMTPConf
 	Orchestrator OrchestratorConf
+	Reconcile    ReconcileConf
+	RotateKey    RotateKeyConf
+	Replay       ReplayConf
+	// ChecksumAlgorithms are the checksums computed in addition to md5 and sha256
+	ChecksumAlgorithms []string
+	// SecretsRefreshInterval is how often WatchSecrets resolves the secrets again
+	SecretsRefreshInterval time.Duration
 }
 
 type APIConf struct {
@@ -44,10 +62,24 @@ type APIConf struct {
 	Host       string
 	Port       int
 	Session    SessionConfig
+	JWT        JWTConf
 	DB         *database.SQLdb
 	MQ         *broker.AMQPBroker
 }
 
+// JWTConf holds the settings for validating the tokens the api is accessed with
+type JWTConf struct {
+	// PubKeyPath is a PEM encoded public key, or a directory of them
+	PubKeyPath string
+	// JwksPath is a JSON Web Key Set file, such as the one published by an OIDC provider
+	JwksPath  string
+	Issuer    string
+	Audience  string
+	UserClaim string
+	RoleClaim string
+	AdminRole string
+}
+
 type SessionConfig struct {
 	Expiration time.Duration
 	Domain     string
@@ -75,6 +107,41 @@ type OrchestratorConf struct {
 	ReleaseDelay   time.Duration
 }
 
+// BackupConf holds the configuration of one backup destination
+type BackupConf struct {
+	Name       string
+	Storage    storage.Conf
+	CopyHeader bool
+	PublicKeys [][32]byte
+	// prefix is where the destination is configured
+	prefix string
+}
+
+type ReconcileConf struct {
+	Action           string
+	QuarantinePrefix string
+	MinAge           time.Duration
+	Report           string
+}
+
+type RotateKeyConf struct {
+	PublicKey [32]byte
+	KeyHash   string
+}
+
+// ReplayConf holds what error messages the replay command selects and what
+// it does with them
+type ReplayConf struct {
+	Action        string
+	CorrelationID string
+	User          string
+	Since         time.Time
+	Until         time.Time
+	Operator      string
+	Wait          time.Duration
+	Report        string
+}
+
 // NewConfig initializes and parses the config file and/or environment using
 // the viper library.
 func NewConfig(app string) (*Config, error) {
@@ -120,6 +187,25 @@ func NewConfig(app string) (*Config, error) {
 		requiredConfVars = []string{
 			"broker.host", "broker.port", "broker.user", "broker.password", "broker.queue", "smtp.host", "smtp.port", "smtp.password", "smtp.from",
 		}
+	case "reconcile":
+		// Reconcile does not read or send any messages
+		requiredConfVars = []string{
+			"db.host", "db.port", "db.user", "db.password", "db.database",
+		}
+	case "rotatekey":
+		// Rotatekey only needs a broker connection when reading files to rotate from a queue
+		requiredConfVars = []string{
+			"db.host", "db.port", "db.user", "db.password", "db.database", "c4gh.filepath", "c4gh.passphrase", "c4gh.rotatePubKey",
+		}
+		if viper.IsSet("broker.queue") {
+			requiredConfVars = append(requiredConfVars, []string{"broker.host", "broker.port", "broker.user", "broker.password"}...)
+		}
+	case "replay":
+		// Replay reads the error queue, and sends the messages on with
+		// their original routing keys
+		requiredConfVars = []string{
+			"broker.host", "broker.port", "broker.user", "broker.password", "broker.queue", "db.host", "db.port", "db.user", "db.password", "db.database",
+		}
 	case "orchestrate":
 		// Orchestrate requires broker connection, a series of
 		// queues, and the project FQDN.
@@ -161,6 +247,11 @@ func NewConfig(app string) (*Config, error) {
 		}
 	}
 
+	err := resolveSecrets()
+	if err != nil {
+		return nil, err
+	}
+
 	if viper.IsSet("log.format") {
 		if viper.GetString("log.format") == "json" {
 			log.SetFormatter(&log.JSONFormatter{})
@@ -179,13 +270,15 @@ func NewConfig(app string) (*Config, error) {
 		log.Printf("Setting log level to '%s'", stringLevel)
 	}
 
-	c := &Config{}
-	err := c.configBroker()
+	c := &Config{SecretsRefreshInterval: viper.GetDuration("secrets.refreshInterval")}
+	err = c.configBroker()
 	if err != nil {
 		return nil, err
 	}
 	viper.SetDefault("schema.type", "federated")
 	c.configSchemas()
+	c.configMetrics()
+	c.configHealth()
 	switch app {
 	case "api":
 		err = c.configDatabase()
@@ -203,6 +296,11 @@ func NewConfig(app string) (*Config, error) {
 		c.configInbox()
 		c.configArchive()
 
+		err = c.configChecksums()
+		if err != nil {
+			return nil, err
+		}
+
 		err = c.configDatabase()
 		if err != nil {
 			return nil, err
@@ -214,6 +312,11 @@ func NewConfig(app string) (*Config, error) {
 	case "verify":
 		c.configArchive()
 
+		err = c.configChecksums()
+		if err != nil {
+			return nil, err
+		}
+
 		err = c.configDatabase()
 		if err != nil {
 			return nil, err
@@ -229,7 +332,11 @@ func NewConfig(app string) (*Config, error) {
 		return c, nil
 	case "backup":
 		c.configArchive()
-		c.configBackup()
+
+		err = c.configBackup()
+		if err != nil {
+			return nil, err
+		}
 
 		err = c.configDatabase()
 		if err != nil {
@@ -252,6 +359,44 @@ func NewConfig(app string) (*Config, error) {
 	case "orchestrate":
 		c.configOrchestrator()
 
+		return c, nil
+	case "rotatekey":
+		err = c.configDatabase()
+		if err != nil {
+			return nil, err
+		}
+
+		err = c.configRotateKey()
+		if err != nil {
+			return nil, err
+		}
+
+		return c, nil
+	case "reconcile":
+		c.configArchive()
+
+		err = c.configDatabase()
+		if err != nil {
+			return nil, err
+		}
+
+		err = c.configReconcile()
+		if err != nil {
+			return nil, err
+		}
+
+		return c, nil
+	case "replay":
+		err = c.configDatabase()
+		if err != nil {
+			return nil, err
+		}
+
+		err = c.configReplay()
+		if err != nil {
+			return nil, err
+		}
+
 		return c, nil
 	}
 
@@ -268,14 +413,33 @@ func (c *Config) configSchemas() {
 	}
 }
 
+// configMetrics sets the port the metrics are served on, if any
+func (c *Config) configMetrics() {
+	if viper.IsSet("metrics.port") {
+		c.Metrics.Port = viper.GetInt("metrics.port")
+	}
+}
+
+// configHealth sets the port the health endpoints are served on, if any,
+// and how long each health check may take
+func (c *Config) configHealth() {
+	if viper.IsSet("health.port") {
+		c.Health.Port = viper.GetInt("health.port")
+	}
+
+	if viper.IsSet("health.timeout") {
+		c.Health.Timeout = viper.GetDuration("health.timeout")
+	}
+}
+
 // configS3Storage populates and returns a S3Conf from the
 // configuration
 func configS3Storage(prefix string) storage.S3Conf {
 	s3 := storage.S3Conf{}
 	// All these are required
 	s3.URL = viper.GetString(prefix + ".url")
-	s3.AccessKey = viper.GetString(prefix + ".accesskey")
-	s3.SecretKey = viper.GetString(prefix + ".secretkey")
+	s3.AccessKey = getSecret(prefix + ".accesskey")
+	s3.SecretKey = getSecret(prefix + ".secretkey")
 	s3.Bucket = viper.GetString(prefix + ".bucket")
 
 	// Defaults (move to viper?)
@@ -316,7 +480,7 @@ func configSFTP(prefix string) storage.SftpConf {
 	sftpConf.Port = viper.GetString(prefix + ".sftp.port")
 	sftpConf.UserName = viper.GetString(prefix + ".sftp.userName")
 	sftpConf.PemKeyPath = viper.GetString(prefix + ".sftp.pemKeyPath")
-	sftpConf.PemKeyPass = viper.GetString(prefix + ".sftp.pemKeyPass")
+	sftpConf.PemKeyPass = getSecret(prefix + ".sftp.pemKeyPass")
 
 	return sftpConf
 }
@@ -332,6 +496,28 @@ func (c *Config) configArchive() {
 	}
 }
 
+// configChecksums provides the checksum algorithms that are computed in
+// addition to md5 and sha256, which always are
+func (c *Config) configChecksums() error {
+	c.ChecksumAlgorithms = nil
+	// A comma separated list from the environment, or a list in the config
+	// file
+	for _, list := range viper.GetStringSlice("checksums.algorithms") {
+		for _, algorithm := range strings.Split(list, ",") {
+			algorithm = strings.ToLower(strings.TrimSpace(algorithm))
+			if algorithm == "" || algorithm == "md5" || algorithm == "sha256" {
+				continue
+			}
+			if _, err := database.NewDigests(algorithm); err != nil {
+				return fmt.Errorf("checksums.algorithms: %v", err)
+			}
+			c.ChecksumAlgorithms = append(c.ChecksumAlgorithms, algorithm)
+		}
+	}
+
+	return nil
+}
+
 // configInbox provides configuration for the inbox storage
 func (c *Config) configInbox() {
 	if viper.GetString("inbox.type") == S3 {
@@ -343,19 +529,154 @@ func (c *Config) configInbox() {
 	}
 }
 
-// configBackup provides configuration for the backup storage
-func (c *Config) configBackup() {
-	switch viper.GetString("backup.type") {
+// configBackup provides configuration for the backup storage. Several
+// destinations can be given as a map of names under backup.destinations,
+// otherwise the backup.* settings make up a single destination named
+// "backup".
+func (c *Config) configBackup() error {
+	if !viper.IsSet("backup.destinations") {
+		switch viper.GetString("backup.type") {
+		case S3:
+			c.Backup.Type = S3
+			c.Backup.S3 = configS3Storage("backup")
+		case SFTP:
+			c.Backup.Type = SFTP
+			c.Backup.SFTP = configSFTP("backup")
+		default:
+			c.Backup.Type = POSIX
+			c.Backup.Posix.Location = viper.GetString("backup.location")
+		}
+
+		destination := BackupConf{
+			Name:       "backup",
+			prefix:     "backup",
+			Storage:    c.Backup,
+			CopyHeader: viper.GetBool("backup.copyHeader"),
+		}
+		if destination.CopyHeader {
+			publicKeys, err := configBackupPublicKeys("c4gh.backupPubKeys", "c4gh.backupPubKey")
+			if err != nil {
+				return err
+			}
+			if publicKeys == nil {
+				return errors.New("c4gh.backupPubKeys or c4gh.backupPubKey must be set when copying headers")
+			}
+			destination.PublicKeys = publicKeys
+		}
+
+		c.Backups = []BackupConf{destination}
+		c.BackupQuorum = 1
+
+		return nil
+	}
+
+	names := make([]string, 0)
+	for name := range viper.GetStringMap("backup.destinations") {
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return errors.New("backup.destinations does not contain any destinations")
+	}
+	sort.Strings(names)
+
+	c.Backups = make([]BackupConf, 0, len(names))
+	for _, name := range names {
+		destination, err := configBackupDestination(name)
+		if err != nil {
+			return err
+		}
+		c.Backups = append(c.Backups, destination)
+	}
+
+	c.BackupQuorum = len(c.Backups)
+	if viper.IsSet("backup.quorum") {
+		c.BackupQuorum = viper.GetInt("backup.quorum")
+	}
+	if c.BackupQuorum < 1 || c.BackupQuorum > len(c.Backups) {
+		return fmt.Errorf("backup.quorum must be between 1 and the number of backup destinations (%d)", len(c.Backups))
+	}
+
+	return nil
+}
+
+// configBackupDestination provides configuration for the backup
+// destination with the given name
+func configBackupDestination(name string) (BackupConf, error) {
+	prefix := "backup.destinations." + name
+	destination := BackupConf{Name: name, prefix: prefix}
+
+	var required []string
+	switch viper.GetString(prefix + ".type") {
 	case S3:
-		c.Backup.Type = S3
-		c.Backup.S3 = configS3Storage("backup")
+		required = []string{"url", "accesskey", "secretkey", "bucket"}
+		destination.Storage.Type = S3
+		destination.Storage.S3 = configS3Storage(prefix)
 	case SFTP:
-		c.Backup.Type = SFTP
-		c.Backup.SFTP = configSFTP("backup")
+		required = []string{"sftp.host", "sftp.port", "sftp.userName", "sftp.pemKeyPath", "sftp.pemKeyPass"}
+		destination.Storage.Type = SFTP
+		destination.Storage.SFTP = configSFTP(prefix)
+	case POSIX:
+		required = []string{"location"}
+		destination.Storage.Type = POSIX
+		destination.Storage.Posix.Location = viper.GetString(prefix + ".location")
 	default:
-		c.Backup.Type = POSIX
-		c.Backup.Posix.Location = viper.GetString("backup.location")
+		return destination, fmt.Errorf("%s.type '%s' is not supported, use one of posix, s3 or sftp", prefix, viper.GetString(prefix+".type"))
 	}
+
+	for _, s := range required {
+		if !viper.IsSet(prefix + "." + s) {
+			return destination, fmt.Errorf("%s.%s not set", prefix, s)
+		}
+	}
+
+	destination.CopyHeader = viper.GetBool("backup.copyHeader")
+	if viper.IsSet(prefix + ".copyHeader") {
+		destination.CopyHeader = viper.GetBool(prefix + ".copyHeader")
+	}
+
+	if !destination.CopyHeader {
+		return destination, nil
+	}
+
+	publicKeys, err := configBackupPublicKeys(prefix+".pubKeys", prefix+".pubKey")
+	if err == nil && publicKeys == nil {
+		publicKeys, err = configBackupPublicKeys("c4gh.backupPubKeys", "c4gh.backupPubKey")
+	}
+	if err != nil {
+		return destination, fmt.Errorf("%s: %v", prefix, err)
+	}
+	if publicKeys == nil {
+		return destination, fmt.Errorf("%s.pubKeys or c4gh.backupPubKeys must be set when copying headers", prefix)
+	}
+	destination.PublicKeys = publicKeys
+
+	return destination, nil
+}
+
+// configBackupPublicKeys reads the crypt4gh public keys that backup
+// headers are reencrypted for, from the list of key files in listKey or
+// the single key file in key. No keys are returned if neither is set.
+func configBackupPublicKeys(listKey, key string) ([][32]byte, error) {
+	var keyPaths []string
+	switch {
+	case viper.IsSet(listKey):
+		keyPaths = viper.GetStringSlice(listKey)
+	case viper.IsSet(key):
+		keyPaths = []string{viper.GetString(key)}
+	default:
+		return nil, nil
+	}
+
+	publicKeys := make([][32]byte, 0, len(keyPaths))
+	for _, keyPath := range keyPaths {
+		publicKey, err := ReadC4GHPublicKey(keyPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read backup public key %s, reason: %v", keyPath, err)
+		}
+		publicKeys = append(publicKeys, *publicKey)
+	}
+
+	return publicKeys, nil
 }
 
 // configBroker provides configuration for the message broker
@@ -366,7 +687,7 @@ func (c *Config) configBroker() error {
 	broker.Host = viper.GetString("broker.host")
 	broker.Port = viper.GetInt("broker.port")
 	broker.User = viper.GetString("broker.user")
-	broker.Password = viper.GetString("broker.password")
+	broker.Password = getSecret("broker.password")
 
 	broker.Queue = viper.GetString("broker.queue")
 	broker.ServerName = viper.GetString("broker.serverName")
@@ -385,6 +706,9 @@ func (c *Config) configBroker() error {
 	if viper.IsSet("broker.routingerror") {
 		broker.RoutingError = viper.GetString("broker.routingerror")
 	}
+	if viper.IsSet("broker.routingUserError") {
+		broker.RoutingUserError = viper.GetString("broker.routingUserError")
+	}
 	if viper.IsSet("broker.vhost") {
 		if strings.HasPrefix(viper.GetString("broker.vhost"), "/") {
 			broker.Vhost = viper.GetString("broker.vhost")
@@ -419,6 +743,53 @@ func (c *Config) configBroker() error {
 		broker.PrefetchCount = viper.GetInt("broker.prefetchCount")
 	}
 
+	broker.ShutdownTimeout = 30 * time.Second
+	if viper.IsSet("broker.shutdownTimeout") {
+		broker.ShutdownTimeout = viper.GetDuration("broker.shutdownTimeout")
+	}
+
+	if viper.IsSet("broker.reconnectTimeout") {
+		broker.ReconnectTimeout = viper.GetDuration("broker.reconnectTimeout")
+	}
+
+	broker.Workers = 1
+	if viper.IsSet("broker.workers") {
+		broker.Workers = viper.GetInt("broker.workers")
+		if broker.Workers < 1 {
+			return errors.New("broker.workers must be at least 1")
+		}
+	}
+
+	broker.RetryMax = 5
+	if viper.IsSet("broker.retryMax") {
+		broker.RetryMax = viper.GetInt("broker.retryMax")
+		if broker.RetryMax < 0 {
+			return errors.New("broker.retryMax can not be negative")
+		}
+	}
+
+	broker.RetryDelays = []time.Duration{10 * time.Second, time.Minute, 10 * time.Minute}
+	if viper.IsSet("broker.retryDelays") {
+		// A comma separated list from the environment, or a list in the
+		// config file
+		broker.RetryDelays = nil
+		for _, list := range viper.GetStringSlice("broker.retryDelays") {
+			for _, d := range strings.Split(list, ",") {
+				if strings.TrimSpace(d) == "" {
+					continue
+				}
+				delay, err := time.ParseDuration(strings.TrimSpace(d))
+				if err != nil || delay <= 0 {
+					return fmt.Errorf("broker.retryDelays has an invalid delay: %s", d)
+				}
+				broker.RetryDelays = append(broker.RetryDelays, delay)
+			}
+		}
+		if len(broker.RetryDelays) == 0 {
+			return errors.New("broker.retryDelays needs at least one delay")
+		}
+	}
+
 	c.Broker = broker
 
 	return nil
@@ -432,7 +803,7 @@ func (c *Config) configDatabase() error {
 	db.Host = viper.GetString("db.host")
 	db.Port = viper.GetInt("db.port")
 	db.User = viper.GetString("db.user")
-	db.Password = viper.GetString("db.password")
+	db.Password = getSecret("db.password")
 	db.Database = viper.GetString("db.database")
 	db.SslMode = viper.GetString("db.sslmode")
 
@@ -475,6 +846,17 @@ func (c *Config) configAPI() error {
 	api.ServerCert = viper.GetString("api.serverCert")
 	api.CACert = viper.GetString("api.CACert")
 
+	if !viper.IsSet("api.jwt.pubKeyPath") && !viper.IsSet("api.jwt.jwksPath") {
+		return errors.New("api.jwt.pubKeyPath or api.jwt.jwksPath must be set")
+	}
+	api.JWT.PubKeyPath = viper.GetString("api.jwt.pubKeyPath")
+	api.JWT.JwksPath = viper.GetString("api.jwt.jwksPath")
+	api.JWT.Issuer = viper.GetString("api.jwt.issuer")
+	api.JWT.Audience = viper.GetString("api.jwt.audience")
+	api.JWT.UserClaim = viper.GetString("api.jwt.userClaim")
+	api.JWT.RoleClaim = viper.GetString("api.jwt.roleClaim")
+	api.JWT.AdminRole = viper.GetString("api.jwt.adminRole")
+
 	c.API = api
 
 	return nil
@@ -488,6 +870,9 @@ func (c *Config) apiDefaults() {
 	viper.SetDefault("api.session.secure", true)
 	viper.SetDefault("api.session.httponly", true)
 	viper.SetDefault("api.session.name", "api_session_key")
+	viper.SetDefault("api.jwt.userClaim", "sub")
+	viper.SetDefault("api.jwt.roleClaim", "role")
+	viper.SetDefault("api.jwt.adminRole", "admin")
 }
 
 // configNotify provides configuration for the backup storage
@@ -495,7 +880,7 @@ func (c *Config) configSMTP() {
 	c.Notify = SMTPConf{}
 	c.Notify.Host = viper.GetString("smtp.host")
 	c.Notify.Port = viper.GetInt("smtp.port")
-	c.Notify.Password = viper.GetString("smtp.password")
+	c.Notify.Password = getSecret("smtp.password")
 	c.Notify.FromAddr = viper.GetString("smtp.from")
 }
 
@@ -552,11 +937,98 @@ func (c *Config) configOrchestrator() {
 
 }
 
+// configReconcile provides the configuration for the reconcile command
+func (c *Config) configReconcile() error {
+	viper.SetDefault("reconcile.action", "report")
+	viper.SetDefault("reconcile.quarantinePrefix", "quarantine/")
+	viper.SetDefault("reconcile.minAge", 24*time.Hour)
+
+	c.Reconcile = ReconcileConf{}
+	c.Reconcile.Action = viper.GetString("reconcile.action")
+	switch c.Reconcile.Action {
+	case "report", "quarantine", "delete":
+	default:
+		return fmt.Errorf("reconcile.action '%s' is not supported, use one of report, quarantine or delete", c.Reconcile.Action)
+	}
+
+	c.Reconcile.QuarantinePrefix = viper.GetString("reconcile.quarantinePrefix")
+	if c.Reconcile.Action == "quarantine" && c.Reconcile.QuarantinePrefix == "" {
+		return errors.New("reconcile.quarantinePrefix can not be empty when quarantining files")
+	}
+	c.Reconcile.MinAge = viper.GetDuration("reconcile.minAge")
+	c.Reconcile.Report = viper.GetString("reconcile.report")
+
+	return nil
+}
+
+// configReplay provides the configuration for the replay command
+func (c *Config) configReplay() error {
+	viper.SetDefault("replay.action", "report")
+	viper.SetDefault("replay.wait", 5*time.Second)
+
+	c.Replay = ReplayConf{}
+	c.Replay.Action = viper.GetString("replay.action")
+	switch c.Replay.Action {
+	case "report", "replay":
+	default:
+		return fmt.Errorf("replay.action '%s' is not supported, use one of report or replay", c.Replay.Action)
+	}
+
+	c.Replay.CorrelationID = viper.GetString("replay.correlationId")
+	c.Replay.User = viper.GetString("replay.user")
+	for key, t := range map[string]*time.Time{"replay.since": &c.Replay.Since, "replay.until": &c.Replay.Until} {
+		if !viper.IsSet(key) {
+			continue
+		}
+
+		parsed, err := time.Parse(time.RFC3339, viper.GetString(key))
+		if err != nil {
+			return fmt.Errorf("%s is not a RFC3339 time, reason: %v", key, err)
+		}
+		*t = parsed
+	}
+
+	c.Replay.Operator = viper.GetString("replay.operator")
+	if c.Replay.Action == "replay" && c.Replay.Operator == "" {
+		return errors.New("replay.operator must be set to replay messages")
+	}
+	c.Replay.Wait = viper.GetDuration("replay.wait")
+	c.Replay.Report = viper.GetString("replay.report")
+
+	// The messages are held until the replay is done, so all of them have
+	// to be delivered at once
+	if !viper.IsSet("broker.prefetchCount") {
+		c.Broker.PrefetchCount = 0
+	}
+
+	return nil
+}
+
+// configRotateKey reads the public key that archive headers are rotated to
+func (c *Config) configRotateKey() error {
+	publicKey, err := ReadC4GHPublicKey(viper.GetString("c4gh.rotatePubKey"))
+	if err != nil {
+		return fmt.Errorf("failed to read c4gh.rotatePubKey, reason: %v", err)
+	}
+
+	c.RotateKey.PublicKey = *publicKey
+	c.RotateKey.KeyHash = KeyHash(*publicKey)
+
+	return nil
+}
+
 // GetC4GHKey reads and decrypts and returns the c4gh key
 func GetC4GHKey() (*[32]byte, error) {
-	keyPath := viper.GetString("c4gh.filepath")
-	passphrase := viper.GetString("c4gh.passphrase")
+	passphrase, err := resolveSecret(viper.GetString("c4gh.passphrase"), secretProviders())
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve c4gh.passphrase, reason: %v", err)
+	}
 
+	return readC4GHKey(viper.GetString("c4gh.filepath"), passphrase)
+}
+
+// readC4GHKey reads and decrypts the c4gh key at keyPath
+func readC4GHKey(keyPath, passphrase string) (*[32]byte, error) {
 	// Make sure the key path and passphrase is valid
 	keyFile, err := os.Open(keyPath)
 	if err != nil {
@@ -573,11 +1045,83 @@ func GetC4GHKey() (*[32]byte, error) {
 	return &key, nil
 }
 
+// C4GHKey is a c4gh private key together with the hash of its public key
+type C4GHKey struct {
+	PrivateKey [32]byte
+	KeyHash    string
+}
+
+// keyringEntry is how a key in c4gh.keys is configured
+type keyringEntry struct {
+	FilePath   string `mapstructure:"filepath"`
+	Passphrase string `mapstructure:"passphrase"`
+}
+
+// GetC4GHKeyring reads and decrypts the c4gh keys listed in c4gh.keys, in
+// the order they are listed. If no list is given the keyring holds the
+// single key in c4gh.filepath.
+func GetC4GHKeyring() ([]C4GHKey, error) {
+	var entries []keyringEntry
+	if viper.IsSet("c4gh.keys") {
+		if err := viper.UnmarshalKey("c4gh.keys", &entries); err != nil {
+			return nil, fmt.Errorf("failed to parse c4gh.keys, reason: %v", err)
+		}
+		if len(entries) == 0 {
+			return nil, errors.New("c4gh.keys does not contain any keys")
+		}
+	} else {
+		entries = []keyringEntry{{FilePath: viper.GetString("c4gh.filepath"), Passphrase: viper.GetString("c4gh.passphrase")}}
+	}
+
+	keyring := make([]C4GHKey, 0, len(entries))
+	for _, entry := range entries {
+		passphrase, err := entry.passphrase()
+		if err != nil {
+			return nil, err
+		}
+
+		key, err := readC4GHKey(entry.FilePath, passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read c4gh key %s, reason: %v", entry.FilePath, err)
+		}
+
+		keyring = append(keyring, C4GHKey{PrivateKey: *key, KeyHash: KeyHash(keys.DerivePublicKey(*key))})
+	}
+
+	return keyring, nil
+}
+
+// FindC4GHKey returns the first key in the keyring that can decrypt the
+// header
+func FindC4GHKey(keyring []C4GHKey, header []byte) (*C4GHKey, error) {
+	err := errors.New("no keys to decrypt with")
+	for i := range keyring {
+		if _, err = headers.NewHeader(bytes.NewReader(header), keyring[i].PrivateKey); err == nil {
+			return &keyring[i], nil
+		}
+	}
+
+	return nil, err
+}
+
+// passphrase returns the passphrase of the key, which can refer to a secret
+// like other secret settings
+func (e keyringEntry) passphrase() (string, error) {
+	passphrase, err := resolveSecret(e.Passphrase, secretProviders())
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve passphrase for c4gh key %s, reason: %v", e.FilePath, err)
+	}
+
+	return passphrase, nil
+}
+
 // GetC4GHPublicKey reads the c4gh public key
 func GetC4GHPublicKey() (*[32]byte, error) {
-	keyPath := viper.GetString("c4gh.backupPubKey")
+	return ReadC4GHPublicKey(viper.GetString("c4gh.backupPubKey"))
+}
 
-	// Make sure the key path and passphrase is valid
+// ReadC4GHPublicKey reads the c4gh public key at keyPath
+func ReadC4GHPublicKey(keyPath string) (*[32]byte, error) {
 	keyFile, err := os.Open(keyPath)
 	if err != nil {
 		return nil, err
@@ -593,6 +1137,14 @@ func GetC4GHPublicKey() (*[32]byte, error) {
 	return &key, nil
 }
 
+// KeyHash returns the fingerprint of a c4gh public key, the hex encoded
+// sha256 checksum of the key
+func KeyHash(publicKey [32]byte) string {
+	hash := sha256.Sum256(publicKey[:])
+
+	return hex.EncodeToString(hash[:])
+}
+
 // CopyHeader reads the config and returns if the header will be copied
 func CopyHeader() bool {
 	if viper.IsSet("backup.copyHeader") {
@@ -3,10 +3,15 @@ package config
 import (
 	"errors"
 	"fmt"
+	"os"
 	"path/filepath"
 	"testing"
 	"time"
 
+	"sda-pipeline/internal/health"
+
+	"github.com/neicnordic/crypt4gh/keys"
+	"github.com/neicnordic/crypt4gh/model/headers"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
@@ -333,6 +338,44 @@ func (suite *TestSuite) TestConfigBroker() {
 	assert.Equal(suite.T(), "test", config.Broker.ClientKey)
 	assert.Equal(suite.T(), "test", config.Broker.CACert)
 	assert.Equal(suite.T(), "file://schemas/federated/", config.Broker.SchemasPath)
+	assert.Equal(suite.T(), "", config.Broker.RoutingUserError)
+	assert.Equal(suite.T(), 30*time.Second, config.Broker.ShutdownTimeout)
+	viper.Set("broker.routingUserError", "user-error")
+	config, _ = NewConfig("ingest")
+	assert.Equal(suite.T(), "user-error", config.Broker.RoutingUserError)
+	viper.Set("broker.shutdownTimeout", "5s")
+	config, _ = NewConfig("ingest")
+	assert.Equal(suite.T(), 5*time.Second, config.Broker.ShutdownTimeout)
+	assert.Equal(suite.T(), time.Duration(0), config.Broker.ReconnectTimeout)
+	viper.Set("broker.reconnectTimeout", "10m")
+	config, _ = NewConfig("ingest")
+	assert.Equal(suite.T(), 10*time.Minute, config.Broker.ReconnectTimeout)
+	assert.Equal(suite.T(), 1, config.Broker.Workers)
+	viper.Set("broker.workers", 4)
+	config, _ = NewConfig("ingest")
+	assert.Equal(suite.T(), 4, config.Broker.Workers)
+	viper.Set("broker.workers", 0)
+	_, err = NewConfig("ingest")
+	assert.EqualError(suite.T(), err, "broker.workers must be at least 1")
+	viper.Set("broker.workers", 1)
+	assert.Equal(suite.T(), 5, config.Broker.RetryMax)
+	assert.Equal(suite.T(), []time.Duration{10 * time.Second, time.Minute, 10 * time.Minute}, config.Broker.RetryDelays)
+	viper.Set("broker.retryMax", 3)
+	viper.Set("broker.retryDelays", "30s, 5m")
+	config, _ = NewConfig("ingest")
+	assert.Equal(suite.T(), 3, config.Broker.RetryMax)
+	assert.Equal(suite.T(), []time.Duration{30 * time.Second, 5 * time.Minute}, config.Broker.RetryDelays)
+	viper.Set("broker.retryDelays", []string{"1m", "1h"})
+	config, _ = NewConfig("ingest")
+	assert.Equal(suite.T(), []time.Duration{time.Minute, time.Hour}, config.Broker.RetryDelays)
+	viper.Set("broker.retryDelays", "1m,soon")
+	_, err = NewConfig("ingest")
+	assert.EqualError(suite.T(), err, "broker.retryDelays has an invalid delay: soon")
+	viper.Set("broker.retryMax", -1)
+	_, err = NewConfig("ingest")
+	assert.EqualError(suite.T(), err, "broker.retryMax can not be negative")
+	viper.Set("broker.retryMax", 5)
+	viper.Set("broker.retryDelays", "10s")
 	viper.Set("schema.type", "standalone")
 	viper.Set("broker.vhost", "/test")
 	config, _ = NewConfig("ingest")
@@ -343,6 +386,50 @@ func (suite *TestSuite) TestConfigBroker() {
 	assert.Equal(suite.T(), "/", config.Broker.Vhost)
 }
 
+func (suite *TestSuite) TestConfigChecksums() {
+	config, err := NewConfig("ingest")
+	assert.NoError(suite.T(), err)
+	assert.Nil(suite.T(), config.ChecksumAlgorithms)
+
+	viper.Set("checksums.algorithms", "sha512, BLAKE3,sha256")
+	config, err = NewConfig("verify")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), []string{"sha512", "blake3"}, config.ChecksumAlgorithms)
+
+	viper.Set("checksums.algorithms", []string{"crc32c"})
+	config, err = NewConfig("ingest")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), []string{"crc32c"}, config.ChecksumAlgorithms)
+
+	viper.Set("checksums.algorithms", "sha1")
+	_, err = NewConfig("ingest")
+	assert.EqualError(suite.T(), err, "checksums.algorithms: unsupported checksum algorithm: sha1")
+	viper.Set("checksums.algorithms", "")
+}
+
+func (suite *TestSuite) TestConfigMetrics() {
+	config, err := NewConfig("ingest")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 0, config.Metrics.Port)
+
+	viper.Set("metrics.port", 9100)
+	config, err = NewConfig("mapper")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 9100, config.Metrics.Port)
+}
+
+func (suite *TestSuite) TestConfigHealth() {
+	config, err := NewConfig("ingest")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), health.Conf{}, config.Health)
+
+	viper.Set("health.port", 8080)
+	viper.Set("health.timeout", "2s")
+	config, err = NewConfig("mapper")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), health.Conf{Port: 8080, Timeout: 2 * time.Second}, config.Health)
+}
+
 func (suite *TestSuite) TestConfigDatabase() {
 	viper.Set("db.sslmode", "verify-full")
 	_, err := NewConfig("ingest")
@@ -595,6 +682,124 @@ func (suite *TestSuite) TestInterceptConfiguration() {
 	assert.NoError(suite.T(), err)
 	assert.NotNil(suite.T(), config)
 }
+func (suite *TestSuite) TestRotateKeyConfiguration() {
+	viper.Set("c4gh.filepath", "../../dev_utils/c4gh.sec.pem")
+	viper.Set("c4gh.passphrase", "test")
+
+	_, err := NewConfig("rotatekey")
+	assert.EqualError(suite.T(), err, "c4gh.rotatePubKey not set")
+
+	viper.Set("c4gh.rotatePubKey", "../../dev_utils/c4gh-new.pub.pem")
+	config, err := NewConfig("rotatekey")
+	assert.NoError(suite.T(), err)
+	publicKey, err := ReadC4GHPublicKey("../../dev_utils/c4gh-new.pub.pem")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), *publicKey, config.RotateKey.PublicKey)
+	assert.Equal(suite.T(), KeyHash(*publicKey), config.RotateKey.KeyHash)
+	assert.Len(suite.T(), config.RotateKey.KeyHash, 64)
+
+	viper.Set("c4gh.rotatePubKey", "../../dev_utils/missing.pub.pem")
+	_, err = NewConfig("rotatekey")
+	assert.ErrorContains(suite.T(), err, "failed to read c4gh.rotatePubKey")
+
+	// The broker is only needed when reading files to rotate from a queue
+	viper.Reset()
+	viper.Set("db.host", "test")
+	viper.Set("db.port", 123)
+	viper.Set("db.user", "test")
+	viper.Set("db.password", "test")
+	viper.Set("db.database", "test")
+	viper.Set("c4gh.filepath", "../../dev_utils/c4gh.sec.pem")
+	viper.Set("c4gh.passphrase", "test")
+	viper.Set("c4gh.rotatePubKey", "../../dev_utils/c4gh-new.pub.pem")
+	_, err = NewConfig("rotatekey")
+	assert.NoError(suite.T(), err)
+
+	viper.Set("broker.queue", "rotatekey")
+	_, err = NewConfig("rotatekey")
+	assert.EqualError(suite.T(), err, "broker.host not set")
+}
+
+func (suite *TestSuite) TestReconcileConfiguration() {
+	viper.Set("archive.location", "test")
+	config, err := NewConfig("reconcile")
+	assert.NoError(suite.T(), err)
+	assert.NotNil(suite.T(), config)
+	assert.Equal(suite.T(), "test", config.Archive.Posix.Location)
+	assert.Equal(suite.T(), "test", config.Database.Host)
+	assert.Equal(suite.T(), "report", config.Reconcile.Action)
+	assert.Equal(suite.T(), "quarantine/", config.Reconcile.QuarantinePrefix)
+	assert.Equal(suite.T(), 24*time.Hour, config.Reconcile.MinAge)
+	assert.Equal(suite.T(), "", config.Reconcile.Report)
+
+	viper.Set("reconcile.action", "delete")
+	viper.Set("reconcile.minAge", "2h")
+	viper.Set("reconcile.report", "/tmp/report.json")
+	config, err = NewConfig("reconcile")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "delete", config.Reconcile.Action)
+	assert.Equal(suite.T(), 2*time.Hour, config.Reconcile.MinAge)
+	assert.Equal(suite.T(), "/tmp/report.json", config.Reconcile.Report)
+
+	viper.Set("reconcile.action", "shred")
+	config, err = NewConfig("reconcile")
+	assert.Nil(suite.T(), config)
+	assert.EqualError(suite.T(), err, "reconcile.action 'shred' is not supported, use one of report, quarantine or delete")
+
+	viper.Set("reconcile.action", "quarantine")
+	viper.Set("reconcile.quarantinePrefix", "")
+	config, err = NewConfig("reconcile")
+	assert.Nil(suite.T(), config)
+	assert.EqualError(suite.T(), err, "reconcile.quarantinePrefix can not be empty when quarantining files")
+
+	// The broker is not needed
+	viper.Reset()
+	viper.Set("db.host", "test")
+	viper.Set("db.port", 123)
+	viper.Set("db.user", "test")
+	viper.Set("db.password", "test")
+	viper.Set("db.database", "test")
+	viper.Set("archive.location", "test")
+	_, err = NewConfig("reconcile")
+	assert.NoError(suite.T(), err)
+}
+
+func (suite *TestSuite) TestReplayConfiguration() {
+	config, err := NewConfig("replay")
+	assert.NoError(suite.T(), err)
+	assert.NotNil(suite.T(), config)
+	assert.Equal(suite.T(), "report", config.Replay.Action)
+	assert.Equal(suite.T(), 5*time.Second, config.Replay.Wait)
+	assert.True(suite.T(), config.Replay.Since.IsZero())
+	assert.Equal(suite.T(), 0, config.Broker.PrefetchCount)
+
+	viper.Set("replay.action", "replay")
+	viper.Set("replay.operator", "admin")
+	viper.Set("replay.correlationId", "ec4fbe1b-f9ca-4b9d-a2ff-16b3c8fc5bd1")
+	viper.Set("replay.since", "2023-06-01T10:00:00Z")
+	viper.Set("replay.wait", "1s")
+	config, err = NewConfig("replay")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "replay", config.Replay.Action)
+	assert.Equal(suite.T(), "admin", config.Replay.Operator)
+	assert.Equal(suite.T(), "ec4fbe1b-f9ca-4b9d-a2ff-16b3c8fc5bd1", config.Replay.CorrelationID)
+	assert.Equal(suite.T(), time.Date(2023, 6, 1, 10, 0, 0, 0, time.UTC), config.Replay.Since)
+	assert.Equal(suite.T(), time.Second, config.Replay.Wait)
+
+	viper.Set("replay.until", "yesterday")
+	_, err = NewConfig("replay")
+	assert.ErrorContains(suite.T(), err, "replay.until is not a RFC3339 time")
+	viper.Set("replay.until", "2023-06-02T10:00:00Z")
+
+	viper.Set("replay.operator", "")
+	_, err = NewConfig("replay")
+	assert.EqualError(suite.T(), err, "replay.operator must be set to replay messages")
+
+	viper.Set("replay.action", "drop")
+	_, err = NewConfig("replay")
+	assert.EqualError(suite.T(), err, "replay.action 'drop' is not supported, use one of report or replay")
+}
+
 func (suite *TestSuite) TestDefaultLogLevel() {
 	viper.Set("log.level", "test")
 	config, err := NewConfig("test")
@@ -639,6 +844,86 @@ func (suite *TestSuite) TestGetC4GHKey_passError() {
 	assert.EqualError(suite.T(), err, "chacha20poly1305: message authentication failed")
 }
 
+func (suite *TestSuite) TestGetC4GHKeyring() {
+	// Without a list of keys the keyring holds the single key
+	viper.Set("c4gh.filepath", "../../dev_utils/c4gh.sec.pem")
+	viper.Set("c4gh.passphrase", "oaagCP1YgAZeEyl2eJAkHv9lkcWXWFgm")
+	keyring, err := GetC4GHKeyring()
+	assert.NoError(suite.T(), err)
+	assert.Len(suite.T(), keyring, 1)
+	key, err := GetC4GHKey()
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), *key, keyring[0].PrivateKey)
+	publicKey, err := ReadC4GHPublicKey("../../dev_utils/c4gh.pub.pem")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), KeyHash(*publicKey), keyring[0].KeyHash)
+
+	// A second key with its passphrase in a file and a third with it in the environment
+	dir := suite.T().TempDir()
+	_, newKey, err := keys.GenerateKeyPair()
+	assert.NoError(suite.T(), err)
+	keyFile, err := os.Create(filepath.Join(dir, "new.sec.pem"))
+	assert.NoError(suite.T(), err)
+	assert.NoError(suite.T(), keys.WriteCrypt4GHX25519PrivateKey(keyFile, newKey, []byte("filepass")))
+	keyFile.Close()
+	assert.NoError(suite.T(), os.WriteFile(filepath.Join(dir, "passphrase"), []byte("filepass\n"), 0600))
+	suite.T().Setenv("TEST_C4GH_PASSPHRASE", "oaagCP1YgAZeEyl2eJAkHv9lkcWXWFgm")
+
+	viper.Set("c4gh.keys", []map[string]interface{}{
+		{"filepath": filepath.Join(dir, "new.sec.pem"), "passphrase": "file://" + filepath.Join(dir, "passphrase")},
+		{"filepath": "../../dev_utils/c4gh.sec.pem", "passphrase": "env://TEST_C4GH_PASSPHRASE"},
+	})
+	keyring, err = GetC4GHKeyring()
+	assert.NoError(suite.T(), err)
+	assert.Len(suite.T(), keyring, 2)
+	assert.Equal(suite.T(), newKey, keyring[0].PrivateKey)
+	assert.Equal(suite.T(), KeyHash(keys.DerivePublicKey(newKey)), keyring[0].KeyHash)
+	assert.Equal(suite.T(), *key, keyring[1].PrivateKey)
+
+	viper.Set("c4gh.keys", []map[string]interface{}{
+		{"filepath": "../../dev_utils/c4gh.sec.pem", "passphrase": "env://TEST_C4GH_MISSING"},
+	})
+	_, err = GetC4GHKeyring()
+	assert.EqualError(suite.T(), err, "failed to resolve passphrase for c4gh key ../../dev_utils/c4gh.sec.pem, reason: environment variable TEST_C4GH_MISSING is not set")
+
+	viper.Set("c4gh.keys", []map[string]interface{}{
+		{"filepath": "../../dev_utils/c4gh.sec.pem", "passphrase": "wrong"},
+	})
+	_, err = GetC4GHKeyring()
+	assert.EqualError(suite.T(), err, "failed to read c4gh key ../../dev_utils/c4gh.sec.pem, reason: chacha20poly1305: message authentication failed")
+
+	viper.Set("c4gh.keys", []map[string]interface{}{})
+	_, err = GetC4GHKeyring()
+	assert.EqualError(suite.T(), err, "c4gh.keys does not contain any keys")
+}
+
+func (suite *TestSuite) TestFindC4GHKey() {
+	viper.Set("c4gh.filepath", "../../dev_utils/c4gh.sec.pem")
+	viper.Set("c4gh.passphrase", "oaagCP1YgAZeEyl2eJAkHv9lkcWXWFgm")
+	archiveKeyring, err := GetC4GHKeyring()
+	assert.NoError(suite.T(), err)
+
+	file, err := os.Open("../../dev_utils/dummy_data.c4gh")
+	assert.NoError(suite.T(), err)
+	defer file.Close()
+	header, err := headers.ReadHeader(file)
+	assert.NoError(suite.T(), err)
+
+	_, newKey, err := keys.GenerateKeyPair()
+	assert.NoError(suite.T(), err)
+	keyring := []C4GHKey{{PrivateKey: newKey, KeyHash: "new"}, archiveKeyring[0]}
+
+	key, err := FindC4GHKey(keyring, header)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), archiveKeyring[0].KeyHash, key.KeyHash)
+
+	_, err = FindC4GHKey(keyring[:1], header)
+	assert.Error(suite.T(), err)
+
+	_, err = FindC4GHKey(nil, header)
+	assert.EqualError(suite.T(), err, "no keys to decrypt with")
+}
+
 func (suite *TestSuite) TestGetC4GHPublicKey() {
 	viper.Set("c4gh.backupPubKey", "../../dev_utils/c4gh-new.pub.pem")
 	byte, err := GetC4GHPublicKey()
@@ -711,6 +996,97 @@ func (suite *TestSuite) TestBackupConfiguration() {
 	assert.NotNil(suite.T(), config)
 }
 
+func (suite *TestSuite) TestBackupDestinations() {
+	viper.Set("archive.location", "test")
+	viper.Set("backup.location", "test")
+
+	// Without destinations the backup settings make up a single destination
+	config, err := NewConfig("backup")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), []BackupConf{{Name: "backup", Storage: config.Backup, prefix: "backup"}}, config.Backups)
+	assert.Equal(suite.T(), 1, config.BackupQuorum)
+
+	viper.Set("backup.copyHeader", true)
+	viper.Set("c4gh.backupPubKey", "../../dev_utils/c4gh.pub.pem")
+	viper.Set("backup.destinations", map[string]interface{}{
+		"north": map[string]interface{}{"type": POSIX, "location": "/north"},
+		"south": map[string]interface{}{
+			"type": S3, "url": "test", "accesskey": "test", "secretkey": "test", "bucket": "south",
+			"copyHeader": true, "pubKeys": []string{"../../dev_utils/c4gh.pub.pem", "../../dev_utils/c4gh-new.pub.pem"},
+		},
+	})
+	config, err = NewConfig("backup")
+	assert.NoError(suite.T(), err)
+	assert.Len(suite.T(), config.Backups, 2)
+	assert.Equal(suite.T(), 2, config.BackupQuorum)
+	assert.Equal(suite.T(), "north", config.Backups[0].Name)
+	assert.Equal(suite.T(), POSIX, config.Backups[0].Storage.Type)
+	assert.Equal(suite.T(), "/north", config.Backups[0].Storage.Posix.Location)
+	assert.True(suite.T(), config.Backups[0].CopyHeader)
+	assert.Len(suite.T(), config.Backups[0].PublicKeys, 1)
+	assert.Equal(suite.T(), "south", config.Backups[1].Name)
+	assert.Equal(suite.T(), S3, config.Backups[1].Storage.Type)
+	assert.Equal(suite.T(), "south", config.Backups[1].Storage.S3.Bucket)
+	assert.True(suite.T(), config.Backups[1].CopyHeader)
+	assert.Len(suite.T(), config.Backups[1].PublicKeys, 2)
+	assert.Equal(suite.T(), config.Backups[0].PublicKeys[0], config.Backups[1].PublicKeys[0])
+	assert.NotEqual(suite.T(), config.Backups[1].PublicKeys[0], config.Backups[1].PublicKeys[1])
+
+	viper.Set("backup.quorum", 1)
+	config, err = NewConfig("backup")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 1, config.BackupQuorum)
+
+	viper.Set("backup.quorum", 3)
+	_, err = NewConfig("backup")
+	assert.EqualError(suite.T(), err, "backup.quorum must be between 1 and the number of backup destinations (2)")
+
+	viper.Set("backup.quorum", 1)
+	viper.Set("backup.destinations.north.type", "tape")
+	_, err = NewConfig("backup")
+	assert.EqualError(suite.T(), err, "backup.destinations.north.type 'tape' is not supported, use one of posix, s3 or sftp")
+
+	viper.Set("backup.destinations.north.type", SFTP)
+	_, err = NewConfig("backup")
+	assert.EqualError(suite.T(), err, "backup.destinations.north.sftp.host not set")
+}
+
+func (suite *TestSuite) TestBackupPublicKeys() {
+	viper.Set("archive.location", "test")
+	viper.Set("backup.location", "test")
+	viper.Set("backup.copyHeader", true)
+
+	_, err := NewConfig("backup")
+	assert.EqualError(suite.T(), err, "c4gh.backupPubKeys or c4gh.backupPubKey must be set when copying headers")
+
+	viper.Set("c4gh.backupPubKey", "../../dev_utils/c4gh.pub.pem")
+	config, err := NewConfig("backup")
+	assert.NoError(suite.T(), err)
+	assert.Len(suite.T(), config.Backups[0].PublicKeys, 1)
+
+	// The list of keys takes precedence over the single key
+	viper.Set("c4gh.backupPubKeys", []string{"../../dev_utils/c4gh.pub.pem", "../../dev_utils/c4gh-new.pub.pem"})
+	config, err = NewConfig("backup")
+	assert.NoError(suite.T(), err)
+	assert.Len(suite.T(), config.Backups[0].PublicKeys, 2)
+
+	viper.Set("c4gh.backupPubKeys", "../../dev_utils/c4gh.pub.pem ../../dev_utils/README.md")
+	_, err = NewConfig("backup")
+	assert.ErrorContains(suite.T(), err, "failed to read backup public key ../../dev_utils/README.md")
+
+	viper.Set("c4gh.backupPubKeys", []string{"../../dev_utils/missing.pub.pem"})
+	viper.Set("backup.destinations", map[string]interface{}{
+		"north": map[string]interface{}{"type": POSIX, "location": "/north", "pubKey": "../../dev_utils/c4gh-new.pub.pem"},
+	})
+	config, err = NewConfig("backup")
+	assert.NoError(suite.T(), err)
+	assert.Len(suite.T(), config.Backups[0].PublicKeys, 1)
+
+	viper.Set("backup.destinations.north.pubKeys", []string{"../../dev_utils/missing.pub.pem"})
+	_, err = NewConfig("backup")
+	assert.ErrorContains(suite.T(), err, "backup.destinations.north: failed to read backup public key ../../dev_utils/missing.pub.pem")
+}
+
 func (suite *TestSuite) TestCopyHeader() {
 	viper.Set("backup.copyHeader", "true")
 	cHeader := CopyHeader()
@@ -724,9 +1100,14 @@ func (suite *TestSuite) TestAPIConfiguration() {
 	assert.Error(suite.T(), err)
 	assert.Nil(suite.T(), config)
 
-	// testing deafult values
 	suite.SetupTest()
 	config, err = NewConfig("api")
+	assert.Nil(suite.T(), config)
+	assert.EqualError(suite.T(), err, "api.jwt.pubKeyPath or api.jwt.jwksPath must be set")
+
+	// testing deafult values
+	viper.Set("api.jwt.jwksPath", "/jwks.json")
+	config, err = NewConfig("api")
 	assert.NotNil(suite.T(), config)
 	assert.NoError(suite.T(), err)
 	assert.NotNil(suite.T(), config.API)
@@ -736,6 +1117,7 @@ func (suite *TestSuite) TestAPIConfiguration() {
 	assert.Equal(suite.T(), true, config.API.Session.HTTPOnly)
 	assert.Equal(suite.T(), "api_session_key", config.API.Session.Name)
 	assert.Equal(suite.T(), -1*time.Second, config.API.Session.Expiration)
+	assert.Equal(suite.T(), JWTConf{JwksPath: "/jwks.json", UserClaim: "sub", RoleClaim: "role", AdminRole: "admin"}, config.API.JWT)
 
 	viper.Reset()
 	suite.SetupTest()
@@ -744,6 +1126,9 @@ func (suite *TestSuite) TestAPIConfiguration() {
 	viper.Set("api.session.secure", false)
 	viper.Set("api.session.domain", "test")
 	viper.Set("api.session.expiration", 60)
+	viper.Set("api.jwt.pubKeyPath", "/keys")
+	viper.Set("api.jwt.issuer", "https://login.example.org")
+	viper.Set("api.jwt.roleClaim", "groups")
 
 	config, err = NewConfig("api")
 	assert.NotNil(suite.T(), config)
@@ -754,6 +1139,9 @@ func (suite *TestSuite) TestAPIConfiguration() {
 	assert.Equal(suite.T(), false, config.API.Session.Secure)
 	assert.Equal(suite.T(), "test", config.API.Session.Domain)
 	assert.Equal(suite.T(), 60*time.Second, config.API.Session.Expiration)
+	assert.Equal(suite.T(), "/keys", config.API.JWT.PubKeyPath)
+	assert.Equal(suite.T(), "https://login.example.org", config.API.JWT.Issuer)
+	assert.Equal(suite.T(), "groups", config.API.JWT.RoleClaim)
 }
 
 func (suite *TestSuite) TestNotifyConfiguration() {
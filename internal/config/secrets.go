@@ -0,0 +1,371 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"sda-pipeline/internal/storage"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// SecretProvider looks up the secrets that settings refer to.
+// A setting refers to a secret with a value like <scheme>://<ref>, where
+// scheme selects the provider and ref is passed to it.
+type SecretProvider interface {
+	GetSecret(ref string) (string, error)
+}
+
+// secretKeys are settings that can refer to secrets even if they are only
+// set in the environment. Any other setting whose name ends with one of
+// secretSuffixes can refer to a secret when set in the config file.
+var secretKeys = []string{
+	"broker.password",
+	"db.password",
+	"smtp.password",
+	"c4gh.passphrase",
+	"archive.accesskey", "archive.secretkey",
+	"inbox.accesskey", "inbox.secretkey",
+	"backup.accesskey", "backup.secretkey", "backup.sftp.pemkeypass",
+}
+
+var secretSuffixes = []string{"password", "passphrase", "accesskey", "secretkey", "pemkeypass"}
+
+// secretsMu guards secrets and secretRefs, which WatchSecrets updates while
+// the service runs
+var secretsMu sync.RWMutex
+
+// secrets holds the resolved values of the settings that can refer to
+// secrets
+var secrets = map[string]string{}
+
+// secretRefs holds the references of the settings that refer to secrets,
+// and secretRefProviders the providers to resolve them with again
+var secretRefs = map[string]string{}
+var secretRefProviders map[string]SecretProvider
+
+// fileSecrets reads secrets from files, such as mounted kubernetes secrets
+type fileSecrets struct{}
+
+// GetSecret returns the content of the file at path, without trailing newlines
+func (fileSecrets) GetSecret(path string) (string, error) {
+	secret, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(string(secret), "\r\n"), nil
+}
+
+// envSecrets reads secrets from other environment variables
+type envSecrets struct{}
+
+// GetSecret returns the value of the environment variable name
+func (envSecrets) GetSecret(name string) (string, error) {
+	secret, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", name)
+	}
+
+	return secret, nil
+}
+
+// vaultSecrets reads secrets from a HashiCorp Vault compatible KV version 2
+// secrets engine
+type vaultSecrets struct {
+	address string
+	token   string
+	mount   string
+	client  *http.Client
+}
+
+// newVaultSecrets configures the vault provider from the vault.* settings.
+// The token can itself refer to a file or an environment variable.
+func newVaultSecrets() (*vaultSecrets, error) {
+	if !viper.IsSet("vault.address") {
+		return nil, errors.New("vault.address not set")
+	}
+
+	token, err := resolveSecret(viper.GetString("vault.token"), map[string]SecretProvider{"file": fileSecrets{}, "env": envSecrets{}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve vault.token, reason: %v", err)
+	}
+
+	v := &vaultSecrets{
+		address: strings.TrimRight(viper.GetString("vault.address"), "/"),
+		token:   token,
+		mount:   "secret",
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+	if viper.IsSet("vault.mount") {
+		v.mount = strings.Trim(viper.GetString("vault.mount"), "/")
+	}
+
+	if viper.IsSet("vault.cacert") {
+		caCert, err := os.ReadFile(viper.GetString("vault.cacert"))
+		if err != nil {
+			return nil, err
+		}
+		certPool := x509.NewCertPool()
+		if !certPool.AppendCertsFromPEM(caCert) {
+			return nil, errors.New("failed to parse vault.cacert")
+		}
+		v.client.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: certPool, MinVersion: tls.VersionTLS12}}
+	}
+
+	return v, nil
+}
+
+// GetSecret returns a field of a secret, given as <path>#<field>
+func (v *vaultSecrets) GetSecret(ref string) (string, error) {
+	path, field, found := strings.Cut(ref, "#")
+	if !found || path == "" || field == "" {
+		return "", fmt.Errorf("vault secret %s is not on the form <path>#<field>", ref)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/v1/%s/data/%s", v.address, v.mount, strings.Trim(path, "/")), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+
+	res, err := v.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("vault returned %s for secret %s", res.Status, path)
+	}
+
+	var secret struct {
+		Data struct {
+			Data map[string]interface{} `json:"data"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&secret); err != nil {
+		return "", fmt.Errorf("failed to decode vault secret %s, reason: %v", path, err)
+	}
+
+	value, ok := secret.Data.Data[field].(string)
+	if !ok {
+		return "", fmt.Errorf("vault secret %s has no field %s", path, field)
+	}
+
+	return value, nil
+}
+
+// secretProviders returns the available secret providers by scheme. The
+// vault provider is only set up if a setting refers to it.
+func secretProviders() map[string]SecretProvider {
+	return map[string]SecretProvider{
+		"file":  fileSecrets{},
+		"env":   envSecrets{},
+		"vault": &lazyVaultSecrets{},
+	}
+}
+
+// lazyVaultSecrets sets up the vault provider on first use
+type lazyVaultSecrets struct {
+	vault *vaultSecrets
+	err   error
+}
+
+func (l *lazyVaultSecrets) GetSecret(ref string) (string, error) {
+	if l.vault == nil && l.err == nil {
+		l.vault, l.err = newVaultSecrets()
+	}
+	if l.err != nil {
+		return "", l.err
+	}
+
+	return l.vault.GetSecret(ref)
+}
+
+// resolveSecret returns the secret that value refers to, or value itself
+// if it doesn't refer to a secret
+func resolveSecret(value string, providers map[string]SecretProvider) (string, error) {
+	scheme, ref, found := strings.Cut(value, "://")
+	if !found {
+		return value, nil
+	}
+
+	provider, ok := providers[scheme]
+	if !ok {
+		return value, nil
+	}
+
+	return provider.GetSecret(ref)
+}
+
+// resolveSecrets resolves all settings that refer to secrets, and keeps
+// the references so that WatchSecrets can resolve them again
+func resolveSecrets() error {
+	keys := map[string]bool{}
+	for _, key := range secretKeys {
+		keys[key] = true
+	}
+	for _, key := range viper.AllKeys() {
+		for _, suffix := range secretSuffixes {
+			if strings.HasSuffix(key, "."+suffix) || key == suffix {
+				keys[key] = true
+			}
+		}
+	}
+
+	providers := secretProviders()
+	resolved := map[string]string{}
+	refs := map[string]string{}
+	for key := range keys {
+		if !viper.IsSet(key) {
+			continue
+		}
+
+		value := viper.GetString(key)
+		secret, err := resolveSecret(value, providers)
+		if err != nil {
+			return fmt.Errorf("failed to resolve secret for %s, reason: %v", key, err)
+		}
+		resolved[key] = secret
+		if scheme, _, found := strings.Cut(value, "://"); found && providers[scheme] != nil {
+			refs[key] = value
+		}
+	}
+
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+
+	secrets, secretRefs, secretRefProviders = resolved, refs, providers
+
+	return nil
+}
+
+// getSecret returns the value of a setting that can refer to a secret
+func getSecret(key string) string {
+	secretsMu.RLock()
+	value, ok := secrets[strings.ToLower(key)]
+	secretsMu.RUnlock()
+	if ok {
+		return value
+	}
+
+	return viper.GetString(key)
+}
+
+// currentSecret returns the resolved value of a setting that can refer to
+// a secret, or value if the setting is not set. Unlike getSecret it does
+// not read the configuration, so it is safe to use while the service runs.
+func currentSecret(key, value string) string {
+	secretsMu.RLock()
+	defer secretsMu.RUnlock()
+
+	if secret, ok := secrets[strings.ToLower(key)]; ok {
+		return secret
+	}
+
+	return value
+}
+
+// WatchSecrets resolves the secret references of c again every
+// secrets.refreshInterval, and calls onChange with a copy of c that has
+// the new secrets when any of them has changed. It returns at once if no
+// refresh interval is set.
+func WatchSecrets(c *Config, onChange func(*Config)) {
+	if c.SecretsRefreshInterval <= 0 {
+		return
+	}
+
+	for {
+		time.Sleep(c.SecretsRefreshInterval)
+
+		changed, err := refreshSecrets()
+		if err != nil {
+			log.Errorf("Failed to refresh secrets, reason: %v", err)
+
+			continue
+		}
+		if len(changed) == 0 {
+			continue
+		}
+
+		log.Infof("Secrets changed for %s", strings.Join(changed, ", "))
+		c = c.withCurrentSecrets()
+		onChange(c)
+	}
+}
+
+// refreshSecrets resolves the secret references again and returns the
+// settings whose secrets have changed. The secrets are kept as they were
+// if any of them fails to resolve.
+func refreshSecrets() ([]string, error) {
+	secretsMu.RLock()
+	refs := make(map[string]string, len(secretRefs))
+	for key, ref := range secretRefs {
+		refs[key] = ref
+	}
+	providers := secretRefProviders
+	secretsMu.RUnlock()
+
+	resolved := map[string]string{}
+	for key, ref := range refs {
+		secret, err := resolveSecret(ref, providers)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve secret for %s, reason: %v", key, err)
+		}
+		resolved[key] = secret
+	}
+
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+
+	var changed []string
+	for key, secret := range resolved {
+		if secrets[key] != secret {
+			secrets[key] = secret
+			changed = append(changed, key)
+		}
+	}
+	sort.Strings(changed)
+
+	return changed, nil
+}
+
+// withCurrentSecrets returns a copy of c with the secrets as they are now
+func (c *Config) withCurrentSecrets() *Config {
+	refreshed := *c
+	refreshed.Broker.Password = currentSecret("broker.password", c.Broker.Password)
+	refreshed.Database.Password = currentSecret("db.password", c.Database.Password)
+	refreshed.Notify.Password = currentSecret("smtp.password", c.Notify.Password)
+	refreshed.Archive = storageWithCurrentSecrets("archive", c.Archive)
+	refreshed.Inbox = storageWithCurrentSecrets("inbox", c.Inbox)
+	refreshed.Backup = storageWithCurrentSecrets("backup", c.Backup)
+
+	refreshed.Backups = make([]BackupConf, len(c.Backups))
+	for i, backup := range c.Backups {
+		refreshed.Backups[i] = backup
+		refreshed.Backups[i].Storage = storageWithCurrentSecrets(backup.prefix, backup.Storage)
+	}
+
+	return &refreshed
+}
+
+// storageWithCurrentSecrets returns a copy of the storage configuration
+// under prefix with the secrets as they are now
+func storageWithCurrentSecrets(prefix string, conf storage.Conf) storage.Conf {
+	conf.S3.AccessKey = currentSecret(prefix+".accesskey", conf.S3.AccessKey)
+	conf.S3.SecretKey = currentSecret(prefix+".secretkey", conf.S3.SecretKey)
+	conf.SFTP.PemKeyPass = currentSecret(prefix+".sftp.pemkeypass", conf.SFTP.PemKeyPass)
+
+	return conf
+}
@@ -0,0 +1,191 @@
+package config
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// vaultStub serves the secrets as a KV version 2 secrets engine mounted at
+// secret/ for the token "vault-token"
+func vaultStub(secrets map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "vault-token" {
+			w.WriteHeader(http.StatusForbidden)
+
+			return
+		}
+		value, ok := secrets[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+
+			return
+		}
+		fmt.Fprintf(w, `{"data": {"data": {"password": %q}, "metadata": {"version": 1}}}`, value)
+	}))
+}
+
+func (suite *TestSuite) TestResolveSecrets() {
+	dir := suite.T().TempDir()
+	assert.NoError(suite.T(), os.WriteFile(filepath.Join(dir, "db-password"), []byte("from-file\n"), 0600))
+	suite.T().Setenv("SECRET_MQ_PASSWORD", "from-env")
+
+	vault := vaultStub(map[string]string{"/v1/secret/data/sda/smtp": "from-vault"})
+	defer vault.Close()
+	viper.Set("vault.address", vault.URL)
+	viper.Set("vault.token", "env://VAULT_TOKEN")
+	suite.T().Setenv("VAULT_TOKEN", "vault-token")
+
+	viper.Set("db.password", "file://"+filepath.Join(dir, "db-password"))
+	viper.Set("broker.password", "env://SECRET_MQ_PASSWORD")
+	viper.Set("smtp.host", "test")
+	viper.Set("smtp.port", 456)
+	viper.Set("smtp.password", "vault://sda/smtp#password")
+	viper.Set("smtp.from", "noreply")
+	viper.Set("inbox.type", "s3")
+	viper.Set("inbox.url", "test")
+	viper.Set("inbox.accesskey", "plain")
+	viper.Set("inbox.secretkey", "env://SECRET_MQ_PASSWORD")
+	viper.Set("inbox.bucket", "test")
+
+	config, err := NewConfig("reconcile")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "from-file", config.Database.Password)
+	assert.Equal(suite.T(), "from-env", config.Broker.Password)
+
+	config, err = NewConfig("notify")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "from-vault", config.Notify.Password)
+
+	config, err = NewConfig("mapper")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "plain", config.Inbox.S3.AccessKey)
+	assert.Equal(suite.T(), "from-env", config.Inbox.S3.SecretKey)
+}
+
+func (suite *TestSuite) TestResolveSecrets_errors() {
+	viper.Set("db.password", "file:///does/not/exist")
+	_, err := NewConfig("reconcile")
+	assert.ErrorContains(suite.T(), err, "failed to resolve secret for db.password")
+
+	viper.Set("db.password", "env://SECRET_NOT_SET")
+	_, err = NewConfig("reconcile")
+	assert.EqualError(suite.T(), err, "failed to resolve secret for db.password, reason: environment variable SECRET_NOT_SET is not set")
+
+	viper.Set("db.password", "vault://sda/db#password")
+	_, err = NewConfig("reconcile")
+	assert.EqualError(suite.T(), err, "failed to resolve secret for db.password, reason: vault.address not set")
+
+	vault := vaultStub(map[string]string{"/v1/secret/data/sda/db": "secret"})
+	defer vault.Close()
+	viper.Set("vault.address", vault.URL)
+	viper.Set("vault.token", "wrong-token")
+	_, err = NewConfig("reconcile")
+	assert.EqualError(suite.T(), err, "failed to resolve secret for db.password, reason: vault returned 403 Forbidden for secret sda/db")
+
+	viper.Set("vault.token", "vault-token")
+	viper.Set("db.password", "vault://sda/db#username")
+	_, err = NewConfig("reconcile")
+	assert.EqualError(suite.T(), err, "failed to resolve secret for db.password, reason: vault secret sda/db has no field username")
+
+	viper.Set("db.password", "vault://sda/db")
+	_, err = NewConfig("reconcile")
+	assert.EqualError(suite.T(), err, "failed to resolve secret for db.password, reason: vault secret sda/db is not on the form <path>#<field>")
+
+	// Values with an unknown scheme are not secret references
+	viper.Set("db.password", "pass://word")
+	config, err := NewConfig("reconcile")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "pass://word", config.Database.Password)
+}
+
+func (suite *TestSuite) TestResolveSecrets_vaultMount() {
+	vault := vaultStub(map[string]string{"/v1/kv/data/sda/db": "secret"})
+	defer vault.Close()
+	viper.Set("vault.address", vault.URL+"/")
+	viper.Set("vault.token", "vault-token")
+	viper.Set("vault.mount", "kv")
+	viper.Set("db.password", "vault://sda/db#password")
+
+	config, err := NewConfig("reconcile")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "secret", config.Database.Password)
+}
+
+func (suite *TestSuite) TestRefreshSecrets() {
+	secretFile := filepath.Join(suite.T().TempDir(), "db-password")
+	assert.NoError(suite.T(), os.WriteFile(secretFile, []byte("old"), 0600))
+	viper.Set("db.password", "file://"+secretFile)
+
+	config, err := NewConfig("reconcile")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "old", config.Database.Password)
+
+	changed, err := refreshSecrets()
+	assert.NoError(suite.T(), err)
+	assert.Empty(suite.T(), changed)
+
+	// Only the references are resolved again, the configuration is not read
+	viper.Set("db.password", "file:///does/not/exist")
+	assert.NoError(suite.T(), os.WriteFile(secretFile, []byte("new"), 0600))
+	changed, err = refreshSecrets()
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), []string{"db.password"}, changed)
+	assert.Equal(suite.T(), "new", config.withCurrentSecrets().Database.Password)
+	assert.Equal(suite.T(), "old", config.Database.Password)
+
+	// A failed refresh keeps the secrets from before
+	assert.NoError(suite.T(), os.Remove(secretFile))
+	_, err = refreshSecrets()
+	assert.Error(suite.T(), err)
+	assert.Equal(suite.T(), "new", config.withCurrentSecrets().Database.Password)
+}
+
+func (suite *TestSuite) TestWithCurrentSecrets() {
+	suite.T().Setenv("SECRET_MQ_PASSWORD", "mq-old")
+	suite.T().Setenv("SECRET_SOUTH_KEY", "south-old")
+	viper.Set("broker.password", "env://SECRET_MQ_PASSWORD")
+	viper.Set("archive.location", "test")
+	viper.Set("backup.destinations", map[string]interface{}{
+		"north": map[string]interface{}{"type": POSIX, "location": "/north"},
+		"south": map[string]interface{}{
+			"type": S3, "url": "test", "accesskey": "test", "secretkey": "env://SECRET_SOUTH_KEY", "bucket": "south",
+		},
+	})
+
+	config, err := NewConfig("backup")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "south-old", config.Backups[1].Storage.S3.SecretKey)
+
+	suite.T().Setenv("SECRET_MQ_PASSWORD", "mq-new")
+	suite.T().Setenv("SECRET_SOUTH_KEY", "south-new")
+	changed, err := refreshSecrets()
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), []string{"backup.destinations.south.secretkey", "broker.password"}, changed)
+
+	refreshed := config.withCurrentSecrets()
+	assert.Equal(suite.T(), "mq-new", refreshed.Broker.Password)
+	assert.Equal(suite.T(), "south-new", refreshed.Backups[1].Storage.S3.SecretKey)
+	assert.Equal(suite.T(), "test", refreshed.Backups[1].Storage.S3.AccessKey)
+	assert.Equal(suite.T(), "/north", refreshed.Backups[0].Storage.Posix.Location)
+	assert.Equal(suite.T(), "south-old", config.Backups[1].Storage.S3.SecretKey)
+}
+
+func (suite *TestSuite) TestGetC4GHKey_passphraseReference() {
+	suite.T().Setenv("C4GH_PASSPHRASE", "oaagCP1YgAZeEyl2eJAkHv9lkcWXWFgm")
+	viper.Set("c4gh.filepath", "../../dev_utils/c4gh.sec.pem")
+	viper.Set("c4gh.passphrase", "env://C4GH_PASSPHRASE")
+
+	key, err := GetC4GHKey()
+	assert.NoError(suite.T(), err)
+	assert.NotNil(suite.T(), key)
+
+	keyring, err := GetC4GHKeyring()
+	assert.NoError(suite.T(), err)
+	assert.Len(suite.T(), keyring, 1)
+}
@@ -3,14 +3,20 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"hash"
 	"math"
+	"strings"
+	"sync"
 	"time"
 
+	"sda-pipeline/internal/metrics"
+
 	log "github.com/sirupsen/logrus"
 
 	// Needed implicitly to enable Postgres driver
@@ -34,6 +40,8 @@ type Database interface {
 type SQLdb struct {
 	DB       *sql.DB
 	ConnInfo string
+	// mu guards DB and ConnInfo, which are replaced when reconnecting
+	mu sync.RWMutex
 }
 
 // DBConf stores information about the database backend
@@ -56,6 +64,50 @@ type FileInfo struct {
 	Path              string
 	DecryptedChecksum hash.Hash
 	DecryptedSize     int64
+	// UploadedDigests and DecryptedDigests are checksums of the uploaded
+	// and the decrypted file besides Checksum and DecryptedChecksum
+	UploadedDigests  Digests
+	DecryptedDigests Digests
+}
+
+// FileDetails is what is known about a file in the database
+type FileDetails struct {
+	FileID        string      `json:"fileId"`
+	AccessionID   string      `json:"accessionId,omitempty"`
+	User          string      `json:"user"`
+	InboxPath     string      `json:"inboxPath"`
+	ArchivePath   string      `json:"archivePath,omitempty"`
+	ArchiveSize   int64       `json:"archiveSize,omitempty"`
+	DecryptedSize int64       `json:"decryptedSize,omitempty"`
+	CreatedAt     time.Time   `json:"createdAt"`
+	Checksums     []Checksum  `json:"checksums"`
+	Datasets      []string    `json:"datasets"`
+	Events        []FileEvent `json:"events"`
+}
+
+// Checksum is a checksum of a file, where source tells which version of
+// the file it is for
+type Checksum struct {
+	Checksum string `json:"checksum"`
+	Type     string `json:"type"`
+	Source   string `json:"source"`
+}
+
+// FileEvent is an entry in the event log of a file
+type FileEvent struct {
+	Event         string          `json:"event"`
+	CorrelationID string          `json:"correlationId,omitempty"`
+	User          string          `json:"user,omitempty"`
+	Message       json.RawMessage `json:"message,omitempty"`
+	Time          time.Time       `json:"time"`
+}
+
+// DatasetFile is a file in a dataset with its latest event
+type DatasetFile struct {
+	FileID      string `json:"fileId"`
+	AccessionID string `json:"accessionId"`
+	InboxPath   string `json:"inboxPath"`
+	Status      string `json:"status"`
 }
 
 // dbRetryTimes is the number of times to retry the same function if it fails
@@ -73,12 +125,6 @@ var sqlOpen = sql.Open
 // logFatalf is an internal variable to ease testing
 var logFatalf = log.Fatalf
 
-// hashType returns the identification string for the hash type
-func hashType(h hash.Hash) string {
-	// TODO: Support/check type
-	return "SHA256"
-}
-
 // NewDB creates a new DB connection
 func NewDB(config DBConf) (*SQLdb, error) {
 	connInfo := buildConnInfo(config)
@@ -120,7 +166,58 @@ func buildConnInfo(config DBConf) string {
 	return connInfo
 }
 
+// UpdateConf reconnects to the database with new connection settings, for
+// instance after the password has been rotated. The old connection is kept
+// if the database can't be reached with the new settings.
+func (dbs *SQLdb) UpdateConf(config DBConf) error {
+	connInfo := buildConnInfo(config)
+
+	db, err := sqlOpen("postgres", connInfo)
+	if err != nil {
+		return err
+	}
+
+	if err = db.Ping(); err != nil {
+		db.Close()
+
+		return err
+	}
+
+	dbs.mu.Lock()
+	old := dbs.DB
+	dbs.DB = db
+	dbs.ConnInfo = connInfo
+	dbs.mu.Unlock()
+
+	// Closing waits for the queries that are running on the old connection
+	// to finish, queries that fail to start on it are retried on the new one
+	old.Close()
+
+	return nil
+}
+
+// handle returns the current connection to the database
+func (dbs *SQLdb) handle() *sql.DB {
+	dbs.mu.RLock()
+	defer dbs.mu.RUnlock()
+
+	return dbs.DB
+}
+
+// Ping checks that the database can be reached
+func (dbs *SQLdb) Ping(ctx context.Context) error {
+	db := dbs.handle()
+	if db == nil {
+		return errors.New("database is nil")
+	}
+
+	return db.PingContext(ctx)
+}
+
 func (dbs *SQLdb) Reconnect() {
+	dbs.mu.Lock()
+	defer dbs.mu.Unlock()
+
 	dbs.DB.Close()
 	dbs.DB, _ = sqlOpen("postgres", dbs.ConnInfo)
 }
@@ -130,22 +227,23 @@ func (dbs *SQLdb) Reconnect() {
 func (dbs *SQLdb) checkAndReconnectIfNeeded() {
 	start := time.Now()
 
-	for dbs.DB.Ping() != nil {
+	for dbs.handle().Ping() != nil {
 		log.Errorln("Database unreachable, reconnecting")
-		dbs.DB.Close()
 
 		if time.Since(start) > dbReconnectTimeout {
 			logFatalf("Could not reconnect to failed database in reasonable time, giving up")
 		}
 		time.Sleep(dbReconnectSleep)
 		log.Debugln("Reconnecting to DB")
-		dbs.DB, _ = sqlOpen("postgres", dbs.ConnInfo)
+		dbs.Reconnect()
 	}
 
 }
 
 // GetHeader retrieves the file header
 func (dbs *SQLdb) GetHeader(fileID string) ([]byte, error) {
+	defer metrics.DatabaseCall("GetHeader", time.Now())
+
 	var (
 		r     []byte
 		err   error
@@ -164,7 +262,7 @@ func (dbs *SQLdb) GetHeader(fileID string) ([]byte, error) {
 func (dbs *SQLdb) getHeader(fileID string) ([]byte, error) {
 	dbs.checkAndReconnectIfNeeded()
 
-	db := dbs.DB
+	db := dbs.handle()
 	const query = "SELECT header from sda.files WHERE id = $1"
 
 	var hexString string
@@ -182,9 +280,11 @@ func (dbs *SQLdb) getHeader(fileID string) ([]byte, error) {
 
 // GetHeaderForStableID retrieves the file header by using stable id
 func (dbs *SQLdb) GetHeaderForStableID(stableID string) (string, error) {
+	defer metrics.DatabaseCall("GetHeaderForStableID", time.Now())
+
 	dbs.checkAndReconnectIfNeeded()
 
-	db := dbs.DB
+	db := dbs.handle()
 	const query = "SELECT header from local_ega.files WHERE stable_id = $1"
 
 	var header string
@@ -197,6 +297,8 @@ func (dbs *SQLdb) GetHeaderForStableID(stableID string) (string, error) {
 
 // MarkCompleted marks the file as "COMPLETED"
 func (dbs *SQLdb) MarkCompleted(file FileInfo, fileID, corrID string) error {
+	defer metrics.DatabaseCall("MarkCompleted", time.Now())
+
 	var (
 		err   error
 		count int
@@ -210,13 +312,19 @@ func (dbs *SQLdb) MarkCompleted(file FileInfo, fileID, corrID string) error {
 	return err
 }
 
-// markCompleted performs actual work for MarkCompleted
+// markCompleted performs actual work for MarkCompleted, and stores the
+// checksums of the decrypted file in the same transaction
 func (dbs *SQLdb) markCompleted(file FileInfo, fileID, corrID string) error {
 	dbs.checkAndReconnectIfNeeded()
 
-	db := dbs.DB
+	db := dbs.handle()
+	transaction, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
 	const completed = "SELECT sda.set_verified($1, $2, $3, $4, $5, $6, $7);"
-	result, err := db.Exec(completed,
+	result, err := transaction.Exec(completed,
 		fileID,
 		corrID,
 		fmt.Sprintf("%x", file.Checksum.Sum(nil)),
@@ -225,18 +333,25 @@ func (dbs *SQLdb) markCompleted(file FileInfo, fileID, corrID string) error {
 		fmt.Sprintf("%x", file.DecryptedChecksum.Sum(nil)),
 		hashType(file.DecryptedChecksum),
 	)
+	if err == nil {
+		err = checkRowsAffected(result)
+	}
+	if err == nil {
+		err = setChecksums(transaction, fileID, "UNENCRYPTED", file.DecryptedDigests)
+	}
 	if err != nil {
+		rollback(transaction)
+
 		return err
 	}
-	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
-		return errors.New("something went wrong with the query zero rows were changed")
-	}
 
-	return nil
+	return transaction.Commit()
 }
 
 // RegisterFile inserts a file in the database
 func (dbs *SQLdb) RegisterFile(filePath, user string) (string, error) {
+	defer metrics.DatabaseCall("RegisterFile", time.Now())
+
 	var (
 		err   error
 		id    string
@@ -252,7 +367,7 @@ func (dbs *SQLdb) RegisterFile(filePath, user string) (string, error) {
 }
 func (dbs *SQLdb) registerFile(filePath, user string) (string, error) {
 	dbs.checkAndReconnectIfNeeded()
-	db := dbs.DB
+	db := dbs.handle()
 
 	const query = "SELECT sda.register_file($1, $2);"
 	var fileUUID string
@@ -265,6 +380,8 @@ func (dbs *SQLdb) registerFile(filePath, user string) (string, error) {
 }
 
 func (dbs *SQLdb) GetFileID(corrID string) (string, error) {
+	defer metrics.DatabaseCall("GetFileID", time.Now())
+
 	var (
 		err   error
 		count int
@@ -280,7 +397,7 @@ func (dbs *SQLdb) GetFileID(corrID string) (string, error) {
 }
 func (dbs *SQLdb) getFileID(corrID string) (string, error) {
 	dbs.checkAndReconnectIfNeeded()
-	db := dbs.DB
+	db := dbs.handle()
 	const getFileID = "SELECT DISTINCT file_id FROM sda.file_event_log where correlation_id = $1;"
 
 	var fileID string
@@ -294,6 +411,8 @@ func (dbs *SQLdb) getFileID(corrID string) (string, error) {
 
 // StoreHeader stores the file header in the database
 func (dbs *SQLdb) StoreHeader(header []byte, id string) error {
+	defer metrics.DatabaseCall("StoreHeader", time.Now())
+
 	var (
 		err   error
 		count int
@@ -311,7 +430,7 @@ func (dbs *SQLdb) StoreHeader(header []byte, id string) error {
 func (dbs *SQLdb) storeHeader(header []byte, id string) error {
 	dbs.checkAndReconnectIfNeeded()
 
-	db := dbs.DB
+	db := dbs.handle()
 	const query = "UPDATE sda.files SET header = $1 WHERE id = $2;"
 	result, err := db.Exec(query, hex.EncodeToString(header), id)
 	if err != nil {
@@ -326,6 +445,8 @@ func (dbs *SQLdb) storeHeader(header []byte, id string) error {
 
 // SetArchived marks the file as 'ARCHIVED'
 func (dbs *SQLdb) SetArchived(file FileInfo, fileID, corrID string) error {
+	defer metrics.DatabaseCall("SetArchived", time.Now())
+
 	var (
 		err   error
 		count int
@@ -339,13 +460,19 @@ func (dbs *SQLdb) SetArchived(file FileInfo, fileID, corrID string) error {
 	return err
 }
 
-// setArchived performs actual work for SetArchived
+// setArchived performs actual work for SetArchived, and stores the
+// checksums of the uploaded file in the same transaction
 func (dbs *SQLdb) setArchived(file FileInfo, fileID, corrID string) error {
 	dbs.checkAndReconnectIfNeeded()
 
-	db := dbs.DB
+	db := dbs.handle()
+	transaction, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
 	const query = "SELECT sda.set_archived($1, $2, $3, $4, $5, $6);"
-	result, err := db.Exec(query,
+	result, err := transaction.Exec(query,
 		fileID,
 		corrID,
 		file.Path,
@@ -353,9 +480,23 @@ func (dbs *SQLdb) setArchived(file FileInfo, fileID, corrID string) error {
 		fmt.Sprintf("%x", file.Checksum.Sum(nil)),
 		hashType(file.Checksum),
 	)
+	if err == nil {
+		err = checkRowsAffected(result)
+	}
+	if err == nil {
+		err = setChecksums(transaction, fileID, "UPLOADED", file.UploadedDigests)
+	}
 	if err != nil {
+		rollback(transaction)
+
 		return err
 	}
+
+	return transaction.Commit()
+}
+
+// checkRowsAffected returns an error if the statement changed no rows
+func checkRowsAffected(result sql.Result) error {
 	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
 		return errors.New("something went wrong with the query zero rows were changed")
 	}
@@ -363,8 +504,77 @@ func (dbs *SQLdb) setArchived(file FileInfo, fileID, corrID string) error {
 	return nil
 }
 
+// rollback rolls back a transaction that failed
+func rollback(transaction *sql.Tx) {
+	if e := transaction.Rollback(); e != nil {
+		log.Errorf("failed to rollback the transaction: %s", e)
+	}
+}
+
+// setChecksums stores the digests of a file in sda.checksums in the
+// transaction, one for each algorithm, replacing any that are already
+// stored for the same source
+func setChecksums(transaction *sql.Tx, fileID, source string, digests Digests) error {
+	const update = "UPDATE sda.checksums SET checksum = $1 WHERE file_id = $2 AND type = $3 AND source = $4;"
+	const insert = "INSERT INTO sda.checksums(file_id, checksum, type, source) VALUES($1, $2, $3, $4);"
+
+	for _, name := range digests.Names() {
+		checksumType, checksum := strings.ToUpper(name), digests.Hex(name)
+		result, err := transaction.Exec(update, checksum, fileID, checksumType, source)
+		if err != nil {
+			return err
+		}
+		if rowsAffected, _ := result.RowsAffected(); rowsAffected > 0 {
+			continue
+		}
+
+		if _, err := transaction.Exec(insert, fileID, checksum, checksumType, source); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// CheckChecksumAlgorithms returns an error if any of the checksum
+// algorithms can not be stored in sda.checksums, because the
+// sda.checksum_algorithm type of the database lacks it
+func (dbs *SQLdb) CheckChecksumAlgorithms(algorithms ...string) error {
+	defer metrics.DatabaseCall("CheckChecksumAlgorithms", time.Now())
+
+	dbs.checkAndReconnectIfNeeded()
+
+	const query = "SELECT unnest(enum_range(NULL::sda.checksum_algorithm))::text;"
+	rows, err := dbs.handle().Query(query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	supported := map[string]bool{}
+	for rows.Next() {
+		var algorithm string
+		if err := rows.Scan(&algorithm); err != nil {
+			return err
+		}
+		supported[algorithm] = true
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, algorithm := range algorithms {
+		if !supported[strings.ToUpper(algorithm)] {
+			return fmt.Errorf("checksum algorithm %s is not a value of sda.checksum_algorithm", strings.ToUpper(algorithm))
+		}
+	}
+
+	return nil
+}
+
 // CheckAccessionIdExists validates if an accessionID exists in the db
 func (dbs *SQLdb) CheckAccessionIDExists(accessionID string) (bool, error) {
+	defer metrics.DatabaseCall("CheckAccessionIDExists", time.Now())
 
 	var err error
 	var exists bool
@@ -385,7 +595,7 @@ func (dbs *SQLdb) CheckAccessionIDExists(accessionID string) (bool, error) {
 func (dbs *SQLdb) checkAccessionIDExists(accessionID string) (bool, error) {
 	dbs.checkAndReconnectIfNeeded()
 
-	db := dbs.DB
+	db := dbs.handle()
 
 	const checkIDExist = "SELECT COUNT(*) FROM sda.files WHERE stable_id = $1;"
 
@@ -403,6 +613,7 @@ func (dbs *SQLdb) checkAccessionIDExists(accessionID string) (bool, error) {
 
 // UpdateDatasetEvent marks the files in a dataset as "ready" or "disabled"
 func (dbs *SQLdb) UpdateDatasetEvent(datasetID, status, correlationID, user string) error {
+	defer metrics.DatabaseCall("UpdateDatasetEvent", time.Now())
 
 	var err error
 
@@ -422,7 +633,7 @@ func (dbs *SQLdb) UpdateDatasetEvent(datasetID, status, correlationID, user stri
 func (dbs *SQLdb) updateDatasetEvent(datasetID, status, correlationID, user string) error {
 	dbs.checkAndReconnectIfNeeded()
 
-	db := dbs.DB
+	db := dbs.handle()
 	const dataset = "SELECT id FROM sda.datasets WHERE stable_id = $1;"
 	const markFile = "INSERT INTO sda.file_event_log(file_id, event, correlation_id, user_id) " +
 		"SELECT file_id, $2, $3, $4 from sda.file_dataset " +
@@ -449,6 +660,7 @@ func (dbs *SQLdb) updateDatasetEvent(datasetID, status, correlationID, user stri
 // SetAccessionID adds a stable id to a file
 // identified by the user submitting it, inbox path and decrypted checksum
 func (dbs *SQLdb) SetAccessionID(accessionID, user, filepath, checksum string) error {
+	defer metrics.DatabaseCall("SetAccessionID", time.Now())
 
 	var err error
 
@@ -469,7 +681,7 @@ func (dbs *SQLdb) SetAccessionID(accessionID, user, filepath, checksum string) e
 func (dbs *SQLdb) setAccessionID(accessionID, user, filepath, checksum string) error {
 	dbs.checkAndReconnectIfNeeded()
 
-	db := dbs.DB
+	db := dbs.handle()
 
 	const ready = "UPDATE local_ega.files SET stable_id = $1 WHERE " +
 		"elixir_id = $2 and inbox_path = $3 and decrypted_file_checksum = $4 and status = 'COMPLETED';"
@@ -487,6 +699,7 @@ func (dbs *SQLdb) setAccessionID(accessionID, user, filepath, checksum string) e
 
 // MapFilesToDataset maps a set of files to a dataset in the database
 func (dbs *SQLdb) MapFilesToDataset(datasetID string, accessionIDs []string) error {
+	defer metrics.DatabaseCall("MapFilesToDataset", time.Now())
 
 	var err error
 
@@ -512,7 +725,7 @@ func (dbs *SQLdb) mapFilesToDataset(datasetID string, accessionIDs []string) err
 	const mapping = "INSERT INTO sda.file_dataset (file_id, dataset_id) " +
 		"SELECT $1, id FROM sda.datasets WHERE stable_id = $2 ON CONFLICT " +
 		"DO NOTHING;"
-	db := dbs.DB
+	db := dbs.handle()
 	var fileID string
 	_, err := db.Exec(dataset, datasetID)
 	if err != nil {
@@ -545,6 +758,8 @@ func (dbs *SQLdb) mapFilesToDataset(datasetID string, accessionIDs []string) err
 
 // GetArchived retrieves the location and size of archive
 func (dbs *SQLdb) GetArchived(user, filepath, checksum string) (string, int, error) {
+	defer metrics.DatabaseCall("GetArchived", time.Now())
+
 	var (
 		filePath string
 		fileSize int
@@ -564,7 +779,7 @@ func (dbs *SQLdb) GetArchived(user, filepath, checksum string) (string, int, err
 func (dbs *SQLdb) getArchived(user, filepath, checksum string) (string, int, error) {
 	dbs.checkAndReconnectIfNeeded()
 
-	db := dbs.DB
+	db := dbs.handle()
 	const query = "SELECT archive_path, archive_filesize from local_ega.files WHERE " +
 		"elixir_id = $1 and inbox_path = $2 and decrypted_file_checksum = $3 and status in ('COMPLETED', 'READY');"
 
@@ -577,18 +792,66 @@ func (dbs *SQLdb) getArchived(user, filepath, checksum string) (string, int, err
 	return filePath, fileSize, nil
 }
 
+// GetArchivePaths returns the archive paths of all files in the archive,
+// mapped to the id of the file
+func (dbs *SQLdb) GetArchivePaths() (map[string]string, error) {
+	defer metrics.DatabaseCall("GetArchivePaths", time.Now())
+
+	var (
+		paths map[string]string
+		err   error
+		count int
+	)
+
+	for count == 0 || (err != nil && count < dbRetryTimes) {
+		paths, err = dbs.getArchivePaths()
+		count++
+	}
+
+	return paths, err
+}
+
+// getArchivePaths is the actual function performing work for GetArchivePaths
+func (dbs *SQLdb) getArchivePaths() (map[string]string, error) {
+	dbs.checkAndReconnectIfNeeded()
+
+	db := dbs.handle()
+	const query = "SELECT id, archive_file_path from sda.files WHERE archive_file_path IS NOT NULL AND archive_file_path != '';"
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	paths := make(map[string]string)
+	for rows.Next() {
+		var fileID, archivePath string
+		if err := rows.Scan(&fileID, &archivePath); err != nil {
+			return nil, err
+		}
+		paths[archivePath] = fileID
+	}
+
+	return paths, rows.Err()
+}
+
 func (dbs *SQLdb) GetVersion() (int, error) {
+	defer metrics.DatabaseCall("GetVersion", time.Now())
+
 	dbs.checkAndReconnectIfNeeded()
 	log.Debug("Fetching database schema version")
 
 	query := "SELECT MAX(version) FROM sda.dbschema_version"
 	var dbVersion = -1
-	err := dbs.DB.QueryRow(query).Scan(&dbVersion)
+	err := dbs.handle().QueryRow(query).Scan(&dbVersion)
 
 	return dbVersion, err
 }
 
 func (dbs *SQLdb) UpdateFileStatus(fileUUID, event, corrID, user, message string) error {
+	defer metrics.DatabaseCall("UpdateFileStatus", time.Now())
+
 	var (
 		err   error
 		count int
@@ -604,7 +867,7 @@ func (dbs *SQLdb) UpdateFileStatus(fileUUID, event, corrID, user, message string
 func (dbs *SQLdb) updateFileStatus(fileUUID, event, corrID, user, message string) error {
 	dbs.checkAndReconnectIfNeeded()
 
-	db := dbs.DB
+	db := dbs.handle()
 	const query = "INSERT INTO sda.file_event_log(file_id, event, correlation_id, user_id, message) VALUES($1, $2, $3, $4, $5);"
 
 	result, err := db.Exec(query, fileUUID, event, corrID, user, message)
@@ -619,6 +882,8 @@ func (dbs *SQLdb) updateFileStatus(fileUUID, event, corrID, user, message string
 }
 
 func (dbs *SQLdb) GetFileStatus(corrID string) (string, error) {
+	defer metrics.DatabaseCall("GetFileStatus", time.Now())
+
 	var (
 		err    error
 		count  int
@@ -634,7 +899,7 @@ func (dbs *SQLdb) GetFileStatus(corrID string) (string, error) {
 }
 func (dbs *SQLdb) getFileStatus(corrID string) (string, error) {
 	dbs.checkAndReconnectIfNeeded()
-	db := dbs.DB
+	db := dbs.handle()
 	const getFileID = "SELECT event from sda.file_event_log WHERE correlation_id = $1 ORDER BY id DESC LIMIT 1;"
 
 	var status string
@@ -647,6 +912,8 @@ func (dbs *SQLdb) getFileStatus(corrID string) (string, error) {
 }
 
 func (dbs *SQLdb) GetInboxPath(stableID string) (string, error) {
+	defer metrics.DatabaseCall("GetInboxPath", time.Now())
+
 	var (
 		err       error
 		count     int
@@ -662,7 +929,7 @@ func (dbs *SQLdb) GetInboxPath(stableID string) (string, error) {
 }
 func (dbs *SQLdb) getInboxPath(stableID string) (string, error) {
 	dbs.checkAndReconnectIfNeeded()
-	db := dbs.DB
+	db := dbs.handle()
 	const getFileID = "SELECT submission_file_path from sda.files WHERE stable_id = $1;"
 
 	var inboxPath string
@@ -674,8 +941,560 @@ func (dbs *SQLdb) getInboxPath(stableID string) (string, error) {
 	return inboxPath, nil
 }
 
+// GetArchivedChecksum returns the sha256 checksum of the archived file
+// with the given stable id
+func (dbs *SQLdb) GetArchivedChecksum(stableID string) (string, error) {
+	defer metrics.DatabaseCall("GetArchivedChecksum", time.Now())
+
+	var (
+		err      error
+		count    int
+		checksum string
+	)
+
+	for count == 0 || (err != nil && count < dbRetryTimes) {
+		checksum, err = dbs.getArchivedChecksum(stableID)
+		count++
+	}
+
+	return checksum, err
+}
+
+// getArchivedChecksum is the actual function performing work for GetArchivedChecksum
+func (dbs *SQLdb) getArchivedChecksum(stableID string) (string, error) {
+	dbs.checkAndReconnectIfNeeded()
+	db := dbs.handle()
+	const query = "SELECT checksum from sda.checksums WHERE source = 'ARCHIVED' AND type = 'SHA256' AND " +
+		"file_id = (SELECT id from sda.files WHERE stable_id = $1);"
+
+	var checksum string
+	if err := db.QueryRow(query, stableID).Scan(&checksum); err != nil {
+		return "", err
+	}
+
+	return checksum, nil
+}
+
+// SetBackupStatus records the outcome of the last attempt to back up the
+// file with the given stable id to a backup destination, in sda.backups so
+// that it does not change the status of the file
+func (dbs *SQLdb) SetBackupStatus(stableID, destination, status, corrID, user, reason string) error {
+	defer metrics.DatabaseCall("SetBackupStatus", time.Now())
+
+	var (
+		err   error
+		count int
+	)
+
+	for count == 0 || (err != nil && count < dbRetryTimes) {
+		err = dbs.setBackupStatus(stableID, destination, status, corrID, user, reason)
+		count++
+	}
+
+	return err
+}
+
+// setBackupStatus is the actual function performing work for SetBackupStatus
+func (dbs *SQLdb) setBackupStatus(stableID, destination, status, corrID, user, reason string) error {
+	dbs.checkAndReconnectIfNeeded()
+
+	db := dbs.handle()
+	const query = "INSERT INTO sda.backups(file_id, destination, status, reason, correlation_id, user_id) " +
+		"SELECT id, $2, $3, $4, $5, $6 FROM sda.files WHERE stable_id = $1 " +
+		"ON CONFLICT (file_id, destination) DO UPDATE SET status = EXCLUDED.status, reason = EXCLUDED.reason, " +
+		"correlation_id = EXCLUDED.correlation_id, user_id = EXCLUDED.user_id, updated_at = clock_timestamp();"
+
+	result, err := db.Exec(query, stableID, destination, status, reason, corrID, user)
+	if err != nil {
+		return err
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		return errors.New("something went wrong with the query zero rows were changed")
+	}
+
+	return nil
+}
+
+// SetBackupError marks the file with the given stable id with an error
+// event, for backups that did not reach the quorum
+func (dbs *SQLdb) SetBackupError(stableID, corrID, user, reason string) error {
+	defer metrics.DatabaseCall("SetBackupError", time.Now())
+
+	var (
+		err   error
+		count int
+	)
+
+	for count == 0 || (err != nil && count < dbRetryTimes) {
+		err = dbs.setBackupError(stableID, corrID, user, reason)
+		count++
+	}
+
+	return err
+}
+
+// setBackupError is the actual function performing work for SetBackupError
+func (dbs *SQLdb) setBackupError(stableID, corrID, user, reason string) error {
+	dbs.checkAndReconnectIfNeeded()
+
+	db := dbs.handle()
+	const query = "INSERT INTO sda.file_event_log(file_id, event, correlation_id, user_id, message) " +
+		"SELECT id, 'error', $2, $3, jsonb_build_object('error', 'Backup quorum not reached', 'reason', $4::text) FROM sda.files WHERE stable_id = $1;"
+
+	result, err := db.Exec(query, stableID, corrID, user, reason)
+	if err != nil {
+		return err
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		return errors.New("something went wrong with the query zero rows were changed")
+	}
+
+	return nil
+}
+
+// GetFilesToRotate returns the ids of the files with a header that is not
+// encrypted with the key with the given key hash
+func (dbs *SQLdb) GetFilesToRotate(keyHash string) ([]string, error) {
+	defer metrics.DatabaseCall("GetFilesToRotate", time.Now())
+
+	var (
+		err     error
+		count   int
+		fileIDs []string
+	)
+
+	for count == 0 || (err != nil && count < dbRetryTimes) {
+		fileIDs, err = dbs.getFilesToRotate(keyHash)
+		count++
+	}
+
+	return fileIDs, err
+}
+
+// getFilesToRotate is the actual function performing work for GetFilesToRotate
+func (dbs *SQLdb) getFilesToRotate(keyHash string) ([]string, error) {
+	dbs.checkAndReconnectIfNeeded()
+	db := dbs.handle()
+	const query = "SELECT id from sda.files WHERE header IS NOT NULL AND header != '' AND " +
+		"(key_hash IS NULL OR key_hash != $1) ORDER BY created_at;"
+
+	rows, err := db.Query(query, keyHash)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	fileIDs := []string{}
+	for rows.Next() {
+		var fileID string
+		if err := rows.Scan(&fileID); err != nil {
+			return nil, err
+		}
+		fileIDs = append(fileIDs, fileID)
+	}
+
+	return fileIDs, rows.Err()
+}
+
+// SetKeyHash records the hash of the key that the header of the file is
+// encrypted with
+func (dbs *SQLdb) SetKeyHash(keyHash, fileID string) error {
+	defer metrics.DatabaseCall("SetKeyHash", time.Now())
+
+	var (
+		err   error
+		count int
+	)
+
+	for count == 0 || (err != nil && count < dbRetryTimes) {
+		err = dbs.setKeyHash(keyHash, fileID)
+		count++
+	}
+
+	return err
+}
+
+// setKeyHash is the actual function performing work for SetKeyHash
+func (dbs *SQLdb) setKeyHash(keyHash, fileID string) error {
+	dbs.checkAndReconnectIfNeeded()
+
+	db := dbs.handle()
+	const query = "UPDATE sda.files SET key_hash = $1 WHERE id = $2;"
+	result, err := db.Exec(query, keyHash, fileID)
+	if err != nil {
+		return err
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		return errors.New("something went wrong with the query zero rows were changed")
+	}
+
+	return nil
+}
+
+// RotateHeader replaces the header of the file with one encrypted for a
+// new key and records the hash of that key, both in the same statement so
+// that the key hash always matches the stored header
+func (dbs *SQLdb) RotateHeader(header []byte, keyHash, fileID string) error {
+	defer metrics.DatabaseCall("RotateHeader", time.Now())
+
+	var (
+		err   error
+		count int
+	)
+
+	for count == 0 || (err != nil && count < dbRetryTimes) {
+		err = dbs.rotateHeader(header, keyHash, fileID)
+		count++
+	}
+
+	return err
+}
+
+// rotateHeader is the actual function performing work for RotateHeader
+func (dbs *SQLdb) rotateHeader(header []byte, keyHash, fileID string) error {
+	dbs.checkAndReconnectIfNeeded()
+
+	db := dbs.handle()
+	const query = "UPDATE sda.files SET header = $1, key_hash = $2 WHERE id = $3;"
+	result, err := db.Exec(query, hex.EncodeToString(header), keyHash, fileID)
+	if err != nil {
+		return err
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		return errors.New("something went wrong with the query zero rows were changed")
+	}
+
+	return nil
+}
+
+// ColumnExists reports whether a table in the sda schema has the column,
+// for features that need columns that older schemas don't have
+func (dbs *SQLdb) ColumnExists(table, column string) (bool, error) {
+	defer metrics.DatabaseCall("ColumnExists", time.Now())
+
+	dbs.checkAndReconnectIfNeeded()
+
+	const query = "SELECT EXISTS(SELECT 1 FROM information_schema.columns " +
+		"WHERE table_schema = 'sda' AND table_name = $1 AND column_name = $2);"
+	var exists bool
+	err := dbs.handle().QueryRow(query, table, column).Scan(&exists)
+
+	return exists, err
+}
+
+// TableExists reports whether the sda schema has the table, for features
+// that need tables that older schemas don't have
+func (dbs *SQLdb) TableExists(table string) (bool, error) {
+	defer metrics.DatabaseCall("TableExists", time.Now())
+
+	dbs.checkAndReconnectIfNeeded()
+
+	const query = "SELECT EXISTS(SELECT 1 FROM information_schema.tables " +
+		"WHERE table_schema = 'sda' AND table_name = $1);"
+	var exists bool
+	err := dbs.handle().QueryRow(query, table).Scan(&exists)
+
+	return exists, err
+}
+
+// GetFileIDByAccession returns the id of the file with the accession id
+func (dbs *SQLdb) GetFileIDByAccession(accessionID string) (string, error) {
+	defer metrics.DatabaseCall("GetFileIDByAccession", time.Now())
+
+	var (
+		fileID string
+		err    error
+		count  int
+	)
+
+	// Files that are not found are not retried
+	for count == 0 || (err != nil && !errors.Is(err, sql.ErrNoRows) && count < dbRetryTimes) {
+		fileID, err = dbs.getFileIDByAccession(accessionID)
+		count++
+	}
+
+	return fileID, err
+}
+
+// getFileIDByAccession is the actual function performing work for GetFileIDByAccession
+func (dbs *SQLdb) getFileIDByAccession(accessionID string) (string, error) {
+	dbs.checkAndReconnectIfNeeded()
+
+	db := dbs.handle()
+	const query = "SELECT id from sda.files WHERE stable_id = $1;"
+
+	var fileID string
+	if err := db.QueryRow(query, accessionID).Scan(&fileID); err != nil {
+		return "", err
+	}
+
+	return fileID, nil
+}
+
+// GetFileIDByUserPath returns the id of the file most recently uploaded by
+// the user to the path in the inbox
+func (dbs *SQLdb) GetFileIDByUserPath(user, filePath string) (string, error) {
+	defer metrics.DatabaseCall("GetFileIDByUserPath", time.Now())
+
+	var (
+		fileID string
+		err    error
+		count  int
+	)
+
+	// Files that are not found are not retried
+	for count == 0 || (err != nil && !errors.Is(err, sql.ErrNoRows) && count < dbRetryTimes) {
+		fileID, err = dbs.getFileIDByUserPath(user, filePath)
+		count++
+	}
+
+	return fileID, err
+}
+
+// getFileIDByUserPath is the actual function performing work for GetFileIDByUserPath
+func (dbs *SQLdb) getFileIDByUserPath(user, filePath string) (string, error) {
+	dbs.checkAndReconnectIfNeeded()
+
+	db := dbs.handle()
+	const query = "SELECT id from sda.files WHERE submission_user = $1 AND submission_file_path = $2 " +
+		"ORDER BY created_at DESC LIMIT 1;"
+
+	var fileID string
+	if err := db.QueryRow(query, user, filePath).Scan(&fileID); err != nil {
+		return "", err
+	}
+
+	return fileID, nil
+}
+
+// GetCorrID returns the latest correlation id in the event log of the file
+// most recently uploaded by the user to the path in the inbox
+func (dbs *SQLdb) GetCorrID(user, filePath string) (string, error) {
+	defer metrics.DatabaseCall("GetCorrID", time.Now())
+
+	var (
+		corrID string
+		err    error
+		count  int
+	)
+
+	// Files that are not found are not retried
+	for count == 0 || (err != nil && !errors.Is(err, sql.ErrNoRows) && count < dbRetryTimes) {
+		corrID, err = dbs.getCorrID(user, filePath)
+		count++
+	}
+
+	return corrID, err
+}
+
+// getCorrID is the actual function performing work for GetCorrID
+func (dbs *SQLdb) getCorrID(user, filePath string) (string, error) {
+	dbs.checkAndReconnectIfNeeded()
+
+	db := dbs.handle()
+	const query = "SELECT correlation_id from sda.file_event_log WHERE file_id = " +
+		"(SELECT id from sda.files WHERE submission_user = $1 AND submission_file_path = $2 ORDER BY created_at DESC LIMIT 1) " +
+		"AND correlation_id IS NOT NULL ORDER BY id DESC LIMIT 1;"
+
+	var corrID string
+	if err := db.QueryRow(query, user, filePath).Scan(&corrID); err != nil {
+		return "", err
+	}
+
+	return corrID, nil
+}
+
+// GetFileDetails returns what is known about the file, its checksums, the
+// datasets it belongs to and the history of events for it
+func (dbs *SQLdb) GetFileDetails(fileID string) (*FileDetails, error) {
+	defer metrics.DatabaseCall("GetFileDetails", time.Now())
+
+	var (
+		details *FileDetails
+		err     error
+		count   int
+	)
+
+	// Files that are not found are not retried
+	for count == 0 || (err != nil && !errors.Is(err, sql.ErrNoRows) && count < dbRetryTimes) {
+		details, err = dbs.getFileDetails(fileID)
+		count++
+	}
+
+	return details, err
+}
+
+// getFileDetails is the actual function performing work for GetFileDetails
+func (dbs *SQLdb) getFileDetails(fileID string) (*FileDetails, error) {
+	dbs.checkAndReconnectIfNeeded()
+
+	db := dbs.handle()
+	const file = "SELECT id, COALESCE(stable_id, ''), submission_user, submission_file_path, " +
+		"COALESCE(archive_file_path, ''), COALESCE(archive_file_size, 0), COALESCE(decrypted_file_size, 0), created_at " +
+		"from sda.files WHERE id = $1;"
+	const checksums = "SELECT checksum, type, source from sda.checksums WHERE file_id = $1 ORDER BY source, type;"
+	const datasets = "SELECT d.stable_id from sda.file_dataset fd JOIN sda.datasets d ON fd.dataset_id = d.id " +
+		"WHERE fd.file_id = $1 ORDER BY d.stable_id;"
+	const events = "SELECT event, COALESCE(correlation_id::text, ''), COALESCE(user_id, ''), message, started_at " +
+		"from sda.file_event_log WHERE file_id = $1 ORDER BY id;"
+
+	details := FileDetails{Checksums: []Checksum{}, Datasets: []string{}, Events: []FileEvent{}}
+	err := db.QueryRow(file, fileID).Scan(&details.FileID, &details.AccessionID, &details.User, &details.InboxPath,
+		&details.ArchivePath, &details.ArchiveSize, &details.DecryptedSize, &details.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(checksums, fileID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c Checksum
+		if err := rows.Scan(&c.Checksum, &c.Type, &c.Source); err != nil {
+			return nil, err
+		}
+		details.Checksums = append(details.Checksums, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = db.Query(datasets, fileID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var dataset string
+		if err := rows.Scan(&dataset); err != nil {
+			return nil, err
+		}
+		details.Datasets = append(details.Datasets, dataset)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = db.Query(events, fileID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			e       FileEvent
+			message []byte
+		)
+		if err := rows.Scan(&e.Event, &e.CorrelationID, &e.User, &message, &e.Time); err != nil {
+			return nil, err
+		}
+		if len(message) > 0 {
+			e.Message = json.RawMessage(message)
+		}
+		details.Events = append(details.Events, e)
+	}
+
+	return &details, rows.Err()
+}
+
+// GetDatasetFiles returns the files in the dataset along with the latest
+// event for each of them
+func (dbs *SQLdb) GetDatasetFiles(datasetID string) ([]DatasetFile, error) {
+	defer metrics.DatabaseCall("GetDatasetFiles", time.Now())
+
+	var (
+		files []DatasetFile
+		err   error
+		count int
+	)
+
+	for count == 0 || (err != nil && count < dbRetryTimes) {
+		files, err = dbs.getDatasetFiles(datasetID)
+		count++
+	}
+
+	return files, err
+}
+
+// getDatasetFiles is the actual function performing work for GetDatasetFiles
+func (dbs *SQLdb) getDatasetFiles(datasetID string) ([]DatasetFile, error) {
+	dbs.checkAndReconnectIfNeeded()
+
+	db := dbs.handle()
+	const query = "SELECT f.id, COALESCE(f.stable_id, ''), f.submission_file_path, " +
+		"COALESCE((SELECT event from sda.file_event_log e WHERE e.file_id = f.id ORDER BY e.id DESC LIMIT 1), '') " +
+		"from sda.file_dataset fd JOIN sda.datasets d ON fd.dataset_id = d.id JOIN sda.files f ON fd.file_id = f.id " +
+		"WHERE d.stable_id = $1 ORDER BY f.stable_id;"
+
+	rows, err := db.Query(query, datasetID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	files := []DatasetFile{}
+	for rows.Next() {
+		var f DatasetFile
+		if err := rows.Scan(&f.FileID, &f.AccessionID, &f.InboxPath, &f.Status); err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+
+	return files, rows.Err()
+}
+
+// Replay is a message from the error queue that has been sent again
+type Replay struct {
+	CorrelationID string
+	RoutingKey    string
+	Error         string
+	Reason        string
+	Message       []byte
+	Operator      string
+}
+
+// RecordReplay keeps a record of a message that was replayed from the
+// error queue and who replayed it
+func (dbs *SQLdb) RecordReplay(replay Replay) error {
+	defer metrics.DatabaseCall("RecordReplay", time.Now())
+
+	var (
+		err   error
+		count int
+	)
+
+	for count == 0 || (err != nil && count < dbRetryTimes) {
+		err = dbs.recordReplay(replay)
+		count++
+	}
+
+	return err
+}
+
+// recordReplay is the actual function performing work for RecordReplay
+func (dbs *SQLdb) recordReplay(replay Replay) error {
+	dbs.checkAndReconnectIfNeeded()
+
+	db := dbs.handle()
+	const query = "INSERT INTO sda.replays(correlation_id, routing_key, error, reason, message, replayed_by) " +
+		"VALUES($1, $2, $3, $4, $5, $6);"
+
+	result, err := db.Exec(query, replay.CorrelationID, replay.RoutingKey, replay.Error, replay.Reason, string(replay.Message), replay.Operator)
+	if err != nil {
+		return err
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		return errors.New("something went wrong with the query zero rows were changed")
+	}
+
+	return nil
+}
+
 // Close terminates the connection to the database
 func (dbs *SQLdb) Close() {
-	db := dbs.DB
+	db := dbs.handle()
 	db.Close()
 }
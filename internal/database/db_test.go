@@ -2,8 +2,10 @@ package database
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
@@ -74,12 +76,12 @@ func TestCheckAndReconnect(t *testing.T) {
 
 	mock.ExpectPing().WillReturnError(fmt.Errorf("ping fail for testing bad conn"))
 
-	err := CatchPanicCheckAndReconnect(SQLdb{db, ""})
+	err := CatchPanicCheckAndReconnect(&SQLdb{DB: db})
 	assert.Error(t, err, "Should have received error from checkAndReconnectOnNeeded fataling")
 
 }
 
-func CatchPanicCheckAndReconnect(db SQLdb) (err error) {
+func CatchPanicCheckAndReconnect(db *SQLdb) (err error) {
 	defer func() {
 		r := recover()
 		if r != nil {
@@ -168,6 +170,60 @@ func TestNewDB(t *testing.T) {
 
 }
 
+func TestUpdateConf(t *testing.T) {
+	oldDB, oldMock, _ := sqlmock.New(sqlmock.MonitorPingsOption(true))
+	testDb := &SQLdb{DB: oldDB, ConnInfo: testConnInfo}
+
+	newConf := testPgconf
+	newConf.Password = "rotated"
+	newDB, newMock, _ := sqlmock.New(sqlmock.MonitorPingsOption(true))
+	sqlOpen = func(_ string, connInfo string) (*sql.DB, error) {
+		assert.Equal(t, buildConnInfo(newConf), connInfo)
+
+		return newDB, nil
+	}
+
+	// Keep the old connection if the new settings don't work
+	newMock.ExpectPing().WillReturnError(fmt.Errorf("password authentication failed"))
+	newMock.ExpectClose()
+	assert.Error(t, testDb.UpdateConf(newConf))
+	assert.Equal(t, oldDB, testDb.DB)
+	assert.Equal(t, testConnInfo, testDb.ConnInfo)
+
+	newDB, newMock, _ = sqlmock.New(sqlmock.MonitorPingsOption(true))
+	newMock.ExpectPing()
+	oldMock.ExpectClose()
+	assert.NoError(t, testDb.UpdateConf(newConf))
+	assert.Equal(t, newDB, testDb.DB)
+	assert.Equal(t, buildConnInfo(newConf), testDb.ConnInfo)
+
+	assert.NoError(t, oldMock.ExpectationsWereMet())
+	assert.NoError(t, newMock.ExpectationsWereMet())
+}
+
+func TestUpdateConf_concurrent(t *testing.T) {
+	oldDB, _, _ := sqlmock.New()
+	testDb := &SQLdb{DB: oldDB, ConnInfo: testConnInfo}
+	sqlOpen = func(_ string, _ string) (*sql.DB, error) {
+		db, _, err := sqlmock.New()
+
+		return db, err
+	}
+
+	// The connection is replaced while it is in use
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			_ = testDb.Ping(context.Background())
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, testDb.UpdateConf(testPgconf))
+	}
+	<-done
+}
+
 // Helper function for "simple" sql tests
 func sqlTesterHelper(t *testing.T, f func(sqlmock.Sqlmock, *SQLdb) error) error {
 	db, mock, err := sqlmock.New()
@@ -189,7 +245,7 @@ func sqlTesterHelper(t *testing.T, f func(sqlmock.Sqlmock, *SQLdb) error) error
 }
 
 func TestMarkCompleted(t *testing.T) {
-	file := FileInfo{sha256.New(), 46, "/somepath", sha256.New(), 48}
+	file := FileInfo{sha256.New(), 46, "/somepath", sha256.New(), 48, nil, nil}
 
 	_, err := file.Checksum.Write([]byte("checksum"))
 	if err != nil {
@@ -203,6 +259,7 @@ func TestMarkCompleted(t *testing.T) {
 
 	r := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
 		r := sqlmock.NewResult(0, 1)
+		mock.ExpectBegin()
 		mock.ExpectExec("SELECT sda.set_verified\\(\\$1, \\$2, \\$3, \\$4, \\$5, \\$6, \\$7\\);").
 			WithArgs(
 				"fb140b10-1354-4266-879e-b34ad3e64c57",
@@ -213,12 +270,14 @@ func TestMarkCompleted(t *testing.T) {
 				"b353d3058b350466bb75a4e5e2263c73a7b900e2c48804780c6dd820b8b151ba",
 				"SHA256",
 			).WillReturnResult(r)
+		mock.ExpectCommit()
 
 		return testDb.MarkCompleted(file, "fb140b10-1354-4266-879e-b34ad3e64c57", "71bb2f05-2061-41ac-9f62-32322fde7e7d")
 	})
 	assert.Nil(t, r, "MarkCompleted failed unexpectedly")
 
 	r = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		mock.ExpectBegin()
 		mock.ExpectExec("SELECT sda.set_verified\\(\\$1, \\$2, \\$3, \\$4, \\$5, \\$6, \\$7\\);").
 			WithArgs(
 				"fb140b10-1354-4266-879e-b34ad3e64c57",
@@ -229,6 +288,7 @@ func TestMarkCompleted(t *testing.T) {
 				"b353d3058b350466bb75a4e5e2263c73a7b900e2c48804780c6dd820b8b151ba",
 				"SHA256",
 			).WillReturnError(fmt.Errorf("error for testing"))
+		mock.ExpectRollback()
 
 		return testDb.MarkCompleted(file, "fb140b10-1354-4266-879e-b34ad3e64c57", "71bb2f05-2061-41ac-9f62-32322fde7e7d")
 	})
@@ -339,7 +399,7 @@ func TestStoreHeader(t *testing.T) {
 
 func TestSetArchived(t *testing.T) {
 
-	file := FileInfo{sha256.New(), 1000, "/tmp/file.c4gh", sha256.New(), -1}
+	file := FileInfo{sha256.New(), 1000, "/tmp/file.c4gh", sha256.New(), -1, nil, nil}
 	_, err := file.Checksum.Write([]byte("checksum"))
 
 	if err != nil {
@@ -348,24 +408,87 @@ func TestSetArchived(t *testing.T) {
 
 	r := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
 		r := sqlmock.NewResult(0, 1)
+		mock.ExpectBegin()
 		mock.ExpectExec("SELECT sda.set_archived\\(\\$1, \\$2, \\$3, \\$4, \\$5, \\$6\\);").
 			WithArgs("108b842a-5d8e-4189-8e8a-9f54dc22576e", "108b842a-5d8e-4189-8e8a-9f54dc22576e", file.Path, file.Size, "96fa8f226d3801741e807533552bc4b177ac4544d834073b6a5298934d34b40b", "SHA256").
 			WillReturnResult(r)
+		mock.ExpectCommit()
 
 		return testDb.SetArchived(file, "108b842a-5d8e-4189-8e8a-9f54dc22576e", "108b842a-5d8e-4189-8e8a-9f54dc22576e")
 	})
 	assert.Nil(t, r, "SetArchived failed unexpectedly")
 
 	r = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		mock.ExpectBegin()
 		mock.ExpectExec("SELECT sda.set_archived\\(\\$1, \\$2, \\$3, \\$4, \\$5, \\$6\\);").
 			WithArgs("108b842a-5d8e-4189-8e8a-9f54dc22576e", "108b842a-5d8e-4189-8e8a-9f54dc22576e", file.Path, file.Size, "96fa8f226d3801741e807533552bc4b177ac4544d834073b6a5298934d34b40b", "SHA256").
 			WillReturnError(fmt.Errorf("error for testing"))
+		mock.ExpectRollback()
 
 		return testDb.SetArchived(file, "108b842a-5d8e-4189-8e8a-9f54dc22576e", "108b842a-5d8e-4189-8e8a-9f54dc22576e")
 	})
 	assert.NotNil(t, r, "SetArchived did not fail correctly")
 }
 
+func TestSetChecksums(t *testing.T) {
+	digests, err := NewDigests("sha512", "crc32c")
+	assert.NoError(t, err)
+	_, err = digests.Writer().Write([]byte("checksum"))
+	assert.NoError(t, err)
+
+	file := FileInfo{sha256.New(), 46, "/somepath", sha256.New(), 48, nil, digests}
+
+	// The checksums are stored in the same transaction as the status
+	r := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		mock.ExpectBegin()
+		mock.ExpectExec("SELECT sda.set_verified").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("UPDATE sda.checksums SET checksum = \\$1 WHERE file_id = \\$2 AND type = \\$3 AND source = \\$4;").
+			WithArgs(digests.Hex("crc32c"), "file-id", "CRC32C", "UNENCRYPTED").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("UPDATE sda.checksums SET checksum = \\$1 WHERE file_id = \\$2 AND type = \\$3 AND source = \\$4;").
+			WithArgs(digests.Hex("sha512"), "file-id", "SHA512", "UNENCRYPTED").
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("INSERT INTO sda.checksums\\(file_id, checksum, type, source\\) VALUES\\(\\$1, \\$2, \\$3, \\$4\\);").
+			WithArgs("file-id", digests.Hex("sha512"), "SHA512", "UNENCRYPTED").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		return testDb.MarkCompleted(file, "file-id", "corr-id")
+	})
+	assert.Nil(t, r, "MarkCompleted with checksums failed unexpectedly")
+
+	// A checksum that can not be stored rolls back the status change
+	r = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		for i := 0; i < dbRetryTimes; i++ {
+			mock.ExpectBegin()
+			mock.ExpectExec("SELECT sda.set_verified").WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectExec("UPDATE sda.checksums").WillReturnError(fmt.Errorf("error for testing"))
+			mock.ExpectRollback()
+		}
+
+		return testDb.MarkCompleted(file, "file-id", "corr-id")
+	})
+	assert.NotNil(t, r, "MarkCompleted did not fail correctly")
+}
+
+func TestCheckChecksumAlgorithms(t *testing.T) {
+	r := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		mock.ExpectQuery("SELECT unnest\\(enum_range\\(NULL::sda.checksum_algorithm\\)\\)::text;").
+			WillReturnRows(sqlmock.NewRows([]string{"unnest"}).AddRow("MD5").AddRow("SHA256").AddRow("SHA512").AddRow("CRC32C"))
+
+		return testDb.CheckChecksumAlgorithms("sha512", "crc32c")
+	})
+	assert.NoError(t, r)
+
+	r = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		mock.ExpectQuery("SELECT unnest\\(enum_range\\(NULL::sda.checksum_algorithm\\)\\)::text;").
+			WillReturnRows(sqlmock.NewRows([]string{"unnest"}).AddRow("MD5").AddRow("SHA256").AddRow("SHA512"))
+
+		return testDb.CheckChecksumAlgorithms("sha512", "blake3")
+	})
+	assert.EqualError(t, r, "checksum algorithm BLAKE3 is not a value of sda.checksum_algorithm")
+}
+
 func TestUpdateDatasetEvent(t *testing.T) {
 	r := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
 		success := sqlmock.NewResult(1, 1)
@@ -618,6 +741,62 @@ func TestGetInboxPath(t *testing.T) {
 	assert.Nil(t, err, "GetInboxPath failed unexpectedly")
 }
 
+func TestGetArchivePaths(t *testing.T) {
+	err := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		mock.ExpectQuery("SELECT id, archive_file_path from sda.files WHERE archive_file_path IS NOT NULL AND archive_file_path != '';").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "archive_file_path"}).
+				AddRow("f83976fc-7e59-4a12-ad17-0154a36e36fc", "a8f4e3b1-1e4b-4a0b-9f5e-6f2b4b2b8f10").
+				AddRow("074803cc-718e-4dc4-a48d-a4770aa9f93b", "0f1e9c1c-6a07-4f0e-8d8a-4f3b1d1a3c2b"))
+
+		paths, err := testDb.GetArchivePaths()
+		assert.Equal(t, map[string]string{
+			"a8f4e3b1-1e4b-4a0b-9f5e-6f2b4b2b8f10": "f83976fc-7e59-4a12-ad17-0154a36e36fc",
+			"0f1e9c1c-6a07-4f0e-8d8a-4f3b1d1a3c2b": "074803cc-718e-4dc4-a48d-a4770aa9f93b",
+		}, paths)
+
+		return err
+	})
+	assert.Nil(t, err, "GetArchivePaths failed unexpectedly")
+
+	err = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		mock.ExpectQuery("SELECT id, archive_file_path from sda.files WHERE archive_file_path IS NOT NULL AND archive_file_path != '';").
+			WillReturnError(fmt.Errorf("error for testing"))
+
+		_, err := testDb.GetArchivePaths()
+
+		return err
+	})
+	assert.NotNil(t, err, "GetArchivePaths did not fail as expected")
+}
+
+func TestGetArchivedChecksum(t *testing.T) {
+	query := "SELECT checksum from sda.checksums WHERE source = 'ARCHIVED' AND type = 'SHA256' AND " +
+		"file_id = \\(SELECT id from sda.files WHERE stable_id = \\$1\\);"
+
+	err := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		mock.ExpectQuery(query).
+			WithArgs("EGAF00000000001").
+			WillReturnRows(sqlmock.NewRows([]string{"checksum"}).AddRow("96fa8f226d3801741e807533552bc4b177ac4544d834073b6a5298934d34b40b"))
+
+		checksum, err := testDb.GetArchivedChecksum("EGAF00000000001")
+		assert.Equal(t, "96fa8f226d3801741e807533552bc4b177ac4544d834073b6a5298934d34b40b", checksum)
+
+		return err
+	})
+	assert.Nil(t, err, "GetArchivedChecksum failed unexpectedly")
+
+	err = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		mock.ExpectQuery(query).
+			WithArgs("EGAF00000000001").
+			WillReturnError(fmt.Errorf("error for testing"))
+
+		_, err := testDb.GetArchivedChecksum("EGAF00000000001")
+
+		return err
+	})
+	assert.NotNil(t, err, "GetArchivedChecksum did not fail as expected")
+}
+
 func TestClose(t *testing.T) {
 	r := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
 
@@ -629,3 +808,345 @@ func TestClose(t *testing.T) {
 
 	assert.Nil(t, r, "Close failed unexpectedly")
 }
+
+func TestSetBackupStatus(t *testing.T) {
+	query := "INSERT INTO sda.backups\\(file_id, destination, status, reason, correlation_id, user_id\\) " +
+		"SELECT id, \\$2, \\$3, \\$4, \\$5, \\$6 FROM sda.files WHERE stable_id = \\$1 " +
+		"ON CONFLICT \\(file_id, destination\\) DO UPDATE SET status = EXCLUDED.status, reason = EXCLUDED.reason, " +
+		"correlation_id = EXCLUDED.correlation_id, user_id = EXCLUDED.user_id, updated_at = clock_timestamp\\(\\);"
+
+	err := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		mock.ExpectExec(query).
+			WithArgs("EGAF00000000001", "north", "backed up", "", "f83976fc-7e59-4a12-ad17-0154a36e36fc", "dummy").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+
+		return testDb.SetBackupStatus("EGAF00000000001", "north", "backed up", "f83976fc-7e59-4a12-ad17-0154a36e36fc", "dummy", "")
+	})
+	assert.Nil(t, err, "SetBackupStatus failed unexpectedly")
+
+	err = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		mock.ExpectExec(query).
+			WithArgs("EGAF00000000001", "north", "error", "copy failed", "f83976fc-7e59-4a12-ad17-0154a36e36fc", "dummy").
+			WillReturnResult(sqlmock.NewResult(0, 0))
+
+		return testDb.SetBackupStatus("EGAF00000000001", "north", "error", "f83976fc-7e59-4a12-ad17-0154a36e36fc", "dummy", "copy failed")
+	})
+	assert.NotNil(t, err, "SetBackupStatus did not fail as expected")
+}
+
+func TestSetBackupError(t *testing.T) {
+	query := "INSERT INTO sda.file_event_log\\(file_id, event, correlation_id, user_id, message\\) " +
+		"SELECT id, 'error', \\$2, \\$3, jsonb_build_object\\('error', 'Backup quorum not reached', 'reason', \\$4::text\\) FROM sda.files WHERE stable_id = \\$1;"
+
+	err := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		mock.ExpectExec(query).
+			WithArgs("EGAF00000000001", "f83976fc-7e59-4a12-ad17-0154a36e36fc", "dummy", "0 of 2 destinations succeeded and 1 are required").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+
+		return testDb.SetBackupError("EGAF00000000001", "f83976fc-7e59-4a12-ad17-0154a36e36fc", "dummy", "0 of 2 destinations succeeded and 1 are required")
+	})
+	assert.Nil(t, err, "SetBackupError failed unexpectedly")
+
+	err = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		mock.ExpectExec(query).
+			WithArgs("EGAF00000000002", "f83976fc-7e59-4a12-ad17-0154a36e36fc", "dummy", "copy failed").
+			WillReturnResult(sqlmock.NewResult(0, 0))
+
+		return testDb.SetBackupError("EGAF00000000002", "f83976fc-7e59-4a12-ad17-0154a36e36fc", "dummy", "copy failed")
+	})
+	assert.NotNil(t, err, "SetBackupError did not fail as expected")
+}
+
+func TestGetFilesToRotate(t *testing.T) {
+	query := "SELECT id from sda.files WHERE header IS NOT NULL AND header != '' AND " +
+		"\\(key_hash IS NULL OR key_hash != \\$1\\) ORDER BY created_at;"
+
+	err := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		mock.ExpectQuery(query).
+			WithArgs("keyhash").
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).
+				AddRow("7559caae-a17c-40ae-bdb9-3a7d33408c49").
+				AddRow("f83976fc-7e59-4a12-ad17-0154a36e36fc"))
+
+		fileIDs, err := testDb.GetFilesToRotate("keyhash")
+		assert.Equal(t, []string{"7559caae-a17c-40ae-bdb9-3a7d33408c49", "f83976fc-7e59-4a12-ad17-0154a36e36fc"}, fileIDs)
+
+		return err
+	})
+	assert.Nil(t, err, "GetFilesToRotate failed unexpectedly")
+
+	err = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		mock.ExpectQuery(query).
+			WithArgs("keyhash").
+			WillReturnError(fmt.Errorf("error for testing"))
+
+		_, err := testDb.GetFilesToRotate("keyhash")
+
+		return err
+	})
+	assert.NotNil(t, err, "GetFilesToRotate did not fail as expected")
+}
+
+func TestSetKeyHash(t *testing.T) {
+	query := "UPDATE sda.files SET key_hash = \\$1 WHERE id = \\$2;"
+
+	err := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		mock.ExpectExec(query).
+			WithArgs("keyhash", "7559caae-a17c-40ae-bdb9-3a7d33408c49").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+
+		return testDb.SetKeyHash("keyhash", "7559caae-a17c-40ae-bdb9-3a7d33408c49")
+	})
+	assert.Nil(t, err, "SetKeyHash failed unexpectedly")
+
+	err = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		mock.ExpectExec(query).
+			WithArgs("keyhash", "7559caae-a17c-40ae-bdb9-3a7d33408c49").
+			WillReturnResult(sqlmock.NewResult(0, 0))
+
+		return testDb.SetKeyHash("keyhash", "7559caae-a17c-40ae-bdb9-3a7d33408c49")
+	})
+	assert.NotNil(t, err, "SetKeyHash did not fail as expected")
+}
+
+func TestRotateHeader(t *testing.T) {
+	query := "UPDATE sda.files SET header = \\$1, key_hash = \\$2 WHERE id = \\$3;"
+
+	err := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		mock.ExpectExec(query).
+			WithArgs("0f40", "keyhash", "7559caae-a17c-40ae-bdb9-3a7d33408c49").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+
+		return testDb.RotateHeader([]byte{0x0f, 0x40}, "keyhash", "7559caae-a17c-40ae-bdb9-3a7d33408c49")
+	})
+	assert.Nil(t, err, "RotateHeader failed unexpectedly")
+
+	err = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		for i := 0; i < dbRetryTimes; i++ {
+			mock.ExpectExec(query).
+				WithArgs("0f40", "keyhash", "7559caae-a17c-40ae-bdb9-3a7d33408c49").
+				WillReturnResult(sqlmock.NewResult(0, 0))
+		}
+
+		return testDb.RotateHeader([]byte{0x0f, 0x40}, "keyhash", "7559caae-a17c-40ae-bdb9-3a7d33408c49")
+	})
+	assert.NotNil(t, err, "RotateHeader did not fail as expected")
+}
+
+func TestColumnExists(t *testing.T) {
+	query := "SELECT EXISTS\\(SELECT 1 FROM information_schema.columns " +
+		"WHERE table_schema = 'sda' AND table_name = \\$1 AND column_name = \\$2\\);"
+
+	err := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		mock.ExpectQuery(query).
+			WithArgs("files", "key_hash").
+			WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+
+		exists, err := testDb.ColumnExists("files", "key_hash")
+		assert.False(t, exists)
+
+		return err
+	})
+	assert.Nil(t, err, "ColumnExists failed unexpectedly")
+}
+
+func TestTableExists(t *testing.T) {
+	query := "SELECT EXISTS\\(SELECT 1 FROM information_schema.tables " +
+		"WHERE table_schema = 'sda' AND table_name = \\$1\\);"
+
+	err := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		mock.ExpectQuery(query).
+			WithArgs("replays").
+			WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+
+		exists, err := testDb.TableExists("replays")
+		assert.True(t, exists)
+
+		return err
+	})
+	assert.Nil(t, err, "TableExists failed unexpectedly")
+}
+
+func TestGetFileIDByAccession(t *testing.T) {
+	query := "SELECT id from sda.files WHERE stable_id = \\$1;"
+
+	err := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		mock.ExpectQuery(query).
+			WithArgs("EGAF00000000001").
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("f83976fc-7e59-4a12-ad17-0154a36e36fc"))
+
+		fileID, err := testDb.GetFileIDByAccession("EGAF00000000001")
+		assert.Equal(t, "f83976fc-7e59-4a12-ad17-0154a36e36fc", fileID)
+
+		return err
+	})
+	assert.Nil(t, err, "GetFileIDByAccession failed unexpectedly")
+}
+
+func TestGetFileIDByUserPath(t *testing.T) {
+	query := "SELECT id from sda.files WHERE submission_user = \\$1 AND submission_file_path = \\$2 " +
+		"ORDER BY created_at DESC LIMIT 1;"
+
+	err := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		mock.ExpectQuery(query).
+			WithArgs("dummy", "/inbox/file.c4gh").
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("f83976fc-7e59-4a12-ad17-0154a36e36fc"))
+
+		fileID, err := testDb.GetFileIDByUserPath("dummy", "/inbox/file.c4gh")
+		assert.Equal(t, "f83976fc-7e59-4a12-ad17-0154a36e36fc", fileID)
+
+		return err
+	})
+	assert.Nil(t, err, "GetFileIDByUserPath failed unexpectedly")
+
+	err = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		mock.ExpectQuery(query).
+			WithArgs("dummy", "/inbox/missing.c4gh").
+			WillReturnRows(sqlmock.NewRows([]string{"id"}))
+
+		_, err := testDb.GetFileIDByUserPath("dummy", "/inbox/missing.c4gh")
+
+		return err
+	})
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+}
+
+func TestGetCorrID(t *testing.T) {
+	query := "SELECT correlation_id from sda.file_event_log WHERE file_id = " +
+		"\\(SELECT id from sda.files WHERE submission_user = \\$1 AND submission_file_path = \\$2 ORDER BY created_at DESC LIMIT 1\\) " +
+		"AND correlation_id IS NOT NULL ORDER BY id DESC LIMIT 1;"
+
+	err := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		mock.ExpectQuery(query).
+			WithArgs("dummy", "/inbox/file.c4gh").
+			WillReturnRows(sqlmock.NewRows([]string{"correlation_id"}).AddRow("7559caae-a17c-40ae-bdb9-3a7d33408c49"))
+
+		corrID, err := testDb.GetCorrID("dummy", "/inbox/file.c4gh")
+		assert.Equal(t, "7559caae-a17c-40ae-bdb9-3a7d33408c49", corrID)
+
+		return err
+	})
+	assert.Nil(t, err, "GetCorrID failed unexpectedly")
+
+	err = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		mock.ExpectQuery(query).
+			WithArgs("dummy", "/inbox/missing.c4gh").
+			WillReturnRows(sqlmock.NewRows([]string{"correlation_id"}))
+
+		_, err := testDb.GetCorrID("dummy", "/inbox/missing.c4gh")
+
+		return err
+	})
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+}
+
+func TestGetFileDetails(t *testing.T) {
+	fileID := "f83976fc-7e59-4a12-ad17-0154a36e36fc"
+	created := time.Date(2023, 10, 2, 12, 0, 0, 0, time.UTC)
+
+	err := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		mock.ExpectQuery("SELECT id, COALESCE\\(stable_id, ''\\), submission_user, submission_file_path, " +
+			"COALESCE\\(archive_file_path, ''\\), COALESCE\\(archive_file_size, 0\\), COALESCE\\(decrypted_file_size, 0\\), created_at " +
+			"from sda.files WHERE id = \\$1;").
+			WithArgs(fileID).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "stable_id", "submission_user", "submission_file_path", "archive_file_path", "archive_file_size", "decrypted_file_size", "created_at"}).
+				AddRow(fileID, "EGAF00000000001", "dummy", "/inbox/file.c4gh", "a8f4e3b1-1e4b-4a0b-9f5e-6f2b4b2b8f10", 1024, 1000, created))
+		mock.ExpectQuery("SELECT checksum, type, source from sda.checksums WHERE file_id = \\$1 ORDER BY source, type;").
+			WithArgs(fileID).
+			WillReturnRows(sqlmock.NewRows([]string{"checksum", "type", "source"}).
+				AddRow("96fa8f226d3801741e807533552bc4b177ac4544d834073b6a5298934d34b40b", "SHA256", "ARCHIVED"))
+		mock.ExpectQuery("SELECT d.stable_id from sda.file_dataset fd JOIN sda.datasets d ON fd.dataset_id = d.id " +
+			"WHERE fd.file_id = \\$1 ORDER BY d.stable_id;").
+			WithArgs(fileID).
+			WillReturnRows(sqlmock.NewRows([]string{"stable_id"}).AddRow("EGAD00000000001"))
+		mock.ExpectQuery("SELECT event, COALESCE\\(correlation_id::text, ''\\), COALESCE\\(user_id, ''\\), message, started_at " +
+			"from sda.file_event_log WHERE file_id = \\$1 ORDER BY id;").
+			WithArgs(fileID).
+			WillReturnRows(sqlmock.NewRows([]string{"event", "correlation_id", "user_id", "message", "started_at"}).
+				AddRow("registered", "", "dummy", nil, created).
+				AddRow("archived", "7559caae-a17c-40ae-bdb9-3a7d33408c49", "dummy", []byte(`{"filepath": "/inbox/file.c4gh"}`), created.Add(time.Minute)))
+
+		details, err := testDb.GetFileDetails(fileID)
+		assert.Equal(t, &FileDetails{
+			FileID:        fileID,
+			AccessionID:   "EGAF00000000001",
+			User:          "dummy",
+			InboxPath:     "/inbox/file.c4gh",
+			ArchivePath:   "a8f4e3b1-1e4b-4a0b-9f5e-6f2b4b2b8f10",
+			ArchiveSize:   1024,
+			DecryptedSize: 1000,
+			CreatedAt:     created,
+			Checksums:     []Checksum{{Checksum: "96fa8f226d3801741e807533552bc4b177ac4544d834073b6a5298934d34b40b", Type: "SHA256", Source: "ARCHIVED"}},
+			Datasets:      []string{"EGAD00000000001"},
+			Events: []FileEvent{
+				{Event: "registered", User: "dummy", Time: created},
+				{Event: "archived", CorrelationID: "7559caae-a17c-40ae-bdb9-3a7d33408c49", User: "dummy", Message: json.RawMessage(`{"filepath": "/inbox/file.c4gh"}`), Time: created.Add(time.Minute)},
+			},
+		}, details)
+
+		return err
+	})
+	assert.Nil(t, err, "GetFileDetails failed unexpectedly")
+}
+
+func TestGetDatasetFiles(t *testing.T) {
+	query := "SELECT f.id, COALESCE\\(f.stable_id, ''\\), f.submission_file_path, " +
+		"COALESCE\\(\\(SELECT event from sda.file_event_log e WHERE e.file_id = f.id ORDER BY e.id DESC LIMIT 1\\), ''\\) " +
+		"from sda.file_dataset fd JOIN sda.datasets d ON fd.dataset_id = d.id JOIN sda.files f ON fd.file_id = f.id " +
+		"WHERE d.stable_id = \\$1 ORDER BY f.stable_id;"
+
+	err := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		mock.ExpectQuery(query).
+			WithArgs("EGAD00000000001").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "stable_id", "submission_file_path", "event"}).
+				AddRow("f83976fc-7e59-4a12-ad17-0154a36e36fc", "EGAF00000000001", "/inbox/file.c4gh", "ready"))
+
+		files, err := testDb.GetDatasetFiles("EGAD00000000001")
+		assert.Equal(t, []DatasetFile{{FileID: "f83976fc-7e59-4a12-ad17-0154a36e36fc", AccessionID: "EGAF00000000001", InboxPath: "/inbox/file.c4gh", Status: "ready"}}, files)
+
+		return err
+	})
+	assert.Nil(t, err, "GetDatasetFiles failed unexpectedly")
+
+	err = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		mock.ExpectQuery(query).
+			WithArgs("EGAD00000000001").
+			WillReturnError(fmt.Errorf("error for testing"))
+
+		_, err := testDb.GetDatasetFiles("EGAD00000000001")
+
+		return err
+	})
+	assert.NotNil(t, err, "GetDatasetFiles did not fail as expected")
+}
+
+func TestRecordReplay(t *testing.T) {
+	query := "INSERT INTO sda.replays\\(correlation_id, routing_key, error, reason, message, replayed_by\\) " +
+		"VALUES\\(\\$1, \\$2, \\$3, \\$4, \\$5, \\$6\\);"
+	replay := Replay{
+		CorrelationID: "f83976fc-7e59-4a12-ad17-0154a36e36fc",
+		RoutingKey:    "ingest",
+		Error:         "Failed to open file to ingest",
+		Reason:        "file not found",
+		Message:       []byte(`{"type":"ingest"}`),
+		Operator:      "admin",
+	}
+
+	err := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		mock.ExpectExec(query).
+			WithArgs(replay.CorrelationID, "ingest", replay.Error, replay.Reason, `{"type":"ingest"}`, "admin").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+
+		return testDb.RecordReplay(replay)
+	})
+	assert.Nil(t, err, "RecordReplay failed unexpectedly")
+
+	err = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		mock.ExpectExec(query).
+			WithArgs(replay.CorrelationID, "ingest", replay.Error, replay.Reason, `{"type":"ingest"}`, "admin").
+			WillReturnError(fmt.Errorf("relation \"sda.replays\" does not exist"))
+
+		return testDb.RecordReplay(replay)
+	})
+	assert.EqualError(t, err, "relation \"sda.replays\" does not exist")
+}
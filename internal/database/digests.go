@@ -0,0 +1,88 @@
+package database
+
+import (
+	"crypto/md5" // #nosec
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/zeebo/blake3"
+)
+
+// castagnoli is the table of the CRC32C checksum, which is what cloud
+// object stores use
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// digestAlgorithms are the checksum algorithms digests can be computed
+// with, by the names they have in messages. In sda.checksums the names are
+// in upper case.
+var digestAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+	"blake3": func() hash.Hash { return blake3.New() },
+	"crc32c": func() hash.Hash { return crc32.New(castagnoli) },
+}
+
+// Digests are checksums of a file that are computed in a single pass, by
+// the name of their algorithm
+type Digests map[string]hash.Hash
+
+// NewDigests returns digests of the named algorithms
+func NewDigests(algorithms ...string) (Digests, error) {
+	digests := Digests{}
+	for _, algorithm := range algorithms {
+		newHash, ok := digestAlgorithms[algorithm]
+		if !ok {
+			return nil, fmt.Errorf("unsupported checksum algorithm: %s", algorithm)
+		}
+		digests[algorithm] = newHash()
+	}
+
+	return digests, nil
+}
+
+// Names returns the names of the algorithms of the digests in order
+func (d Digests) Names() []string {
+	names := make([]string, 0, len(d))
+	for name := range d {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Writer returns a writer that writes to all the digests at once
+func (d Digests) Writer() io.Writer {
+	writers := make([]io.Writer, 0, len(d))
+	for _, name := range d.Names() {
+		writers = append(writers, d[name])
+	}
+
+	return io.MultiWriter(writers...)
+}
+
+// Hex returns the hex encoded digest of the algorithm
+func (d Digests) Hex(algorithm string) string {
+	return fmt.Sprintf("%x", d[algorithm].Sum(nil))
+}
+
+// hashType returns the identification string for the hash type, as it is
+// stored in sda.checksums
+func hashType(h hash.Hash) string {
+	for name, newHash := range digestAlgorithms {
+		// The sha2 variants share their types, and differ in size
+		if known := newHash(); reflect.TypeOf(known) == reflect.TypeOf(h) && known.Size() == h.Size() {
+			return strings.ToUpper(name)
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,33 @@
+package database
+
+import (
+	"crypto/md5" // #nosec
+	"crypto/sha256"
+	"crypto/sha512"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewDigests(t *testing.T) {
+	digests, err := NewDigests("sha512", "blake3", "crc32c")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"blake3", "crc32c", "sha512"}, digests.Names())
+
+	_, err = digests.Writer().Write([]byte("hello"))
+	assert.NoError(t, err)
+
+	assert.Equal(t, "9b71d224bd62f3785d96d46ad3ea3d73319bfbc2890caadae2dff72519673ca72323c3d99ba5c11d7c7acc6e14b8c5da0c4663475c2e5c3adef46f73bcdec043", digests.Hex("sha512"))
+	assert.Equal(t, "ea8f163db38682925e4491c5e58d4bb3506ef8c14eb78a86e908c5624a67200f", digests.Hex("blake3"))
+	assert.Equal(t, "9a71bb4c", digests.Hex("crc32c"))
+
+	_, err = NewDigests("sha1")
+	assert.EqualError(t, err, "unsupported checksum algorithm: sha1")
+}
+
+func TestHashType(t *testing.T) {
+	assert.Equal(t, "MD5", hashType(md5.New())) // #nosec
+	assert.Equal(t, "SHA256", hashType(sha256.New()))
+	assert.Equal(t, "SHA512", hashType(sha512.New()))
+	assert.Equal(t, "", hashType(sha512.New384()))
+}
@@ -0,0 +1,175 @@
+// Package health provides the liveness and readiness endpoints of the
+// pipeline services
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"sda-pipeline/internal/broker"
+	"sda-pipeline/internal/database"
+	"sda-pipeline/internal/storage"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Conf stores the settings of the health server
+type Conf struct {
+	// Port is the port the endpoints are served on, zero disables the server
+	Port int
+	// Timeout is how long each check may take before it fails
+	Timeout time.Duration
+}
+
+// Check reports whether something the service depends on is usable
+type Check func(ctx context.Context) error
+
+// Server serves /health/live and /health/ready. The liveness endpoint
+// fails when the service can't recover without a restart, the readiness
+// endpoint also fails when anything the service depends on is unreachable.
+type Server struct {
+	conf      Conf
+	liveness  map[string]Check
+	readiness map[string]Check
+}
+
+// status is the response of the endpoints
+type status struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// NewServer returns a health server without any checks
+func NewServer(conf Conf) *Server {
+	if conf.Timeout <= 0 {
+		conf.Timeout = 5 * time.Second
+	}
+
+	return &Server{conf: conf, liveness: map[string]Check{}, readiness: map[string]Check{}}
+}
+
+// AddLivenessCheck adds a check that fails both endpoints
+func (s *Server) AddLivenessCheck(name string, check Check) {
+	s.liveness[name] = check
+	s.readiness[name] = check
+}
+
+// AddReadinessCheck adds a check that fails the readiness endpoint
+func (s *Server) AddReadinessCheck(name string, check Check) {
+	s.readiness[name] = check
+}
+
+// Handler returns the http handler serving the endpoints
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health/live", s.respond(s.liveness))
+	mux.HandleFunc("/health/ready", s.respond(s.readiness))
+
+	return mux
+}
+
+// Start serves the endpoints on the configured port. It does nothing if no
+// port is set.
+func (s *Server) Start() {
+	if s.conf.Port == 0 {
+		return
+	}
+
+	srv := &http.Server{
+		Addr:              fmt.Sprintf(":%d", s.conf.Port),
+		Handler:           s.Handler(),
+		ReadHeaderTimeout: 20 * time.Second,
+	}
+
+	go func() {
+		log.Infof("Serving health checks on :%d/health", s.conf.Port)
+		if err := srv.ListenAndServe(); err != nil {
+			log.Errorf("Health server failed, reason: %v", err)
+		}
+	}()
+}
+
+// respond runs the checks concurrently and responds with the result of
+// each, with status 503 if any of them failed
+func (s *Server) respond(checks map[string]Check) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), s.conf.Timeout)
+		defer cancel()
+
+		res := status{Status: "ok", Checks: map[string]string{}}
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		for name, check := range checks {
+			wg.Add(1)
+			go func(name string, check Check) {
+				defer wg.Done()
+				err := run(ctx, check)
+
+				mu.Lock()
+				defer mu.Unlock()
+				res.Checks[name] = "ok"
+				if err != nil {
+					log.Warnf("Health check %s failed, reason: %v", name, err)
+					res.Checks[name] = err.Error()
+					res.Status = "unavailable"
+				}
+			}(name, check)
+		}
+		wg.Wait()
+
+		statusCode := http.StatusOK
+		if res.Status != "ok" {
+			statusCode = http.StatusServiceUnavailable
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(statusCode)
+		_ = json.NewEncoder(w).Encode(res)
+	}
+}
+
+// run runs check, failing it if it doesn't return before ctx is done
+func run(ctx context.Context, check Check) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- check(ctx)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("check timed out, reason: %v", ctx.Err())
+	}
+}
+
+// BrokerCheck fails when the connection or the channel to the broker is
+// closed, which is the case while the broker is reconnecting
+func BrokerCheck(mq *broker.AMQPBroker) Check {
+	return func(context.Context) error {
+		if !mq.IsConnected() {
+			return errors.New("broker connection or channel is closed")
+		}
+
+		return nil
+	}
+}
+
+// DatabaseCheck fails when the database can't be pinged
+func DatabaseCheck(db *database.SQLdb) Check {
+	return func(ctx context.Context) error {
+		return db.Ping(ctx)
+	}
+}
+
+// StorageCheck fails when the storage backend can't be reached
+func StorageCheck(backend storage.Backend) Check {
+	return func(context.Context) error {
+		return backend.Ping()
+	}
+}
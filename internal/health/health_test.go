@@ -0,0 +1,94 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"sda-pipeline/internal/broker"
+	"sda-pipeline/internal/database"
+	"sda-pipeline/internal/storage"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func get(t *testing.T, s *Server, path string) (int, status) {
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+
+	var res status
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&res))
+
+	return w.Code, res
+}
+
+func TestEndpoints(t *testing.T) {
+	s := NewServer(Conf{})
+	s.AddLivenessCheck("broker", func(context.Context) error { return nil })
+	s.AddReadinessCheck("database", func(context.Context) error { return nil })
+
+	code, res := get(t, s, "/health/live")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, status{Status: "ok", Checks: map[string]string{"broker": "ok"}}, res)
+
+	code, res = get(t, s, "/health/ready")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, status{Status: "ok", Checks: map[string]string{"broker": "ok", "database": "ok"}}, res)
+
+	s.AddReadinessCheck("archive", func(context.Context) error { return errors.New("unreachable") })
+
+	code, _ = get(t, s, "/health/live")
+	assert.Equal(t, http.StatusOK, code, "readiness checks should not fail liveness")
+
+	code, res = get(t, s, "/health/ready")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "unavailable", res.Status)
+	assert.Equal(t, "unreachable", res.Checks["archive"])
+	assert.Equal(t, "ok", res.Checks["database"])
+}
+
+func TestCheckTimeout(t *testing.T) {
+	s := NewServer(Conf{Timeout: 10 * time.Millisecond})
+	s.AddLivenessCheck("broker", func(context.Context) error {
+		time.Sleep(time.Second)
+
+		return nil
+	})
+
+	code, res := get(t, s, "/health/live")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Contains(t, res.Checks["broker"], "check timed out")
+}
+
+func TestBrokerCheck(t *testing.T) {
+	err := BrokerCheck(&broker.AMQPBroker{})(context.Background())
+	assert.EqualError(t, err, "broker connection or channel is closed")
+}
+
+func TestDatabaseCheck(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
+	assert.NoError(t, err)
+	defer db.Close()
+
+	mock.ExpectPing()
+	assert.NoError(t, DatabaseCheck(&database.SQLdb{DB: db})(context.Background()))
+
+	mock.ExpectPing().WillReturnError(errors.New("connection refused"))
+	assert.EqualError(t, DatabaseCheck(&database.SQLdb{DB: db})(context.Background()), "connection refused")
+
+	assert.EqualError(t, DatabaseCheck(&database.SQLdb{})(context.Background()), "database is nil")
+}
+
+func TestStorageCheck(t *testing.T) {
+	conf := storage.Conf{Type: "posix"}
+	conf.Posix.Location = t.TempDir()
+	backend, err := storage.NewBackend(conf)
+	assert.NoError(t, err)
+
+	assert.NoError(t, StorageCheck(backend)(context.Background()))
+}
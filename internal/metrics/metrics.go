@@ -0,0 +1,134 @@
+// Package metrics provides the prometheus metrics of the pipeline services
+// and the http server that exposes them
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+// Conf stores the settings of the metrics server
+type Conf struct {
+	// Port is the port /metrics is served on, zero disables the server
+	Port int
+}
+
+var (
+	messages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sda_messages_total",
+		Help: "Messages handled, by result: acked, nacked, rejected, retried (sent to a retry queue) or errored (sent to the error queue).",
+	}, []string{"result"})
+
+	messageDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "sda_message_duration_seconds",
+		Help:    "Time from delivery of a message until it was acked or nacked.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 4, 10),
+	}, []string{"result"})
+
+	fileBytes = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "sda_file_bytes",
+		Help:    "Bytes of file data processed per file.",
+		Buckets: prometheus.ExponentialBuckets(1024, 8, 10),
+	})
+
+	databaseDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "sda_database_call_duration_seconds",
+		Help:    "Duration of database calls, including retries.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method"})
+
+	storageDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "sda_storage_call_duration_seconds",
+		Help:    "Duration of storage backend calls.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"backend", "method"})
+)
+
+// registry holds the metrics of the service, it is set up by Start
+var registry = newRegistry("")
+
+// newRegistry returns a registry with the metrics of the pipeline and of
+// the go runtime, labelled with the service they are from
+func newRegistry(service string) *prometheus.Registry {
+	r := prometheus.NewRegistry()
+	prometheus.WrapRegistererWith(prometheus.Labels{"service": service}, r).MustRegister(
+		messages,
+		messageDuration,
+		fileBytes,
+		databaseDuration,
+		storageDuration,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+
+	return r
+}
+
+// Handler returns the http handler serving the metrics
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// Start labels the metrics with the service name and serves them on
+// /metrics on the configured port. It does nothing if no port is set.
+func Start(service string, conf Conf) {
+	if conf.Port == 0 {
+		return
+	}
+
+	registry = newRegistry(service)
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+	srv := &http.Server{
+		Addr:              fmt.Sprintf(":%d", conf.Port),
+		Handler:           mux,
+		ReadHeaderTimeout: 20 * time.Second,
+	}
+
+	go func() {
+		log.Infof("Serving metrics on :%d/metrics", conf.Port)
+		if err := srv.ListenAndServe(); err != nil {
+			log.Errorf("Metrics server failed, reason: %v", err)
+		}
+	}()
+}
+
+// MessageHandled counts a message as acked, nacked or rejected and records
+// how long it took from delivery
+func MessageHandled(result string, delivered time.Time) {
+	messages.WithLabelValues(result).Inc()
+	messageDuration.WithLabelValues(result).Observe(time.Since(delivered).Seconds())
+}
+
+// MessageErrored counts a message sent to the error queue
+func MessageErrored() {
+	messages.WithLabelValues("errored").Inc()
+}
+
+// MessageRetried counts a message sent to a retry queue
+func MessageRetried() {
+	messages.WithLabelValues("retried").Inc()
+}
+
+// FileProcessed records the bytes of file data processed for a file
+func FileProcessed(bytes int64) {
+	fileBytes.Observe(float64(bytes))
+}
+
+// DatabaseCall records the duration of a database call started at start,
+// to be deferred at the start of the call
+func DatabaseCall(method string, start time.Time) {
+	databaseDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+}
+
+// StorageCall records the duration of a storage backend call started at
+// start, to be deferred at the start of the call
+func StorageCall(backend, method string, start time.Time) {
+	storageDuration.WithLabelValues(backend, method).Observe(time.Since(start).Seconds())
+}
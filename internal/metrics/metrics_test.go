@@ -0,0 +1,50 @@
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessageHandled(t *testing.T) {
+	before := testutil.ToFloat64(messages.WithLabelValues("acked"))
+	MessageHandled("acked", time.Now().Add(-time.Second))
+	assert.Equal(t, before+1, testutil.ToFloat64(messages.WithLabelValues("acked")))
+
+	before = testutil.ToFloat64(messages.WithLabelValues("errored"))
+	MessageErrored()
+	assert.Equal(t, before+1, testutil.ToFloat64(messages.WithLabelValues("errored")))
+
+	before = testutil.ToFloat64(messages.WithLabelValues("retried"))
+	MessageRetried()
+	assert.Equal(t, before+1, testutil.ToFloat64(messages.WithLabelValues("retried")))
+}
+
+func TestHandler(t *testing.T) {
+	registry = newRegistry("test")
+	FileProcessed(2048)
+	DatabaseCall("GetHeader", time.Now())
+	StorageCall("posix", "GetFileSize", time.Now())
+
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	body, err := io.ReadAll(w.Body)
+	assert.NoError(t, err)
+	assert.Contains(t, string(body), `sda_file_bytes_count{service="test"} 1`)
+	assert.Contains(t, string(body), `sda_database_call_duration_seconds_count{method="GetHeader",service="test"} 1`)
+	assert.Contains(t, string(body), `sda_storage_call_duration_seconds_count{backend="posix",method="GetFileSize",service="test"} 1`)
+	assert.Contains(t, string(body), "go_goroutines")
+}
+
+func TestStart(t *testing.T) {
+	current := registry
+	Start("test", Conf{})
+	assert.Same(t, current, registry, "Start should do nothing without a port")
+}
@@ -2,19 +2,27 @@
 package storage
 
 import (
+	"bytes"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"net"
 	"net/http"
 	"os"
 	"path/filepath"
 	"reflect"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
+	"sda-pipeline/internal/metrics"
+
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
@@ -27,12 +35,98 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// listPageSize is the number of objects to ask for in each s3 list request,
+// it is a variable to make testing of pagination easier
+var listPageSize int64 = 1000
+
 // Backend defines methods to be implemented by PosixBackend, S3Backend and sftpBackend
 type Backend interface {
 	GetFileSize(filePath string) (int64, error)
 	RemoveFile(filePath string) error
 	NewFileReader(filePath string) (io.ReadCloser, error)
+	NewFileReaderAt(filePath string, offset, length int64) (io.ReadCloser, error)
 	NewFileWriter(filePath string) (io.WriteCloser, error)
+	List(prefix string) ([]FileInfo, error)
+	Walk(prefix string, fn WalkFunc) error
+	Ping() error
+}
+
+// ResumableBackend is implemented by backends that can resume an
+// interrupted write of a file instead of starting over
+type ResumableBackend interface {
+	ResumableWrite(filePath string, size int64, source RangeSource) error
+}
+
+// CredentialsUpdater is implemented by backends whose credentials can be
+// replaced while they are in use
+type CredentialsUpdater interface {
+	UpdateCredentials(config Conf)
+}
+
+// UpdateCredentials replaces the credentials of backend with the ones in
+// config, if the backend supports it
+func UpdateCredentials(backend Backend, config Conf) {
+	if updater, ok := backend.(CredentialsUpdater); ok {
+		updater.UpdateCredentials(config)
+	}
+}
+
+// RangeSource returns a reader for length bytes of the data to write,
+// starting at offset
+type RangeSource func(offset, length int64) (io.ReadCloser, error)
+
+// WalkFunc is called by Walk for each file, returning an error stops the walk
+type WalkFunc func(file FileInfo) error
+
+// FileInfo describes a file in a storage backend
+type FileInfo struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+}
+
+// rangeReader reads a range of a file and closes the file when closed
+type rangeReader struct {
+	io.Reader
+	io.Closer
+}
+
+// limitReadCloser limits reads from r to length bytes, a negative length
+// means no limit
+func limitReadCloser(r io.ReadCloser, length int64) io.ReadCloser {
+	if length < 0 {
+		return r
+	}
+
+	return rangeReader{io.LimitReader(r, length), r}
+}
+
+// list collects all files visited by walk
+func list(walk func(string, WalkFunc) error, prefix string) ([]FileInfo, error) {
+	files := []FileInfo{}
+	err := walk(prefix, func(file FileInfo) error {
+		files = append(files, file)
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+// walkRoot returns the deepest directory that holds all paths starting with
+// prefix, so that a walk doesn't have to visit the whole storage
+func walkRoot(prefix string) string {
+	switch i := strings.LastIndex(prefix, "/"); {
+	case i > 0:
+		return prefix[:i]
+	case i == 0:
+		return "/"
+	default:
+		return "."
+	}
 }
 
 // Conf is a wrapper for the storage config
@@ -81,6 +175,8 @@ func newPosixBackend(config posixConf) (*posixBackend, error) {
 
 // NewFileReader returns an io.Reader instance
 func (pb *posixBackend) NewFileReader(filePath string) (io.ReadCloser, error) {
+	defer metrics.StorageCall("posix", "NewFileReader", time.Now())
+
 	if pb == nil {
 		return nil, fmt.Errorf("Invalid posixBackend")
 	}
@@ -95,8 +191,39 @@ func (pb *posixBackend) NewFileReader(filePath string) (io.ReadCloser, error) {
 	return file, nil
 }
 
+// NewFileReaderAt returns an io.Reader instance for length bytes of the
+// file starting at offset, a negative length reads to the end of the file
+func (pb *posixBackend) NewFileReaderAt(filePath string, offset, length int64) (io.ReadCloser, error) {
+	defer metrics.StorageCall("posix", "NewFileReaderAt", time.Now())
+
+	if pb == nil {
+		return nil, fmt.Errorf("Invalid posixBackend")
+	}
+	if offset < 0 {
+		return nil, fmt.Errorf("Invalid offset %d", offset)
+	}
+
+	file, err := os.Open(filepath.Join(filepath.Clean(pb.Location), filePath))
+	if err != nil {
+		log.Error(err)
+
+		return nil, err
+	}
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		log.Error(err)
+
+		return nil, err
+	}
+
+	return limitReadCloser(file, length), nil
+}
+
 // NewFileWriter returns an io.Writer instance
 func (pb *posixBackend) NewFileWriter(filePath string) (io.WriteCloser, error) {
+	defer metrics.StorageCall("posix", "NewFileWriter", time.Now())
+
 	if pb == nil {
 		return nil, fmt.Errorf("Invalid posixBackend")
 	}
@@ -113,6 +240,8 @@ func (pb *posixBackend) NewFileWriter(filePath string) (io.WriteCloser, error) {
 
 // GetFileSize returns the size of the file
 func (pb *posixBackend) GetFileSize(filePath string) (int64, error) {
+	defer metrics.StorageCall("posix", "GetFileSize", time.Now())
+
 	if pb == nil {
 		return 0, fmt.Errorf("Invalid posixBackend")
 	}
@@ -129,6 +258,8 @@ func (pb *posixBackend) GetFileSize(filePath string) (int64, error) {
 
 // RemoveFile removes a file from a given path
 func (pb *posixBackend) RemoveFile(filePath string) error {
+	defer metrics.StorageCall("posix", "RemoveFile", time.Now())
+
 	if pb == nil {
 		return fmt.Errorf("Invalid posixBackend")
 	}
@@ -143,11 +274,121 @@ func (pb *posixBackend) RemoveFile(filePath string) error {
 	return nil
 }
 
+// Ping checks that the storage location is a reachable directory
+func (pb *posixBackend) Ping() error {
+	defer metrics.StorageCall("posix", "Ping", time.Now())
+
+	if pb == nil {
+		return fmt.Errorf("Invalid posixBackend")
+	}
+
+	fileInfo, err := os.Stat(pb.Location)
+	if err != nil {
+		return err
+	}
+	if !fileInfo.IsDir() {
+		return fmt.Errorf("%s is not a directory", pb.Location)
+	}
+
+	return nil
+}
+
+// List returns the files whose path, relative to the storage location,
+// starts with prefix
+func (pb *posixBackend) List(prefix string) ([]FileInfo, error) {
+	return list(pb.Walk, prefix)
+}
+
+// Walk calls fn for each file whose path, relative to the storage location,
+// starts with prefix
+func (pb *posixBackend) Walk(prefix string, fn WalkFunc) error {
+	defer metrics.StorageCall("posix", "Walk", time.Now())
+
+	if pb == nil {
+		return fmt.Errorf("Invalid posixBackend")
+	}
+
+	root := filepath.Clean(pb.Location)
+	start := filepath.Join(root, walkRoot(prefix))
+	err := filepath.WalkDir(start, func(filePath string, d fs.DirEntry, err error) error {
+		// Nothing can match a prefix in a directory that doesn't exist
+		if filePath == start && errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(root, filePath)
+		if err != nil {
+			return err
+		}
+		relPath = filepath.ToSlash(relPath)
+		if !strings.HasPrefix(relPath, prefix) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		return fn(FileInfo{Path: relPath, Size: info.Size(), ModTime: info.ModTime()})
+	})
+	if err != nil {
+		log.Error(err)
+
+		return err
+	}
+
+	return nil
+}
+
 type s3Backend struct {
-	Client   *s3.S3
-	Uploader *s3manager.Uploader
-	Bucket   string
-	Conf     *S3Conf
+	Client      *s3.S3
+	Uploader    *s3manager.Uploader
+	Bucket      string
+	Conf        *S3Conf
+	credentials *s3Credentials
+}
+
+// s3Credentials provides the keys the s3 client signs requests with, and
+// makes the client use new keys once they are replaced
+type s3Credentials struct {
+	mu      sync.Mutex
+	value   credentials.Value
+	updated bool
+}
+
+// Retrieve returns the current keys
+func (c *s3Credentials) Retrieve() (credentials.Value, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.updated = false
+
+	return c.value, nil
+}
+
+// IsExpired reports whether the keys have been replaced since they were
+// last retrieved
+func (c *s3Credentials) IsExpired() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.updated
+}
+
+// set replaces the keys
+func (c *s3Credentials) set(accessKey, secretKey string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.value = credentials.Value{AccessKeyID: accessKey, SecretAccessKey: secretKey, ProviderName: "s3Credentials"}
+	c.updated = true
 }
 
 // S3Conf stores information about the S3 storage backend
@@ -165,6 +406,8 @@ type S3Conf struct {
 }
 
 func newS3Backend(config S3Conf) (*s3Backend, error) {
+	keys := &s3Credentials{}
+	keys.set(config.AccessKey, config.SecretKey)
 	s3Transport := transportConfigS3(config)
 	client := http.Client{Transport: s3Transport}
 	s3Session := session.Must(session.NewSession(
@@ -174,7 +417,7 @@ func newS3Backend(config S3Conf) (*s3Backend, error) {
 			HTTPClient:       &client,
 			S3ForcePathStyle: aws.Bool(true),
 			DisableSSL:       aws.Bool(strings.HasPrefix(config.URL, "http:")),
-			Credentials:      credentials.NewStaticCredentials(config.AccessKey, config.SecretKey, ""),
+			Credentials:      credentials.NewCredentials(keys),
 		},
 	))
 
@@ -201,8 +444,9 @@ func newS3Backend(config S3Conf) (*s3Backend, error) {
 			u.Concurrency = config.UploadConcurrency
 			u.LeavePartsOnError = false
 		}),
-		Client: s3.New(s3Session),
-		Conf:   &config}
+		Client:      s3.New(s3Session),
+		Conf:        &config,
+		credentials: keys}
 
 	_, err = sb.Client.ListObjectsV2(&s3.ListObjectsV2Input{Bucket: &config.Bucket})
 
@@ -213,15 +457,57 @@ func newS3Backend(config S3Conf) (*s3Backend, error) {
 	return sb, nil
 }
 
+// UpdateCredentials makes the backend sign the requests that follow with
+// the keys in config
+func (sb *s3Backend) UpdateCredentials(config Conf) {
+	sb.credentials.set(config.S3.AccessKey, config.S3.SecretKey)
+}
+
 // NewFileReader returns an io.Reader instance
 func (sb *s3Backend) NewFileReader(filePath string) (io.ReadCloser, error) {
+	defer metrics.StorageCall("s3", "NewFileReader", time.Now())
+
 	if sb == nil {
 		return nil, fmt.Errorf("Invalid s3Backend")
 	}
 
+	return sb.getObject(filePath, nil)
+}
+
+// NewFileReaderAt returns an io.Reader instance for length bytes of the
+// object starting at offset, a negative length reads to the end of the
+// object. Only the requested bytes are fetched, using an HTTP range request.
+func (sb *s3Backend) NewFileReaderAt(filePath string, offset, length int64) (io.ReadCloser, error) {
+	defer metrics.StorageCall("s3", "NewFileReaderAt", time.Now())
+
+	if sb == nil {
+		return nil, fmt.Errorf("Invalid s3Backend")
+	}
+	if offset < 0 {
+		return nil, fmt.Errorf("Invalid offset %d", offset)
+	}
+
+	// An empty range can't be expressed as an HTTP range
+	if length == 0 {
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+
+	byteRange := fmt.Sprintf("bytes=%d-", offset)
+	if length > 0 {
+		byteRange = fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)
+	}
+
+	return sb.getObject(filePath, aws.String(byteRange))
+}
+
+// getObject returns the body of the object, or of the byteRange of the
+// object if it is set. Getting the object is retried for as long as the
+// configured NonExistRetryTime.
+func (sb *s3Backend) getObject(filePath string, byteRange *string) (io.ReadCloser, error) {
 	r, err := sb.Client.GetObject(&s3.GetObjectInput{
 		Bucket: aws.String(sb.Bucket),
 		Key:    aws.String(filePath),
+		Range:  byteRange,
 	})
 
 	retryTime := 2 * time.Minute
@@ -234,6 +520,7 @@ func (sb *s3Backend) NewFileReader(filePath string) (io.ReadCloser, error) {
 		r, err = sb.Client.GetObject(&s3.GetObjectInput{
 			Bucket: aws.String(sb.Bucket),
 			Key:    aws.String(filePath),
+			Range:  byteRange,
 		})
 		time.Sleep(1 * time.Second)
 	}
@@ -249,11 +536,14 @@ func (sb *s3Backend) NewFileReader(filePath string) (io.ReadCloser, error) {
 
 // NewFileWriter uploads the contents of an io.Reader to a S3 bucket
 func (sb *s3Backend) NewFileWriter(filePath string) (io.WriteCloser, error) {
+	defer metrics.StorageCall("s3", "NewFileWriter", time.Now())
+
 	if sb == nil {
 		return nil, fmt.Errorf("Invalid s3Backend")
 	}
 
 	reader, writer := io.Pipe()
+	w := &s3Writer{PipeWriter: writer, done: make(chan error, 1)}
 	go func() {
 
 		_, err := sb.Uploader.Upload(&s3manager.UploadInput{
@@ -266,13 +556,49 @@ func (sb *s3Backend) NewFileWriter(filePath string) (io.WriteCloser, error) {
 		if err != nil {
 			_ = reader.CloseWithError(err)
 		}
+		w.done <- err
 	}()
 
-	return writer, nil
+	return w, nil
+}
+
+// s3Writer writes to an object through the pipe that the uploader reads
+// from, the upload is only done once the writer is closed
+type s3Writer struct {
+	*io.PipeWriter
+	done chan error
+	err  error
+	once sync.Once
+}
+
+// Close ends the upload, and returns when the object has been written,
+// with the error of the upload if it failed
+func (w *s3Writer) Close() error {
+	_ = w.PipeWriter.Close()
+
+	return w.wait()
+}
+
+// CloseWithError aborts the upload, and returns once the uploader has
+// stopped, so that nothing is written to the object afterwards
+func (w *s3Writer) CloseWithError(err error) error {
+	_ = w.PipeWriter.CloseWithError(err)
+	_ = w.wait()
+
+	return nil
+}
+
+// wait waits for the upload to finish and returns its error
+func (w *s3Writer) wait() error {
+	w.once.Do(func() { w.err = <-w.done })
+
+	return w.err
 }
 
 // GetFileSize returns the size of a specific object
 func (sb *s3Backend) GetFileSize(filePath string) (int64, error) {
+	defer metrics.StorageCall("s3", "GetFileSize", time.Now())
+
 	if sb == nil {
 		return 0, fmt.Errorf("Invalid s3Backend")
 	}
@@ -310,6 +636,8 @@ func (sb *s3Backend) GetFileSize(filePath string) (int64, error) {
 
 // RemoveFile removes an object from a bucket
 func (sb *s3Backend) RemoveFile(filePath string) error {
+	defer metrics.StorageCall("s3", "RemoveFile", time.Now())
+
 	if sb == nil {
 		return fmt.Errorf("Invalid s3Backend")
 	}
@@ -333,6 +661,277 @@ func (sb *s3Backend) RemoveFile(filePath string) error {
 	return nil
 }
 
+// Ping checks that the bucket exists and can be accessed
+func (sb *s3Backend) Ping() error {
+	defer metrics.StorageCall("s3", "Ping", time.Now())
+
+	if sb == nil {
+		return fmt.Errorf("Invalid s3Backend")
+	}
+
+	_, err := sb.Client.HeadBucket(&s3.HeadBucketInput{Bucket: aws.String(sb.Bucket)})
+
+	return err
+}
+
+// List returns the objects in the bucket whose key starts with prefix
+func (sb *s3Backend) List(prefix string) ([]FileInfo, error) {
+	return list(sb.Walk, prefix)
+}
+
+// Walk calls fn for each object in the bucket whose key starts with prefix.
+// The objects are listed one page at a time.
+func (sb *s3Backend) Walk(prefix string, fn WalkFunc) error {
+	defer metrics.StorageCall("s3", "Walk", time.Now())
+
+	if sb == nil {
+		return fmt.Errorf("Invalid s3Backend")
+	}
+
+	var walkErr error
+	err := sb.Client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket:  aws.String(sb.Bucket),
+		Prefix:  aws.String(prefix),
+		MaxKeys: aws.Int64(listPageSize),
+	}, func(page *s3.ListObjectsV2Output, _ bool) bool {
+		for _, object := range page.Contents {
+			walkErr = fn(FileInfo{
+				Path:    aws.StringValue(object.Key),
+				Size:    aws.Int64Value(object.Size),
+				ModTime: aws.TimeValue(object.LastModified),
+			})
+			if walkErr != nil {
+				return false
+			}
+		}
+
+		return true
+	})
+	if err != nil {
+		log.Error(err)
+
+		return err
+	}
+
+	return walkErr
+}
+
+// uploadStateSuffix is appended to the object key to get the key of the
+// object holding the state of a resumable upload
+const uploadStateSuffix = ".upload"
+
+// minPartSize and maxParts are the s3 limits for multipart uploads
+const (
+	minPartSize = 5 * 1024 * 1024
+	maxParts    = 10000
+)
+
+// uploadState is the state of a resumable multipart upload. It is stored
+// next to the object being written until the upload is completed.
+type uploadState struct {
+	UploadID string          `json:"upload_id"`
+	Size     int64           `json:"size"`
+	PartSize int64           `json:"part_size"`
+	Parts    []completedPart `json:"parts"`
+}
+
+// completedPart is a part of a multipart upload that has been uploaded
+type completedPart struct {
+	PartNumber int64  `json:"part_number"`
+	ETag       string `json:"etag"`
+}
+
+// ResumableWrite writes size bytes from source to the object as a multipart
+// upload. The upload id and the completed parts are saved after each part,
+// so that a write that is interrupted only uploads the missing parts when
+// it is retried.
+func (sb *s3Backend) ResumableWrite(filePath string, size int64, source RangeSource) error {
+	defer metrics.StorageCall("s3", "ResumableWrite", time.Now())
+
+	if sb == nil {
+		return fmt.Errorf("Invalid s3Backend")
+	}
+
+	partSize := sb.partSize(size)
+	state, err := sb.loadUploadState(filePath)
+	switch {
+	case err != nil:
+		return err
+	case state != nil && state.Size == size && state.PartSize == partSize:
+		log.Infof("Resuming upload of %s, %d parts already uploaded", filePath, len(state.Parts))
+	default:
+		if state != nil {
+			// The old upload can't be used for this data
+			sb.abortUpload(filePath, state)
+		}
+		out, err := sb.Client.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+			Bucket:          aws.String(sb.Bucket),
+			Key:             aws.String(filePath),
+			ContentEncoding: aws.String("application/octet-stream"),
+		})
+		if err != nil {
+			return err
+		}
+		state = &uploadState{UploadID: aws.StringValue(out.UploadId), Size: size, PartSize: partSize, Parts: []completedPart{}}
+		if err := sb.saveUploadState(filePath, state); err != nil {
+			return err
+		}
+	}
+
+	uploaded := make(map[int64]bool, len(state.Parts))
+	for _, part := range state.Parts {
+		uploaded[part.PartNumber] = true
+	}
+
+	// An empty file is still uploaded as one part
+	numParts := (size + partSize - 1) / partSize
+	if numParts == 0 {
+		numParts = 1
+	}
+
+	buf := make([]byte, partSize)
+	for partNumber := int64(1); partNumber <= numParts; partNumber++ {
+		if uploaded[partNumber] {
+			continue
+		}
+
+		offset := (partNumber - 1) * partSize
+		length := partSize
+		if offset+length > size {
+			length = size - offset
+		}
+
+		r, err := source(offset, length)
+		if err != nil {
+			return err
+		}
+		_, err = io.ReadFull(r, buf[:length])
+		r.Close()
+		if err != nil {
+			return fmt.Errorf("Failed to read part %d, %v", partNumber, err)
+		}
+
+		out, err := sb.Client.UploadPart(&s3.UploadPartInput{
+			Bucket:     aws.String(sb.Bucket),
+			Key:        aws.String(filePath),
+			UploadId:   aws.String(state.UploadID),
+			PartNumber: aws.Int64(partNumber),
+			Body:       bytes.NewReader(buf[:length]),
+		})
+		if err != nil {
+			if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchUpload {
+				// Start over next time
+				sb.removeUploadState(filePath)
+			}
+
+			return err
+		}
+
+		state.Parts = append(state.Parts, completedPart{PartNumber: partNumber, ETag: aws.StringValue(out.ETag)})
+		if err := sb.saveUploadState(filePath, state); err != nil {
+			return err
+		}
+	}
+
+	sort.Slice(state.Parts, func(i, j int) bool { return state.Parts[i].PartNumber < state.Parts[j].PartNumber })
+	parts := make([]*s3.CompletedPart, 0, len(state.Parts))
+	for _, part := range state.Parts {
+		parts = append(parts, &s3.CompletedPart{PartNumber: aws.Int64(part.PartNumber), ETag: aws.String(part.ETag)})
+	}
+
+	_, err = sb.Client.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(sb.Bucket),
+		Key:             aws.String(filePath),
+		UploadId:        aws.String(state.UploadID),
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		return err
+	}
+
+	sb.removeUploadState(filePath)
+
+	return nil
+}
+
+// partSize returns the part size to use for an upload of size bytes
+func (sb *s3Backend) partSize(size int64) int64 {
+	partSize := int64(minPartSize)
+	if sb.Conf != nil && int64(sb.Conf.Chunksize) > partSize {
+		partSize = int64(sb.Conf.Chunksize)
+	}
+	if size > partSize*maxParts {
+		partSize = (size + maxParts - 1) / maxParts
+	}
+
+	return partSize
+}
+
+// loadUploadState returns the saved state of an upload to filePath, or
+// nil if there is none
+func (sb *s3Backend) loadUploadState(filePath string) (*uploadState, error) {
+	r, err := sb.Client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(sb.Bucket),
+		Key:    aws.String(filePath + uploadStateSuffix),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Body.Close()
+
+	state := &uploadState{}
+	if err := json.NewDecoder(r.Body).Decode(state); err != nil {
+		log.Warnf("Ignoring broken upload state for %s, %v", filePath, err)
+
+		return nil, nil
+	}
+
+	return state, nil
+}
+
+// saveUploadState saves the state of an upload to filePath
+func (sb *s3Backend) saveUploadState(filePath string, state *uploadState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	_, err = sb.Client.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(sb.Bucket),
+		Key:    aws.String(filePath + uploadStateSuffix),
+		Body:   bytes.NewReader(data),
+	})
+
+	return err
+}
+
+// removeUploadState removes the saved state of an upload to filePath
+func (sb *s3Backend) removeUploadState(filePath string) {
+	_, err := sb.Client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(sb.Bucket),
+		Key:    aws.String(filePath + uploadStateSuffix),
+	})
+	if err != nil {
+		log.Warnf("Failed to remove upload state for %s, %v", filePath, err)
+	}
+}
+
+// abortUpload aborts a saved upload to filePath and removes its state
+func (sb *s3Backend) abortUpload(filePath string, state *uploadState) {
+	_, err := sb.Client.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(sb.Bucket),
+		Key:      aws.String(filePath),
+		UploadId: aws.String(state.UploadID),
+	})
+	if err != nil {
+		log.Warnf("Failed to abort upload of %s, %v", filePath, err)
+	}
+	sb.removeUploadState(filePath)
+}
+
 // transportConfigS3 is a helper method to setup TLS for the S3 client.
 func transportConfigS3(config S3Conf) http.RoundTripper {
 	cfg := new(tls.Config)
@@ -433,6 +1032,8 @@ func newSftpBackend(config SftpConf) (*sftpBackend, error) {
 
 // NewFileWriter returns an io.Writer instance for the sftp remote
 func (sfb *sftpBackend) NewFileWriter(filePath string) (io.WriteCloser, error) {
+	defer metrics.StorageCall("sftp", "NewFileWriter", time.Now())
+
 	if sfb == nil {
 		return nil, fmt.Errorf("Invalid sftpBackend")
 	}
@@ -453,6 +1054,8 @@ func (sfb *sftpBackend) NewFileWriter(filePath string) (io.WriteCloser, error) {
 
 // GetFileSize returns the size of the file
 func (sfb *sftpBackend) GetFileSize(filePath string) (int64, error) {
+	defer metrics.StorageCall("sftp", "GetFileSize", time.Now())
+
 	if sfb == nil {
 		return 0, fmt.Errorf("Invalid sftpBackend")
 	}
@@ -467,6 +1070,8 @@ func (sfb *sftpBackend) GetFileSize(filePath string) (int64, error) {
 
 // NewFileReader returns an io.Reader instance
 func (sfb *sftpBackend) NewFileReader(filePath string) (io.ReadCloser, error) {
+	defer metrics.StorageCall("sftp", "NewFileReader", time.Now())
+
 	if sfb == nil {
 		return nil, fmt.Errorf("Invalid sftpBackend")
 	}
@@ -479,8 +1084,36 @@ func (sfb *sftpBackend) NewFileReader(filePath string) (io.ReadCloser, error) {
 	return file, nil
 }
 
+// NewFileReaderAt returns an io.Reader instance for length bytes of the
+// file starting at offset, a negative length reads to the end of the file
+func (sfb *sftpBackend) NewFileReaderAt(filePath string, offset, length int64) (io.ReadCloser, error) {
+	defer metrics.StorageCall("sftp", "NewFileReaderAt", time.Now())
+
+	if sfb == nil {
+		return nil, fmt.Errorf("Invalid sftpBackend")
+	}
+	if offset < 0 {
+		return nil, fmt.Errorf("Invalid offset %d", offset)
+	}
+
+	file, err := sfb.Client.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open file with sftp, %v", err)
+	}
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+
+		return nil, fmt.Errorf("Failed to seek in file with sftp, %v", err)
+	}
+
+	return limitReadCloser(file, length), nil
+}
+
 // RemoveFile removes a file or an empty directory.
 func (sfb *sftpBackend) RemoveFile(filePath string) error {
+	defer metrics.StorageCall("sftp", "RemoveFile", time.Now())
+
 	if sfb == nil {
 		return fmt.Errorf("Invalid sftpBackend")
 	}
@@ -493,6 +1126,58 @@ func (sfb *sftpBackend) RemoveFile(filePath string) error {
 	return nil
 }
 
+// Ping checks that the home directory of the sftp user can be read
+func (sfb *sftpBackend) Ping() error {
+	defer metrics.StorageCall("sftp", "Ping", time.Now())
+
+	if sfb == nil {
+		return fmt.Errorf("Invalid sftpBackend")
+	}
+
+	if _, err := sfb.Client.Stat("."); err != nil {
+		return fmt.Errorf("Failed to reach sftp server, %v", err)
+	}
+
+	return nil
+}
+
+// List returns the files whose path, relative to the home directory of
+// the sftp user, starts with prefix
+func (sfb *sftpBackend) List(prefix string) ([]FileInfo, error) {
+	return list(sfb.Walk, prefix)
+}
+
+// Walk calls fn for each file whose path, relative to the home directory
+// of the sftp user, starts with prefix
+func (sfb *sftpBackend) Walk(prefix string, fn WalkFunc) error {
+	defer metrics.StorageCall("sftp", "Walk", time.Now())
+
+	if sfb == nil {
+		return fmt.Errorf("Invalid sftpBackend")
+	}
+
+	root := walkRoot(prefix)
+	walker := sfb.Client.Walk(root)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			// Nothing can match a prefix in a directory that doesn't exist
+			if walker.Path() == root && errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+
+			return fmt.Errorf("Failed to list files with sftp, %v", err)
+		}
+		if !walker.Stat().Mode().IsRegular() || !strings.HasPrefix(walker.Path(), prefix) {
+			continue
+		}
+		if err := fn(FileInfo{Path: walker.Path(), Size: walker.Stat().Size(), ModTime: walker.Stat().ModTime()}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func TrustedHostKeyCallback(key string) ssh.HostKeyCallback {
 	if key == "" {
 		return func(_ string, _ net.Addr, k ssh.PublicKey) error {
@@ -7,6 +7,7 @@ import (
 	"crypto/x509"
 	"encoding/pem"
 	"io"
+	"net"
 	"net/http/httptest"
 	"os"
 	"regexp"
@@ -174,6 +175,7 @@ func TestPosixBackend(t *testing.T) {
 	var buf bytes.Buffer
 
 	assert.IsType(t, backend, &posixBackend{}, "Wrong type from NewBackend with posix")
+	assert.Nil(t, backend.Ping(), "posix Ping failed when it should work")
 
 	log.SetOutput(os.Stdout)
 
@@ -314,6 +316,16 @@ func TestS3Fail(t *testing.T) {
 
 	err = dummyBackend.RemoveFile("/")
 	assert.NotNil(t, err, "RemoveFile worked when it should not")
+
+	err = dummyBackend.Ping()
+	assert.NotNil(t, err, "Ping worked when it should not")
+
+	_, err = dummyBackend.List("")
+	assert.NotNil(t, err, "List worked when it should not")
+
+	reader, err = dummyBackend.NewFileReaderAt("/", 0, -1)
+	assert.NotNil(t, err, "NewFileReaderAt worked when it should not")
+	assert.Nil(t, reader, "Got a Reader when expected not to")
 }
 
 func TestPOSIXFail(t *testing.T) {
@@ -348,6 +360,16 @@ func TestPOSIXFail(t *testing.T) {
 
 	err = dummyBackend.RemoveFile("/")
 	assert.NotNil(t, err, "RemoveFile worked when it should not")
+
+	err = dummyBackend.Ping()
+	assert.NotNil(t, err, "Ping worked when it should not")
+
+	_, err = dummyBackend.List("")
+	assert.NotNil(t, err, "List worked when it should not")
+
+	reader, err = dummyBackend.NewFileReaderAt("/", 0, -1)
+	assert.NotNil(t, err, "NewFileReaderAt worked when it should not")
+	assert.Nil(t, reader, "Got a Reader when expected not to")
 }
 
 // Initializes a mock sftp server instance
@@ -400,6 +422,17 @@ func setupMockSFTP() error {
 		}
 	}()
 
+	// Wait for the server to accept connections before running the tests
+	for i := 0; i < 50; i++ {
+		var conn net.Conn
+		if conn, err = net.Dial("tcp", addr); err == nil {
+			conn.Close()
+
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
 	return err
 }
 
@@ -461,6 +494,15 @@ func TestSftpFail(t *testing.T) {
 	err = dummyBackend.RemoveFile("/")
 	assert.NotNil(t, err, "RemoveFile worked when it should not")
 	assert.EqualError(t, err, "Invalid sftpBackend")
+
+	_, err = dummyBackend.List("")
+	assert.EqualError(t, err, "Invalid sftpBackend")
+
+	err = dummyBackend.Ping()
+	assert.EqualError(t, err, "Invalid sftpBackend")
+
+	_, err = dummyBackend.NewFileReaderAt("/", 0, -1)
+	assert.EqualError(t, err, "Invalid sftpBackend")
 	testConf.SFTP.Host = tmpHost
 
 	// wrong key password
@@ -513,6 +555,7 @@ func TestS3Backend(t *testing.T) {
 	var buf bytes.Buffer
 
 	assert.IsType(t, s3back, &s3Backend{}, "Wrong type from NewBackend with s3")
+	assert.Nil(t, s3back.Ping(), "s3 Ping failed when it should work")
 
 	writer, err := s3back.NewFileWriter(s3Creatable)
 
@@ -523,7 +566,7 @@ func TestS3Backend(t *testing.T) {
 
 	assert.Nil(t, err, "Failure when writing to s3 writer")
 	assert.Equal(t, len(writeData), written, "Did not write all writeData")
-	writer.Close()
+	assert.Nil(t, writer.Close(), "s3 writer Close failed when it shouldn't")
 
 	reader, err := s3back.NewFileReader(s3Creatable)
 	assert.Nil(t, err, "s3 NewFileReader failed when it should work")
@@ -568,6 +611,23 @@ func TestS3Backend(t *testing.T) {
 
 }
 
+func TestS3WriterClose_uploadFails(t *testing.T) {
+	testConf.Type = s3Type
+	backend, err := NewBackend(testConf)
+	require.Nil(t, err, "Backend failed")
+
+	// Uploads to a bucket that does not exist fail
+	s3back := *backend.(*s3Backend)
+	s3back.Bucket = "nosuchbucket"
+
+	writer, err := s3back.NewFileWriter(s3Creatable)
+	require.Nil(t, err, "s3 NewFileWriter failed when it shouldn't")
+
+	_, _ = writer.Write(writeData)
+	assert.NotNil(t, writer.Close(), "s3 writer Close did not return the error of the upload")
+	assert.NotNil(t, writer.Close(), "s3 writer Close did not return the error of the upload again")
+}
+
 func TestSftpBackend(t *testing.T) {
 
 	var buf bytes.Buffer
@@ -583,6 +643,7 @@ func TestSftpBackend(t *testing.T) {
 	sftpBack := backend.(*sftpBackend)
 
 	assert.IsType(t, sftpBack, &sftpBackend{}, "Wrong type from NewBackend with sftp")
+	assert.Nil(t, sftpBack.Ping(), "sftp Ping failed when it should work")
 
 	var sftpDoesNotExist = "nonexistent/file"
 	var sftpCreatable = os.TempDir() + "/this/file/exists"
@@ -631,3 +692,318 @@ func TestSftpBackend(t *testing.T) {
 	}
 
 }
+
+// listTestFiles are written to the backends to test listing
+var listTestFiles = []string{"list/a/file1", "list/a/file2", "list/b/file3", "listing/file4"}
+
+// listPaths returns the paths of files
+func listPaths(files []FileInfo) []string {
+	paths := []string{}
+	for _, file := range files {
+		paths = append(paths, file.Path)
+	}
+
+	return paths
+}
+
+// writeListTestFiles writes listTestFiles below base using backend
+func writeListTestFiles(t *testing.T, backend Backend, base string) {
+	for _, name := range listTestFiles {
+		writer, err := backend.NewFileWriter(base + name)
+		require.Nil(t, err, "NewFileWriter failed when it shouldn't")
+		_, err = writer.Write(writeData)
+		require.Nil(t, err, "Failure when writing test file")
+		writer.Close()
+
+		// s3 uploads in the background, wait until the file is there
+		_, err = backend.GetFileSize(base + name)
+		require.Nil(t, err, "GetFileSize failed for test file")
+	}
+}
+
+func TestPosixList(t *testing.T) {
+	dir := t.TempDir()
+	for _, d := range []string{"list/a", "list/b", "listing"} {
+		require.Nil(t, os.MkdirAll(dir+"/"+d, 0750))
+	}
+	backend := &posixBackend{Location: dir}
+	writeListTestFiles(t, backend, "")
+
+	files, err := backend.List("")
+	assert.Nil(t, err, "posix List failed when it should work")
+	assert.ElementsMatch(t, listTestFiles, listPaths(files))
+	for _, file := range files {
+		assert.Equal(t, int64(len(writeData)), file.Size, "Got an incorrect file size")
+		assert.WithinDuration(t, time.Now(), file.ModTime, time.Minute, "Got an incorrect modification time")
+	}
+
+	files, err = backend.List("list/")
+	assert.Nil(t, err, "posix List failed when it should work")
+	assert.ElementsMatch(t, []string{"list/a/file1", "list/a/file2", "list/b/file3"}, listPaths(files))
+
+	files, err = backend.List("list/a/file")
+	assert.Nil(t, err, "posix List failed when it should work")
+	assert.ElementsMatch(t, []string{"list/a/file1", "list/a/file2"}, listPaths(files))
+
+	files, err = backend.List("nothing/here")
+	assert.Nil(t, err, "posix List failed for a prefix without files")
+	assert.Empty(t, files)
+
+	// Returning an error stops the walk
+	visited := 0
+	err = backend.Walk("", func(FileInfo) error {
+		visited++
+
+		return io.ErrUnexpectedEOF
+	})
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	assert.Equal(t, 1, visited)
+}
+
+func TestS3List(t *testing.T) {
+	testConf.Type = s3Type
+	backend, err := NewBackend(testConf)
+	require.Nil(t, err, "Backend failed")
+	writeListTestFiles(t, backend, "")
+
+	// List more than one page at a time
+	defer func(size int64) { listPageSize = size }(listPageSize)
+	listPageSize = 1
+
+	files, err := backend.List("list")
+	assert.Nil(t, err, "s3 List failed when it should work")
+	assert.ElementsMatch(t, listTestFiles, listPaths(files))
+	for _, file := range files {
+		assert.Equal(t, int64(len(writeData)), file.Size, "Got an incorrect file size")
+		assert.False(t, file.ModTime.IsZero(), "Got no modification time")
+	}
+
+	files, err = backend.List("list/a/")
+	assert.Nil(t, err, "s3 List failed when it should work")
+	assert.ElementsMatch(t, []string{"list/a/file1", "list/a/file2"}, listPaths(files))
+
+	files, err = backend.List("nothing/here")
+	assert.Nil(t, err, "s3 List failed for a prefix without files")
+	assert.Empty(t, files)
+
+	visited := 0
+	err = backend.Walk("list", func(FileInfo) error {
+		visited++
+
+		return io.ErrUnexpectedEOF
+	})
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	assert.Equal(t, 1, visited)
+
+	for _, name := range listTestFiles {
+		assert.Nil(t, backend.RemoveFile(name), "s3 RemoveFile failed when it should work")
+	}
+}
+
+func TestSftpList(t *testing.T) {
+	testConf.Type = sftpType
+	backend, err := NewBackend(testConf)
+	require.Nil(t, err, "Backend failed")
+
+	base := t.TempDir() + "/"
+	writeListTestFiles(t, backend, base)
+
+	files, err := backend.List(base)
+	assert.Nil(t, err, "sftp List failed when it should work")
+	expected := []string{}
+	for _, name := range listTestFiles {
+		expected = append(expected, base+name)
+	}
+	assert.ElementsMatch(t, expected, listPaths(files))
+	for _, file := range files {
+		assert.Equal(t, int64(len(writeData)), file.Size, "Got an incorrect file size")
+		assert.WithinDuration(t, time.Now(), file.ModTime, time.Minute, "Got an incorrect modification time")
+	}
+
+	files, err = backend.List(base + "list/a/file")
+	assert.Nil(t, err, "sftp List failed when it should work")
+	assert.ElementsMatch(t, []string{base + "list/a/file1", base + "list/a/file2"}, listPaths(files))
+
+	files, err = backend.List(base + "nothing/here")
+	assert.Nil(t, err, "sftp List failed for a prefix without files")
+	assert.Empty(t, files)
+}
+
+// readRanges checks ranged reads of a file containing writeData
+func readRanges(t *testing.T, backend Backend, filePath string) {
+	for _, r := range []struct {
+		offset, length int64
+		expected       string
+	}{
+		{0, -1, "this is a test"},
+		{5, 2, "is"},
+		{5, -1, "is a test"},
+		{10, 100, "test"},
+		{3, 0, ""},
+	} {
+		reader, err := backend.NewFileReaderAt(filePath, r.offset, r.length)
+		require.Nil(t, err, "NewFileReaderAt failed when it should work")
+		data, err := io.ReadAll(reader)
+		assert.Nil(t, err, "unexpected error when reading range")
+		assert.Equal(t, r.expected, string(data), "did not read back range as expected")
+		assert.Nil(t, reader.Close(), "failed to close ranged reader")
+	}
+
+	_, err := backend.NewFileReaderAt(filePath, -1, 2)
+	assert.EqualError(t, err, "Invalid offset -1")
+}
+
+func TestPosixReadRange(t *testing.T) {
+	backend := &posixBackend{Location: t.TempDir()}
+	require.Nil(t, os.WriteFile(backend.Location+"/file", writeData, 0600))
+
+	readRanges(t, backend, "file")
+
+	// Reading past the end gives nothing
+	reader, err := backend.NewFileReaderAt("file", 100, 2)
+	require.Nil(t, err, "NewFileReaderAt failed when it should work")
+	data, err := io.ReadAll(reader)
+	assert.Nil(t, err, "unexpected error when reading range")
+	assert.Empty(t, data)
+
+	_, err = backend.NewFileReaderAt(posixDoesNotExist, 0, 2)
+	assert.NotNil(t, err, "NewFileReaderAt worked when it should not")
+}
+
+func TestS3ReadRange(t *testing.T) {
+	testConf.Type = s3Type
+	backend, err := NewBackend(testConf)
+	require.Nil(t, err, "Backend failed")
+
+	writer, err := backend.NewFileWriter("range/file")
+	require.Nil(t, err, "NewFileWriter failed when it shouldn't")
+	_, err = writer.Write(writeData)
+	require.Nil(t, err, "Failure when writing test file")
+	writer.Close()
+	_, err = backend.GetFileSize("range/file")
+	require.Nil(t, err, "GetFileSize failed for test file")
+
+	readRanges(t, backend, "range/file")
+
+	assert.Nil(t, backend.RemoveFile("range/file"), "s3 RemoveFile failed when it should work")
+}
+
+func TestSftpReadRange(t *testing.T) {
+	testConf.Type = sftpType
+	backend, err := NewBackend(testConf)
+	require.Nil(t, err, "Backend failed")
+
+	filePath := t.TempDir() + "/file"
+	writer, err := backend.NewFileWriter(filePath)
+	require.Nil(t, err, "NewFileWriter failed when it shouldn't")
+	_, err = writer.Write(writeData)
+	require.Nil(t, err, "Failure when writing test file")
+	writer.Close()
+
+	readRanges(t, backend, filePath)
+
+	_, err = backend.NewFileReaderAt("nonexistent/file", 0, 2)
+	assert.EqualError(t, err, "Failed to open file with sftp, file does not exist")
+}
+
+func TestS3ResumableWrite(t *testing.T) {
+	testConf.Type = s3Type
+	backend, err := NewBackend(testConf)
+	require.Nil(t, err, "Backend failed")
+
+	resumable, ok := backend.(ResumableBackend)
+	require.True(t, ok, "s3 backend is not resumable")
+
+	data := make([]byte, 2*minPartSize+1024)
+	_, err = rand.Read(data)
+	require.Nil(t, err)
+
+	var offsets []int64
+	source := func(failAt int64) RangeSource {
+		return func(offset, length int64) (io.ReadCloser, error) {
+			if offset == failAt {
+				return nil, io.ErrUnexpectedEOF
+			}
+			offsets = append(offsets, offset)
+
+			return io.NopCloser(bytes.NewReader(data[offset : offset+length])), nil
+		}
+	}
+
+	// Interrupt the upload at the second part
+	err = resumable.ResumableWrite("resumable/file", int64(len(data)), source(minPartSize))
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	assert.Equal(t, []int64{0}, offsets)
+
+	_, err = backend.GetFileSize("resumable/file" + uploadStateSuffix)
+	assert.Nil(t, err, "upload state was not saved")
+
+	// Only the missing parts are read when resuming
+	offsets = nil
+	err = resumable.ResumableWrite("resumable/file", int64(len(data)), source(-1))
+	assert.Nil(t, err, "s3 ResumableWrite failed when it should work")
+	assert.Equal(t, []int64{minPartSize, 2 * minPartSize}, offsets)
+
+	reader, err := backend.NewFileReader("resumable/file")
+	require.Nil(t, err, "s3 NewFileReader failed when it should work")
+	written, err := io.ReadAll(reader)
+	assert.Nil(t, err, "unexpected error when reading back data")
+	assert.Equal(t, data, written, "did not read back data as expected")
+
+	files, err := backend.List("resumable/")
+	assert.Nil(t, err, "s3 List failed when it should work")
+	assert.Equal(t, []string{"resumable/file"}, listPaths(files), "upload state was not removed")
+
+	// A saved state for other data is not resumed
+	offsets = nil
+	err = resumable.ResumableWrite("resumable/other", int64(len(data)), source(minPartSize))
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	err = resumable.ResumableWrite("resumable/other", int64(len(writeData)), func(offset, length int64) (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(writeData[offset : offset+length])), nil
+	})
+	assert.Nil(t, err, "s3 ResumableWrite failed when it should work")
+	size, err := backend.GetFileSize("resumable/other")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(writeData)), size)
+
+	for _, name := range []string{"resumable/file", "resumable/other"} {
+		assert.Nil(t, backend.RemoveFile(name), "s3 RemoveFile failed when it should work")
+	}
+
+	var dummyBackend *s3Backend
+	err = dummyBackend.ResumableWrite("/", 0, source(-1))
+	assert.EqualError(t, err, "Invalid s3Backend")
+}
+
+func TestResumableBackends(t *testing.T) {
+	var posix Backend = &posixBackend{}
+	_, ok := posix.(ResumableBackend)
+	assert.False(t, ok, "posix backend should not be resumable")
+
+	var sftp Backend = &sftpBackend{}
+	_, ok = sftp.(ResumableBackend)
+	assert.False(t, ok, "sftp backend should not be resumable")
+}
+
+func TestUpdateCredentials(t *testing.T) {
+	testConf.Type = s3Type
+	backend, err := NewBackend(testConf)
+	assert.NoError(t, err)
+
+	keys, err := backend.(*s3Backend).Client.Config.Credentials.Get()
+	assert.NoError(t, err)
+	assert.Equal(t, testConf.S3.AccessKey, keys.AccessKeyID)
+
+	refreshed := testConf
+	refreshed.S3.AccessKey = "refreshed"
+	refreshed.S3.SecretKey = "refreshed-secret"
+	UpdateCredentials(backend, refreshed)
+
+	keys, err = backend.(*s3Backend).Client.Config.Credentials.Get()
+	assert.NoError(t, err)
+	assert.Equal(t, "refreshed", keys.AccessKeyID)
+	assert.Equal(t, "refreshed-secret", keys.SecretAccessKey)
+
+	// Backends without credentials are left as they are
+	UpdateCredentials(&posixBackend{}, refreshed)
+}
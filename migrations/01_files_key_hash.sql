@@ -0,0 +1,6 @@
+-- Records which archive key the header of each file is encrypted with, as
+-- the hex encoded sha256 checksum of the public key. Needed by rotatekey,
+-- and used by ingest and verify when it exists.
+ALTER TABLE sda.files ADD COLUMN IF NOT EXISTS key_hash TEXT;
+
+CREATE INDEX IF NOT EXISTS files_key_hash_idx ON sda.files(key_hash);
@@ -0,0 +1,24 @@
+-- Records the messages that the replay command sent again from the error
+-- queue, and who replayed them.
+CREATE TABLE IF NOT EXISTS sda.replays (
+    id             SERIAL PRIMARY KEY,
+    correlation_id TEXT NOT NULL,
+    routing_key    TEXT NOT NULL,
+    error          TEXT,
+    reason         TEXT,
+    message        JSONB NOT NULL,
+    replayed_by    TEXT NOT NULL,
+    replayed_at    TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT clock_timestamp()
+);
+
+CREATE INDEX IF NOT EXISTS replays_correlation_id_idx ON sda.replays(correlation_id);
+
+-- lega_in is the database user of the pipeline services in the sda-db image
+DO $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM pg_roles WHERE rolname = 'lega_in') THEN
+        GRANT SELECT, INSERT ON sda.replays TO lega_in;
+        GRANT USAGE, SELECT ON SEQUENCE sda.replays_id_seq TO lega_in;
+    END IF;
+END
+$$;
@@ -0,0 +1,22 @@
+-- Holds the outcome of the last attempt to back up each file to each
+-- backup destination, kept apart from sda.file_event_log so that the
+-- destinations don't change the status of the file.
+CREATE TABLE IF NOT EXISTS sda.backups (
+    file_id        UUID NOT NULL REFERENCES sda.files(id),
+    destination    TEXT NOT NULL,
+    status         TEXT NOT NULL,
+    reason         TEXT,
+    correlation_id TEXT NOT NULL,
+    user_id        TEXT,
+    updated_at     TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT clock_timestamp(),
+    PRIMARY KEY (file_id, destination)
+);
+
+-- lega_in is the database user of the pipeline services in the sda-db image
+DO $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM pg_roles WHERE rolname = 'lega_in') THEN
+        GRANT SELECT, INSERT, UPDATE ON sda.backups TO lega_in;
+    END IF;
+END
+$$;